@@ -0,0 +1,31 @@
+package iavl
+
+import "fmt"
+
+// SaveVersionWithAnnotation is SaveVersion, but also stores the given annotation with the version,
+// e.g. the block height or chain id the version was saved at, for cross-referencing. The
+// annotation is opaque metadata: it is not part of the hash of the version, and it is read back
+// with VersionAnnotation. It is deleted along with the version. An empty annotation is not stored.
+//
+// If the version is not written, since it is already saved with the same hash or unchanged with
+// SkipUnchangedVersions, the annotation is not stored either.
+func (tree *MutableTree) SaveVersionWithAnnotation(annotation []byte) ([]byte, int64, error) {
+	return tree.saveVersion(tree.ndb.opts.Sync, nil, nil, annotation)
+}
+
+// VersionAnnotation returns the annotation saved with the given version by
+// SaveVersionWithAnnotation, or nil if the version was saved without one. It returns
+// ErrVersionDoesNotExist if the version is not available.
+func (tree *MutableTree) VersionAnnotation(version int64) ([]byte, error) {
+	if !tree.VersionExists(version) {
+		return nil, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	return tree.ndb.db.Get(annotationKeyFormat.Key(version))
+}
+
+// saveAnnotation saves the annotation of the given version.
+func (ndb *nodeDB) saveAnnotation(version int64, annotation []byte) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Set(annotationKeyFormat.Key(version), annotation)
+}
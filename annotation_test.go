@@ -0,0 +1,68 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestMutableTree_SaveVersionWithAnnotation(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for v := int64(1); v <= 6; v++ {
+		for _, tr := range []*MutableTree{tree, plain} {
+			_, err := tr.Set([]byte(fmt.Sprintf("k%d", v)), []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		var (
+			hash    []byte
+			version int64
+			err     error
+		)
+		if v == 3 {
+			hash, version, err = tree.SaveVersion()
+		} else {
+			hash, version, err = tree.SaveVersionWithAnnotation([]byte(fmt.Sprintf("height=%d", v*10)))
+		}
+		require.NoError(t, err)
+		require.Equal(t, v, version)
+		// the annotation is not hashed
+		plainHash, _, err := plain.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, plainHash, hash)
+	}
+
+	checkAnnotations := func(tree *MutableTree, first, last int64) {
+		for v := first; v <= last; v++ {
+			annotation, err := tree.VersionAnnotation(v)
+			require.NoError(t, err)
+			if v == 3 {
+				require.Nil(t, annotation)
+			} else {
+				require.Equal(t, fmt.Sprintf("height=%d", v*10), string(annotation))
+			}
+		}
+	}
+	checkAnnotations(tree, 1, 6)
+
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := reopened.Load()
+	require.NoError(t, err)
+	checkAnnotations(reopened, 1, 6)
+
+	// the annotations are deleted along with their versions
+	require.NoError(t, reopened.DeleteVersionsTo(2))
+	require.NoError(t, reopened.DeleteVersionsFrom(6))
+	checkAnnotations(reopened, 3, 5)
+	for _, v := range []int64{2, 6} {
+		_, err := reopened.VersionAnnotation(v)
+		require.ErrorIs(t, err, ErrVersionDoesNotExist)
+		bz, err := db.Get(annotationKeyFormat.Key(v))
+		require.NoError(t, err)
+		require.Nil(t, bz)
+	}
+}
@@ -500,9 +500,10 @@ func TestTreeProof(t *testing.T) {
 	hash := tree.Hash()
 	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", hex.EncodeToString(hash))
 
-	// should get false for proof with nil root
-	_, err := tree.GetProof([]byte("foo"))
-	require.Error(t, err)
+	// an empty tree gives the empty-tree proof
+	proof, err := tree.GetProof([]byte("foo"))
+	require.NoError(t, err)
+	require.NotNil(t, proof.GetNonexist())
 
 	// insert lots of info and store the bytes
 	keys := make([][]byte, 200)
@@ -530,3 +531,179 @@ func TestTreeProof(t *testing.T) {
 		}
 	}
 }
+
+func TestEmptyKeys(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+		_, err := tree.Set([]byte("a"), []byte("1"))
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("b"), []byte{})
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("c"), []byte("3"))
+		require.NoError(t, err)
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+
+		for _, key := range [][]byte{nil, {}} {
+			_, err := tree.Set(key, []byte("v"))
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, err = tree.Get(key)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, _, err = tree.Remove(key)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, err = tree.RemoveMany([][]byte{[]byte("a"), key})
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, err = tree.GetVersioned(key, version)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, err = tree.GetVersionedProof(key, version)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+
+			_, err = itree.Get(key)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, _, err = itree.GetWithIndex(key)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, err = itree.Has(key)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, err = itree.GetProof(key)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, err = itree.GetMembershipProof(key)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+			_, err = itree.GetNonMembershipProof(key)
+			require.ErrorIs(t, err, ErrKeyEmpty)
+		}
+		// the rejected calls must not have modified the tree
+		require.EqualValues(t, 3, tree.Size())
+
+		// nil values are rejected while empty values are stored as is
+		_, err = tree.Set([]byte("d"), nil)
+		require.Error(t, err)
+		for _, getter := range []func([]byte) ([]byte, error){tree.Get, itree.Get} {
+			value, err := getter([]byte("b"))
+			require.NoError(t, err)
+			require.NotNil(t, value)
+			require.Empty(t, value)
+		}
+		has, err := itree.Has([]byte("b"))
+		require.NoError(t, err)
+		require.True(t, has)
+		// ics23 refuses to verify empty values, but the proof itself is still generated
+		proof, err := itree.GetMembershipProof([]byte("b"))
+		require.NoError(t, err)
+		require.NotNil(t, proof.GetExist().Value)
+		require.Empty(t, proof.GetExist().Value)
+
+		// nil and empty iteration bounds both denote an open end
+		_, err = tree.Set([]byte("e"), []byte("5"))
+		require.NoError(t, err)
+		collect := func(itr interface {
+			Valid() bool
+			Next()
+			Key() []byte
+			Close() error
+		},
+		) []string {
+			keys := []string{}
+			for ; itr.Valid(); itr.Next() {
+				keys = append(keys, string(itr.Key()))
+			}
+			require.NoError(t, itr.Close())
+			return keys
+		}
+		for _, ascending := range []bool{true, false} {
+			for _, start := range [][]byte{nil, {}} {
+				for _, end := range [][]byte{nil, {}} {
+					itr, err := tree.Iterator(start, end, ascending)
+					require.NoError(t, err)
+					require.Len(t, collect(itr), 4)
+
+					itr, err = itree.Iterator(start, end, ascending)
+					require.NoError(t, err)
+					require.Len(t, collect(itr), 3)
+
+					count := 0
+					itree.IterateRange(start, end, ascending, func(_, _ []byte) bool {
+						count++
+						return false
+					})
+					require.Equal(t, 3, count)
+				}
+			}
+		}
+	}
+}
+
+func TestEmptyTree(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+		check := func(name string, tree ModelTree, itree *ImmutableTree) {
+			value, err := tree.Get([]byte("a"))
+			require.NoError(t, err, name)
+			require.Nil(t, value, name)
+			for _, bounds := range [][2][]byte{{nil, nil}, {[]byte("a"), []byte("z")}} {
+				for _, ascending := range []bool{true, false} {
+					itr, err := tree.Iterator(bounds[0], bounds[1], ascending)
+					require.NoError(t, err, name)
+					require.False(t, itr.Valid(), name)
+					require.NoError(t, itr.Error(), name)
+					require.NoError(t, itr.Close(), name)
+				}
+			}
+
+			has, err := itree.Has([]byte("a"))
+			require.NoError(t, err, name)
+			require.False(t, has, name)
+			_, err = itree.GetMembershipProof([]byte("a"))
+			require.ErrorIs(t, err, ErrKeyDoesNotExist, name)
+			proof, err := itree.GetProof([]byte("a"))
+			require.NoError(t, err, name)
+			nonexist := proof.GetNonexist()
+			require.NotNil(t, nonexist, name)
+			require.Nil(t, nonexist.Left, name)
+			require.Nil(t, nonexist.Right, name)
+			ok, err := itree.VerifyProof(proof, []byte("a"))
+			require.NoError(t, err, name)
+			require.True(t, ok, name)
+			ok, err = itree.VerifyProof(proof, []byte("b"))
+			require.NoError(t, err, name)
+			require.False(t, ok, name)
+		}
+
+		// before any version is saved
+		check("working tree", tree, tree.ImmutableTree)
+		has, err := tree.Has([]byte("a"))
+		require.NoError(t, err)
+		require.False(t, has)
+
+		// a saved empty version
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		check("saved", itree, itree)
+
+		// a version emptied by removals, with unsaved changes on top of it
+		_, err = tree.Set([]byte("a"), []byte("1"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = tree.Remove([]byte("a"))
+		require.NoError(t, err)
+		check("removed", tree, tree.ImmutableTree)
+		_, version, err = tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err = tree.GetImmutable(version)
+		require.NoError(t, err)
+		check("emptied", itree, itree)
+
+		// the proofs of a non-empty tree do not verify against an empty one
+		_, err = tree.Set([]byte("b"), []byte("2"))
+		require.NoError(t, err)
+		proof, err := tree.GetProof([]byte("a"))
+		require.NoError(t, err)
+		ok, err := itree.VerifyProof(proof, []byte("a"))
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+}
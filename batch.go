@@ -1,6 +1,8 @@
 package iavl
 
 import (
+	"bytes"
+	"errors"
 	"sync"
 
 	corestore "cosmossdk.io/core/store"
@@ -14,7 +16,8 @@ type BatchWithFlusher struct {
 	db    corestore.KVStoreWithBatch // This is only used to create new batch
 	batch corestore.Batch            // Batched writing buffer.
 
-	flushThreshold int // The threshold to flush the batch to disk.
+	flushThreshold int   // The threshold to flush the batch to disk.
+	added          int64 // The total size of the keys and values added, see bytesAdded.
 }
 
 var _ corestore.Batch = (*BatchWithFlusher)(nil)
@@ -58,12 +61,18 @@ func (b *BatchWithFlusher) Set(key, value []byte) error {
 	}
 	if batchSizeAfter > b.flushThreshold {
 		b.mtx.Unlock()
-		if err := b.Write(); err != nil {
+		err := b.Write()
+		// relock before returning, as the deferred unlock expects the lock to be held
+		b.mtx.Lock()
+		if err != nil {
 			return err
 		}
-		b.mtx.Lock()
 	}
-	return b.batch.Set(key, value)
+	if err := b.batch.Set(key, value); err != nil {
+		return err
+	}
+	b.added += int64(len(key) + len(value))
+	return nil
 }
 
 // Delete delete value at the given key to the db.
@@ -80,12 +89,18 @@ func (b *BatchWithFlusher) Delete(key []byte) error {
 	}
 	if batchSizeAfter > b.flushThreshold {
 		b.mtx.Unlock()
-		if err := b.Write(); err != nil {
+		err := b.Write()
+		// relock before returning, as the deferred unlock expects the lock to be held
+		b.mtx.Lock()
+		if err != nil {
 			return err
 		}
-		b.mtx.Lock()
 	}
-	return b.batch.Delete(key)
+	if err := b.batch.Delete(key); err != nil {
+		return err
+	}
+	b.added += int64(len(key))
+	return nil
 }
 
 func (b *BatchWithFlusher) Write() error {
@@ -123,6 +138,87 @@ func (b *BatchWithFlusher) Close() error {
 	return b.batch.Close()
 }
 
+// bytesAdded returns the total size of the keys and values added to the batch since its creation,
+// including those already flushed.
+func (b *BatchWithFlusher) bytesAdded() int64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.added
+}
+
 func (b *BatchWithFlusher) GetByteSize() (int, error) {
 	return b.batch.GetByteSize()
 }
+
+// stagedBatch records the writes of the callback of MutableTree.SaveVersionWithBatch, so they are
+// only added to the batch of the tree once the callback succeeded. It is written by the tree,
+// along with the version.
+type stagedBatch struct {
+	ops    []stagedOp
+	size   int
+	closed bool
+}
+
+type stagedOp struct {
+	key, value []byte
+	delete     bool
+}
+
+var _ corestore.Batch = (*stagedBatch)(nil)
+
+var errStagedBatchWrite = errors.New("the batch is written along with the version by SaveVersionWithBatch")
+
+func (b *stagedBatch) Set(key, value []byte) error {
+	if b.closed {
+		return errors.New("batch has been written or closed")
+	}
+	if len(key) == 0 {
+		return errors.New("key cannot be empty")
+	}
+	if value == nil {
+		return errors.New("value cannot be nil")
+	}
+	// the caller may reuse the slices once Set returns
+	b.ops = append(b.ops, stagedOp{key: bytes.Clone(key), value: bytes.Clone(value)})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+func (b *stagedBatch) Delete(key []byte) error {
+	if b.closed {
+		return errors.New("batch has been written or closed")
+	}
+	if len(key) == 0 {
+		return errors.New("key cannot be empty")
+	}
+	b.ops = append(b.ops, stagedOp{key: bytes.Clone(key), delete: true})
+	b.size += len(key)
+	return nil
+}
+
+func (b *stagedBatch) Write() error { return errStagedBatchWrite }
+
+func (b *stagedBatch) WriteSync() error { return errStagedBatchWrite }
+
+func (b *stagedBatch) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *stagedBatch) GetByteSize() (int, error) { return b.size, nil }
+
+// replay adds the recorded writes to the batch, in order.
+func (b *stagedBatch) replay(batch corestore.Batch) error {
+	for _, op := range b.ops {
+		var err error
+		if op.delete {
+			err = batch.Delete(op.key)
+		} else {
+			err = batch.Set(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,11 +2,13 @@ package iavl
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
+	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/require"
 
 	dbm "github.com/cosmos/iavl/db"
@@ -63,3 +65,109 @@ func testBatchWithFlusher(t *testing.T) {
 		keyNonce++
 	}
 }
+
+// flushCountingDB is a MemDB recording the size of the flushed batches, and failing the flushes
+// once failAfter of them have been written, if set.
+type flushCountingDB struct {
+	*dbm.MemDB
+	flushes   int
+	maxSize   int
+	failAfter int
+}
+
+func (db *flushCountingDB) NewBatch() corestore.Batch {
+	return &flushCountingBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+func (db *flushCountingDB) NewBatchWithSize(size int) corestore.Batch {
+	return &flushCountingBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type flushCountingBatch struct {
+	corestore.Batch
+	db *flushCountingDB
+}
+
+func (b *flushCountingBatch) Write() error {
+	if b.db.failAfter > 0 && b.db.flushes >= b.db.failAfter {
+		return errors.New("disk full")
+	}
+	size, err := b.Batch.GetByteSize()
+	if err != nil {
+		return err
+	}
+	b.db.flushes++
+	b.db.maxSize = max(b.db.maxSize, size)
+	return b.Batch.Write()
+}
+
+func (b *flushCountingBatch) WriteSync() error {
+	return b.Write()
+}
+
+func TestMaxBatchBytesCommit(t *testing.T) {
+	const maxBytes = 4096
+	db := &flushCountingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), MaxBatchBytesOption(maxBytes))
+	_, err := tree.Set([]byte("genesis"), []byte("1"))
+	require.NoError(t, err)
+	hash1, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// a state much larger than the threshold
+	value := make([]byte, 64)
+	for i := 0; i < 5000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%05d", i)), value)
+		require.NoError(t, err)
+	}
+	db.flushes, db.maxSize = 0, 0
+	hash2, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Greater(t, db.flushes, 100)
+	// a batch exceeds the cap by the last entry at most
+	require.Less(t, db.maxSize, maxBytes+512)
+
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reopened.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	require.Equal(t, hash2, reopened.Hash())
+	require.Equal(t, int64(5001), reopened.Size())
+	got, err := reopened.Get([]byte("key-04999"))
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+
+	// a commit interrupted after some flushes is not visible
+	for i := 0; i < 5000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%05d", i)), []byte("updated"))
+		require.NoError(t, err)
+	}
+	db.flushes, db.failAfter = 0, 10
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+
+	reopened = NewMutableTree(db.MemDB, 0, false, NewNopLogger())
+	version, err = reopened.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	require.Equal(t, hash2, reopened.Hash())
+	require.NotEqual(t, hash1, hash2)
+	// the fast nodes flushed by the interrupted commit are not served
+	for _, key := range []string{"key-00000", "key-04999"} {
+		got, err = reopened.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+	}
+	itr, err := reopened.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	defer itr.Close()
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		if string(itr.Key()) != "genesis" {
+			require.Equal(t, value, itr.Value(), "key %s", itr.Key())
+		}
+		count++
+	}
+	require.NoError(t, itr.Error())
+	require.Equal(t, 5001, count)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"runtime"
 	"testing"
+	"time"
 
 	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/require"
@@ -26,7 +27,11 @@ func randBytes(length int) []byte {
 }
 
 func prepareTree(b *testing.B, db corestore.KVStoreWithBatch, size, keyLen, dataLen int) (*iavl.MutableTree, [][]byte) {
-	t := iavl.NewMutableTree(db, size, false, iavl.NewNopLogger())
+	return prepareTreeWithCache(b, db, size, size, keyLen, dataLen)
+}
+
+func prepareTreeWithCache(b *testing.B, db corestore.KVStoreWithBatch, cacheSize, size, keyLen, dataLen int, options ...iavl.Option) (*iavl.MutableTree, [][]byte) {
+	t := iavl.NewMutableTree(db, cacheSize, false, iavl.NewNopLogger(), options...)
 	keys := make([][]byte, size)
 
 	for i := 0; i < size; i++ {
@@ -297,6 +302,42 @@ func BenchmarkLarge(b *testing.B) {
 	runBenchmarks(b, benchmarks)
 }
 
+// BenchmarkLargeGCPause compares the garbage collection cost of the large tree with a node cache
+// holding all the nodes, and with a tenth of it plus weak references to the evicted nodes. The
+// pauses are summed over the blocks, and the duration of a full collection after them is
+// reported along with the live heap, which the marking work is proportional to.
+func BenchmarkLargeGCPause(b *testing.B) {
+	const initSize, blockSize, keyLen, dataLen = 1000000, 100, 16, 40
+	benchmarks := []struct {
+		name      string
+		cacheSize int
+		options   []iavl.Option
+	}{
+		{"strong", initSize, nil},
+		{"weak", initSize / 10, []iavl.Option{iavl.WeakNodeCacheSizeOption(initSize)}},
+	}
+	for _, bb := range benchmarks {
+		b.Run(bb.name, func(sub *testing.B) {
+			t, keys := prepareTreeWithCache(sub, dbm.NewMemDB(), bb.cacheSize, initSize, keyLen, dataLen, bb.options...)
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			sub.ResetTimer()
+			sub.ReportAllocs()
+			t = runBlock(sub, t, keyLen, dataLen, blockSize, keys)
+			sub.StopTimer()
+
+			start := time.Now()
+			runtime.GC()
+			gcTime := time.Since(start)
+			runtime.ReadMemStats(&after)
+			sub.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(sub.N), "gc-pause-ns/op")
+			sub.ReportMetric(float64(gcTime.Microseconds()), "full-gc-us")
+			sub.ReportMetric(float64(after.HeapAlloc)/1e6, "live-heap-MB")
+			runtime.KeepAlive(t)
+		})
+	}
+}
+
 func BenchmarkLevelDBBatchSizes(b *testing.B) {
 	benchmarks := []benchmark{
 		{"goleveldb", 100000, 5, 16, 40},
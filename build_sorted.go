@@ -0,0 +1,128 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// BuildFromSorted builds a tree holding the given pairs, which must be in strictly ascending key
+// order, in an empty db, and saves it as the given version, e.g. to import genesis data. The tree
+// is created with NewMutableTree and the given options, without a node cache and with the fast
+// storage, and its root hash is the one setting the pairs one by one with Set, in order, would
+// give.
+//
+// Setting ascending keys only ever inserts at the right end of the tree, so rather than searching
+// and cloning a path for every key, the tree is built by appending the leaves along its right
+// spine and rebalancing the spine bottom-up, which stops at the first node whose height does not
+// change. This takes amortized constant time per pair.
+func BuildFromSorted(db corestore.KVStoreWithBatch, pairs []KVPair, version int64, options ...Option) (*MutableTree, error) {
+	if version <= 0 {
+		return nil, fmt.Errorf("version must be positive, got %d", version)
+	}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), options...)
+	latest, err := tree.Load()
+	if err != nil {
+		return nil, err
+	}
+	if latest > 0 {
+		return nil, fmt.Errorf("found database at version %d, must be empty", latest)
+	}
+
+	for i := range pairs {
+		pair := &pairs[i]
+		if err := validateKey(pair.Key); err != nil {
+			return nil, err
+		}
+		if pair.Delete {
+			return nil, fmt.Errorf("cannot build a tree from the deletion of key '%s'", pair.Key)
+		}
+		if pair.Value == nil {
+			return nil, fmt.Errorf("attempt to store nil value at key '%s'", pair.Key)
+		}
+		if err := tree.checkSizeLimits(pair.Key, pair.Value); err != nil {
+			return nil, err
+		}
+		if i > 0 && bytes.Compare(pairs[i-1].Key, pair.Key) >= 0 {
+			return nil, fmt.Errorf("keys are not in strictly ascending order at key '%s'", pair.Key)
+		}
+	}
+
+	tree.SetInitialVersion(uint64(version)) // nolint:gosec // the version is positive
+	tree.root, err = buildAscendingTree(pairs)
+	if err != nil {
+		return nil, err
+	}
+	if !tree.skipFastStorageUpgrade {
+		for _, pair := range pairs {
+			tree.addUnsavedAddition(pair.Key, fastnode.NewNode(pair.Key, pair.Value, version))
+		}
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// buildAscendingTree builds the tree of new nodes which setting the given pairs in ascending key
+// order into an empty tree gives, see BuildFromSorted. It returns nil if there are none.
+func buildAscendingTree(pairs []KVPair) (*Node, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	// the nodes from the root to the rightmost leaf, whose sizes are only computed at the end,
+	// since the size of every node on the spine grows with every leaf
+	spine := []*Node{NewNode(pairs[0].Key, pairs[0].Value)}
+	for _, pair := range pairs[1:] {
+		// the rightmost leaf is split like in recursiveSetLeaf
+		last := len(spine) - 1
+		leaf := NewNode(pair.Key, pair.Value)
+		spine[last] = &Node{
+			key:           pair.Key,
+			subtreeHeight: 1,
+			size:          2,
+			leftNode:      spine[last],
+			rightNode:     leaf,
+		}
+		spine = append(spine, leaf)
+
+		// rebalance the ancestors of the split leaf like balance
+		for i := last - 1; i >= 0; i-- {
+			node, right := spine[i], spine[i+1]
+			node.rightNode = right
+			height := max(node.leftNode.subtreeHeight, right.subtreeHeight) + 1
+			if node.leftNode.subtreeHeight-right.subtreeHeight < -1 {
+				// the right subtree grew on its right, so a single left rotation balances it, and
+				// brings the subtree back to its height before the leaf was added
+				if right.leftNode.subtreeHeight > right.rightNode.subtreeHeight {
+					return nil, errors.New("unexpected right-left case while building an ascending tree")
+				}
+				node.rightNode = right.leftNode
+				node.subtreeHeight = max(node.leftNode.subtreeHeight, node.rightNode.subtreeHeight) + 1
+				// the node leaves the spine, so its size is final
+				node.size = node.leftNode.size + node.rightNode.size
+				right.leftNode = node
+				right.subtreeHeight = max(node.subtreeHeight, right.rightNode.subtreeHeight) + 1
+				spine = append(spine[:i], spine[i+1:]...)
+				if i > 0 {
+					spine[i-1].rightNode = right
+				}
+				break
+			}
+			if height == node.subtreeHeight {
+				break
+			}
+			node.subtreeHeight = height
+		}
+	}
+
+	for i := len(spine) - 2; i >= 0; i-- {
+		spine[i].rightNode = spine[i+1]
+		spine[i].size = spine[i].leftNode.size + spine[i+1].size
+	}
+	return spine[0], nil
+}
@@ -0,0 +1,94 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func sortedPairs(n int) []KVPair {
+	pairs := make([]KVPair, n)
+	for i := range pairs {
+		pairs[i] = KVPair{Key: []byte(fmt.Sprintf("key%08d", i)), Value: []byte(fmt.Sprintf("value%d", i))}
+	}
+	return pairs
+}
+
+func TestBuildFromSorted(t *testing.T) {
+	sizes := []int{0, 1, 2, 3, 4, 5, 7, 8, 9, 15, 16, 17, 31, 33, 100, 1000}
+	if !testing.Short() {
+		sizes = append(sizes, 12345)
+	}
+	for _, n := range sizes {
+		for _, version := range []int64{1, 10} {
+			pairs := sortedPairs(n)
+			tree, err := BuildFromSorted(dbm.NewMemDB(), pairs, version)
+			require.NoError(t, err)
+
+			expected := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), InitialVersionOption(uint64(version)))
+			for _, pair := range pairs {
+				_, err := expected.Set(pair.Key, pair.Value)
+				require.NoError(t, err)
+			}
+			hash, savedVersion, err := expected.SaveVersion()
+			require.NoError(t, err)
+
+			require.Equal(t, hash, tree.Hash(), "%d pairs", n)
+			require.Equal(t, savedVersion, tree.Version())
+			require.Equal(t, int64(n), tree.Size())
+			if n > 0 {
+				value, err := tree.Get(pairs[n/2].Key)
+				require.NoError(t, err)
+				require.Equal(t, pairs[n/2].Value, value)
+			}
+		}
+	}
+
+	// the tree is saved and can be reloaded
+	db := dbm.NewMemDB()
+	tree, err := BuildFromSorted(db, sortedPairs(100), 5)
+	require.NoError(t, err)
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), version)
+	require.Equal(t, tree.Hash(), reloaded.Hash())
+
+	_, err = BuildFromSorted(db, sortedPairs(1), 6)
+	require.Error(t, err)
+	unsorted := sortedPairs(3)
+	unsorted[1], unsorted[2] = unsorted[2], unsorted[1]
+	_, err = BuildFromSorted(dbm.NewMemDB(), unsorted, 1)
+	require.Error(t, err)
+	duplicate := append(sortedPairs(2), sortedPairs(2)[1])
+	_, err = BuildFromSorted(dbm.NewMemDB(), duplicate, 1)
+	require.Error(t, err)
+	_, err = BuildFromSorted(dbm.NewMemDB(), []KVPair{{Key: []byte("k"), Delete: true}}, 1)
+	require.Error(t, err)
+}
+
+func BenchmarkBuildFromSorted(b *testing.B) {
+	pairs := sortedPairs(100000)
+	b.Run("BuildFromSorted", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := BuildFromSorted(dbm.NewMemDB(), pairs, 1)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("Set", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+			for _, pair := range pairs {
+				_, err := tree.Set(pair.Key, pair.Value)
+				require.NoError(b, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(b, err)
+		}
+	})
+}
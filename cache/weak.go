@@ -0,0 +1,130 @@
+//go:build go1.24
+
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"weak"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// weakCache is an LRU cache holding up to a number of nodes strongly, which keeps tracking the
+// nodes it evicts through weak references, up to another number of them. The evicted nodes can
+// then be reclaimed by the garbage collector, but are still found by the cache as long as they are
+// alive, i.e. referenced elsewhere, in which case they are moved back to the strong nodes.
+//
+// It reduces the memory retained by the cache, and the garbage collection work it causes, while
+// keeping the hits on the nodes which the application still holds on to.
+type weakCache[T any, PT interface {
+	*T
+	Node
+}] struct {
+	strong       Cache
+	dict         map[string]*list.Element // weakly referenced nodes
+	ll           *list.List               // LRU queue of the weakly referenced nodes
+	maxWeakCount int
+}
+
+type weakEntry[T any] struct {
+	key  string
+	node weak.Pointer[T]
+}
+
+// NewWeak returns a cache holding up to strongCount nodes strongly, and tracking up to weakCount
+// of the nodes it evicted through weak references, which the garbage collector can reclaim. The
+// nodes are returned as they were added, so they must be of the pointer type PT.
+func NewWeak[T any, PT interface {
+	*T
+	Node
+}](strongCount, weakCount int,
+) Cache {
+	return &weakCache[T, PT]{
+		strong:       New(strongCount),
+		dict:         make(map[string]*list.Element),
+		ll:           list.New(),
+		maxWeakCount: weakCount,
+	}
+}
+
+func (c *weakCache[T, PT]) Add(node Node) Node {
+	c.removeWeak(ibytes.UnsafeBytesToStr(node.GetKey()))
+	evicted := c.strong.Add(node)
+	// a node replaced by another one with the same key is not evicted
+	if evicted != nil && !bytes.Equal(evicted.GetKey(), node.GetKey()) {
+		c.addWeak(evicted.(PT))
+	}
+	return evicted
+}
+
+func (c *weakCache[T, PT]) Get(key []byte) Node {
+	if node := c.strong.Get(key); node != nil {
+		return node
+	}
+	node := c.getWeak(key)
+	if node == nil {
+		return nil
+	}
+	// a node still alive is moved back to the strong nodes
+	c.Add(node)
+	return node
+}
+
+func (c *weakCache[T, PT]) Has(key []byte) bool {
+	return c.strong.Has(key) || c.getWeak(key) != nil
+}
+
+func (c *weakCache[T, PT]) Remove(key []byte) Node {
+	if node := c.strong.Remove(key); node != nil {
+		return node
+	}
+	node := c.getWeak(key)
+	if node == nil {
+		return nil
+	}
+	c.removeWeak(ibytes.UnsafeBytesToStr(key))
+	return node
+}
+
+// Len returns the number of nodes in the cache, including the weakly referenced nodes which have
+// been reclaimed but not noticed yet.
+func (c *weakCache[T, PT]) Len() int {
+	return c.strong.Len() + c.ll.Len()
+}
+
+func (c *weakCache[T, PT]) addWeak(node PT) {
+	if c.maxWeakCount <= 0 {
+		return
+	}
+	key := string(node.GetKey())
+	c.dict[key] = c.ll.PushFront(&weakEntry[T]{key: key, node: weak.Make((*T)(node))})
+	if c.ll.Len() > c.maxWeakCount {
+		oldest := c.ll.Remove(c.ll.Back()).(*weakEntry[T])
+		delete(c.dict, oldest.key)
+	}
+}
+
+// getWeak returns the weakly referenced node with the given key if it is still alive, forgetting
+// it otherwise.
+func (c *weakCache[T, PT]) getWeak(key []byte) PT {
+	elem, ok := c.dict[ibytes.UnsafeBytesToStr(key)]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*weakEntry[T])
+	node := entry.node.Value()
+	if node == nil {
+		c.ll.Remove(elem)
+		delete(c.dict, entry.key)
+		return nil
+	}
+	return PT(node)
+}
+
+func (c *weakCache[T, PT]) removeWeak(key string) {
+	if elem, ok := c.dict[key]; ok {
+		c.ll.Remove(elem)
+		delete(c.dict, key)
+	}
+}
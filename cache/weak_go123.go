@@ -0,0 +1,13 @@
+//go:build !go1.24
+
+package cache
+
+// NewWeak returns a cache holding up to strongCount nodes. The weak references it tracks the
+// evicted nodes with need go1.24, so the evicted nodes are dropped as by New.
+func NewWeak[T any, PT interface {
+	*T
+	Node
+}](strongCount, _ int,
+) Cache {
+	return New(strongCount)
+}
@@ -0,0 +1,35 @@
+//go:build go1.24
+
+package cache_test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl/cache"
+)
+
+func Test_WeakCache(t *testing.T) {
+	c := cache.NewWeak[testNode](1, 2)
+	held := &testNode{key: []byte("held")}
+	require.Nil(t, c.Add(held))
+	require.Equal(t, cache.Node(held), c.Add(&testNode{key: []byte("dropped")}))
+	// evicts dropped, which is no longer referenced
+	require.NotNil(t, c.Add(&testNode{key: []byte("last")}))
+	require.Equal(t, 3, c.Len())
+
+	runtime.GC()
+
+	// held is still alive, and is found through its weak reference
+	require.True(t, c.Has([]byte("held")))
+	require.Same(t, held, c.Get([]byte("held")))
+	require.False(t, c.Has([]byte("dropped")))
+	require.Nil(t, c.Get([]byte("dropped")))
+	require.True(t, c.Has([]byte("last")))
+
+	require.Same(t, held, c.Remove([]byte("held")))
+	require.Nil(t, c.Get([]byte("held")))
+	runtime.KeepAlive(held)
+}
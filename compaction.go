@@ -0,0 +1,90 @@
+package iavl
+
+import "bytes"
+
+// AutoCompactThreshold triggers a compaction of the backend once pruning has deleted enough
+// entries, see Options.AutoCompactThreshold. A zero field is not considered, and the compaction
+// runs as soon as any of the others is exceeded.
+type AutoCompactThreshold struct {
+	// Nodes is the number of deleted nodes.
+	Nodes int64
+
+	// Bytes is the total size of the keys and values of the deleted entries, including the
+	// metadata of the pruned versions. Counting it reads the value of every deleted entry.
+	Bytes int64
+}
+
+// dbCompactor is implemented by the backends which can compact a key range, e.g. db.GoLevelDB.
+type dbCompactor interface {
+	ForceCompact(start, limit []byte) error
+}
+
+// prunedRange accumulates the entries deleted by pruning, see Options.AutoCompactThreshold.
+type prunedRange struct {
+	nodes, bytes int64
+	start, end   []byte // the smallest and largest deleted keys, both included
+}
+
+func (r *prunedRange) add(key []byte, nodes, size int64) {
+	r.nodes += nodes
+	r.bytes += size
+	if r.start == nil || bytes.Compare(key, r.start) < 0 {
+		r.start = bytes.Clone(key)
+	}
+	if r.end == nil || bytes.Compare(key, r.end) > 0 {
+		r.end = bytes.Clone(key)
+	}
+}
+
+func (r *prunedRange) merge(other prunedRange) {
+	if other.start == nil {
+		return
+	}
+	r.add(other.start, other.nodes, other.bytes)
+	r.add(other.end, 0, 0)
+}
+
+// autoCompacting returns whether the entries deleted by pruning are tracked to trigger the
+// compaction of the backend.
+func (ndb *nodeDB) autoCompacting() bool {
+	return ndb.opts.AutoCompactThreshold != nil && ndb.compactor != nil
+}
+
+// recordPruned records an entry deleted by pruning. It must be called with ndb.mtx held.
+func (ndb *nodeDB) recordPruned(key []byte) error {
+	var nodes, size int64
+	if prefix := key[0]; prefix == nodeKeyFormat.Prefix()[0] || prefix == legacyNodeKeyFormat.Prefix()[0] {
+		nodes = 1
+	}
+	if ndb.opts.AutoCompactThreshold.Bytes > 0 {
+		bz, err := ndb.db.Get(key)
+		if err != nil {
+			return err
+		}
+		size = int64(len(key) + len(bz))
+	}
+	ndb.pruned.add(key, nodes, size)
+	return nil
+}
+
+// compactIfDue compacts the key range of the entries deleted by pruning and committed since the
+// last compaction, if they exceed Options.AutoCompactThreshold. The compaction runs without the
+// nodeDB lock held, so the reads of the tree only contend with the backend itself.
+func (ndb *nodeDB) compactIfDue() error {
+	if !ndb.autoCompacting() {
+		return nil
+	}
+	threshold := ndb.opts.AutoCompactThreshold
+	ndb.mtx.Lock()
+	due := ndb.prunedCommitted
+	if (threshold.Nodes <= 0 || due.nodes <= threshold.Nodes) && (threshold.Bytes <= 0 || due.bytes <= threshold.Bytes) {
+		ndb.mtx.Unlock()
+		return nil
+	}
+	ndb.prunedCommitted = prunedRange{}
+	ndb.mtx.Unlock()
+
+	ndb.logger.Debug("compacting after pruning", "nodes", due.nodes, "bytes", due.bytes)
+	// the limit is excluded, so it is the smallest key after the largest deleted one
+	return ndb.compactor.ForceCompact(due.start, append(due.end, 0))
+}
@@ -0,0 +1,88 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// compactingDB records the compactions of the db.
+type compactingDB struct {
+	*dbm.MemDB
+	compactions [][2][]byte
+}
+
+func (db *compactingDB) ForceCompact(start, limit []byte) error {
+	db.compactions = append(db.compactions, [2][]byte{start, limit})
+	return nil
+}
+
+func saveCompactionWorkload(t *testing.T, tree *MutableTree, versions int) {
+	for v := 0; v < versions; v++ {
+		for i := 0; i < 100; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+func TestAutoCompactThreshold(t *testing.T) {
+	db := &compactingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, true, NewNopLogger(), AutoCompactThresholdOption(&AutoCompactThreshold{Nodes: 300}))
+	saveCompactionWorkload(t, tree, 10)
+
+	// the deleted nodes are accumulated until the threshold is exceeded
+	var deleted [][]byte
+	for _, version := range []int64{1, 2} {
+		require.NoError(t, tree.ndb.traverseVersionDeletions(version, newRootkeyCache(), true, func(key []byte) error {
+			deleted = append(deleted, key)
+			return nil
+		}, nil))
+		require.NoError(t, tree.DeleteVersionsTo(version))
+		if version == 1 {
+			require.Empty(t, db.compactions)
+		}
+	}
+	require.Len(t, db.compactions, 1)
+	start, limit := db.compactions[0][0], db.compactions[0][1]
+	for _, key := range deleted {
+		require.True(t, bytes.Compare(start, key) <= 0 && bytes.Compare(key, limit) < 0, "key %X", key)
+	}
+
+	// the count starts over after a compaction
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	require.Len(t, db.compactions, 1)
+
+	// the bytes threshold
+	db = &compactingDB{MemDB: dbm.NewMemDB()}
+	tree = NewMutableTree(db, 0, true, NewNopLogger(), AutoCompactThresholdOption(&AutoCompactThreshold{Bytes: 1}))
+	saveCompactionWorkload(t, tree, 3)
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	require.Len(t, db.compactions, 1)
+
+	// the backends which cannot compact are skipped
+	tree = NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger(), AutoCompactThresholdOption(&AutoCompactThreshold{Nodes: 1}))
+	saveCompactionWorkload(t, tree, 3)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	require.Zero(t, tree.ndb.prunedCommitted.nodes)
+}
+
+func TestAutoCompactThresholdGoLevelDB(t *testing.T) {
+	db, err := dbm.NewGoLevelDB("test", t.TempDir())
+	require.NoError(t, err)
+	tree := NewMutableTree(db, 0, true, NewNopLogger(), AutoCompactThresholdOption(&AutoCompactThreshold{Nodes: 1}))
+	saveCompactionWorkload(t, tree, 5)
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	require.Zero(t, tree.ndb.prunedCommitted.nodes)
+	for version := int64(4); version <= 5; version++ {
+		_, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.Close())
+}
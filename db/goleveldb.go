@@ -179,6 +179,80 @@ func (db *GoLevelDB) ReverseIterator(start, end []byte) (corestore.Iterator, err
 	return newGoLevelDBIterator(itr, start, end, true), nil
 }
 
+// errSnapshotReadOnly is returned when attempting to write to a snapshot.
+var errSnapshotReadOnly = errors.New("snapshot is read-only")
+
+// GoLevelDBSnapshot is a read-only point-in-time view of a GoLevelDB, which later writes to the db
+// do not affect. It implements corestore.KVStore, whose writes fail, and must be released when
+// done.
+type GoLevelDBSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+var _ corestore.KVStore = (*GoLevelDBSnapshot)(nil)
+
+// Snapshot takes a snapshot of the current state of the db.
+func (db *GoLevelDB) Snapshot() (*GoLevelDBSnapshot, error) {
+	snap, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &GoLevelDBSnapshot{snap: snap}, nil
+}
+
+// Get implements corestore.KVStore.
+func (s *GoLevelDBSnapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("key is empty")
+	}
+	res, err := s.snap.Get(key, nil)
+	if err != nil {
+		if errors.Is(err, dberrors.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// Has implements corestore.KVStore.
+func (s *GoLevelDBSnapshot) Has(key []byte) (bool, error) {
+	return s.snap.Has(key, nil)
+}
+
+// Set implements corestore.KVStore, it always fails.
+func (s *GoLevelDBSnapshot) Set(_, _ []byte) error {
+	return errSnapshotReadOnly
+}
+
+// Delete implements corestore.KVStore, it always fails.
+func (s *GoLevelDBSnapshot) Delete(_ []byte) error {
+	return errSnapshotReadOnly
+}
+
+// Iterator implements corestore.KVStore.
+func (s *GoLevelDBSnapshot) Iterator(start, end []byte) (corestore.Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errors.New("key is empty")
+	}
+	itr := s.snap.NewIterator(&util.Range{Start: start, Limit: end}, nil)
+	return newGoLevelDBIterator(itr, start, end, false), nil
+}
+
+// ReverseIterator implements corestore.KVStore.
+func (s *GoLevelDBSnapshot) ReverseIterator(start, end []byte) (corestore.Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errors.New("key is empty")
+	}
+	itr := s.snap.NewIterator(&util.Range{Start: start, Limit: end}, nil)
+	return newGoLevelDBIterator(itr, start, end, true), nil
+}
+
+// Release releases the snapshot, which must not be used afterwards.
+func (s *GoLevelDBSnapshot) Release() {
+	s.snap.Release()
+}
+
 type goLevelDBIterator struct {
 	source    iterator.Iterator
 	start     []byte
@@ -280,6 +354,12 @@ func (itr *goLevelDBIterator) Value() []byte {
 	return cp(itr.source.Value())
 }
 
+// UnsafeValue implements UnsafeValueIterator.
+func (itr *goLevelDBIterator) UnsafeValue() []byte {
+	itr.assertIsValid()
+	return itr.source.Value()
+}
+
 // Next implements Iterator.
 func (itr *goLevelDBIterator) Next() {
 	itr.assertIsValid()
@@ -258,6 +258,15 @@ func (itr *prefixDBIterator) Value() []byte {
 	return itr.source.Value()
 }
 
+// UnsafeValue implements UnsafeValueIterator.
+func (itr *prefixDBIterator) UnsafeValue() []byte {
+	itr.assertIsValid()
+	if source, ok := itr.source.(UnsafeValueIterator); ok {
+		return source.UnsafeValue()
+	}
+	return itr.source.Value()
+}
+
 // Error implements Iterator.
 func (itr *prefixDBIterator) Error() error {
 	if err := itr.source.Error(); err != nil {
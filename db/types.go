@@ -60,3 +60,12 @@ type DB interface {
 	// This will does the same thing as NewBatch if the batch implementation doesn't support pre-allocation.
 	NewBatchWithSize(int) corestore.Batch
 }
+
+// UnsafeValueIterator is an iterator which can return its current value without copying it.
+type UnsafeValueIterator interface {
+	corestore.Iterator
+
+	// UnsafeValue returns the current value like Value, but it may alias a buffer of the iterator,
+	// which is only valid until the next call to Next or Close, and must not be modified.
+	UnsafeValue() []byte
+}
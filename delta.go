@@ -0,0 +1,443 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	corestore "cosmossdk.io/core/store"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// deltaMagic prefixes every stream written by DeltaExporter.WriteTo.
+var deltaMagic = []byte("IAVLDLTA")
+
+// deltaFormatVersion is the version of the format written after the magic.
+const deltaFormatVersion byte = 1
+
+const (
+	deltaRecordEnd    byte = 0
+	deltaRecordNode   byte = 1
+	deltaRecordShared byte = 2
+)
+
+// ErrDeltaBaseMismatch is returned by ImportDelta when the db does not hold the version the delta
+// was exported from, with the same root hash.
+var ErrDeltaBaseMismatch = errors.New("delta base version mismatch")
+
+// DeltaNode is a node exported by DeltaExporter. A node of the target version which is part of
+// the base version too is exported as a reference to its subtree: SharedHash is set to the hash of
+// the node, only Key and Height are set besides, and the nodes of the subtree are not exported.
+type DeltaNode struct {
+	ExportNode
+	SharedHash []byte
+}
+
+// DeltaExporter exports the nodes of a version which are not part of an earlier version, e.g. for
+// a state sync peer already holding the earlier version. It is created by
+// MutableTree.ExportDelta.
+//
+// Like with Exporter, the nodes are exported depth-first post-order (LRN), and the subtrees
+// shared with the base version are replaced by references, see DeltaNode. The delta can be
+// written to a stream with WriteTo and applied with ImportDelta.
+type DeltaExporter struct {
+	tree        *ImmutableTree
+	fromVersion int64
+	fromHash    []byte
+	ch          chan *DeltaNode
+	cancel      context.CancelFunc
+	err         error // the error of the traversal, set before ch is closed
+}
+
+// ExportDelta returns an exporter of the nodes of toVersion which are not part of fromVersion,
+// which must be an earlier version, see DeltaExporter. Since the nodes of a version are never
+// changed, a node of toVersion is part of fromVersion if and only if it was created at fromVersion
+// or before, so the shared subtrees are found without reading fromVersion. Both versions must be
+// available. Callers must call Close when done.
+func (tree *MutableTree) ExportDelta(fromVersion, toVersion int64) (*DeltaExporter, error) {
+	if fromVersion >= toVersion {
+		return nil, fmt.Errorf("delta from version %d must be below to version %d", fromVersion, toVersion)
+	}
+	from, err := tree.GetImmutable(fromVersion)
+	if err != nil {
+		return nil, fmt.Errorf("version %d: %w", fromVersion, err)
+	}
+	to, err := tree.GetImmutable(toVersion)
+	if err != nil {
+		return nil, fmt.Errorf("version %d: %w", toVersion, err)
+	}
+
+	return newDeltaExporter(to, fromVersion, from.Hash()), nil
+}
+
+// newDeltaExporter returns an exporter of the nodes of the tree created after fromVersion, whose
+// root hash is fromHash.
+func newDeltaExporter(tree *ImmutableTree, fromVersion int64, fromHash []byte) *DeltaExporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	exporter := &DeltaExporter{
+		tree:        tree,
+		fromVersion: fromVersion,
+		fromHash:    fromHash,
+		ch:          make(chan *DeltaNode, exportBufferSize),
+		cancel:      cancel,
+	}
+	tree.ndb.incrVersionReaders(tree.version)
+	go exporter.export(ctx)
+	return exporter
+}
+
+func (e *DeltaExporter) export(ctx context.Context) {
+	defer close(e.ch)
+	if e.tree.root != nil {
+		_, e.err = e.exportNode(ctx, e.tree.root)
+	}
+}
+
+// exportNode exports the subtree of the given node, and returns whether the export is canceled.
+func (e *DeltaExporter) exportNode(ctx context.Context, node *Node) (bool, error) {
+	exportNode := &DeltaNode{
+		ExportNode: ExportNode{
+			Key:     node.key,
+			Version: node.nodeKey.version,
+			Height:  node.subtreeHeight,
+		},
+	}
+	switch {
+	case node.nodeKey.version <= e.fromVersion:
+		exportNode.SharedHash = node.hash
+	case node.isLeaf():
+		exportNode.Value = node.value
+	default:
+		leftNode, err := node.getLeftNode(e.tree)
+		if err != nil {
+			return false, err
+		}
+		if canceled, err := e.exportNode(ctx, leftNode); canceled || err != nil {
+			return canceled, err
+		}
+		rightNode, err := node.getRightNode(e.tree)
+		if err != nil {
+			return false, err
+		}
+		if canceled, err := e.exportNode(ctx, rightNode); canceled || err != nil {
+			return canceled, err
+		}
+	}
+
+	select {
+	case e.ch <- exportNode:
+		return false, nil
+	case <-ctx.Done():
+		return true, nil
+	}
+}
+
+// Next fetches the next exported node, or returns ErrorExportDone when done.
+func (e *DeltaExporter) Next() (*DeltaNode, error) {
+	if exportNode, ok := <-e.ch; ok {
+		return exportNode, nil
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return nil, ErrorExportDone
+}
+
+// WriteTo writes the delta to w as a self-describing stream, which ImportDelta applies. It writes
+// the nodes not fetched with Next yet, so it is meant to be called on a new exporter.
+func (e *DeltaExporter) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	header := make([]byte, 0, len(deltaMagic)+1+2*binary.MaxVarintLen64+2*hashSize)
+	header = append(header, deltaMagic...)
+	header = append(header, deltaFormatVersion)
+	header = binary.AppendVarint(header, e.fromVersion)
+	header = binary.AppendVarint(header, e.tree.version)
+	header = append(header, e.fromHash...)
+	header = append(header, e.tree.Hash()...)
+	if _, err := bw.Write(header); err != nil {
+		return cw.n, err
+	}
+
+	for {
+		node, err := e.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return cw.n, err
+		}
+		if err := writeDeltaNode(bw, node); err != nil {
+			return cw.n, err
+		}
+	}
+	if err := bw.WriteByte(deltaRecordEnd); err != nil {
+		return cw.n, err
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Close closes the exporter. It is safe to call multiple times.
+func (e *DeltaExporter) Close() {
+	e.cancel()
+	for range e.ch { //nolint:revive
+	} // drain channel
+	if e.tree != nil {
+		e.tree.ndb.decrVersionReaders(e.tree.version)
+	}
+	e.tree = nil
+}
+
+// ImportDelta applies a delta written by DeltaExporter.WriteTo to the tree stored in db, whose
+// latest version must be the base version of the delta, fromVersion, with the same root hash, or
+// ErrDeltaBaseMismatch is returned. The target version of the delta is saved once the root hash
+// of the rebuilt tree is checked against the one of the exported version. The options are the
+// ones the tree is opened with.
+//
+// The shared subtrees referenced by the delta are found in the base version by their hash, so the
+// base version may have been imported or rebuilt differently, as long as its root hash is the
+// same. If the import fails, nodes of the target version may already have been flushed to the
+// db, but they are not visible.
+//
+// The versions between fromVersion and the target version are skipped: they are not stored, nor
+// listed by MutableTree.AvailableVersions, and fromVersion is pruned against the target version.
+func ImportDelta(db corestore.KVStoreWithBatch, fromVersion int64, r io.Reader, options ...Option) error {
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), options...)
+	defer tree.Close()
+	if _, err := tree.Load(); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	importer, err := tree.readDelta(br, fromVersion)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+	if err := readStreamEOF(br); err != nil {
+		return err
+	}
+	return importer.Commit()
+}
+
+// readDelta reads a delta from fromVersion, which must be the latest version of the tree, and
+// returns the importer of the target version once its root hash is checked. The caller commits
+// it, or closes it.
+func (tree *MutableTree) readDelta(r *bufio.Reader, fromVersion int64) (_ *Importer, err error) {
+	header, err := readDeltaHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.fromVersion != fromVersion {
+		return nil, fmt.Errorf("%w: the delta is from version %d, not %d", ErrDeltaBaseMismatch, header.fromVersion, fromVersion)
+	}
+	if latestVersion := tree.ndb.latestVersion; latestVersion != fromVersion {
+		return nil, fmt.Errorf("%w: found database at version %d, not %d", ErrDeltaBaseMismatch, latestVersion, fromVersion)
+	}
+	if hash := tree.Hash(); !bytes.Equal(hash, header.fromHash) {
+		return nil, fmt.Errorf("%w: version %d has root hash %X, not %X", ErrDeltaBaseMismatch, fromVersion, hash, header.fromHash)
+	}
+
+	importer := &Importer{
+		tree:          tree,
+		version:       header.toVersion,
+		batch:         tree.ndb.db.NewBatch(),
+		stack:         make([]*Node, 0, 8),
+		nonces:        make([]uint32, header.toVersion+1),
+		sharedVersion: fromVersion,
+	}
+	defer func() {
+		if err != nil {
+			importer.Close()
+		}
+	}()
+	for {
+		node, err := readDeltaNode(r)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			break
+		}
+		if node.SharedHash == nil {
+			if node.Version <= fromVersion {
+				return nil, fmt.Errorf("%w: node of version %d is not shared with version %d", ErrInvalidStream, node.Version, fromVersion)
+			}
+			if err := importer.Add(&node.ExportNode); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		shared, err := tree.findNode(node.Key, node.SharedHash, node.Height)
+		if err != nil {
+			return nil, err
+		}
+		importer.stack = append(importer.stack, shared)
+	}
+
+	var root *Node
+	switch len(importer.stack) {
+	case 0:
+	case 1:
+		root = importer.stack[0]
+		root._hash(root.nodeKey.version)
+	default:
+		return nil, fmt.Errorf("%w: found stack size %d at the end of the delta", ErrInvalidStream, len(importer.stack))
+	}
+	if hash := root.hashWithCount(header.toVersion + 1); !bytes.Equal(hash, header.toHash) {
+		return nil, fmt.Errorf("the delta rebuilds version %d with root hash %X instead of %X", header.toVersion, hash, header.toHash)
+	}
+	return importer, nil
+}
+
+// findNode returns the node of the tree with the given hash and height on the path to the given
+// key, which must be a key of its subtree, e.g. its own key.
+func (t *ImmutableTree) findNode(key, hash []byte, height int8) (*Node, error) {
+	node := t.root
+	for node != nil && node.subtreeHeight >= height {
+		if node.subtreeHeight == height && bytes.Equal(node.hash, hash) {
+			return node, nil
+		}
+		if node.isLeaf() {
+			break
+		}
+		var err error
+		if bytes.Compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: shared node %X is not part of version %d", ErrDeltaBaseMismatch, hash, t.version)
+}
+
+// deltaHeader is the header of a delta stream.
+type deltaHeader struct {
+	fromVersion, toVersion int64
+	fromHash, toHash       []byte
+}
+
+func readDeltaHeader(r *bufio.Reader) (*deltaHeader, error) {
+	magic := make([]byte, len(deltaMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("%w: reading header: %w", ErrInvalidStream, err)
+	}
+	if !bytes.Equal(magic[:len(deltaMagic)], deltaMagic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidStream)
+	}
+	if format := magic[len(deltaMagic)]; format != deltaFormatVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrInvalidStream, format)
+	}
+	header := &deltaHeader{
+		fromHash: make([]byte, sha256.Size),
+		toHash:   make([]byte, sha256.Size),
+	}
+	var err error
+	if header.fromVersion, err = binary.ReadVarint(r); err != nil {
+		return nil, fmt.Errorf("%w: reading from version: %w", ErrInvalidStream, err)
+	}
+	if header.toVersion, err = binary.ReadVarint(r); err != nil {
+		return nil, fmt.Errorf("%w: reading to version: %w", ErrInvalidStream, err)
+	}
+	if header.fromVersion < 0 || header.toVersion <= header.fromVersion {
+		return nil, fmt.Errorf("%w: invalid versions %d to %d", ErrInvalidStream, header.fromVersion, header.toVersion)
+	}
+	if _, err := io.ReadFull(r, header.fromHash); err != nil {
+		return nil, fmt.Errorf("%w: reading from hash: %w", ErrInvalidStream, err)
+	}
+	if _, err := io.ReadFull(r, header.toHash); err != nil {
+		return nil, fmt.Errorf("%w: reading to hash: %w", ErrInvalidStream, err)
+	}
+	return header, nil
+}
+
+func writeDeltaNode(w *bufio.Writer, node *DeltaNode) error {
+	record := deltaRecordNode
+	if node.SharedHash != nil {
+		record = deltaRecordShared
+	}
+	if err := w.WriteByte(record); err != nil {
+		return err
+	}
+	if err := w.WriteByte(byte(node.Height)); err != nil {
+		return err
+	}
+	if err := encoding.EncodeBytes(w, node.Key); err != nil {
+		return err
+	}
+	if node.SharedHash != nil {
+		_, err := w.Write(node.SharedHash)
+		return err
+	}
+	if err := encoding.EncodeVarint(w, node.Version); err != nil {
+		return err
+	}
+	if node.Height != 0 {
+		return nil
+	}
+	return encoding.EncodeBytes(w, node.Value)
+}
+
+// readDeltaNode reads the next node from a delta stream, it returns nil at the end marker.
+func readDeltaNode(r *bufio.Reader) (*DeltaNode, error) {
+	record, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	switch record {
+	case deltaRecordEnd:
+		return nil, nil
+	case deltaRecordNode, deltaRecordShared:
+	default:
+		return nil, fmt.Errorf("%w: unknown record %d", ErrInvalidStream, record)
+	}
+
+	height, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	node := &DeltaNode{ExportNode: ExportNode{Height: int8(height)}}
+	if node.Key, err = readStreamBytes(r); err != nil {
+		return nil, err
+	}
+	if record == deltaRecordShared {
+		node.SharedHash = make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, node.SharedHash); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+		}
+		return node, nil
+	}
+	if node.Version, err = binary.ReadVarint(r); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	if node.Height != 0 {
+		return node, nil
+	}
+	if node.Value, err = readStreamBytes(r); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
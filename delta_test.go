@@ -0,0 +1,153 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func saveDeltaWorkload(t *testing.T, r *rand.Rand, trees []*MutableTree, versions, changes int) {
+	for v := 0; v < versions; v++ {
+		for i := 0; i < changes; i++ {
+			key := []byte(fmt.Sprintf("k%03d", r.Intn(200)))
+			remove, value := r.Intn(5) == 0, []byte(fmt.Sprintf("v%d", r.Int()))
+			for _, tree := range trees {
+				if remove {
+					_, _, err := tree.Remove(key)
+					require.NoError(t, err)
+				} else {
+					_, err := tree.Set(key, value)
+					require.NoError(t, err)
+				}
+			}
+		}
+		for _, tree := range trees {
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+}
+
+// countNodeEntries returns the number of node entries stored by the tree.
+func countNodeEntries(t *testing.T, tree *MutableTree) int {
+	var count int
+	require.NoError(t, tree.ndb.traversePrefix(nodeKeyFormat.Prefix(), func(_, _ []byte) error {
+		count++
+		return nil
+	}))
+	return count
+}
+
+func TestDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	source := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	db := dbm.NewMemDB()
+	peer := NewMutableTree(db, 0, false, NewNopLogger())
+	saveDeltaWorkload(t, r, []*MutableTree{source, peer}, 5, 100)
+	saveDeltaWorkload(t, r, []*MutableTree{source}, 3, 5)
+
+	exporter, err := source.ExportDelta(5, 8)
+	require.NoError(t, err)
+	defer exporter.Close()
+	var delta bytes.Buffer
+	n, err := exporter.WriteTo(&delta)
+	require.NoError(t, err)
+	require.EqualValues(t, delta.Len(), n)
+
+	// the delta is smaller than a full snapshot
+	itree, err := source.GetImmutable(8)
+	require.NoError(t, err)
+	var snapshot bytes.Buffer
+	err = itree.ExportCompressed(&snapshot, NoneCodec{})
+	require.NoError(t, err)
+	require.Less(t, delta.Len(), snapshot.Len())
+
+	// a mismatched base is rejected
+	require.ErrorIs(t, ImportDelta(db, 4, bytes.NewReader(delta.Bytes())), ErrDeltaBaseMismatch)
+	other := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	saveDeltaWorkload(t, r, []*MutableTree{other}, 5, 100)
+	require.ErrorIs(t, ImportDelta(other.ndb.db, 5, bytes.NewReader(delta.Bytes())), ErrDeltaBaseMismatch)
+
+	require.NoError(t, ImportDelta(db, 5, bytes.NewReader(delta.Bytes())))
+	synced := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := synced.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 8, version)
+	require.Equal(t, itree.Hash(), synced.Hash())
+	_, err = itree.Iterate(func(key, value []byte) bool {
+		actual, err := synced.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, actual)
+		return false
+	})
+	require.NoError(t, err)
+
+	// the base version is still readable and the synced tree keeps going
+	base, err := synced.GetImmutable(5)
+	require.NoError(t, err)
+	require.Equal(t, peer.Hash(), base.Hash())
+	saveDeltaWorkload(t, r, []*MutableTree{source, synced}, 2, 20)
+	require.Equal(t, source.Hash(), synced.Hash())
+}
+
+func TestDeltaNodes(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	saveDeltaWorkload(t, rand.New(rand.NewSource(1)), []*MutableTree{tree}, 4, 20)
+	_, err := tree.ExportDelta(3, 3)
+	require.Error(t, err)
+
+	exporter, err := tree.ExportDelta(3, 4)
+	require.NoError(t, err)
+	defer exporter.Close()
+	var nodes, shared int
+	for {
+		node, err := exporter.Next()
+		if err == ErrorExportDone {
+			break
+		}
+		require.NoError(t, err)
+		if node.SharedHash != nil {
+			require.LessOrEqual(t, node.Version, int64(3))
+			shared++
+		} else {
+			require.EqualValues(t, 4, node.Version)
+			nodes++
+		}
+	}
+	require.Positive(t, nodes)
+	require.Positive(t, shared)
+}
+
+func TestDeltaPruning(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	source := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	db := dbm.NewMemDB()
+	peer := NewMutableTree(db, 0, false, NewNopLogger())
+	saveDeltaWorkload(t, r, []*MutableTree{source, peer}, 5, 100)
+	saveDeltaWorkload(t, r, []*MutableTree{source}, 3, 20)
+
+	exporter, err := source.ExportDelta(5, 8)
+	require.NoError(t, err)
+	defer exporter.Close()
+	var delta bytes.Buffer
+	_, err = exporter.WriteTo(&delta)
+	require.NoError(t, err)
+	require.NoError(t, ImportDelta(db, 5, bytes.NewReader(delta.Bytes())))
+	synced := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = synced.Load()
+	require.NoError(t, err)
+
+	// the versions 6 and 7 are missing on the peer, so the nodes of 5 are orphaned by 8
+	require.Equal(t, []int{1, 2, 3, 4, 5, 8}, synced.AvailableVersions())
+	require.False(t, synced.VersionExists(6))
+	require.NoError(t, source.DeleteVersionsTo(7))
+	require.NoError(t, synced.DeleteVersionsTo(7))
+	require.Equal(t, countNodeEntries(t, source), countNodeEntries(t, synced))
+	saveDeltaWorkload(t, r, []*MutableTree{source, synced}, 2, 20)
+	require.Equal(t, source.Hash(), synced.Hash())
+}
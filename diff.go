@@ -2,7 +2,12 @@ package iavl
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 
+	corestore "cosmossdk.io/core/store"
+
+	dbm "github.com/cosmos/iavl/db"
 	"github.com/cosmos/iavl/proto"
 )
 
@@ -150,3 +155,288 @@ func (ndb *nodeDB) extractStateChanges(prevVersion int64, prevRoot, root []byte,
 	}
 	return prevIter.Error()
 }
+
+// errDiffFound stops the state changes extraction at the first difference.
+var errDiffFound = errors.New("difference found")
+
+// TreesEqual returns true iff a and b contain identical key/value sets. The root hashes are
+// compared first, and only if they differ, the trees are compared deeply, since trees holding the
+// same key/value pairs can still differ in shape or node versions.
+func TreesEqual(a, b *ImmutableTree) (bool, error) {
+	key, err := FirstDifferingKey(a, b)
+	if err != nil {
+		return false, err
+	}
+	return key == nil, nil
+}
+
+// FirstDifferingKey returns the lowest key which is present in only one of a and b, or holds a
+// different value in each, or nil if both trees contain identical key/value sets.
+//
+// When a and b are saved versions of the same tree, only the subtrees changed between the two
+// versions are visited, using the same traversal as TraverseStateChanges. Otherwise, both trees
+// are iterated in key order.
+func FirstDifferingKey(a, b *ImmutableTree) ([]byte, error) {
+	if a == nil || b == nil {
+		return nil, errors.New("trees cannot be nil")
+	}
+	if bytes.Equal(a.Hash(), b.Hash()) {
+		return nil, nil
+	}
+
+	if a.ndb == b.ndb && a.version != b.version && a.root != nil && b.root != nil &&
+		a.root.nodeKey != nil && b.root.nodeKey != nil {
+		if a.version > b.version {
+			a, b = b, a
+		}
+		return firstDifferingKeyByDiff(a, b)
+	}
+	return firstDifferingKeyByIteration(a, b)
+}
+
+// firstDifferingKeyByDiff finds the first differing key between two saved versions of the same
+// tree, prev being the older one.
+func firstDifferingKeyByDiff(prev, cur *ImmutableTree) ([]byte, error) {
+	var diffKey []byte
+	err := prev.ndb.extractStateChanges(prev.version, prev.root.GetKey(), cur.root.GetKey(), func(pair *KVPair) error {
+		if !pair.Delete {
+			// a key might have been written again with the same value
+			value, err := prev.Get(pair.Key)
+			if err != nil {
+				return err
+			}
+			if value != nil && bytes.Equal(value, pair.Value) {
+				return nil
+			}
+		}
+		diffKey = pair.Key
+		return errDiffFound
+	})
+	if err != nil && !errors.Is(err, errDiffFound) {
+		return nil, err
+	}
+	return diffKey, nil
+}
+
+func firstDifferingKeyByIteration(a, b *ImmutableTree) ([]byte, error) {
+	// iterate over the tree nodes rather than fast nodes, so unsaved changes are taken into account
+	itA := NewIterator(nil, nil, true, a)
+	defer itA.Close()
+	itB := NewIterator(nil, nil, true, b)
+	defer itB.Close()
+
+	for itA.Valid() && itB.Valid() {
+		switch c := bytes.Compare(itA.Key(), itB.Key()); {
+		case c < 0:
+			return itA.Key(), nil
+		case c > 0:
+			return itB.Key(), nil
+		case !bytes.Equal(itA.Value(), itB.Value()):
+			return itA.Key(), nil
+		}
+		itA.Next()
+		itB.Next()
+	}
+	if err := itA.Error(); err != nil {
+		return nil, err
+	}
+	if err := itB.Error(); err != nil {
+		return nil, err
+	}
+	if itA.Valid() {
+		return itA.Key(), nil
+	}
+	if itB.Valid() {
+		return itB.Key(), nil
+	}
+	return nil, nil
+}
+
+// MergeTrees returns a new tree, backed by an in-memory db, holding the key/value pairs of both
+// base and overlay. For a key present in both trees, onConflict is called with the key and the
+// two values, and the returned value is stored, or the key is left out if it returns nil. A nil
+// onConflict lets the overlay value shadow the base one. The keys are merged in ascending order,
+// so the same inputs always produce the same tree and working hash. The merged tree is not saved.
+func MergeTrees(base, overlay *ImmutableTree, onConflict func(key, baseVal, overlayVal []byte) []byte) (*MutableTree, error) {
+	if base == nil || overlay == nil {
+		return nil, errors.New("trees cannot be nil")
+	}
+	lg := base.logger
+	if lg == nil {
+		lg = NewNopLogger()
+	}
+	merged := NewMutableTree(dbm.NewMemDB(), 0, base.skipFastStorageUpgrade, lg)
+
+	itBase := NewIterator(nil, nil, true, base)
+	defer itBase.Close()
+	itOverlay := NewIterator(nil, nil, true, overlay)
+	defer itOverlay.Close()
+
+	for itBase.Valid() || itOverlay.Valid() {
+		var key, value []byte
+		switch c := compareIterators(itBase, itOverlay); {
+		case c < 0:
+			key, value = itBase.Key(), itBase.Value()
+			itBase.Next()
+		case c > 0:
+			key, value = itOverlay.Key(), itOverlay.Value()
+			itOverlay.Next()
+		default:
+			key, value = itOverlay.Key(), itOverlay.Value()
+			if onConflict != nil {
+				value = onConflict(key, itBase.Value(), value)
+			}
+			itBase.Next()
+			itOverlay.Next()
+		}
+		if value == nil {
+			continue
+		}
+		if _, err := merged.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := itBase.Error(); err != nil {
+		return nil, err
+	}
+	if err := itOverlay.Error(); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// compareIterators compares the current keys of two ascending iterators, an exhausted iterator
+// being past any key.
+func compareIterators(a, b corestore.Iterator) int {
+	switch {
+	case !a.Valid():
+		return 1
+	case !b.Valid():
+		return -1
+	}
+	return bytes.Compare(a.Key(), b.Key())
+}
+
+// ChangedKeys returns the keys set or deleted by the given version, in ascending order. They are
+// the keys of the ChangeSet of the version as extracted by TraverseStateChanges, but the values
+// are not collected.
+func (tree *MutableTree) ChangedKeys(version int64) ([][]byte, error) {
+	if !tree.VersionExists(version) {
+		return nil, ErrVersionDoesNotExist
+	}
+	root, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	prevRoot, err := tree.ndb.GetRoot(version - 1)
+	if err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
+		return nil, err
+	}
+
+	var keys [][]byte
+	if err := tree.ndb.extractStateChanges(version-1, prevRoot, root, func(pair *KVPair) error {
+		keys = append(keys, pair.Key)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeletedOnlyIterator returns an iterator over the keys which exist at version from but not at
+// version to, in ascending order, each with the value it held at version from. The tombstones are
+// derived from the state changes between the two versions, so only the subtrees changed in
+// between are visited. They are collected before the iterator is returned.
+func (tree *MutableTree) DeletedOnlyIterator(from, to int64) (corestore.Iterator, error) {
+	if from > to {
+		return nil, fmt.Errorf("from version %d is after to version %d", from, to)
+	}
+	prev, err := tree.GetImmutable(from)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := tree.GetImmutable(to)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := &deletedIterator{}
+	switch {
+	case prev.root == nil || from == to:
+	case cur.root == nil:
+		// everything was deleted
+		if _, err := prev.Iterate(func(key, value []byte) bool {
+			iter.pairs = append(iter.pairs, &KVPair{Delete: true, Key: key, Value: value})
+			return false
+		}); err != nil {
+			return nil, err
+		}
+	default:
+		err := tree.ndb.extractStateChanges(prev.version, prev.root.GetKey(), cur.root.GetKey(), func(pair *KVPair) error {
+			if !pair.Delete {
+				return nil
+			}
+			value, err := prev.Get(pair.Key)
+			if err != nil {
+				return err
+			}
+			iter.pairs = append(iter.pairs, &KVPair{Delete: true, Key: pair.Key, Value: value})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return iter, nil
+}
+
+// deletedIterator iterates over the collected tombstones of DeletedOnlyIterator.
+type deletedIterator struct {
+	pairs []*KVPair
+}
+
+var _ corestore.Iterator = (*deletedIterator)(nil)
+
+// Domain implements corestore.Iterator.
+func (iter *deletedIterator) Domain() ([]byte, []byte) {
+	return nil, nil
+}
+
+// Valid implements corestore.Iterator.
+func (iter *deletedIterator) Valid() bool {
+	return len(iter.pairs) > 0
+}
+
+// Next implements corestore.Iterator.
+func (iter *deletedIterator) Next() {
+	if len(iter.pairs) > 0 {
+		iter.pairs = iter.pairs[1:]
+	}
+}
+
+// Key implements corestore.Iterator.
+func (iter *deletedIterator) Key() []byte {
+	if len(iter.pairs) == 0 {
+		return nil
+	}
+	return iter.pairs[0].Key
+}
+
+// Value implements corestore.Iterator. It returns the last value of the deleted key.
+func (iter *deletedIterator) Value() []byte {
+	if len(iter.pairs) == 0 {
+		return nil
+	}
+	return iter.pairs[0].Value
+}
+
+// Error implements corestore.Iterator.
+func (iter *deletedIterator) Error() error {
+	return nil
+}
+
+// Close implements corestore.Iterator.
+func (iter *deletedIterator) Close() error {
+	iter.pairs = nil
+	return nil
+}
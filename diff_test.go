@@ -38,6 +38,75 @@ func TestDiffRoundTrip(t *testing.T) {
 	require.Equal(t, changeSets, extractChangeSets)
 }
 
+func TestTreesEqual(t *testing.T) {
+	changeSets := genChangeSets(rand.New(rand.NewSource(0)), 50)
+
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for i := range changeSets {
+		_, err := tree.SaveChangeSet(changeSets[i])
+		require.NoError(t, err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		a, err := tree.GetImmutable(r.Int63n(50) + 1)
+		require.NoError(t, err)
+		b, err := tree.GetImmutable(r.Int63n(50) + 1)
+		require.NoError(t, err)
+
+		// the diff based search must agree with a plain iteration
+		expected, err := firstDifferingKeyByIteration(a, b)
+		require.NoError(t, err)
+		key, err := FirstDifferingKey(a, b)
+		require.NoError(t, err)
+		require.Equal(t, expected, key, "versions %d and %d", a.Version(), b.Version())
+		equal, err := TreesEqual(a, b)
+		require.NoError(t, err)
+		require.Equal(t, a.Version() == b.Version(), equal)
+	}
+
+	// the same key/value pairs inserted in another order give a different root
+	latest, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	rebuilt := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	var keys [][]byte
+	latest.Iterate(func(key, _ []byte) bool { //nolint:errcheck
+		keys = append(keys, key)
+		return false
+	})
+	for i := len(keys) - 1; i >= 0; i-- {
+		value, err := latest.Get(keys[i])
+		require.NoError(t, err)
+		_, err = rebuilt.Set(keys[i], value)
+		require.NoError(t, err)
+	}
+	require.NotEqual(t, latest.Hash(), rebuilt.WorkingHash())
+	equal, err := TreesEqual(latest, rebuilt.ImmutableTree)
+	require.NoError(t, err)
+	require.True(t, equal)
+
+	_, err = rebuilt.Set([]byte("test-zzz"), []byte{1})
+	require.NoError(t, err)
+	key, err := FirstDifferingKey(latest, rebuilt.ImmutableTree)
+	require.NoError(t, err)
+	require.Equal(t, []byte("test-zzz"), key)
+
+	// writing a key again with the same value changes the root, but not the content
+	value, err := latest.Get(keys[0])
+	require.NoError(t, err)
+	_, err = tree.Set(keys[0], value)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	next, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	require.NotEqual(t, latest.Hash(), next.Hash())
+	equal, err = TreesEqual(latest, next)
+	require.NoError(t, err)
+	require.True(t, equal)
+}
+
 func genChangeSets(r *rand.Rand, n int) []*ChangeSet {
 	var changeSets []*ChangeSet
 
@@ -100,3 +169,162 @@ func genChangeSets(r *rand.Rand, n int) []*ChangeSet {
 	}
 	return changeSets
 }
+
+func TestMergeTrees(t *testing.T) {
+	newTree := func(pairs ...string) *ImmutableTree {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		for i := 0; i < len(pairs); i += 2 {
+			_, err := tree.Set([]byte(pairs[i]), []byte(pairs[i+1]))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		return tree.ImmutableTree
+	}
+	pairs := func(tree *ImmutableTree) []string {
+		var res []string
+		itr := NewIterator(nil, nil, true, tree)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			res = append(res, string(itr.Key()), string(itr.Value()))
+		}
+		require.NoError(t, itr.Error())
+		return res
+	}
+
+	// disjoint key sets
+	merged, err := MergeTrees(newTree("a", "1", "c", "3"), newTree("b", "2", "d", "4"), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "1", "b", "2", "c", "3", "d", "4"}, pairs(merged.ImmutableTree))
+
+	// overlapping key sets, the overlay shadows the base by default
+	base := newTree("a", "1", "b", "2", "c", "3")
+	overlay := newTree("b", "20", "c", "30", "d", "40")
+	merged, err = MergeTrees(base, overlay, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "1", "b", "20", "c", "30", "d", "40"}, pairs(merged.ImmutableTree))
+
+	// a custom resolver, keeping the base value of b and dropping c
+	var conflicts []string
+	resolve := func(key, baseVal, overlayVal []byte) []byte {
+		conflicts = append(conflicts, string(key))
+		switch string(key) {
+		case "b":
+			return baseVal
+		case "c":
+			return nil
+		}
+		return overlayVal
+	}
+	merged, err = MergeTrees(base, overlay, resolve)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "c"}, conflicts)
+	require.Equal(t, []string{"a", "1", "b", "2", "d", "40"}, pairs(merged.ImmutableTree))
+
+	// the merge is deterministic, and the merged tree can be saved
+	again, err := MergeTrees(base, overlay, resolve)
+	require.NoError(t, err)
+	require.Equal(t, merged.WorkingHash(), again.WorkingHash())
+	hash, version, err := merged.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, again.WorkingHash(), hash)
+
+	// the inputs are left untouched
+	require.Equal(t, []string{"a", "1", "b", "2", "c", "3"}, pairs(base))
+
+	merged, err = MergeTrees(newTree(), newTree(), nil)
+	require.NoError(t, err)
+	require.True(t, merged.IsEmpty())
+}
+
+func TestDeletedOnlyIterator(t *testing.T) {
+	changeSets := genChangeSets(rand.New(rand.NewSource(0)), 30)
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	for i := range changeSets {
+		_, err := tree.SaveChangeSet(changeSets[i])
+		require.NoError(t, err)
+	}
+	// empty the tree in the last version
+	var removeAll ChangeSet
+	_, err := tree.Iterate(func(key, _ []byte) bool {
+		removeAll.Pairs = append(removeAll.Pairs, &KVPair{Delete: true, Key: key})
+		return false
+	})
+	require.NoError(t, err)
+	last, err := tree.SaveChangeSet(&removeAll)
+	require.NoError(t, err)
+
+	collect := func(from, to int64) [][2]string {
+		iter, err := tree.DeletedOnlyIterator(from, to)
+		require.NoError(t, err)
+		defer iter.Close()
+		var res [][2]string
+		for ; iter.Valid(); iter.Next() {
+			res = append(res, [2]string{string(iter.Key()), string(iter.Value())})
+		}
+		require.NoError(t, iter.Error())
+		return res
+	}
+	expected := func(from, to int64) [][2]string {
+		prev, err := tree.GetImmutable(from)
+		require.NoError(t, err)
+		cur, err := tree.GetImmutable(to)
+		require.NoError(t, err)
+		var res [][2]string
+		_, err = prev.Iterate(func(key, value []byte) bool {
+			has, err := cur.Has(key)
+			require.NoError(t, err)
+			if !has {
+				res = append(res, [2]string{string(key), string(value)})
+			}
+			return false
+		})
+		require.NoError(t, err)
+		return res
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 30; i++ {
+		from := r.Int63n(last) + 1
+		to := from + r.Int63n(last-from+1)
+		require.Equal(t, expected(from, to), collect(from, to), "from %d to %d", from, to)
+	}
+	require.Empty(t, collect(5, 5))
+	require.Equal(t, expected(10, last), collect(10, last))
+	require.NotEmpty(t, collect(10, last))
+
+	_, err = tree.DeletedOnlyIterator(5, 4)
+	require.Error(t, err)
+	_, err = tree.DeletedOnlyIterator(1, last+1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestChangedKeys(t *testing.T) {
+	changeSets := genChangeSets(rand.New(rand.NewSource(0)), 30)
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	for i := range changeSets {
+		_, err := tree.SaveChangeSet(changeSets[i])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(10))
+
+	err := tree.TraverseStateChanges(11, 31, func(version int64, changeSet *ChangeSet) error {
+		expected := make([][]byte, 0, len(changeSet.Pairs))
+		for _, pair := range changeSet.Pairs {
+			expected = append(expected, pair.Key)
+		}
+		keys, err := tree.ChangedKeys(version)
+		require.NoError(t, err)
+		require.Equal(t, expected, keys, "version %d", version)
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = tree.ChangedKeys(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.ChangedKeys(31)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
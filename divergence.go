@@ -0,0 +1,62 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// FindDivergence returns the lowest version at which the root hashes of the trees in the two dbs
+// differ, among the versions present in both, or -1 if they are identical over that range. It
+// returns ErrVersionDoesNotExist if the dbs have no version in common. It is meant for debugging
+// a fork between two nodes.
+//
+// Only the root nodes are read, and nothing is written to the dbs. The versions are scanned in
+// ascending order, since the roots of the dbs may converge again after a divergence, e.g. once a
+// key written differently is overwritten with the same value, which a binary search would miss.
+func FindDivergence(dbA, dbB corestore.KVStoreWithBatch) (int64, error) {
+	ndbA := newNodeDB(readOnlyDB{dbA}, 0, DefaultOptions(), NewNopLogger())
+	ndbB := newNodeDB(readOnlyDB{dbB}, 0, DefaultOptions(), NewNopLogger())
+
+	first, last, err := commonVersions(ndbA, ndbB)
+	if err != nil {
+		return 0, err
+	}
+
+	for version := first; version <= last; version++ {
+		hashA, err := ndbA.rootHash(version)
+		if err != nil {
+			return 0, fmt.Errorf("reading the root of version %d from the first db: %w", version, err)
+		}
+		hashB, err := ndbB.rootHash(version)
+		if err != nil {
+			return 0, fmt.Errorf("reading the root of version %d from the second db: %w", version, err)
+		}
+		if !bytes.Equal(hashA, hashB) {
+			return version, nil
+		}
+	}
+	return -1, nil
+}
+
+// commonVersions returns the range of the versions present in both dbs.
+func commonVersions(ndbA, ndbB *nodeDB) (first, last int64, err error) {
+	first, last = 0, math.MaxInt64
+	for _, ndb := range []*nodeDB{ndbA, ndbB} {
+		_, latest, err := ndb.getLatestVersion()
+		if err != nil {
+			return 0, 0, err
+		}
+		earliest, err := ndb.getFirstVersion()
+		if err != nil {
+			return 0, 0, err
+		}
+		first, last = max(first, earliest), min(last, latest)
+	}
+	if first <= 0 || first > last {
+		return 0, 0, fmt.Errorf("%w: no version in common", ErrVersionDoesNotExist)
+	}
+	return first, last, nil
+}
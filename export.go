@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+
+	corestore "cosmossdk.io/core/store"
 )
 
 // exportBufferSize is the number of nodes to buffer in the exporter. It improves throughput by
@@ -97,3 +99,52 @@ func (e *Exporter) Close() {
 	}
 	e.tree = nil
 }
+
+// LeafExporter exports the key/value pairs of an ImmutableTree in ascending key order. It is
+// created by ImmutableTree.ExportLeaves().
+//
+// Unlike Exporter, it does not export the tree structure, so the pairs can be loaded into any
+// store. The tree is walked lazily, so the memory used is bounded by the tree height.
+type LeafExporter struct {
+	tree *ImmutableTree
+	iter corestore.Iterator
+}
+
+func newLeafExporter(tree *ImmutableTree) *LeafExporter {
+	exporter := &LeafExporter{tree: tree}
+	if tree.ndb != nil {
+		tree.ndb.incrVersionReaders(tree.version)
+	}
+	if tree.root != nil {
+		exporter.iter = NewIterator(nil, nil, true, tree)
+	}
+	return exporter
+}
+
+// Next fetches the next key/value pair, or returns ErrorExportDone when done.
+func (e *LeafExporter) Next() (key, value []byte, err error) {
+	if e.iter == nil {
+		return nil, nil, ErrorExportDone
+	}
+	if !e.iter.Valid() {
+		if err := e.iter.Error(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrorExportDone
+	}
+	key, value = e.iter.Key(), e.iter.Value()
+	e.iter.Next()
+	return key, value, nil
+}
+
+// Close closes the exporter. It is safe to call multiple times.
+func (e *LeafExporter) Close() {
+	if e.iter != nil {
+		e.iter.Close()
+		e.iter = nil
+	}
+	if e.tree != nil && e.tree.ndb != nil {
+		e.tree.ndb.decrVersionReaders(e.tree.version)
+	}
+	e.tree = nil
+}
@@ -0,0 +1,330 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// streamMagic prefixes every stream written by ImmutableTree.ExportCompressed.
+var streamMagic = []byte("IAVLSNAP")
+
+// streamFormatVersion is the version of the stream framing written after the magic.
+const streamFormatVersion byte = 1
+
+const (
+	streamRecordEnd  byte = 0
+	streamRecordNode byte = 1
+)
+
+// Codec IDs of the built-in codecs. IDs below 128 are reserved for codecs shipped with IAVL,
+// custom codecs must use an ID of 128 or greater.
+const (
+	CodecIDNone byte = 0
+	CodecIDGzip byte = 1
+	// CodecIDZstd is reserved for a zstd codec. IAVL does not ship one to avoid the dependency,
+	// callers can provide their own implementation using this ID.
+	CodecIDZstd byte = 2
+)
+
+// ErrInvalidStream is returned by MutableTree.ImportCompressed when the stream is not a valid
+// snapshot stream.
+var ErrInvalidStream = errors.New("invalid snapshot stream")
+
+// Codec compresses the payload of a snapshot stream. The codec ID is written in the stream header,
+// which allows MutableTree.ImportCompressed to pick the matching codec when decoding.
+type Codec interface {
+	// ID returns the identifier written in the stream header.
+	ID() byte
+	// NewWriter wraps w with a compressor. Close must flush all pending data, but must not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader wraps r with the matching decompressor.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// NoneCodec writes the stream payload uncompressed.
+type NoneCodec struct{}
+
+var _ Codec = NoneCodec{}
+
+func (NoneCodec) ID() byte { return CodecIDNone }
+
+func (NoneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+
+func (NoneCodec) NewReader(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(r), nil }
+
+// GzipCodec compresses the stream payload with gzip at the given level. The zero value uses
+// gzip.DefaultCompression.
+type GzipCodec struct {
+	Level int
+}
+
+var _ Codec = GzipCodec{}
+
+func (GzipCodec) ID() byte { return CodecIDGzip }
+
+func (c GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// ExportCompressed streams the tree to w as a single self-describing snapshot, compressing the
+// payload on the fly with the given codec. The nodes are encoded with the same delta compression
+// as CompressExporter. The stream can be imported with MutableTree.ImportCompressed, which detects
+// the codec and the tree version from the stream header.
+func (t *ImmutableTree) ExportCompressed(w io.Writer, codec Codec) error {
+	if codec == nil {
+		return errors.New("codec cannot be nil")
+	}
+
+	innerExporter, err := t.Export()
+	if err != nil {
+		return err
+	}
+	defer innerExporter.Close()
+
+	header := make([]byte, 0, len(streamMagic)+2+binary.MaxVarintLen64)
+	header = append(header, streamMagic...)
+	header = append(header, streamFormatVersion, codec.ID())
+	header = binary.AppendVarint(header, t.version)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	cw, err := codec.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(cw)
+
+	exporter := NewCompressExporter(innerExporter)
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			cw.Close()
+			return err
+		}
+		if err := writeStreamNode(bw, node); err != nil {
+			cw.Close()
+			return err
+		}
+	}
+
+	if err := bw.WriteByte(streamRecordEnd); err != nil {
+		cw.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// ImportCompressed imports a snapshot stream written by ImmutableTree.ExportCompressed into an
+// empty tree, and loads the imported version. The built-in codecs are always recognized, custom
+// codecs used when exporting must be passed in codecs.
+func (tree *MutableTree) ImportCompressed(r io.Reader, codecs ...Codec) error {
+	version, cr, err := readStreamHeader(r, codecs)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	payload := bufio.NewReader(cr)
+
+	innerImporter, err := tree.Import(version)
+	if err != nil {
+		return err
+	}
+	defer innerImporter.Close()
+
+	importer := NewCompressImporter(innerImporter)
+	for {
+		node, err := readStreamNode(payload)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			break
+		}
+		if err := importer.Add(node); err != nil {
+			return err
+		}
+	}
+
+	if err := readStreamEOF(payload); err != nil {
+		return err
+	}
+
+	return innerImporter.Commit()
+}
+
+// readStreamHeader reads the header of a snapshot stream, and returns the version of the tree and
+// the reader of the decoded payload.
+func readStreamHeader(r io.Reader, codecs []Codec) (int64, io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(streamMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, nil, fmt.Errorf("%w: reading header: %w", ErrInvalidStream, err)
+	}
+	if !bytes.Equal(header[:len(streamMagic)], streamMagic) {
+		return 0, nil, fmt.Errorf("%w: bad magic", ErrInvalidStream)
+	}
+	if header[len(streamMagic)] != streamFormatVersion {
+		return 0, nil, fmt.Errorf("%w: unsupported format version %d", ErrInvalidStream, header[len(streamMagic)])
+	}
+	codec, err := findCodec(header[len(streamMagic)+1], codecs)
+	if err != nil {
+		return 0, nil, err
+	}
+	version, err := binary.ReadVarint(br)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: reading version: %w", ErrInvalidStream, err)
+	}
+
+	cr, err := codec.NewReader(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	return version, cr, nil
+}
+
+// readStreamEOF reads the payload past the end marker to its end, so the codec gets to verify its
+// checksums.
+func readStreamEOF(payload *bufio.Reader) error {
+	if _, err := payload.ReadByte(); !errors.Is(err, io.EOF) {
+		if err == nil {
+			return fmt.Errorf("%w: trailing data after end of stream", ErrInvalidStream)
+		}
+		return fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	return nil
+}
+
+func findCodec(id byte, codecs []Codec) (Codec, error) {
+	for _, codec := range codecs {
+		if codec.ID() == id {
+			return codec, nil
+		}
+	}
+	switch id {
+	case CodecIDNone:
+		return NoneCodec{}, nil
+	case CodecIDGzip:
+		return GzipCodec{}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown codec %d", ErrInvalidStream, id)
+}
+
+func writeStreamNode(w *bufio.Writer, node *ExportNode) error {
+	if err := w.WriteByte(streamRecordNode); err != nil {
+		return err
+	}
+	if err := w.WriteByte(byte(node.Height)); err != nil {
+		return err
+	}
+	if err := encoding.EncodeVarint(w, node.Version); err != nil {
+		return err
+	}
+	if node.Height != 0 {
+		return nil
+	}
+	if err := encoding.EncodeBytes(w, node.Key); err != nil {
+		return err
+	}
+	return encoding.EncodeBytes(w, node.Value)
+}
+
+// readStreamNode reads the next node from the stream payload, it returns nil at the end marker.
+func readStreamNode(r *bufio.Reader) (*ExportNode, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	switch marker {
+	case streamRecordEnd:
+		return nil, nil
+	case streamRecordNode:
+	default:
+		return nil, fmt.Errorf("%w: unknown record %d", ErrInvalidStream, marker)
+	}
+
+	height, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	node := &ExportNode{
+		Height:  int8(height),
+		Version: version,
+	}
+	if node.Height != 0 {
+		return node, nil
+	}
+	if node.Key, err = readStreamBytes(r); err != nil {
+		return nil, err
+	}
+	if node.Value, err = readStreamBytes(r); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// maxStreamBytes is the maximum length of a key or value in a stream, which bounds the memory a
+// corrupt or crafted length can make readStreamBytes allocate.
+const maxStreamBytes = 1 << 30
+
+// streamChunkBytes is the length up to which readStreamBytes allocates the bytes upfront, longer
+// ones grow as they are read, so a length past the end of the stream fails before allocating it.
+const streamChunkBytes = 1 << 16
+
+func readStreamBytes(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	if size > maxStreamBytes {
+		return nil, fmt.Errorf("%w: length %v exceeds the maximum of %v", ErrInvalidStream, size, maxStreamBytes)
+	}
+	if size <= streamChunkBytes {
+		bz := make([]byte, size)
+		if _, err := io.ReadFull(r, bz); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+		}
+		return bz, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStream, err)
+	}
+	return buf.Bytes(), nil
+}
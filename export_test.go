@@ -1,9 +1,15 @@
 package iavl
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"math"
 	"math/rand"
+	"runtime"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -298,6 +304,105 @@ func TestExporter_Import(t *testing.T) {
 	}
 }
 
+func TestExporter_ExportCompressed(t *testing.T) {
+	testcases := map[string]*ImmutableTree{
+		"empty tree": NewImmutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()),
+		"basic tree": setupExportTreeBasic(t),
+	}
+	if !testing.Short() {
+		testcases["sized tree"] = setupExportTreeSized(t, 4096)
+		testcases["random tree"] = setupExportTreeRandom(t)
+	}
+	codecs := map[string]Codec{
+		"none":      NoneCodec{},
+		"gzip":      GzipCodec{},
+		"gzip-best": GzipCodec{Level: gzip.BestCompression},
+	}
+
+	for desc, tree := range testcases {
+		for name, codec := range codecs {
+			tree, codec := tree, codec
+			t.Run(desc+"-"+name, func(t *testing.T) {
+				t.Parallel()
+
+				var buf bytes.Buffer
+				require.NoError(t, tree.ExportCompressed(&buf, codec))
+
+				newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+				require.NoError(t, newTree.ImportCompressed(&buf))
+
+				require.Equal(t, tree.Hash(), newTree.Hash(), "Tree hash mismatch")
+				require.Equal(t, tree.Size(), newTree.Size(), "Tree size mismatch")
+				require.Equal(t, tree.Version(), newTree.Version(), "Tree version mismatch")
+			})
+		}
+	}
+}
+
+func TestExporter_ImportCompressedErrors(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.ExportCompressed(&buf, GzipCodec{}))
+	stream := buf.Bytes()
+
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	err := newTree.ImportCompressed(bytes.NewReader([]byte("not a snapshot")))
+	require.ErrorIs(t, err, ErrInvalidStream)
+
+	unknown := append([]byte{}, stream...)
+	unknown[len(streamMagic)+1] = 200
+	err = newTree.ImportCompressed(bytes.NewReader(unknown))
+	require.ErrorIs(t, err, ErrInvalidStream)
+
+	err = newTree.ImportCompressed(bytes.NewReader(stream[:len(stream)-10]))
+	require.Error(t, err)
+	require.Equal(t, int64(0), newTree.Version())
+
+	require.NoError(t, newTree.ImportCompressed(bytes.NewReader(stream)))
+	require.Equal(t, tree.Hash(), newTree.Hash())
+}
+
+func TestExporter_ExportLeaves(t *testing.T) {
+	tree := setupExportTreeRandom(t)
+
+	exporter := tree.ExportLeaves()
+	defer exporter.Close()
+	exported := map[string][]byte{}
+	var keys []string
+	for {
+		key, value, err := exporter.Next()
+		if err == ErrorExportDone {
+			break
+		}
+		require.NoError(t, err)
+		exported[string(key)] = value
+		keys = append(keys, string(key))
+	}
+	require.True(t, sort.StringsAreSorted(keys))
+
+	iterated := map[string][]byte{}
+	_, err := tree.Iterate(func(key, value []byte) bool {
+		iterated[string(key)] = value
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, iterated, exported)
+	require.Len(t, keys, int(tree.Size()))
+
+	exporter.Close()
+	_, _, err = exporter.Next()
+	require.Equal(t, ErrorExportDone, err)
+	exporter.Close()
+
+	// an empty tree exports no leaves
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	exporter = empty.ExportLeaves()
+	_, _, err = exporter.Next()
+	require.Equal(t, ErrorExportDone, err)
+	exporter.Close()
+}
+
 func TestExporter_Close(t *testing.T) {
 	tree := setupExportTreeSized(t, 4096)
 	exporter, err := tree.Export()
@@ -375,3 +480,235 @@ func BenchmarkExport(b *testing.B) {
 		exporter.Close()
 	}
 }
+
+func TestVersionMetadata(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	r := rand.New(rand.NewSource(3))
+	saveVersions := func(n int) {
+		for i := 0; i < n; i++ {
+			for j := 0; j < 20; j++ {
+				_, err := tree.Set([]byte{byte(r.Intn(100))}, []byte{byte(r.Intn(256))})
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	saveVersions(10)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	require.NoError(t, tree.HideVersions(5, 5))
+
+	var metadata bytes.Buffer
+	require.NoError(t, tree.ExportVersionMetadata(&metadata))
+	versions := tree.AvailableVersions()
+	hashes := map[int][]byte{}
+	for _, version := range versions {
+		itree, err := tree.GetImmutable(int64(version))
+		require.NoError(t, err)
+		hashes[version] = itree.Hash()
+	}
+
+	// the source keeps saving versions while its db is copied
+	saveVersions(2)
+	copyDB := func() *dbm.MemDB {
+		replica := dbm.NewMemDB()
+		iter, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			require.NoError(t, replica.Set(iter.Key(), iter.Value()))
+		}
+		return replica
+	}
+	replicaDB := copyDB()
+	require.NoError(t, ImportVersionMetadata(replicaDB, bytes.NewReader(metadata.Bytes())))
+
+	replica := NewMutableTree(replicaDB, 0, false, NewNopLogger())
+	latest, err := replica.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), latest)
+	require.Equal(t, versions, replica.AvailableVersions())
+	for _, version := range versions {
+		itree, err := replica.GetImmutable(int64(version))
+		require.NoError(t, err)
+		require.Equal(t, hashes[version], itree.Hash())
+		require.NoError(t, replica.VerifyVersion(int64(version)))
+	}
+	source, err := tree.GetImmutable(10)
+	require.NoError(t, err)
+	for key := 0; key < 100; key++ {
+		expected, err := source.Get([]byte{byte(key)})
+		require.NoError(t, err)
+		got, err := replica.Get([]byte{byte(key)})
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+	}
+	// the replica is writable from the imported version on
+	_, err = replica.Set([]byte{0}, []byte{0})
+	require.NoError(t, err)
+	_, version, err := replica.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(11), version)
+
+	// a tampered root hash is rejected
+	tampered := bytes.Clone(metadata.Bytes())
+	tampered[len(tampered)-1] ^= 0xff
+	err = ImportVersionMetadata(copyDB(), bytes.NewReader(tampered))
+	require.ErrorIs(t, err, ErrInvalidVersionMetadata)
+	err = ImportVersionMetadata(copyDB(), bytes.NewReader(metadata.Bytes()[:20]))
+	require.ErrorIs(t, err, ErrInvalidVersionMetadata)
+
+	// so is a copy missing exported versions, pruned while copying
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	err = ImportVersionMetadata(copyDB(), bytes.NewReader(metadata.Bytes()))
+	require.ErrorIs(t, err, ErrInvalidVersionMetadata)
+}
+
+func TestVersionMetadataNodeCodec(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), NodeCodecOption(testNodeCodec{}))
+	for i := 0; i < 3; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	var metadata bytes.Buffer
+	require.NoError(t, tree.ExportVersionMetadata(&metadata))
+
+	// the roots are decoded with the codec of the tree
+	err := ImportVersionMetadata(db, bytes.NewReader(metadata.Bytes()))
+	require.ErrorIs(t, err, ErrNodeCodecMismatch)
+	require.NoError(t, ImportVersionMetadata(db, bytes.NewReader(metadata.Bytes()), NodeCodecOption(testNodeCodec{})))
+
+	replica := NewMutableTree(db, 0, false, NewNopLogger(), NodeCodecOption(testNodeCodec{}))
+	latest, err := replica.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), latest)
+	require.Equal(t, tree.Hash(), replica.Hash())
+}
+
+func TestValidateExportStream(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+	var buf bytes.Buffer
+	require.NoError(t, tree.ExportCompressed(&buf, NoneCodec{}))
+	stream := buf.Bytes()
+	require.NoError(t, ValidateExportStream(bytes.NewReader(stream), tree.Hash()))
+
+	var gzipped bytes.Buffer
+	require.NoError(t, tree.ExportCompressed(&gzipped, GzipCodec{}))
+	require.NoError(t, ValidateExportStream(&gzipped, tree.Hash()))
+
+	empty := NewImmutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var emptyStream bytes.Buffer
+	require.NoError(t, empty.ExportCompressed(&emptyStream, NoneCodec{}))
+	require.NoError(t, ValidateExportStream(&emptyStream, empty.Hash()))
+
+	err := ValidateExportStream(bytes.NewReader(stream), []byte("wrong root"))
+	require.ErrorIs(t, err, ErrInvalidStream)
+	require.ErrorContains(t, err, "root hash")
+
+	err = ValidateExportStream(bytes.NewReader(stream[:len(stream)-3]), tree.Hash())
+	require.ErrorIs(t, err, ErrInvalidStream)
+
+	// the nodes of the stream, re-encoded after a change to one of them
+	reencode := func(change func(nodes []*ExportNode) []*ExportNode) []byte {
+		exporter, err := tree.Export()
+		require.NoError(t, err)
+		defer exporter.Close()
+		compressed := NewCompressExporter(exporter)
+		var nodes []*ExportNode
+		for {
+			node, err := compressed.Next()
+			if errors.Is(err, ErrorExportDone) {
+				break
+			}
+			require.NoError(t, err)
+			nodes = append(nodes, node)
+		}
+		nodes = change(nodes)
+
+		var out bytes.Buffer
+		out.Write(stream[:len(streamMagic)+2])
+		out.Write(binary.AppendVarint(nil, tree.Version()))
+		bw := bufio.NewWriter(&out)
+		for _, node := range nodes {
+			require.NoError(t, writeStreamNode(bw, node))
+		}
+		require.NoError(t, bw.WriteByte(streamRecordEnd))
+		require.NoError(t, bw.Flush())
+		return out.Bytes()
+	}
+	require.NoError(t, ValidateExportStream(bytes.NewReader(reencode(func(nodes []*ExportNode) []*ExportNode {
+		return nodes
+	})), tree.Hash()))
+
+	testcases := map[string]struct {
+		change func(nodes []*ExportNode) []*ExportNode
+		msg    string
+	}{
+		"tampered value": {func(nodes []*ExportNode) []*ExportNode {
+			nodes[0].Value = []byte("tampered")
+			return nodes
+		}, "root hash"},
+		"swapped leaves": {func(nodes []*ExportNode) []*ExportNode {
+			nodes[0].Key, nodes[1].Key = deltaEncode([]byte("b"), nil), deltaEncode([]byte("a"), []byte("b"))
+			return nodes
+		}, "node 1: leaf key"},
+		"bad height": {func(nodes []*ExportNode) []*ExportNode {
+			nodes[2].Height = 3
+			return nodes
+		}, "node 2: inner node of height 3"},
+		"missing child": {func(nodes []*ExportNode) []*ExportNode {
+			nodes[1].Key = deltaEncode([]byte("b"), nil)
+			return nodes[1:]
+		}, "node 1: inner node"},
+		"newer than the stream": {func(nodes []*ExportNode) []*ExportNode {
+			nodes[0].Version = tree.Version() + 1
+			return nodes
+		}, "node 0: version"},
+		"missing root": {func(nodes []*ExportNode) []*ExportNode {
+			return nodes[:len(nodes)-1]
+		}, "2 subtrees without a parent"},
+		"shared prefix too long": {func(nodes []*ExportNode) []*ExportNode {
+			nodes[1].Key = deltaEncode([]byte("abcdefgh"), []byte("abcdefgh"))
+			return nodes
+		}, "node 1: key shares"},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateExportStream(bytes.NewReader(reencode(tc.change)), tree.Hash())
+			require.ErrorIs(t, err, ErrInvalidStream)
+			require.ErrorContains(t, err, tc.msg)
+		})
+	}
+}
+
+func TestValidateExportStreamOversizedLength(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+	var buf bytes.Buffer
+	require.NoError(t, tree.ExportCompressed(&buf, NoneCodec{}))
+	header := buf.Bytes()[:len(streamMagic)+2]
+
+	// a leaf whose key length is far beyond what the stream holds
+	stream := func(keyLength uint64) []byte {
+		out := bytes.Clone(header)
+		out = binary.AppendVarint(out, tree.Version())
+		out = append(out, streamRecordNode, 0)
+		out = binary.AppendVarint(out, 1)
+		out = binary.AppendUvarint(out, keyLength)
+		return append(out, "key"...)
+	}
+	for _, keyLength := range []uint64{math.MaxUint64, maxStreamBytes + 1, maxStreamBytes, streamChunkBytes + 1} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := ValidateExportStream(bytes.NewReader(stream(keyLength)), tree.Hash())
+		runtime.ReadMemStats(&after)
+		require.ErrorIs(t, err, ErrInvalidStream, "length %d", keyLength)
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20), "length %d", keyLength)
+
+		imported := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		require.ErrorIs(t, imported.ImportCompressed(bytes.NewReader(stream(keyLength))), ErrInvalidStream)
+	}
+}
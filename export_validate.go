@@ -0,0 +1,135 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// maxStreamStackSize bounds the subtrees awaiting their parent while validating a stream. The
+// pending subtrees of a tree are at most two per level along the path to the current node, and
+// the height of a node fits in an int8.
+const maxStreamStackSize = 2 * (math.MaxInt8 + 1)
+
+// ValidateExportStream checks that a snapshot stream written by ImmutableTree.ExportCompressed is
+// a well-formed tree with the given root hash, without importing it, e.g. to screen an untrusted
+// snapshot before MutableTree.ImportCompressed. It checks that the leaf keys are strictly
+// ascending, that every inner node has a height one above its highest child and a version not
+// below those of its children, and that no node is newer than the version of the stream, then
+// computes the root hash from the nodes. An empty tree has the hash of an empty input.
+//
+// The stream is read once, holding only the subtrees awaiting their parent, so the memory is
+// bounded by the depth of the tree. The stream holds no hashes, so a tampered node is only
+// detected by the root hash mismatch. The returned error wraps ErrInvalidStream, and tells the
+// index of the malformed node in the stream, counting from 0. Custom codecs used when exporting
+// must be passed in codecs.
+func ValidateExportStream(r io.Reader, expectedRoot []byte, codecs ...Codec) error {
+	version, cr, err := readStreamHeader(r, codecs)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	payload := bufio.NewReader(cr)
+
+	var (
+		stack   []*Node
+		lastKey []byte
+	)
+	for index := 0; ; index++ {
+		exportNode, err := readStreamNode(payload)
+		if err != nil {
+			return fmt.Errorf("node %d: %w", index, err)
+		}
+		if exportNode == nil {
+			break
+		}
+
+		var node *Node
+		if exportNode.Height == 0 {
+			key, err := streamLeafKey(exportNode.Key, lastKey)
+			if err != nil {
+				return fmt.Errorf("%w: node %d: %w", ErrInvalidStream, index, err)
+			}
+			if lastKey != nil && bytes.Compare(key, lastKey) <= 0 {
+				return fmt.Errorf("%w: node %d: leaf key %X is not greater than the previous key %X",
+					ErrInvalidStream, index, key, lastKey)
+			}
+			lastKey = key
+			node = &Node{
+				key:     key,
+				value:   exportNode.Value,
+				size:    1,
+				nodeKey: &NodeKey{version: exportNode.Version},
+			}
+		} else {
+			if len(stack) < 2 {
+				return fmt.Errorf("%w: node %d: inner node of height %d without two children",
+					ErrInvalidStream, index, exportNode.Height)
+			}
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			if height := max(left.subtreeHeight, right.subtreeHeight) + 1; exportNode.Height != height {
+				return fmt.Errorf("%w: node %d: inner node of height %d has children of heights %d and %d",
+					ErrInvalidStream, index, exportNode.Height, left.subtreeHeight, right.subtreeHeight)
+			}
+			// the version of an inner node is encoded as its delta to the newest child
+			if exportNode.Version < 0 {
+				return fmt.Errorf("%w: node %d: inner node is older than its children", ErrInvalidStream, index)
+			}
+			node = &Node{
+				subtreeHeight: exportNode.Height,
+				size:          left.size + right.size,
+				leftNode:      left,
+				rightNode:     right,
+				nodeKey:       &NodeKey{version: exportNode.Version + max(left.nodeKey.version, right.nodeKey.version)},
+			}
+			stack = stack[:len(stack)-2]
+		}
+		if node.nodeKey.version < 0 || node.nodeKey.version > version {
+			return fmt.Errorf("%w: node %d: version %d is out of the range of the stream version %d",
+				ErrInvalidStream, index, node.nodeKey.version, version)
+		}
+		node._hash(node.nodeKey.version)
+		// only the hash of a node is needed by its parent
+		node.key, node.value, node.leftNode, node.rightNode = nil, nil, nil, nil
+
+		if len(stack) >= maxStreamStackSize {
+			return fmt.Errorf("%w: node %d: more than %d subtrees without a parent", ErrInvalidStream, index, maxStreamStackSize)
+		}
+		stack = append(stack, node)
+	}
+	if err := readStreamEOF(payload); err != nil {
+		return err
+	}
+
+	var root []byte
+	switch len(stack) {
+	case 0:
+		root = sha256.New().Sum(nil)
+	case 1:
+		root = stack[0].hash
+	default:
+		return fmt.Errorf("%w: %d subtrees without a parent at the end of the stream", ErrInvalidStream, len(stack))
+	}
+	if !bytes.Equal(root, expectedRoot) {
+		return fmt.Errorf("%w: root hash %X does not match the expected %X", ErrInvalidStream, root, expectedRoot)
+	}
+	return nil
+}
+
+// streamLeafKey decodes the delta encoded key of a leaf, see CompressExporter, rejecting a shared
+// prefix longer than the previous key.
+func streamLeafKey(key, lastKey []byte) ([]byte, error) {
+	shared, n := binary.Uvarint(key)
+	if n <= 0 {
+		return nil, errors.New("invalid key prefix length")
+	}
+	if shared > uint64(len(lastKey)) {
+		return nil, fmt.Errorf("key shares %d bytes with the previous key of %d bytes", shared, len(lastKey))
+	}
+	return deltaDecode(key, lastKey)
+}
@@ -0,0 +1,115 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// historyMagic prefixes every stream written by ExportAllVersions.
+var historyMagic = []byte("IAVLHIST")
+
+// historyFormatVersion is the version of the format written after the magic.
+const historyFormatVersion byte = 1
+
+const (
+	historyRecordEnd     byte = 0
+	historyRecordVersion byte = 1
+)
+
+// ExportAllVersions writes every available version of the tree to w, which ImportAllVersions
+// restores with the same version numbers and root hashes. The first version is written as a
+// delta from the empty tree and each next one as a delta from the previous one, see
+// DeltaExporter, so every node is written once however many versions it is part of. Only the
+// trees are exported, not e.g. the annotations or checksums of the versions. It returns the
+// number of bytes written.
+func (tree *MutableTree) ExportAllVersions(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	header := append(append([]byte{}, historyMagic...), historyFormatVersion)
+	if _, err := cw.Write(header); err != nil {
+		return cw.n, err
+	}
+
+	var fromVersion int64
+	fromHash := sha256.New().Sum(nil)
+	for _, version := range tree.AvailableVersions() {
+		if version == 0 {
+			// an empty db lists version 0
+			continue
+		}
+		itree, err := tree.GetImmutable(int64(version))
+		if err != nil {
+			return cw.n, fmt.Errorf("version %d: %w", version, err)
+		}
+		if _, err := cw.Write([]byte{historyRecordVersion}); err != nil {
+			return cw.n, err
+		}
+		exporter := newDeltaExporter(itree, fromVersion, fromHash)
+		_, err = exporter.WriteTo(cw)
+		exporter.Close()
+		if err != nil {
+			return cw.n, err
+		}
+		fromVersion, fromHash = itree.version, itree.Hash()
+	}
+
+	_, err := cw.Write([]byte{historyRecordEnd})
+	return cw.n, err
+}
+
+// ImportAllVersions restores the versions written by ExportAllVersions into db, which must be
+// empty. Every version is checked against the root hash it was exported with before it is saved,
+// so a failed import leaves the versions before the failing one in the db. The options are the
+// ones the tree is opened with.
+//
+// The fast nodes are not built while importing, but when the tree is next loaded. The versions
+// missing between the exported ones, e.g. hidden ones, are skipped like by ImportDelta.
+func ImportAllVersions(db corestore.KVStoreWithBatch, r io.Reader, options ...Option) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(historyMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("%w: reading header: %w", ErrInvalidStream, err)
+	}
+	if !bytes.Equal(header[:len(historyMagic)], historyMagic) {
+		return fmt.Errorf("%w: bad magic", ErrInvalidStream)
+	}
+	if format := header[len(historyMagic)]; format != historyFormatVersion {
+		return fmt.Errorf("%w: unsupported format version %d", ErrInvalidStream, format)
+	}
+
+	// the fast nodes would be rebuilt after every version, so they are left to the next load
+	tree := NewMutableTree(db, 0, true, NewNopLogger(), options...)
+	defer tree.Close()
+	latestVersion, err := tree.Load()
+	if err != nil {
+		return err
+	}
+	if latestVersion != 0 {
+		return fmt.Errorf("found database at version %d, must be 0", latestVersion)
+	}
+
+	for {
+		record, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidStream, err)
+		}
+		if record == historyRecordEnd {
+			break
+		}
+		if record != historyRecordVersion {
+			return fmt.Errorf("%w: unknown record %d", ErrInvalidStream, record)
+		}
+		importer, err := tree.readDelta(br, tree.ndb.latestVersion)
+		if err != nil {
+			return err
+		}
+		if err := importer.Commit(); err != nil {
+			return err
+		}
+	}
+	return readStreamEOF(br)
+}
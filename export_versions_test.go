@@ -0,0 +1,109 @@
+package iavl
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestExportAllVersions(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	saveDeltaWorkload(t, r, []*MutableTree{tree}, 1, 300)
+	saveDeltaWorkload(t, r, []*MutableTree{tree}, 9, 5)
+	// a version without changes and a pruned history
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsTo(3))
+
+	var buf bytes.Buffer
+	n, err := tree.ExportAllVersions(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, buf.Len(), n)
+
+	// the shared nodes are written once
+	latest, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	var snapshot bytes.Buffer
+	require.NoError(t, latest.ExportCompressed(&snapshot, NoneCodec{}))
+	require.Less(t, buf.Len(), len(tree.AvailableVersions())*snapshot.Len()/2)
+
+	db := dbm.NewMemDB()
+	require.NoError(t, ImportAllVersions(db, bytes.NewReader(buf.Bytes())))
+	restored := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := restored.Load()
+	require.NoError(t, err)
+	require.Equal(t, tree.Version(), version)
+	require.Equal(t, tree.AvailableVersions(), restored.AvailableVersions())
+	for _, version := range tree.AvailableVersions() {
+		expected, err := tree.GetImmutable(int64(version))
+		require.NoError(t, err)
+		actual, err := restored.GetImmutable(int64(version))
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), actual.Hash(), "version %d", version)
+		_, err = expected.Iterate(func(key, value []byte) bool {
+			actualValue, err := actual.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, value, actualValue)
+			return false
+		})
+		require.NoError(t, err)
+	}
+
+	// the restored tree keeps going, with its fast nodes built on load
+	enabled, err := restored.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	saveDeltaWorkload(t, r, []*MutableTree{tree, restored}, 2, 20)
+	require.Equal(t, tree.Hash(), restored.Hash())
+
+	// only an empty db can be restored
+	require.Error(t, ImportAllVersions(db, bytes.NewReader(buf.Bytes())))
+	// a corrupted stream is rejected
+	corrupted := bytes.Clone(buf.Bytes())
+	corrupted[len(corrupted)/2] ^= 0xff
+	require.Error(t, ImportAllVersions(dbm.NewMemDB(), bytes.NewReader(corrupted)))
+}
+
+func TestExportAllVersionsPruning(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	saveDeltaWorkload(t, r, []*MutableTree{tree}, 1, 200)
+	saveDeltaWorkload(t, r, []*MutableTree{tree}, 9, 20)
+	// the hidden versions are not exported, which leaves a gap in the restored versions
+	require.NoError(t, tree.HideVersions(4, 6))
+
+	var buf bytes.Buffer
+	_, err := tree.ExportAllVersions(&buf)
+	require.NoError(t, err)
+	db := dbm.NewMemDB()
+	require.NoError(t, ImportAllVersions(db, bytes.NewReader(buf.Bytes())))
+	restored := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = restored.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 7, 8, 9, 10}, restored.AvailableVersions())
+
+	require.NoError(t, tree.DeleteVersionsTo(8))
+	require.NoError(t, restored.DeleteVersionsTo(8))
+	require.Equal(t, countNodeEntries(t, tree), countNodeEntries(t, restored))
+	saveDeltaWorkload(t, r, []*MutableTree{tree, restored}, 2, 20)
+	require.Equal(t, tree.Hash(), restored.Hash())
+}
+
+func TestExportAllVersionsEmpty(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var buf bytes.Buffer
+	_, err := tree.ExportAllVersions(&buf)
+	require.NoError(t, err)
+
+	db := dbm.NewMemDB()
+	require.NoError(t, ImportAllVersions(db, bytes.NewReader(buf.Bytes())))
+	restored := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := restored.Load()
+	require.NoError(t, err)
+	require.Zero(t, version)
+}
@@ -5,6 +5,7 @@ import (
 
 	"cosmossdk.io/core/store"
 
+	dbm "github.com/cosmos/iavl/db"
 	"github.com/cosmos/iavl/fastnode"
 )
 
@@ -27,11 +28,19 @@ type FastIterator struct {
 	nextFastNode *fastnode.Node
 
 	fastIterator store.Iterator
+
+	// unsafeValues makes the values alias the buffer of the db iterator, see
+	// Options.UnsafeIteratorValues
+	unsafeValues bool
 }
 
 var _ store.Iterator = (*FastIterator)(nil)
 
 func NewFastIterator(start, end []byte, ascending bool, ndb *nodeDB) *FastIterator {
+	return newFastIterator(start, end, ascending, ndb, ndb != nil && ndb.opts.UnsafeIteratorValues)
+}
+
+func newFastIterator(start, end []byte, ascending bool, ndb *nodeDB, unsafeValues bool) *FastIterator {
 	iter := &FastIterator{
 		start:        start,
 		end:          end,
@@ -40,6 +49,7 @@ func NewFastIterator(start, end []byte, ascending bool, ndb *nodeDB) *FastIterat
 		ndb:          ndb,
 		nextFastNode: nil,
 		fastIterator: nil,
+		unsafeValues: unsafeValues,
 	}
 	// Move iterator before the first element
 	iter.Next()
@@ -47,29 +57,9 @@ func NewFastIterator(start, end []byte, ascending bool, ndb *nodeDB) *FastIterat
 }
 
 // Domain implements dbm.Iterator.
-// Maps the underlying nodedb iterator domain, to the 'logical' keys involved.
+// It returns the bounds the iterator was created with.
 func (iter *FastIterator) Domain() ([]byte, []byte) {
-	if iter.fastIterator == nil {
-		return iter.start, iter.end
-	}
-
-	start, end := iter.fastIterator.Domain()
-
-	if start != nil {
-		start = start[1:]
-		if len(start) == 0 {
-			start = nil
-		}
-	}
-
-	if end != nil {
-		end = end[1:]
-		if len(end) == 0 {
-			end = nil
-		}
-	}
-
-	return start, end
+	return iter.start, iter.end
 }
 
 // Valid implements dbm.Iterator.
@@ -114,11 +104,34 @@ func (iter *FastIterator) Next() {
 
 	iter.valid = iter.valid && iter.fastIterator.Valid()
 	if iter.valid {
-		iter.nextFastNode, iter.err = fastnode.DeserializeNode(iter.fastIterator.Key()[1:], iter.fastIterator.Value())
+		iter.nextFastNode, iter.err = fastnode.DeserializeNode(iter.fastIterator.Key()[1:], iter.dbValue())
 		iter.valid = iter.err == nil
 	}
 }
 
+// dbValue returns the value of the db iterator, without copying it if the values are unsafe and
+// the db iterator supports it.
+func (iter *FastIterator) dbValue() []byte {
+	if itr, ok := iter.fastIterator.(dbm.UnsafeValueIterator); ok && iter.unsafeValues {
+		return itr.UnsafeValue()
+	}
+	return iter.fastIterator.Value()
+}
+
+// EstimateRemaining returns an estimate of the number of entries left to iterate, the current one
+// included. It is computed in O(log n) from the subtree sizes of the latest saved version, which
+// the fast nodes reflect, so it is exact unless a version is saved during the iteration.
+func (iter *FastIterator) EstimateRemaining() int64 {
+	if !iter.Valid() {
+		return 0
+	}
+	tree, err := iter.ndb.latestImmutableTree()
+	if err != nil {
+		return 0
+	}
+	return tree.estimateRemaining(iter.Key(), iter.start, iter.end, iter.ascending)
+}
+
 // Close implements dbm.Iterator
 func (iter *FastIterator) Close() error {
 	if iter.fastIterator != nil {
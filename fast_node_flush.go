@@ -0,0 +1,165 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// fastNodeFlusher writes the fast node changes of the saved versions to the db in the background.
+// Until they are written, the pending changes take precedence over the db in GetFastNode, and the
+// iterators fall back to the tree nodes, which are always up to date.
+type fastNodeFlusher struct {
+	pending        map[string]*fastnode.Node // the pending changes by key, nil for a removal, guarded by ndb.mtx
+	pendingVersion int64                     // the latest version whose changes are pending, guarded by ndb.mtx
+	flushedVersion int64                     // the latest version whose changes are written, guarded by ndb.mtx
+	flushMtx       sync.Mutex                // serializes the flushes
+	signal         chan struct{}             // signals that changes are pending
+	done           chan struct{}             // closed once the background flush is stopped
+}
+
+// EnableAsyncFastNodeFlush makes SaveVersion queue the fast node changes of the saved version for
+// a background flush, instead of writing them within the commit, which takes them off the critical
+// path. Reads stay consistent while the changes are pending, since they consult the pending
+// changes before the db, and the iterators use the tree nodes until the changes are written.
+//
+// The fast node index then lags the saved versions until flushed. If the process stops before,
+// the index is detected as stale on the next Load and rebuilt from the latest version, so no data
+// is lost, but the rebuild takes time. FlushFastNodes and Close flush the pending changes. It has
+// no effect if the fast storage is skipped, and must be called before the tree is used
+// concurrently.
+func (tree *MutableTree) EnableAsyncFastNodeFlush() {
+	if tree.skipFastStorageUpgrade || tree.ndb.fastFlusher != nil {
+		return
+	}
+	tree.ndb.startFastNodeFlusher()
+}
+
+// FlushFastNodes writes the fast node changes queued by the background flush, if any, and
+// returns once they are written.
+func (tree *MutableTree) FlushFastNodes() error {
+	return tree.ndb.flushPendingFastNodes()
+}
+
+func (ndb *nodeDB) startFastNodeFlusher() {
+	ndb.mtx.Lock()
+	ndb.fastFlusher = &fastNodeFlusher{
+		pending:        make(map[string]*fastnode.Node),
+		pendingVersion: ndb.latestVersion,
+		flushedVersion: ndb.latestVersion,
+		signal:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	ndb.mtx.Unlock()
+	go ndb.runFastNodeFlusher()
+}
+
+// runFastNodeFlusher flushes the pending changes whenever signaled, until the nodeDB is closed.
+// The changes of a failed flush stay pending, and are retried with the next flush.
+func (ndb *nodeDB) runFastNodeFlusher() {
+	defer close(ndb.fastFlusher.done)
+	for {
+		select {
+		case <-ndb.ctx.Done():
+			return
+		case <-ndb.fastFlusher.signal:
+			if err := ndb.flushPendingFastNodes(); err != nil {
+				ndb.logger.Error("Error while flushing fast nodes", "err", err)
+			}
+		}
+	}
+}
+
+// queueFastNodeChanges queues the fast node changes of the saved version for the background flush.
+func (ndb *nodeDB) queueFastNodeChanges(additions map[string]*fastnode.Node, removals map[string]interface{}, version int64) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	f := ndb.fastFlusher
+	for key, node := range additions {
+		f.pending[key] = node
+		ndb.fastNodeCache.Add(node)
+	}
+	for key := range removals {
+		f.pending[key] = nil
+		ndb.fastNodeCache.Remove([]byte(key))
+	}
+	f.pendingVersion = version
+
+	select {
+	case f.signal <- struct{}{}:
+	default: // a flush is signaled already
+	}
+}
+
+// hasPendingFastNodes returns whether the fast nodes in the db lag the saved versions.
+func (ndb *nodeDB) hasPendingFastNodes() bool {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.fastFlusher != nil && ndb.fastFlusher.pendingVersion != ndb.fastFlusher.flushedVersion
+}
+
+// flushPendingFastNodes writes the pending fast node changes along with the storage version of the
+// latest version they belong to. It is a no-op if the background flush is not enabled.
+func (ndb *nodeDB) flushPendingFastNodes() error {
+	f := ndb.fastFlusher
+	if f == nil {
+		return nil
+	}
+	f.flushMtx.Lock()
+	defer f.flushMtx.Unlock()
+
+	ndb.mtx.Lock()
+	if f.pendingVersion == f.flushedVersion {
+		ndb.mtx.Unlock()
+		return nil
+	}
+	changes, version := maps.Clone(f.pending), f.pendingVersion
+	storageVersion, err := ndb.fastStorageVersionAt(version)
+	ndb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	batch := NewBatchWithFlusher(ndb.fastDB, ndb.opts.FlushThreshold)
+	defer batch.Close()
+	for _, key := range slices.Sorted(maps.Keys(changes)) {
+		node := changes[key]
+		if node == nil {
+			if err := batch.Delete(ndb.fastNodeKey([]byte(key))); err != nil {
+				return err
+			}
+			continue
+		}
+		var buf bytes.Buffer
+		buf.Grow(node.EncodedSize())
+		if err := node.WriteBytes(&buf); err != nil {
+			return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
+		}
+		if err := batch.Set(ndb.fastNodeKey(node.GetKey()), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(storageVersion)); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return fmt.Errorf("failed to write fast nodes, %w", err)
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	for key, node := range changes {
+		// keep the changes queued again since the snapshot
+		if current, ok := f.pending[key]; ok && current == node {
+			delete(f.pending, key)
+		}
+	}
+	f.flushedVersion = version
+	ndb.storageVersion = storageVersion
+	return nil
+}
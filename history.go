@@ -0,0 +1,172 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// VersionedValue is a value a key held from a version on, see MutableTree.GetHistory.
+type VersionedValue struct {
+	// Version is the version the key was set to the value in, or removed in.
+	Version int64
+
+	// Value is the value of the key, nil if the key was removed.
+	Value []byte
+}
+
+// GetHistory returns the distinct values the key held in the saved versions from fromVersion to
+// toVersion, in ascending order, each with the version the key changed to it in. A removal of the
+// key is returned as a nil value along with the version the key was removed in. The value held at
+// fromVersion is returned with the version it was set in, which may precede fromVersion, while
+// the absence of the key before its first value in the range is not returned. The versions which
+// are not available, e.g. pruned ones, are skipped.
+//
+// The versions are not loaded one by one: the version of the leaf of the key tells the version
+// the value was set in, and the version of the lowest inner node spanning the key while it is
+// absent tells a version since which it has been absent, so mostly the versions the key changed
+// in are visited. Only an absent key lower or greater than all the keys of a version is looked up
+// in each preceding version.
+func (tree *MutableTree) GetHistory(key []byte, fromVersion, toVersion int64) ([]VersionedValue, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	if fromVersion > toVersion {
+		return nil, fmt.Errorf("from version %d is greater than to version %d", fromVersion, toVersion)
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, err
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	toVersion = min(toVersion, latestVersion)
+
+	// the runs of versions the key held the same value or was absent in, from the latest one
+	type run struct {
+		since   int64
+		value   []byte
+		present bool
+	}
+	var runs []run
+	for version := toVersion; version >= firstVersion && version > 0; {
+		// before the range, only the version the value held at its start was set in is looked for,
+		// which precedes the leaf version if the key was set again to the same value
+		before := version < fromVersion
+		if before && (len(runs) == 0 || !runs[len(runs)-1].present) {
+			break
+		}
+		t, err := tree.GetImmutable(version)
+		if errors.Is(err, ErrVersionDoesNotExist) || errors.Is(err, ErrVersionPruned) {
+			version--
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		value, present, since, err := t.historyRun(key)
+		if err != nil {
+			return nil, err
+		}
+		if before && (!present || !bytes.Equal(value, runs[len(runs)-1].value)) {
+			break
+		}
+		runs = append(runs, run{since: since, value: value, present: present})
+		version = since - 1
+	}
+
+	var history []VersionedValue
+	present := false
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		switch {
+		case r.present && (!present || !bytes.Equal(r.value, history[len(history)-1].Value)):
+			// an empty value is not nil, which means a removal
+			value := r.value
+			if value == nil {
+				value = []byte{}
+			}
+			history = append(history, VersionedValue{Version: r.since, Value: value})
+		case !r.present && present:
+			// the key was present in the version preceding the run, so the run starts exactly at
+			// the version the key was removed in
+			history = append(history, VersionedValue{Version: r.since})
+		}
+		present = r.present
+	}
+	return history, nil
+}
+
+// GetKeyHistory returns the values of the key at each of the given versions, e.g. to serve the
+// values of a key at chosen versions. The versions the key is absent in are not in the map, and
+// ErrVersionDoesNotExist is returned if a version is not available, e.g. pruned.
+//
+// As with GetHistory, a lookup tells a run of versions the key held the same value or was absent
+// in, so the versions are looked up from the latest one down, and the given versions in the run
+// of a lookup are resolved without loading their trees.
+func (tree *MutableTree) GetKeyHistory(key []byte, versions []int64) (map[int64][]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	versions = slices.Compact(slices.Sorted(slices.Values(versions)))
+	values := make(map[int64][]byte, len(versions))
+	for i := len(versions) - 1; i >= 0; {
+		if !tree.VersionExists(versions[i]) {
+			return nil, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, versions[i])
+		}
+		t, err := tree.GetImmutable(versions[i])
+		if err != nil {
+			return nil, err
+		}
+		value, present, since, err := t.historyRun(key)
+		if err != nil {
+			return nil, err
+		}
+		if present && value == nil {
+			// an empty value is not nil, which means an absent key
+			value = []byte{}
+		}
+		for ; i >= 0 && versions[i] >= since; i-- {
+			if !tree.VersionExists(versions[i]) {
+				return nil, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, versions[i])
+			}
+			if present {
+				values[versions[i]] = value
+			}
+		}
+	}
+	return values, nil
+}
+
+// historyRun looks up the key, returning its value if it exists, and a version since which the
+// key has held this value or been absent, at most the version of the tree.
+func (t *ImmutableTree) historyRun(key []byte) (value []byte, present bool, since int64, err error) {
+	if t.root == nil {
+		return nil, false, t.version, nil
+	}
+	// the lowest inner node the search went left at spans the key if it is absent and greater
+	// than the leaf the search ends at, so the key is absent as long as this node exists
+	var spanning *Node
+	node := t.root
+	for !node.isLeaf() {
+		if bytes.Compare(key, node.key) < 0 {
+			spanning = node
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, false, 0, err
+		}
+	}
+	switch cmp := bytes.Compare(key, node.key); {
+	case cmp == 0:
+		return node.value, true, node.nodeKey.version, nil
+	case cmp > 0 && spanning != nil:
+		return nil, false, spanning.nodeKey.version, nil
+	default:
+		return nil, false, t.version, nil
+	}
+}
@@ -1,7 +1,10 @@
 package iavl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"sort"
 	"strings"
 
 	corestore "cosmossdk.io/core/store"
@@ -141,12 +144,42 @@ func (t *ImmutableTree) Height() int8 {
 
 // Has returns whether or not a key exists.
 func (t *ImmutableTree) Has(key []byte) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
 	if t.root == nil {
 		return false, nil
 	}
 	return t.root.has(t, key)
 }
 
+// HasBatch returns whether each of the given keys exists in the tree, in the order of the keys.
+// The keys are looked up in a single sorted traversal, so the nodes shared by their paths are
+// only loaded once, which is cheaper than a Has call per key.
+func (t *ImmutableTree) HasBatch(keys [][]byte) ([]bool, error) {
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+	}
+	found := make([]bool, len(keys))
+	if t.root == nil || len(keys) == 0 {
+		return found, nil
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	if err := t.root.hasBatch(t, keys, order, found); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
 // Hash returns the root hash.
 func (t *ImmutableTree) Hash() []byte {
 	return t.root.hashWithCount(t.version + 1)
@@ -158,6 +191,12 @@ func (t *ImmutableTree) Export() (*Exporter, error) {
 	return newExporter(t)
 }
 
+// ExportLeaves returns a LeafExporter for the key/value pairs of the tree, without its structure.
+// Callers must call Close on the exporter when done.
+func (t *ImmutableTree) ExportLeaves() *LeafExporter {
+	return newLeafExporter(t)
+}
+
 // GetWithIndex returns the index and value of the specified key if it exists, or nil and the next index
 // otherwise. The returned value must not be modified, since it may point to data stored within
 // IAVL.
@@ -165,17 +204,71 @@ func (t *ImmutableTree) Export() (*Exporter, error) {
 // The index is the index in the list of leaf nodes sorted lexicographically by key. The leftmost leaf has index 0.
 // It's neighbor has index 1 and so on.
 func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
+	if err := validateKey(key); err != nil {
+		return 0, nil, err
+	}
 	if t.root == nil {
 		return 0, nil, nil
 	}
 	return t.root.get(t, key)
 }
 
+// PathTo returns the node keys of the nodes on the path from the root to the leaf of the given
+// key, or to the leaf where it would be inserted if it does not exist, for debugging and tooling
+// such as custom proof formats. The node keys are an implementation detail of the storage: a node
+// key is scoped to the version which created the node, and the legacy nodes, which are stored by
+// hash, have the version of the node and a zero nonce. It returns an error if a node on the path
+// is not saved yet, and nil for an empty tree.
+func (t *ImmutableTree) PathTo(key []byte) ([]NodeKey, error) {
+	var path []NodeKey
+	if err := t.walkPath(key, func(node *Node) error {
+		path = append(path, *node.nodeKey)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
+
+// walkPath calls fn with the nodes on the path from the root to the leaf of the given key, or to
+// the leaf where it would be inserted if it does not exist, see PathTo and ProofPath. It returns
+// an error if a node on the path is not saved yet.
+func (t *ImmutableTree) walkPath(key []byte, fn func(node *Node) error) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	for node := t.root; node != nil; {
+		if node.nodeKey == nil {
+			return fmt.Errorf("node with key %X on the path is not saved", node.key)
+		}
+		if err := fn(node); err != nil {
+			return err
+		}
+		if node.isLeaf() {
+			break
+		}
+		var err error
+		if bytes.Compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Get returns the value of the specified key if it exists, or nil.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 // Get potentially employs a more performant strategy than GetWithIndex for retrieving the value.
 // If tree.skipFastStorageUpgrade is true, this will work almost the same as GetWithIndex.
 func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
+	defer t.ndb.tracer().StartSpan("ImmutableTree.Get").End()
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
 	if t.root == nil {
 		return nil, nil
 	}
@@ -243,9 +336,131 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, e
 	return false, nil
 }
 
-// Iterator returns an iterator over the immutable tree.
+// IterateByValuePrefix calls fn for each key whose value starts with the given prefix, in
+// ascending key order, and stops when fn returns true. Since values are not indexed, it scans the
+// whole tree, i.e. it is O(n). The keys and values must not be modified, since they may point to
+// data stored within IAVL. Returns true if stopped by the callback, false otherwise.
+func (t *ImmutableTree) IterateByValuePrefix(prefix []byte, fn func(key, value []byte) bool) (bool, error) {
+	return t.Iterate(func(key, value []byte) bool {
+		if !bytes.HasPrefix(value, prefix) {
+			return false
+		}
+		return fn(key, value)
+	})
+}
+
+// FindByValuePrefix returns the keys whose value starts with the given prefix, in ascending
+// order. It scans the whole tree, i.e. it is O(n), and holds all the matching keys in memory, so
+// IterateByValuePrefix should be preferred when many keys may match. The keys must not be
+// modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) FindByValuePrefix(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	if _, err := t.IterateByValuePrefix(prefix, func(key, _ []byte) bool {
+		keys = append(keys, key)
+		return false
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// BucketStat describes a bucket of the key space returned by KeyHistogram.
+type BucketStat struct {
+	StartKey      []byte // the first key of the bucket
+	EndKey        []byte // the last key of the bucket, inclusive
+	Keys          int64  // the number of keys in the bucket
+	EstKeyBytes   int64  // an estimate of the total size of the keys in the bucket, not exact
+	EstValueBytes int64  // an estimate of the total size of the values in the bucket, not exact
+}
+
+// KeyHistogram divides the keys into the given number of buckets by rank, i.e. of equal key counts
+// up to one, and returns them in ascending key order. There are fewer buckets if the tree has
+// fewer keys. The bucket bounds and key counts are exact, found by descending the subtree sizes to
+// the first and last leaf of each bucket, so it is O(buckets·log n). The byte totals are not
+// aggregated in the inner nodes, so they are only estimated from these two leaves: the key count
+// times their mean key and value sizes. Exact totals would need reading every leaf, i.e. O(n).
+func (t *ImmutableTree) KeyHistogram(buckets int) ([]BucketStat, error) {
+	if buckets <= 0 {
+		return nil, fmt.Errorf("invalid number of buckets %d", buckets)
+	}
+	size := t.Size()
+	if size == 0 {
+		return nil, nil
+	}
+	n := min(int64(buckets), size)
+
+	stats := make([]BucketStat, n)
+	for i := range stats {
+		// bucket i holds the ranks [i*size/n, (i+1)*size/n)
+		first, last := int64(i)*size/n, (int64(i)+1)*size/n-1
+		startKey, startValue, err := t.GetByIndex(first)
+		if err != nil {
+			return nil, err
+		}
+		endKey, endValue, err := t.GetByIndex(last)
+		if err != nil {
+			return nil, err
+		}
+		keys := last - first + 1
+		stats[i] = BucketStat{
+			StartKey:      startKey,
+			EndKey:        endKey,
+			Keys:          keys,
+			EstKeyBytes:   keys * int64(len(startKey)+len(endKey)) / 2,
+			EstValueBytes: keys * int64(len(startValue)+len(endValue)) / 2,
+		}
+	}
+	return stats, nil
+}
+
+// ValueDuplicationStats returns the number of distinct values in the tree, the total number of
+// values, and the total size of the values if each distinct value were stored once, e.g. to
+// estimate the savings of a content-addressed value store. The values are told apart by their
+// SHA-256 hash, and every leaf is read, i.e. it is O(n).
+func (t *ImmutableTree) ValueDuplicationStats() (distinctValues int64, totalValues int64, bytesIfDeduped int64, err error) {
+	seen := make(map[[sha256.Size]byte]struct{})
+	if _, err := t.Iterate(func(_, value []byte) bool {
+		totalValues++
+		hash := sha256.Sum256(value)
+		if _, ok := seen[hash]; !ok {
+			seen[hash] = struct{}{}
+			distinctValues++
+			bytesIfDeduped += int64(len(value))
+		}
+		return false
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+	return distinctValues, totalValues, bytesIfDeduped, nil
+}
+
+// SplitRange returns the keys splitting the key space into n ranges of equal key counts up to one,
+// e.g. for n workers to iterate disjoint ranges in parallel: the i-th range starts at the i-1-th
+// key, or the first key, and ends before the i-th one, or after the last key. The keys are found
+// by rank from the subtree sizes, in O(n·log(size)). There are fewer ranges if the tree has fewer
+// keys, so fewer than n-1 keys are returned.
+func (t *ImmutableTree) SplitRange(n int) ([][]byte, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of ranges %d", n)
+	}
+	size := t.Size()
+	ranges := min(int64(n), size)
+
+	var splits [][]byte
+	for i := int64(1); i < ranges; i++ {
+		key, _, err := t.GetByIndex(i * size / ranges)
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, key)
+	}
+	return splits, nil
+}
+
+// Iterator returns an iterator over the immutable tree. The iterator of an empty tree is invalid
+// right away.
 func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
-	if !t.skipFastStorageUpgrade {
+	if t.root != nil && !t.skipFastStorageUpgrade {
 		isFastCacheEnabled, err := t.IsFastCacheEnabled()
 		if err != nil {
 			return nil, err
@@ -288,16 +503,68 @@ func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool,
 	})
 }
 
+// IterateLeavesNewerThan calls fn in ascending key order for each leaf stored with a version
+// above the given one, i.e. the keys set since that version which still exist, with their values
+// and leaf versions, e.g. for change feeds. It stops when fn returns true. Since a node is never
+// older than its children, the subtrees of nodes not above the version are skipped without being
+// read. The unsaved leaves have the version being worked on. The keys and values must not be
+// modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) IterateLeavesNewerThan(version int64, fn func(key, value []byte, leafVersion int64) bool) error {
+	if t.root == nil {
+		return nil
+	}
+	_, err := t.iterateLeavesNewerThan(t.root, version, fn)
+	return err
+}
+
+func (t *ImmutableTree) iterateLeavesNewerThan(node *Node, version int64, fn func(key, value []byte, leafVersion int64) bool) (bool, error) {
+	nodeVersion := t.version + 1
+	if node.nodeKey != nil {
+		nodeVersion = node.nodeKey.version
+	}
+	if nodeVersion <= version {
+		return false, nil
+	}
+	if node.isLeaf() {
+		return fn(node.key, node.value, nodeVersion), nil
+	}
+	if !storedNotNewerThan(node.leftNode, node.leftNodeKey, version) {
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return false, err
+		}
+		if stopped, err := t.iterateLeavesNewerThan(leftNode, version, fn); stopped || err != nil {
+			return stopped, err
+		}
+	}
+	if storedNotNewerThan(node.rightNode, node.rightNodeKey, version) {
+		return false, nil
+	}
+	rightNode, err := node.getRightNode(t)
+	if err != nil {
+		return false, err
+	}
+	return t.iterateLeavesNewerThan(rightNode, version, fn)
+}
+
+// storedNotNewerThan returns whether the child with the given node key is stored with a version
+// not above the given one, which is told by its node key without loading it. The unsaved and the
+// legacy children, which are keyed by hash, are not.
+func storedNotNewerThan(child *Node, childKey []byte, version int64) bool {
+	return child == nil && len(childKey) != hashSize && GetNodeKey(childKey).version <= version
+}
+
 // IsFastCacheEnabled returns true if fast cache is enabled, false otherwise.
 // For fast cache to be enabled, the following 2 conditions must be met:
 // 1. The tree is of the latest version.
 // 2. The underlying storage has been upgraded to fast cache
+// 3. No fast node changes are pending for the background flush
 func (t *ImmutableTree) IsFastCacheEnabled() (bool, error) {
 	isLatestTreeVersion, err := t.isLatestTreeVersion()
 	if err != nil {
 		return false, err
 	}
-	return isLatestTreeVersion && t.ndb.hasUpgradedToFastStorage(), nil
+	return isLatestTreeVersion && t.ndb.hasUpgradedToFastStorage() && !t.ndb.hasPendingFastNodes(), nil
 }
 
 func (t *ImmutableTree) isLatestTreeVersion() (bool, error) {
@@ -2,8 +2,10 @@ package iavl
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"slices"
 
 	"cosmossdk.io/core/store"
 )
@@ -29,6 +31,10 @@ type Importer struct {
 	stack     []*Node
 	nonces    []uint32
 
+	// sharedVersion is set when importing a delta, see ImportDelta. The nodes up to this version
+	// are part of the tree already, so they are not written again.
+	sharedVersion int64
+
 	// inflightCommit tracks a batch commit, if any.
 	inflightCommit <-chan error
 }
@@ -59,6 +65,9 @@ func newImporter(tree *MutableTree, version int64) (*Importer, error) {
 
 // writeNode writes the node content to the storage.
 func (i *Importer) writeNode(node *Node) error {
+	if node.nodeKey.version <= i.sharedVersion {
+		return nil
+	}
 	node._hash(node.nodeKey.version)
 	if err := node.validate(); err != nil {
 		return err
@@ -68,9 +77,17 @@ func (i *Importer) writeNode(node *Node) error {
 	buf.Reset()
 	defer bufPool.Put(buf)
 
-	if err := node.writeBytes(buf); err != nil {
+	if err := i.tree.ndb.writeNodeBytes(buf, node); err != nil {
 		return err
 	}
+	if i.tree.ndb.opts.DedupValues && node.isLeaf() {
+		i.tree.ndb.mtx.Lock()
+		err := i.tree.ndb.retainValueUnlocked(i.batch, node.value)
+		i.tree.ndb.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
 
 	bytesCopy := make([]byte, buf.Len())
 	copy(bytesCopy, buf.Bytes())
@@ -199,9 +216,11 @@ func (i *Importer) Commit() error {
 			return err
 		}
 	case 1:
-		i.stack[0].nodeKey.nonce = 1
-		if err := i.writeNode(i.stack[0]); err != nil {
-			return err
+		if i.stack[0].nodeKey.version > i.sharedVersion {
+			i.stack[0].nodeKey.nonce = 1
+			if err := i.writeNode(i.stack[0]); err != nil {
+				return err
+			}
 		}
 		if i.stack[0].nodeKey.version < i.version { // it means there is no update in the given version
 			if err := i.batch.Set(i.tree.ndb.nodeKey(GetRootKey(i.version)), i.tree.ndb.nodeKey(i.stack[0].nodeKey.GetKey())); err != nil {
@@ -212,6 +231,21 @@ func (i *Importer) Commit() error {
 		return fmt.Errorf("invalid node structure, found stack size %v when committing",
 			len(i.stack))
 	}
+	// the versions between the shared version and the imported one are not stored, but the one
+	// which created the root, see skippedKeyFormat
+	var skipped *versionRange
+	if i.sharedVersion > 0 {
+		prev := i.sharedVersion
+		if len(i.stack) == 1 && i.stack[0].nodeKey.version < i.version {
+			prev = max(prev, i.stack[0].nodeKey.version)
+		}
+		if i.version > prev+1 {
+			if err := i.batch.Set(skippedKeyFormat.Key(i.version), binary.AppendVarint(nil, prev)); err != nil {
+				return err
+			}
+			skipped = &versionRange{prev + 1, i.version - 1}
+		}
+	}
 
 	// Wait for previous batch.
 	var err error
@@ -223,11 +257,19 @@ func (i *Importer) Commit() error {
 		return err
 	}
 
+	if err := i.tree.ndb.writeNodeCodec(i.batch); err != nil {
+		return err
+	}
 	err = i.batch.WriteSync()
 	if err != nil {
 		return err
 	}
 	i.tree.ndb.resetLatestVersion(i.version)
+	if skipped != nil {
+		i.tree.ndb.updateSkippedVersions(func(ranges versionRanges) versionRanges {
+			return append(slices.Clone(ranges), *skipped)
+		})
+	}
 
 	_, err = i.tree.LoadVersion(i.version)
 	if err != nil {
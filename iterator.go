@@ -24,8 +24,8 @@ var errIteratorNilTreeGiven = errors.New("iterator must be created with an immut
 func (node *Node) newTraversal(tree *ImmutableTree, start, end []byte, ascending bool, inclusive bool, post bool) *traversal {
 	return &traversal{
 		tree:         tree,
-		start:        start,
-		end:          end,
+		start:        normalizeBound(start),
+		end:          normalizeBound(end),
 		ascending:    ascending,
 		inclusive:    inclusive,
 		post:         post,
@@ -179,6 +179,9 @@ type Iterator struct {
 	err error
 
 	t *traversal
+
+	tree      *ImmutableTree
+	ascending bool
 }
 
 var _ store.Iterator = (*Iterator)(nil)
@@ -186,8 +189,10 @@ var _ store.Iterator = (*Iterator)(nil)
 // Returns a new iterator over the immutable tree. If the tree is nil, the iterator will be invalid.
 func NewIterator(start, end []byte, ascending bool, tree *ImmutableTree) store.Iterator {
 	iter := &Iterator{
-		start: start,
-		end:   end,
+		start:     start,
+		end:       end,
+		tree:      tree,
+		ascending: ascending,
 	}
 
 	if tree == nil {
@@ -228,10 +233,10 @@ func (iter *Iterator) Next() {
 	}
 
 	node, err := iter.t.next()
-	// TODO: double-check if this error is correctly handled.
 	if node == nil || err != nil {
 		iter.t = nil
 		iter.valid = false
+		iter.err = err
 		return
 	}
 
@@ -260,6 +265,48 @@ func (iter *Iterator) IsFast() bool {
 	return false
 }
 
+// EstimateRemaining returns the number of entries left to iterate, the current one included. It
+// is computed from the subtree sizes in O(log n), and is exact since the tree of the iterator
+// cannot change.
+func (iter *Iterator) EstimateRemaining() int64 {
+	if !iter.valid {
+		return 0
+	}
+	return iter.tree.estimateRemaining(iter.key, iter.start, iter.end, iter.ascending)
+}
+
+// estimateRemaining returns the number of keys of the tree from key, included, to the end of the
+// range [start, end) in the iteration order. It returns 0 if the tree fails to be read.
+func (t *ImmutableTree) estimateRemaining(key, start, end []byte, ascending bool) int64 {
+	idx, value, err := t.GetWithIndex(key)
+	if err != nil {
+		return 0
+	}
+	var remaining int64
+	if ascending {
+		last := t.Size()
+		if end = normalizeBound(end); end != nil {
+			if last, _, err = t.GetWithIndex(end); err != nil {
+				return 0
+			}
+		}
+		remaining = last - idx
+	} else {
+		var first int64
+		if start = normalizeBound(start); start != nil {
+			if first, _, err = t.GetWithIndex(start); err != nil {
+				return 0
+			}
+		}
+		// idx is the index of the key if it exists, or of the next key otherwise
+		remaining = idx - first
+		if value != nil {
+			remaining++
+		}
+	}
+	return max(remaining, 0)
+}
+
 // NodeIterator is an iterator for nodeDB to traverse a tree in depth-first, preorder manner.
 type NodeIterator struct {
 	nodesToVisit []*Node
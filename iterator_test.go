@@ -1,6 +1,8 @@
 package iavl
 
 import (
+	"bytes"
+	"fmt"
 	"math/rand"
 	"sort"
 	"sync"
@@ -115,6 +117,112 @@ func TestIterator_Empty_Invalid(t *testing.T) {
 	})
 }
 
+func TestIterator_Domain(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for b := byte('a'); b < 'z'; b++ {
+		_, err := tree.Set([]byte{b}, []byte{b})
+		require.NoError(t, err)
+		if b == 'm' {
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	immutableTree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+
+	for _, bounds := range [][2][]byte{
+		{[]byte("c"), []byte("x")},
+		{[]byte{}, []byte("x")},
+		{[]byte("c"), []byte{}},
+		{nil, nil},
+	} {
+		start, end := bounds[0], bounds[1]
+
+		// the domain is the one given at creation, also once the iterator is exhausted
+		performTest := func(t *testing.T, itr corestore.Iterator) {
+			for ; itr.Valid(); itr.Next() {
+				actualStart, actualEnd := itr.Domain()
+				require.Equal(t, start, actualStart)
+				require.Equal(t, end, actualEnd)
+			}
+			actualStart, actualEnd := itr.Domain()
+			require.Equal(t, start, actualStart)
+			require.Equal(t, end, actualEnd)
+			require.NoError(t, itr.Close())
+		}
+
+		t.Run("Iterator", func(t *testing.T) {
+			performTest(t, NewIterator(start, end, true, immutableTree))
+		})
+
+		t.Run("Fast Iterator", func(t *testing.T) {
+			performTest(t, NewFastIterator(start, end, true, tree.ndb))
+		})
+
+		t.Run("Unsaved Fast Iterator", func(t *testing.T) {
+			performTest(t, NewUnsavedFastIterator(start, end, true, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals))
+		})
+	}
+}
+
+func TestIterator_EstimateRemaining(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for b := byte('a'); b < 'z'; b += 2 {
+		_, err := tree.Set([]byte{b}, []byte{b})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	immutableTree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+
+	type estimator interface {
+		corestore.Iterator
+		EstimateRemaining() int64
+	}
+	performTest := func(t *testing.T, itr estimator) {
+		var keys [][]byte
+		var estimates []int64
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, itr.Key())
+			estimates = append(estimates, itr.EstimateRemaining())
+		}
+		require.NotEmpty(t, keys)
+		for i, estimate := range estimates {
+			require.Equal(t, int64(len(keys)-i), estimate, "at key %s", keys[i])
+		}
+		require.Equal(t, int64(0), itr.EstimateRemaining())
+		require.NoError(t, itr.Close())
+	}
+
+	for _, bounds := range [][2][]byte{
+		{nil, nil},
+		{[]byte("c"), []byte("x")},
+		{[]byte("d"), []byte("w")},
+		{[]byte{}, []byte("m")},
+	} {
+		start, end := bounds[0], bounds[1]
+		for _, ascending := range []bool{true, false} {
+			t.Run("Iterator", func(t *testing.T) {
+				performTest(t, NewIterator(start, end, ascending, immutableTree).(*Iterator))
+			})
+
+			t.Run("Fast Iterator", func(t *testing.T) {
+				performTest(t, NewFastIterator(start, end, ascending, tree.ndb))
+			})
+		}
+	}
+
+	// unsaved additions of new keys are counted exactly
+	for b := byte('b'); b < 'z'; b += 4 {
+		_, err := tree.Set([]byte{b}, []byte{b})
+		require.NoError(t, err)
+	}
+	for _, ascending := range []bool{true, false} {
+		performTest(t, NewUnsavedFastIterator([]byte("c"), []byte("x"), ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals))
+	}
+}
+
 func TestIterator_Basic_Ranged_Ascending_Success(t *testing.T) {
 	config := &iteratorTestConfig{
 		startByteToSet: 'a',
@@ -381,3 +489,84 @@ func syncMapCount(m *sync.Map) int {
 	})
 	return count
 }
+
+// setupUnsafeIteratorTree returns the latest saved version of a tree of the given number of keys
+// in a goleveldb, which copies the values of its iterators unless they are unsafe.
+func setupUnsafeIteratorTree(tb testing.TB, size int, unsafe bool) *ImmutableTree {
+	db, err := dbm.NewGoLevelDB("test", tb.TempDir())
+	require.NoError(tb, err)
+	tb.Cleanup(func() { db.Close() })
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), UnsafeIteratorValuesOption(unsafe))
+	for i := 0; i < size; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%06d", i)), bytes.Repeat([]byte{byte(i)}, 100))
+		require.NoError(tb, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(tb, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(tb, err)
+	return itree
+}
+
+func TestIterator_UnsafeValues(t *testing.T) {
+	const size = 1000
+	scan := func(itree *ImmutableTree) int {
+		itr, err := itree.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		defer itr.Close()
+		_, ok := itr.(*FastIterator)
+		require.True(t, ok)
+		n := 0
+		for ; itr.Valid(); itr.Next() {
+			// the value is only valid until Next, so it is checked right away
+			require.Equal(t, bytes.Repeat([]byte{byte(n)}, 100), itr.Value())
+			n++
+		}
+		require.NoError(t, itr.Error())
+		return n
+	}
+
+	safe := setupUnsafeIteratorTree(t, size, false)
+	unsafe := setupUnsafeIteratorTree(t, size, true)
+	require.Equal(t, size, scan(safe))
+	require.Equal(t, size, scan(unsafe))
+
+	// the values are not copied out of the db iterator: they end where the buffer of its current
+	// value ends
+	aliased := func(itree *ImmutableTree) int {
+		itr, err := itree.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		defer itr.Close()
+		dbItr, ok := itr.(*FastIterator).fastIterator.(dbm.UnsafeValueIterator)
+		require.True(t, ok)
+		n := 0
+		for ; itr.Valid(); itr.Next() {
+			raw, value := dbItr.UnsafeValue(), itr.Value()
+			if &raw[len(raw)-1] == &value[len(value)-1] {
+				n++
+			}
+		}
+		require.NoError(t, itr.Error())
+		return n
+	}
+	require.Equal(t, size, aliased(unsafe))
+	require.Zero(t, aliased(safe))
+}
+
+func BenchmarkIterator_UnsafeValues(b *testing.B) {
+	for _, unsafe := range []bool{false, true} {
+		b.Run(fmt.Sprintf("unsafe=%v", unsafe), func(b *testing.B) {
+			itree := setupUnsafeIteratorTree(b, 100000, unsafe)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				itr, err := itree.Iterator(nil, nil, true)
+				require.NoError(b, err)
+				for ; itr.Valid(); itr.Next() {
+					_ = itr.Value()
+				}
+				require.NoError(b, itr.Close())
+			}
+		})
+	}
+}
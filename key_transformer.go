@@ -0,0 +1,209 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// KeyTransformer maps the logical keys of the application to the keys stored in the tree, e.g.
+// to prefix them with a tenant id.
+type KeyTransformer interface {
+	// Encode returns the stored key of a logical key. It must be injective and preserve the order
+	// of the keys, so that the logical ranges map to ranges of stored keys.
+	Encode(key []byte) []byte
+
+	// Decode returns the logical key of a stored key returned by Encode.
+	Decode(key []byte) ([]byte, error)
+
+	// Range returns the range of stored keys which the logical range [start, end) maps to, nil
+	// bounds being unbounded. It bounds the iterations, which must not see the stored keys that
+	// Encode does not return, e.g. the ones of other tenants.
+	Range(start, end []byte) (storedStart, storedEnd []byte)
+}
+
+// prefixTransformer prefixes the keys with a fixed prefix.
+type prefixTransformer struct {
+	prefix []byte
+}
+
+// NewPrefixKeyTransformer returns a KeyTransformer prefixing the keys with the given prefix.
+func NewPrefixKeyTransformer(prefix []byte) KeyTransformer {
+	return prefixTransformer{prefix: bytes.Clone(prefix)}
+}
+
+func (t prefixTransformer) Encode(key []byte) []byte {
+	return append(bytes.Clone(t.prefix), key...)
+}
+
+func (t prefixTransformer) Decode(key []byte) ([]byte, error) {
+	if !bytes.HasPrefix(key, t.prefix) {
+		return nil, fmt.Errorf("key %X does not have the prefix %X", key, t.prefix)
+	}
+	return key[len(t.prefix):], nil
+}
+
+func (t prefixTransformer) Range(start, end []byte) ([]byte, []byte) {
+	storedStart := t.Encode(start)
+	if end != nil {
+		return storedStart, t.Encode(end)
+	}
+	// the end of the prefix, i.e. the prefix incremented by one, nil if the prefix is all 0xFF
+	storedEnd := bytes.Clone(t.prefix)
+	for i := len(storedEnd) - 1; i >= 0; i-- {
+		if storedEnd[i] < 0xFF {
+			storedEnd[i]++
+			return storedStart, storedEnd[:i+1]
+		}
+	}
+	return storedStart, nil
+}
+
+// KeyTransformedTree is a MutableTree accessed with logical keys, which are transformed by a
+// KeyTransformer at its boundary: the keys given are encoded before being stored, and the keys
+// returned are decoded.
+//
+// The tree itself, including its hash and the proofs, only knows the stored keys: the committed
+// hash is over the transformed keys, and the proofs prove the transformed keys, so a verifier
+// must encode the key to verify a proof against the root hash.
+type KeyTransformedTree struct {
+	tree        *MutableTree
+	transformer KeyTransformer
+}
+
+// NewKeyTransformedTree returns the tree accessed with logical keys transformed by the given
+// transformer.
+func NewKeyTransformedTree(tree *MutableTree, transformer KeyTransformer) *KeyTransformedTree {
+	return &KeyTransformedTree{tree: tree, transformer: transformer}
+}
+
+// Tree returns the underlying tree, e.g. to save versions. Its keys are the transformed ones.
+func (t *KeyTransformedTree) Tree() *MutableTree {
+	return t.tree
+}
+
+// Set sets the value of the given logical key.
+func (t *KeyTransformedTree) Set(key, value []byte) (updated bool, err error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+	return t.tree.Set(t.transformer.Encode(key), value)
+}
+
+// Get returns the value of the given logical key, or nil if it does not exist.
+func (t *KeyTransformedTree) Get(key []byte) ([]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return t.tree.Get(t.transformer.Encode(key))
+}
+
+// Has returns whether the given logical key exists.
+func (t *KeyTransformedTree) Has(key []byte) (bool, error) {
+	value, err := t.Get(key)
+	return value != nil, err
+}
+
+// Remove removes the given logical key, returning its value and whether it existed.
+func (t *KeyTransformedTree) Remove(key []byte) ([]byte, bool, error) {
+	if err := validateKey(key); err != nil {
+		return nil, false, err
+	}
+	return t.tree.Remove(t.transformer.Encode(key))
+}
+
+// Iterator returns an iterator over the logical range [start, end), returning logical keys.
+// CONTRACT: no updates are made to the tree while an iterator is active.
+func (t *KeyTransformedTree) Iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
+	storedStart, storedEnd := t.transformer.Range(start, end)
+	itr, err := t.tree.Iterator(storedStart, storedEnd, ascending)
+	if err != nil {
+		return nil, err
+	}
+	return newDecodingIterator(itr, t.transformer, start, end), nil
+}
+
+// Iterate iterates over all the logical keys of the tree, stopping when fn returns true.
+func (t *KeyTransformedTree) Iterate(fn func(key, value []byte) bool) (stopped bool, err error) {
+	itr, err := t.Iterator(nil, nil, true)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if fn(itr.Key(), itr.Value()) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
+// GetVersionedProof returns the membership or non-membership proof of the given logical key at
+// the given version. The proof is over the transformed key, see KeyTransformedTree.
+func (t *KeyTransformedTree) GetVersionedProof(key []byte, version int64) (*ics23.CommitmentProof, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return t.tree.GetVersionedProof(t.transformer.Encode(key), version)
+}
+
+// VerifyVersionedProof verifies the proof of the given logical key at the given version.
+func (t *KeyTransformedTree) VerifyVersionedProof(proof *ics23.CommitmentProof, key []byte, version int64) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+	itree, err := t.tree.GetImmutable(version)
+	if err != nil {
+		return false, err
+	}
+	return itree.VerifyProof(proof, t.transformer.Encode(key))
+}
+
+// decodingIterator decodes the keys of an iterator over stored keys.
+type decodingIterator struct {
+	corestore.Iterator
+	transformer KeyTransformer
+	start, end  []byte
+	key         []byte
+	err         error
+}
+
+func newDecodingIterator(itr corestore.Iterator, transformer KeyTransformer, start, end []byte) *decodingIterator {
+	iter := &decodingIterator{Iterator: itr, transformer: transformer, start: start, end: end}
+	iter.decode()
+	return iter
+}
+
+// decode decodes the current key, invalidating the iterator if it fails.
+func (iter *decodingIterator) decode() {
+	if iter.err != nil || !iter.Iterator.Valid() {
+		return
+	}
+	iter.key, iter.err = iter.transformer.Decode(iter.Iterator.Key())
+}
+
+func (iter *decodingIterator) Domain() ([]byte, []byte) {
+	return iter.start, iter.end
+}
+
+func (iter *decodingIterator) Valid() bool {
+	return iter.err == nil && iter.Iterator.Valid()
+}
+
+func (iter *decodingIterator) Key() []byte {
+	return iter.key
+}
+
+func (iter *decodingIterator) Next() {
+	iter.Iterator.Next()
+	iter.decode()
+}
+
+func (iter *decodingIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.Iterator.Error()
+}
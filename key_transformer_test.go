@@ -0,0 +1,77 @@
+package iavl
+
+import (
+	"testing"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestKeyTransformedTree(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	tenantA := NewKeyTransformedTree(tree, NewPrefixKeyTransformer([]byte("a/")))
+	tenantB := NewKeyTransformedTree(tree, NewPrefixKeyTransformer([]byte("b/")))
+	tenantFF := NewKeyTransformedTree(tree, NewPrefixKeyTransformer([]byte{0xFF}))
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		_, err := tenantA.Set([]byte(key), []byte("A"+key))
+		require.NoError(t, err)
+		_, err = tenantB.Set([]byte(key), []byte("B"+key))
+		require.NoError(t, err)
+	}
+	_, err := tenantFF.Set([]byte("k9"), []byte("FF"))
+	require.NoError(t, err)
+	_, removed, err := tenantB.Remove([]byte("k2"))
+	require.NoError(t, err)
+	require.True(t, removed)
+
+	// the keys are stored transformed
+	value, err := tree.Get([]byte("a/k2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("Ak2"), value)
+	value, err = tenantA.Get([]byte("k2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("Ak2"), value)
+	has, err := tenantB.Has([]byte("k2"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	collect := func(kt *KeyTransformedTree, start, end []byte, ascending bool) []string {
+		itr, err := kt.Iterator(start, end, ascending)
+		require.NoError(t, err)
+		defer itr.Close()
+		var keys []string
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Key())+"="+string(itr.Value()))
+		}
+		require.NoError(t, itr.Error())
+		return keys
+	}
+	require.Equal(t, []string{"k1=Ak1", "k2=Ak2", "k3=Ak3"}, collect(tenantA, nil, nil, true))
+	require.Equal(t, []string{"k3=Bk3", "k1=Bk1"}, collect(tenantB, nil, nil, false))
+	require.Equal(t, []string{"k2=Ak2"}, collect(tenantA, []byte("k2"), []byte("k3"), true))
+	require.Equal(t, []string{"k9=FF"}, collect(tenantFF, nil, nil, true))
+
+	var keys []string
+	_, err = tenantB.Iterate(func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"k1", "k3"}, keys)
+
+	// the proofs are over the transformed keys
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	proof, err := tenantA.GetVersionedProof([]byte("k1"), version)
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, hash, proof, []byte("a/k1"), []byte("Ak1")))
+	ok, err := tenantA.VerifyVersionedProof(proof, []byte("k1"), version)
+	require.NoError(t, err)
+	require.True(t, ok)
+	proof, err = tenantB.GetVersionedProof([]byte("k2"), version)
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, hash, proof, []byte("b/k2")))
+}
@@ -0,0 +1,155 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// manifestEntry is a db key listed by MutableTree.WriteVersionManifest.
+type manifestEntry struct {
+	key       []byte
+	size      int
+	exclusive bool
+}
+
+// WriteVersionManifest writes the db keys belonging to the given version to w, e.g. for backup
+// tooling copying only the keys a version added. There is a line per key, in ascending key order:
+//
+//	<exclusive|shared> <hex key> <value size>
+//
+// An exclusive key was written by the version itself: the nodes created in the version, the root
+// entry of the version if it does not hold the root node itself, the checksum and annotation of the
+// version, and the record of the versions skipped before it by an import. A shared key is a node created by an earlier version, which the version still
+// refers to. An incremental backup of consecutive versions thus only needs the exclusive keys of
+// each version.
+//
+// With Options.DedupValues, the value store entries the leaves refer to are listed too, as
+// exclusive if a leaf created by the version refers to them, since the version then wrote their
+// reference count. All the nodes of the version are visited. The fast nodes, which only reflect the
+// latest version, are not listed.
+func (tree *MutableTree) WriteVersionManifest(version int64, w io.Writer) error {
+	if !tree.VersionExists(version) {
+		return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	ndb := tree.ndb
+	var entries []manifestEntry
+
+	// the root entry, unless it is the root node itself
+	rootEntryKey := nodeKeyFormat.Key(GetRootKey(version))
+	bz, err := ndb.db.Get(rootEntryKey)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bz == nil:
+		// the legacy root entry refers to the hash of the root
+		rootEntryKey = ndb.legacyRootKey(version)
+		if bz, err = ndb.db.Get(rootEntryKey); err != nil {
+			return err
+		}
+		entries = append(entries, manifestEntry{key: rootEntryKey, size: len(bz), exclusive: true})
+	case len(bz) == 0:
+		// the empty tree
+		entries = append(entries, manifestEntry{key: rootEntryKey, exclusive: true})
+	default:
+		if isRef, _ := isReferenceRoot(bz); isRef {
+			entries = append(entries, manifestEntry{key: rootEntryKey, size: len(bz), exclusive: true})
+		}
+	}
+
+	checksum, err := ndb.db.Get(checksumKeyFormat.Key(version))
+	if err != nil {
+		return err
+	}
+	if checksum != nil {
+		entries = append(entries, manifestEntry{key: checksumKeyFormat.Key(version), size: len(checksum), exclusive: true})
+	}
+	annotation, err := ndb.db.Get(annotationKeyFormat.Key(version))
+	if err != nil {
+		return err
+	}
+	if annotation != nil {
+		entries = append(entries, manifestEntry{key: annotationKeyFormat.Key(version), size: len(annotation), exclusive: true})
+	}
+	skipped, err := ndb.db.Get(skippedKeyFormat.Key(version))
+	if err != nil {
+		return err
+	}
+	if skipped != nil {
+		entries = append(entries, manifestEntry{key: skippedKeyFormat.Key(version), size: len(skipped), exclusive: true})
+	}
+
+	rootKey, err := ndb.GetRoot(version)
+	if err != nil {
+		return err
+	}
+	if rootKey != nil {
+		values := make(map[string]int) // the index of the value store entries in entries
+		stack := [][]byte{rootKey}
+		for len(stack) > 0 {
+			nk := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			legacy := len(nk) == hashSize
+			key := ndb.legacyNodeKey(nk)
+			if !legacy {
+				key = ndb.nodeKey(nk)
+			}
+			bz, err := ndb.db.Get(key)
+			if err != nil {
+				return err
+			}
+			if bz == nil {
+				return fmt.Errorf("node %X of version %d is missing", nk, version)
+			}
+			var node *Node
+			if legacy {
+				node, err = MakeLegacyNode(nk, bz)
+			} else {
+				node, err = ndb.makeNode(nk, bz)
+			}
+			if err != nil {
+				return err
+			}
+			exclusive := node.nodeKey.version == version
+			entries = append(entries, manifestEntry{key: key, size: len(bz), exclusive: exclusive})
+			if !node.isLeaf() {
+				stack = append(stack, node.rightNodeKey, node.leftNodeKey)
+			} else if ndb.opts.DedupValues && !legacy {
+				// the value store entry the leaf refers to, listed once however many leaves do
+				hash := sha256.Sum256(node.value)
+				valueKey := valueKeyFormat.Key(hash[:])
+				if i, ok := values[string(valueKey)]; ok {
+					entries[i].exclusive = entries[i].exclusive || exclusive
+					continue
+				}
+				bz, err := ndb.db.Get(valueKey)
+				if err != nil {
+					return err
+				}
+				values[string(valueKey)] = len(entries)
+				entries = append(entries, manifestEntry{key: valueKey, size: len(bz), exclusive: exclusive})
+			}
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b manifestEntry) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		kind := "shared"
+		if entry.exclusive {
+			kind = "exclusive"
+		}
+		if _, err := fmt.Fprintf(bw, "%s %s %d\n", kind, hex.EncodeToString(entry.key), entry.size); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
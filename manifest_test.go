@@ -0,0 +1,160 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestMutableTree_WriteVersionManifest(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for version := 1; version <= 3; version++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%02d", (i*7+version)%30)), []byte(fmt.Sprintf("value%d", version)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// an unchanged version
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the keys of the manifest, mapped to whether they are exclusive
+	manifest := func(version int64) map[string]bool {
+		var buf bytes.Buffer
+		require.NoError(t, tree.WriteVersionManifest(version, &buf))
+		entries := make(map[string]bool)
+		prev := ""
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			require.Len(t, fields, 3)
+			key, err := hex.DecodeString(fields[1])
+			require.NoError(t, err)
+			require.Less(t, prev, string(key), "keys are sorted")
+			prev = string(key)
+			value, err := db.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, strconv.Itoa(len(value)), fields[2])
+			require.Contains(t, []string{"exclusive", "shared"}, fields[0])
+			entries[string(key)] = fields[0] == "exclusive"
+		}
+		require.NoError(t, scanner.Err())
+		return entries
+	}
+
+	// the nodes reachable from the root of the version
+	reachable := func(version int64) map[string]bool {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		nodes := make(map[string]bool)
+		var walk func(node *Node)
+		walk = func(node *Node) {
+			nodes[string(nodeKeyFormat.Key(node.GetKey()))] = node.nodeKey.version == version
+			if node.isLeaf() {
+				return
+			}
+			left, err := node.getLeftNode(itree)
+			require.NoError(t, err)
+			right, err := node.getRightNode(itree)
+			require.NoError(t, err)
+			walk(left)
+			walk(right)
+		}
+		walk(itree.root)
+		return nodes
+	}
+
+	backup := make(map[string]bool)
+	for version := int64(1); version <= 4; version++ {
+		entries := manifest(version)
+		nodes := reachable(version)
+		require.True(t, entries[string(checksumKeyFormat.Key(version))])
+		delete(entries, string(checksumKeyFormat.Key(version)))
+		if version == 4 {
+			// the root entry refers to the root of version 3
+			require.True(t, entries[string(nodeKeyFormat.Key(GetRootKey(4)))])
+			delete(entries, string(nodeKeyFormat.Key(GetRootKey(4))))
+			for _, exclusive := range nodes {
+				require.False(t, exclusive)
+			}
+		}
+		require.Equal(t, nodes, entries, "version %d", version)
+
+		for key, exclusive := range manifest(version) {
+			if exclusive {
+				backup[key] = true
+			}
+		}
+		// the exclusive keys of the versions so far cover the nodes of the version
+		for key := range nodes {
+			require.True(t, backup[key], "version %d", version)
+		}
+	}
+
+	require.ErrorIs(t, tree.WriteVersionManifest(5, &bytes.Buffer{}), ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_WriteVersionManifestDedupValues(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), DedupValuesOption(true))
+	backup := dbm.NewMemDB()
+	for version := int64(1); version <= 3; version++ {
+		// few distinct values, shared by many leaves across the versions
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%02d", (i*7+int(version))%30)), []byte(fmt.Sprintf("value%d", i%3+int(version))))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		// an incremental backup copies the exclusive keys of every version
+		var buf bytes.Buffer
+		require.NoError(t, tree.WriteVersionManifest(version, &buf))
+		values := 0
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			key, err := hex.DecodeString(fields[1])
+			require.NoError(t, err)
+			if key[0] == valueKeyFormat.Prefix()[0] {
+				values++
+			}
+			if fields[0] != "exclusive" {
+				continue
+			}
+			value, err := db.Get(key)
+			require.NoError(t, err)
+			require.NoError(t, backup.Set(key, value))
+		}
+		require.NoError(t, scanner.Err())
+		require.Positive(t, values)
+	}
+	// along with the metadata, which records the codec of the db
+	require.NoError(t, tree.ndb.traversePrefix([]byte(metadataKeyFormat.Prefix()), func(k, v []byte) error {
+		return backup.Set(k, v)
+	}))
+
+	restored := NewMutableTree(backup, 0, true, NewNopLogger(), DedupValuesOption(true))
+	version, err := restored.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, tree.Hash(), restored.Hash())
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		actual, err := restored.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, actual)
+		return false
+	})
+	require.NoError(t, err)
+}
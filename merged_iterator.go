@@ -0,0 +1,162 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+
+	"cosmossdk.io/core/store"
+)
+
+// MergedIterator is a dbm.Iterator over several ImmutableTrees as one sorted stream, e.g. a base
+// store and its overlays, created by NewMergedIterator.
+//
+// The trees are given in increasing precedence: when several trees hold a key, the value of the
+// last one wins and the others are skipped. Since a tree holds no deletion markers, a key set to
+// an empty value stands for a deletion: the key is skipped when the winning value is empty, which
+// hides the key in the earlier trees too. A key absent from a later tree does not hide it.
+//
+// Each step compares the current keys of all the trees, so it is O(k) for k trees on top of the
+// iterators of the trees.
+type MergedIterator struct {
+	start, end []byte
+	ascending  bool
+	iters      []store.Iterator
+	current    int // the index of the iterator at the current key, -1 when done
+	err        error
+}
+
+var _ store.Iterator = (*MergedIterator)(nil)
+
+// NewMergedIterator returns an iterator over the keys of the given trees between start, included,
+// and end, excluded, see MergedIterator. Either bound may be nil to leave the range open on that
+// side. If an iterator of the trees fails to be created, the returned iterator is invalid and
+// Error returns the error.
+func NewMergedIterator(trees []*ImmutableTree, start, end []byte, ascending bool) *MergedIterator {
+	iter := &MergedIterator{
+		start:     start,
+		end:       end,
+		ascending: ascending,
+		current:   -1,
+	}
+	for _, tree := range trees {
+		if tree == nil {
+			iter.err = errIteratorNilTreeGiven
+			iter.Close()
+			return iter
+		}
+		itr, err := tree.Iterator(start, end, ascending)
+		if err != nil {
+			iter.err = err
+			iter.Close()
+			return iter
+		}
+		iter.iters = append(iter.iters, itr)
+	}
+	iter.settle()
+	return iter
+}
+
+// settle moves to the next key whose winning value is not a deletion, from the current positions
+// of the iterators.
+func (iter *MergedIterator) settle() {
+	for {
+		iter.current = -1
+		for i, itr := range iter.iters {
+			if !itr.Valid() {
+				continue
+			}
+			if iter.current < 0 {
+				iter.current = i
+				continue
+			}
+			cmp := bytes.Compare(itr.Key(), iter.iters[iter.current].Key())
+			if !iter.ascending {
+				cmp = -cmp
+			}
+			// on equal keys, the later tree wins
+			if cmp <= 0 {
+				iter.current = i
+			}
+		}
+		if iter.current < 0 || len(iter.iters[iter.current].Value()) > 0 {
+			return
+		}
+		iter.advance()
+	}
+}
+
+// advance moves the iterators at the current key past it. The iterator of the current key moves
+// last, since its key may not outlive its position.
+func (iter *MergedIterator) advance() {
+	winner := iter.iters[iter.current]
+	key := winner.Key()
+	for i, itr := range iter.iters {
+		if i != iter.current && itr.Valid() && bytes.Equal(itr.Key(), key) {
+			itr.Next()
+		}
+	}
+	winner.Next()
+}
+
+// Domain implements dbm.Iterator.
+func (iter *MergedIterator) Domain() ([]byte, []byte) {
+	return iter.start, iter.end
+}
+
+// Valid implements dbm.Iterator.
+func (iter *MergedIterator) Valid() bool {
+	return iter.err == nil && iter.current >= 0
+}
+
+// Key implements dbm.Iterator.
+func (iter *MergedIterator) Key() []byte {
+	if !iter.Valid() {
+		return nil
+	}
+	return iter.iters[iter.current].Key()
+}
+
+// Value implements dbm.Iterator.
+func (iter *MergedIterator) Value() []byte {
+	if !iter.Valid() {
+		return nil
+	}
+	return iter.iters[iter.current].Value()
+}
+
+// Next implements dbm.Iterator.
+func (iter *MergedIterator) Next() {
+	if !iter.Valid() {
+		return
+	}
+	iter.advance()
+	iter.settle()
+}
+
+// Close implements dbm.Iterator. It closes the iterators of all the trees.
+func (iter *MergedIterator) Close() error {
+	var errs []error
+	for _, itr := range iter.iters {
+		if err := itr.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	iter.iters, iter.current = nil, -1
+	if iter.err != nil {
+		return iter.err
+	}
+	return errors.Join(errs...)
+}
+
+// Error implements dbm.Iterator. It returns the first error of the iterators of the trees.
+func (iter *MergedIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	for _, itr := range iter.iters {
+		if err := itr.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestMergedIterator(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	expected := make(map[string]string)
+	var trees []*ImmutableTree
+	for layer := 0; layer < 3; layer++ {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, layer == 1, NewNopLogger())
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("k%03d", r.Intn(200))
+			value := fmt.Sprintf("v%d-%d", layer, i)
+			if layer > 0 && r.Intn(4) == 0 {
+				// a deletion of the key in the earlier trees
+				value = ""
+			}
+			_, err := tree.Set([]byte(key), []byte(value))
+			require.NoError(t, err)
+			if value == "" {
+				delete(expected, key)
+			} else {
+				expected[key] = value
+			}
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		trees = append(trees, itree)
+	}
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, tc := range []struct {
+		start, end []byte
+	}{
+		{nil, nil},
+		{[]byte("k050"), nil},
+		{nil, []byte("k150")},
+		{[]byte("k050"), []byte("k150")},
+		{[]byte("k150"), []byte("k050")},
+	} {
+		var inRange []string
+		for _, key := range keys {
+			if (tc.start == nil || key >= string(tc.start)) && (tc.end == nil || key < string(tc.end)) {
+				inRange = append(inRange, key)
+			}
+		}
+		for _, ascending := range []bool{true, false} {
+			iter := NewMergedIterator(trees, tc.start, tc.end, ascending)
+			var visited []string
+			for ; iter.Valid(); iter.Next() {
+				require.Equal(t, expected[string(iter.Key())], string(iter.Value()))
+				visited = append(visited, string(iter.Key()))
+			}
+			require.NoError(t, iter.Error())
+			require.NoError(t, iter.Close())
+			require.False(t, iter.Valid())
+
+			want := append([]string(nil), inRange...)
+			if !ascending {
+				sort.Sort(sort.Reverse(sort.StringSlice(want)))
+			}
+			require.Equal(t, want, visited, "range [%s, %s) ascending %t", tc.start, tc.end, ascending)
+		}
+	}
+
+	iter := NewMergedIterator(nil, nil, nil, true)
+	require.False(t, iter.Valid())
+	require.NoError(t, iter.Close())
+
+	iter = NewMergedIterator([]*ImmutableTree{trees[0], nil}, nil, nil, true)
+	require.False(t, iter.Valid())
+	require.ErrorIs(t, iter.Error(), errIteratorNilTreeGiven)
+}
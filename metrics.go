@@ -0,0 +1,74 @@
+package iavl
+
+// TreeMetrics is a snapshot of the gauges of a tree, returned by MutableTree.CollectMetrics, e.g.
+// to be exported to Prometheus by a periodic scrape.
+type TreeMetrics struct {
+	// Version is the latest saved version.
+	Version int64
+	// VersionCount is the number of available versions, not counting the hidden ones, see
+	// MutableTree.HideVersions.
+	VersionCount int64
+	// LatestSize is the number of keys of the latest version loaded or saved by the tree.
+	LatestSize int64
+	// LatestNodes is the number of nodes of the latest version loaded or saved by the tree,
+	// including the ones it shares with the older versions.
+	LatestNodes int64
+	// NodeCacheSize is the number of nodes held by the node cache.
+	NodeCacheSize int
+	// NodeCacheHitRatio is the ratio of the node reads served by the node cache, or 0 if
+	// Options.Stat is not set or there was no read.
+	NodeCacheHitRatio float64
+	// FastCacheSize is the number of fast nodes held by the fast node cache.
+	FastCacheSize int
+	// FastCacheHitRatio is the ratio of the fast node reads served by the fast node cache, or 0 if
+	// Options.Stat is not set or there was no read.
+	FastCacheHitRatio float64
+}
+
+// CollectMetrics returns a snapshot of the gauges of the tree. It only reads counters kept by the
+// tree, and the version metadata which is read from the db at most once, so it is cheap enough to
+// be called periodically, and it is safe to call concurrently with the writes of the tree. The
+// gauges which cannot be read, e.g. because of a db error, are left to zero.
+//
+// The number of nodes stored over all the versions is not known without a traversal, since the
+// nodes are shared between the versions, so only the nodes of the latest version are counted.
+func (tree *MutableTree) CollectMetrics() TreeMetrics {
+	ndb := tree.ndb
+	var metrics TreeMetrics
+	if _, latestVersion, err := ndb.getLatestVersion(); err == nil && latestVersion > 0 {
+		metrics.Version = latestVersion
+		if firstVersion, err := ndb.getFirstVersion(); err == nil && firstVersion > 0 {
+			metrics.VersionCount = latestVersion - firstVersion + 1
+			if hidden, err := ndb.getHiddenVersions(); err == nil {
+				for _, r := range hidden.normalize(firstVersion) {
+					if r.from <= latestVersion {
+						metrics.VersionCount -= min(r.to, latestVersion) - r.from + 1
+					}
+				}
+			}
+		}
+	}
+
+	ndb.mtx.Lock()
+	metrics.LatestSize = ndb.latestSize
+	metrics.NodeCacheSize = ndb.nodeCache.Len()
+	metrics.FastCacheSize = ndb.fastNodeCache.Len()
+	ndb.mtx.Unlock()
+	if metrics.LatestSize > 0 {
+		metrics.LatestNodes = 2*metrics.LatestSize - 1
+	}
+
+	if stat := ndb.opts.Stat; stat != nil {
+		metrics.NodeCacheHitRatio = hitRatio(stat.GetCacheHitCnt(), stat.GetCacheMissCnt())
+		metrics.FastCacheHitRatio = hitRatio(stat.GetFastCacheHitCnt(), stat.GetFastCacheMissCnt())
+	}
+	return metrics
+}
+
+// hitRatio returns the ratio of the hits out of all the reads, or 0 if there was none.
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
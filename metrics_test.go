@@ -0,0 +1,84 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestMutableTree_CollectMetrics(t *testing.T) {
+	stat := &Statistics{}
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 100, false, NewNopLogger(), StatOption(stat))
+	require.Equal(t, TreeMetrics{}, tree.CollectMetrics())
+
+	for v := 0; v < 10; v++ {
+		for i := 0; i < 50; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%03d", v*20+i)), []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	require.NoError(t, tree.HideVersions(4, 5))
+	for i := 0; i < 50; i++ {
+		_, err := tree.Get([]byte(fmt.Sprintf("k%03d", i)))
+		require.NoError(t, err)
+	}
+
+	metrics := tree.CollectMetrics()
+	require.Equal(t, int64(10), metrics.Version)
+	require.Equal(t, int64(6), metrics.VersionCount)
+	require.Equal(t, tree.Size(), metrics.LatestSize)
+	require.Equal(t, 2*tree.Size()-1, metrics.LatestNodes)
+	require.Equal(t, 100, metrics.NodeCacheSize)
+	require.Positive(t, metrics.FastCacheSize)
+	require.Equal(t, hitRatio(stat.GetCacheHitCnt(), stat.GetCacheMissCnt()), metrics.NodeCacheHitRatio)
+	require.Equal(t, hitRatio(stat.GetFastCacheHitCnt(), stat.GetFastCacheMissCnt()), metrics.FastCacheHitRatio)
+	require.Positive(t, metrics.FastCacheHitRatio)
+
+	// the gauges of the latest version are restored on load
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := reopened.Load()
+	require.NoError(t, err)
+	loaded := reopened.CollectMetrics()
+	require.Equal(t, metrics.Version, loaded.Version)
+	require.Equal(t, metrics.VersionCount, loaded.VersionCount)
+	require.Equal(t, metrics.LatestNodes, loaded.LatestNodes)
+	require.Zero(t, loaded.NodeCacheHitRatio)
+}
+
+func TestMutableTree_CollectMetricsConcurrent(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 100, false, NewNopLogger(), StatOption(&Statistics{}))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				metrics := tree.CollectMetrics()
+				require.GreaterOrEqual(t, metrics.VersionCount, int64(0))
+			}
+		}
+	}()
+	for v := 0; v < 20; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%03d", (v*7+i)%100)), []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+	require.Equal(t, int64(20), tree.CollectMetrics().Version)
+}
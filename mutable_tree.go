@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"slices"
 	"sort"
 	"sync"
 
@@ -19,6 +20,35 @@ var (
 
 	// ErrKeyDoesNotExist is returned if a key does not exist.
 	ErrKeyDoesNotExist = errors.New("key does not exist")
+
+	// ErrKeyEmpty is returned if a nil or zero-length key is given.
+	ErrKeyEmpty = errors.New("key cannot be empty")
+
+	// ErrMaxHeightExceeded is returned by Set if the tree would exceed Options.MaxHeight.
+	ErrMaxHeightExceeded = errors.New("tree height exceeds the maximum height")
+
+	// ErrKeyTooLarge is returned by Set if the key is longer than Options.MaxKeyBytes.
+	ErrKeyTooLarge = errors.New("key exceeds the maximum size")
+
+	// ErrValueTooLarge is returned by Set if the value is longer than Options.MaxValueBytes.
+	ErrValueTooLarge = errors.New("value exceeds the maximum size")
+
+	// ErrVersionPruned is returned if a requested version has been hidden with HideVersions.
+	ErrVersionPruned = errors.New("version has been pruned")
+
+	// ErrFastCacheMismatch is returned by ValidateFastCache if a fast node does not match the tree.
+	ErrFastCacheMismatch = errors.New("fast node does not match the tree")
+
+	// ErrMinRetainVersions is returned by DeleteVersionsTo if it would retain fewer versions than
+	// Options.MinRetainVersions.
+	ErrMinRetainVersions = errors.New("pruning would retain fewer versions than the minimum")
+
+	// ErrVersionAlreadySaved is returned by SaveVersion if the working version was already saved
+	// with a different root hash, or at all with Options.StrictSaveVersion.
+	ErrVersionAlreadySaved = errors.New("version already saved")
+
+	// ErrVersionAlreadyExists is an alias of ErrVersionAlreadySaved.
+	ErrVersionAlreadyExists = ErrVersionAlreadySaved
 )
 
 type Option func(*Options)
@@ -39,6 +69,9 @@ type MutableTree struct {
 	unsavedFastNodeAdditions *sync.Map      // map[string]*FastNode FastNodes that have not yet been saved to disk
 	unsavedFastNodeRemovals  *sync.Map      // map[string]interface{} FastNodes that have not yet been removed from disk
 	ndb                      *nodeDB
+	unsavedExpiries          map[string]pendingExpiry // Expiries of keys set with SetWithExpiry or SetWithExpiryHint that have not yet been saved
+	commitCallbacks          []func(version int64, rootHash []byte)
+	versionSavedCallbacks    []func(version int64, rootHash []byte, changes *ChangeSet)
 	skipFastStorageUpgrade   bool // If true, the tree will work like no fast storage and always not upgrade fast storage
 	initialVersionSet        bool
 
@@ -61,6 +94,7 @@ func NewMutableTree(db corestore.KVStoreWithBatch, cacheSize int, skipFastStorag
 		lastSaved:                head.clone(),
 		unsavedFastNodeAdditions: &sync.Map{},
 		unsavedFastNodeRemovals:  &sync.Map{},
+		unsavedExpiries:          make(map[string]pendingExpiry),
 		ndb:                      ndb,
 		skipFastStorageUpgrade:   skipFastStorageUpgrade,
 		initialVersionSet:        opts.initialVersionSet,
@@ -79,8 +113,17 @@ func (tree *MutableTree) GetLatestVersion() (int64, error) {
 	return v, err
 }
 
-// VersionExists returns whether or not a version exists.
+// VersionExists returns whether or not a version exists. Versions hidden with HideVersions do
+// not exist.
 func (tree *MutableTree) VersionExists(version int64) bool {
+	if hidden, err := tree.ndb.isVersionHidden(version); err != nil || hidden {
+		return false
+	}
+	return tree.versionExists(version)
+}
+
+// versionExists returns whether or not a version is stored, even if it is hidden.
+func (tree *MutableTree) versionExists(version int64) bool {
 	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
 	if err != nil {
 		return false
@@ -101,7 +144,11 @@ func (tree *MutableTree) VersionExists(version int64) bool {
 		return false
 	}
 
-	return firstVersion <= version && version <= latestVersion
+	if version < firstVersion || version > latestVersion {
+		return false
+	}
+	skipped, err := tree.ndb.getSkippedVersions()
+	return err == nil && !skipped.contains(version)
 }
 
 // AvailableVersions returns all available versions in ascending order
@@ -110,6 +157,14 @@ func (tree *MutableTree) AvailableVersions() []int {
 	if err != nil {
 		return nil
 	}
+	hidden, err := tree.ndb.getHiddenVersions()
+	if err != nil {
+		return nil
+	}
+	skipped, err := tree.ndb.getSkippedVersions()
+	if err != nil {
+		return nil
+	}
 	_, latestVersion, err := tree.ndb.getLatestVersion()
 	if err != nil {
 		return nil
@@ -136,7 +191,41 @@ func (tree *MutableTree) AvailableVersions() []int {
 	for version := firstVersion; version <= latestVersion; version++ {
 		res = append(res, int(version))
 	}
-	return res
+	return slices.DeleteFunc(res, func(version int) bool {
+		return hidden.contains(int64(version)) || skipped.contains(int64(version))
+	})
+}
+
+// VersionsIdentical returns whether the two saved versions have the same content, by comparing
+// their root hashes. Only the roots are read: a version saved without changes refers to the root
+// of the previous one, and is found identical without reading any node. It returns
+// ErrVersionDoesNotExist if either version does not exist.
+func (tree *MutableTree) VersionsIdentical(a, b int64) (bool, error) {
+	for _, version := range []int64{a, b} {
+		if !tree.VersionExists(version) {
+			return false, fmt.Errorf("%w: version %d", ErrVersionDoesNotExist, version)
+		}
+	}
+	rootKeyA, err := tree.ndb.GetRoot(a)
+	if err != nil {
+		return false, err
+	}
+	rootKeyB, err := tree.ndb.GetRoot(b)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(rootKeyA, rootKeyB) {
+		return true, nil
+	}
+	hashA, err := tree.ndb.rootHash(a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := tree.ndb.rootHash(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hashA, hashB), nil
 }
 
 // Hash returns the hash of the latest saved version of the tree, as returned
@@ -145,11 +234,19 @@ func (tree *MutableTree) Hash() []byte {
 	return tree.lastSaved.Hash()
 }
 
-// WorkingHash returns the hash of the current working tree.
+// WorkingHash returns the hash of the current working tree. The hashes of the nodes are memoized,
+// and the nodes on the paths of the keys changed since are the only ones rehashed, so calling it
+// again without changes in between returns the memoized hash.
 func (tree *MutableTree) WorkingHash() []byte {
 	return tree.root.hashWithCount(tree.WorkingVersion())
 }
 
+// IsDirty returns whether the working tree has changed since its hash was last computed, i.e.
+// whether the next WorkingHash call has to rehash the paths of the changed keys.
+func (tree *MutableTree) IsDirty() bool {
+	return tree.root != nil && tree.root.hash == nil
+}
+
 func (tree *MutableTree) WorkingVersion() int64 {
 	version := tree.version + 1
 	if version == 1 && tree.initialVersionSet {
@@ -168,16 +265,150 @@ func (tree *MutableTree) String() (string, error) {
 // to slices stored within IAVL. It returns true when an existing value was
 // updated, while false means it was a new key.
 func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+	if err := tree.checkSizeLimits(key, value); err != nil {
+		return false, err
+	}
+	if maxHeight := tree.ndb.opts.MaxHeight; maxHeight > 0 {
+		return tree.setWithMaxHeight(key, value, maxHeight)
+	}
+	updated, err = tree.set(key, value)
+	if err != nil {
+		return false, err
+	}
+	// a plain write replaces any pending expiry of the key
+	delete(tree.unsavedExpiries, ibytes.UnsafeBytesToStr(key))
+	return updated, nil
+}
+
+// checkSizeLimits returns ErrKeyTooLarge or ErrValueTooLarge if the key or the value exceeds the
+// limits of the options.
+func (tree *MutableTree) checkSizeLimits(key, value []byte) error {
+	if maxBytes := tree.ndb.opts.MaxKeyBytes; maxBytes > 0 && len(key) > maxBytes {
+		return fmt.Errorf("%w: key of %d bytes, the maximum is %d", ErrKeyTooLarge, len(key), maxBytes)
+	}
+	if maxBytes := tree.ndb.opts.MaxValueBytes; maxBytes > 0 && len(value) > maxBytes {
+		return fmt.Errorf("%w: value of %d bytes at key '%s', the maximum is %d", ErrValueTooLarge, len(value), key, maxBytes)
+	}
+	return nil
+}
+
+// setWithMaxHeight sets the key like Set, but restores the previous working tree and returns
+// ErrMaxHeightExceeded if the tree grows beyond maxHeight.
+func (tree *MutableTree) setWithMaxHeight(key, value []byte, maxHeight int8) (updated bool, err error) {
+	// the working nodes are copied on write, so the previous root stays intact
+	root := tree.root
+	skey := string(key)
+	addition, hasAddition := tree.unsavedFastNodeAdditions.Load(skey)
+	_, hasRemoval := tree.unsavedFastNodeRemovals.Load(skey)
+
 	updated, err = tree.set(key, value)
+	if err == nil && tree.root.subtreeHeight > maxHeight {
+		err = fmt.Errorf("%w: setting key %X would grow the tree to height %d, the maximum is %d",
+			ErrMaxHeightExceeded, key, tree.root.subtreeHeight, maxHeight)
+	}
+	if err != nil {
+		tree.root = root
+		if !tree.skipFastStorageUpgrade {
+			if hasAddition {
+				tree.unsavedFastNodeAdditions.Store(skey, addition)
+			} else {
+				tree.unsavedFastNodeAdditions.Delete(skey)
+			}
+			if hasRemoval {
+				tree.unsavedFastNodeRemovals.Store(skey, true)
+			} else {
+				tree.unsavedFastNodeRemovals.Delete(skey)
+			}
+		}
+		return false, err
+	}
+	delete(tree.unsavedExpiries, skey)
+	return updated, nil
+}
+
+// SetWithExpiry sets a key in the working tree like Set, and schedules its removal at
+// expiryVersion: the key is removed automatically by the SaveVersion call which saves a version
+// greater than or equal to expiryVersion, before the root hash of that version is computed.
+// Writing or removing the key again before it expires cancels the expiry. See SetWithExpiryHint
+// for an expiry which is only recorded.
+//
+// expiryVersion must be greater than the working version. Note that the expiry index is not part
+// of the tree itself, so it is not carried over by Export and Import.
+func (tree *MutableTree) SetWithExpiry(key, value []byte, expiryVersion int64) (updated bool, err error) {
+	return tree.setWithExpiry(key, value, pendingExpiry{version: expiryVersion})
+}
+
+// SetWithExpiryHint sets a key in the working tree like Set, and records expiresAtVersion as its
+// expiry hint. Unlike SetWithExpiry, the key is never removed by the tree: the hint is metadata
+// kept outside of the tree, so the resulting hashes are the ones of a plain Set, and ExpiredKeys
+// lists the key once the hint is due, e.g. for an external janitor to remove it. Writing or
+// removing the key again cancels the hint.
+//
+// expiresAtVersion must be greater than the working version. Like the expiry index, the hints are
+// not carried over by Export and Import.
+func (tree *MutableTree) SetWithExpiryHint(key, value []byte, expiresAtVersion int64) (updated bool, err error) {
+	return tree.setWithExpiry(key, value, pendingExpiry{version: expiresAtVersion, hint: true})
+}
+
+// pendingExpiry is an expiry of the working tree which has not yet been saved.
+type pendingExpiry struct {
+	version int64
+	hint    bool
+}
+
+func (tree *MutableTree) setWithExpiry(key, value []byte, expiry pendingExpiry) (updated bool, err error) {
+	if expiry.version <= tree.WorkingVersion() {
+		return false, fmt.Errorf("expiry version %d must be greater than the working version %d", expiry.version, tree.WorkingVersion())
+	}
+	updated, err = tree.Set(key, value)
 	if err != nil {
 		return false, err
 	}
+	tree.unsavedExpiries[string(key)] = expiry
 	return updated, nil
 }
 
+// CompareAndSwap sets the key to the new value only if its current value in the working tree
+// equals expected, a nil expected meaning that the key must not exist. It returns whether the
+// value was set; the tree is left untouched otherwise.
+func (tree *MutableTree) CompareAndSwap(key, expected, value []byte) (swapped bool, err error) {
+	if value == nil {
+		return false, fmt.Errorf("attempt to store nil value at key '%s'", key)
+	}
+	current, err := tree.Get(key)
+	if err != nil {
+		return false, err
+	}
+	// an empty value is not told apart from a missing key by Get
+	exists := len(current) > 0
+	if !exists {
+		if exists, err = tree.Has(key); err != nil {
+			return false, err
+		}
+	}
+	if expected == nil {
+		if exists {
+			return false, nil
+		}
+	} else if !exists || !bytes.Equal(current, expected) {
+		return false, nil
+	}
+	if _, err := tree.Set(key, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // Get returns the value of the specified key if it exists, or nil otherwise.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 func (tree *MutableTree) Get(key []byte) ([]byte, error) {
+	defer tree.ndb.tracer().StartSpan("MutableTree.Get").End()
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
 	if tree.root == nil {
 		return nil, nil
 	}
@@ -195,6 +426,20 @@ func (tree *MutableTree) Get(key []byte) ([]byte, error) {
 	return tree.ImmutableTree.Get(key)
 }
 
+// GetCommitted returns the value of the specified key in the last saved version, ignoring any
+// unsaved changes of the working tree, or nil if it does not exist. If no version has been saved
+// or loaded yet, the committed state is empty and nil is returned. The returned value must not be
+// modified, since it may point to data stored within IAVL.
+func (tree *MutableTree) GetCommitted(key []byte) ([]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	if tree.lastSaved == nil {
+		return nil, nil
+	}
+	return tree.lastSaved.Get(key)
+}
+
 // Import returns an importer for tree nodes previously exported by ImmutableTree.Export(),
 // producing an identical IAVL tree. The caller must call Close() on the importer when done.
 //
@@ -341,10 +586,13 @@ func (tree *MutableTree) recursiveSetLeaf(node *Node, key []byte, value []byte)
 // Remove removes a key from the working tree. The given key byte slice should not be modified
 // after this call, since it may point to data stored inside IAVL.
 func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
+	if err := validateKey(key); err != nil {
+		return nil, false, err
+	}
 	if tree.root == nil {
 		return nil, false, nil
 	}
-	newRoot, _, value, removed, err := tree.recursiveRemove(tree.root, key)
+	newRoot, _, value, removed, err := tree.recursiveRemove(tree.root, key, false)
 	if err != nil {
 		return nil, false, err
 	}
@@ -355,18 +603,73 @@ func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
 	if !tree.skipFastStorageUpgrade {
 		tree.addUnsavedRemoval(key)
 	}
+	delete(tree.unsavedExpiries, ibytes.UnsafeBytesToStr(key))
 
 	tree.root = newRoot
 	return value, true, nil
 }
 
+// RemoveMany removes the given keys from the working tree and returns the number of keys which
+// were actually removed. The keys are deduplicated and removed one at a time in ascending order,
+// each with its own descent from the root, so the resulting tree is identical to calling Remove
+// for each key in sorted order. The working nodes created by earlier removals of the batch are
+// modified in place instead of being cloned again. A single descent splitting the keys at each
+// inner node and rebalancing once would not preserve that: every removal may rotate the nodes on
+// its path, which changes the subtrees the following keys are removed from.
+//
+// If an error is returned, the working tree may be partially modified and should be discarded
+// via Rollback().
+func (tree *MutableTree) RemoveMany(keys [][]byte) (removed int, err error) {
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return 0, err
+		}
+	}
+	if tree.root == nil || len(keys) == 0 {
+		return 0, nil
+	}
+
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	for i, key := range sorted {
+		if tree.root == nil {
+			break
+		}
+		if i > 0 && bytes.Equal(key, sorted[i-1]) {
+			continue
+		}
+		newRoot, _, _, ok, err := tree.recursiveRemove(tree.root, key, true)
+		if err != nil {
+			return removed, err
+		}
+		if !ok {
+			continue
+		}
+		if !tree.skipFastStorageUpgrade {
+			tree.addUnsavedRemoval(key)
+		}
+		delete(tree.unsavedExpiries, ibytes.UnsafeBytesToStr(key))
+		tree.root = newRoot
+		removed++
+	}
+
+	return removed, nil
+}
+
 // removes the node corresponding to the passed key and balances the tree.
 // It returns:
 // - the hash of the new node (or nil if the node is the one removed)
 // - the node that replaces the orig. node after remove
 // - new leftmost leaf key for tree after successfully removing 'key' if changed.
 // - the removed value
-func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node, newKey []byte, newValue []byte, removed bool, err error) {
+//
+// If inPlace is true, working nodes which are not persisted yet are modified directly instead of
+// being cloned. This is only safe when the working tree is the sole owner of those nodes.
+func (tree *MutableTree) recursiveRemove(node *Node, key []byte, inPlace bool) (newSelf *Node, newKey []byte, newValue []byte, removed bool, err error) {
 	tree.logger.Debug("recursiveRemove", "node", node, "key", key)
 	if node.isLeaf() {
 		if bytes.Equal(key, node.key) {
@@ -375,14 +678,18 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node,
 		return node, nil, nil, false, nil
 	}
 
-	node, err = node.clone(tree)
-	if err != nil {
-		return nil, nil, nil, false, err
+	if inPlace && node.nodeKey == nil {
+		node.hash = nil
+	} else {
+		node, err = node.clone(tree)
+		if err != nil {
+			return nil, nil, nil, false, err
+		}
 	}
 
 	// node.key < key; we go to the left to find the key:
 	if bytes.Compare(key, node.key) < 0 {
-		newLeftNode, newKey, value, removed, err := tree.recursiveRemove(node.leftNode, key)
+		newLeftNode, newKey, value, removed, err := tree.recursiveRemove(node.leftNode, key, inPlace)
 		if err != nil {
 			return nil, nil, nil, false, err
 		}
@@ -408,7 +715,7 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node,
 		return node, newKey, value, removed, nil
 	}
 	// node.key >= key; either found or look to the right:
-	newRightNode, newKey, value, removed, err := tree.recursiveRemove(node.rightNode, key)
+	newRightNode, newKey, value, removed, err := tree.recursiveRemove(node.rightNode, key, inPlace)
 	if err != nil {
 		return nil, nil, nil, false, err
 	}
@@ -460,6 +767,10 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 		return 0, err
 	}
 
+	if err := tree.ndb.checkNodeCodec(ok); err != nil {
+		return 0, err
+	}
+
 	if latestVersion < targetVersion {
 		return latestVersion, fmt.Errorf("wanted to load target %d but only found up to %d", targetVersion, latestVersion)
 	}
@@ -480,6 +791,11 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	if targetVersion <= 0 {
 		targetVersion = latestVersion
 	}
+	if hidden, err := tree.ndb.isVersionHidden(targetVersion); err != nil {
+		return 0, err
+	} else if hidden {
+		return 0, ErrVersionPruned
+	}
 	if !tree.VersionExists(targetVersion) {
 		return 0, ErrVersionDoesNotExist
 	}
@@ -500,9 +816,28 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 			return 0, err
 		}
 	}
+	if err := tree.ndb.checkVersionChecksum(targetVersion, iTree.root); err != nil {
+		return 0, err
+	}
 
 	tree.ImmutableTree = iTree
 	tree.lastSaved = iTree.clone()
+	tree.ndb.resetLatestSize(iTree.Size())
+
+	if tree.ndb.opts.EnableValueIndex && targetVersion == latestVersion {
+		indexVersion, err := tree.ndb.getValueIndexVersion()
+		if err != nil {
+			return 0, err
+		}
+		if indexVersion != targetVersion {
+			if err := tree.rebuildValueIndex(); err != nil {
+				return 0, err
+			}
+			if err := tree.ndb.Commit(); err != nil {
+				return 0, err
+			}
+		}
+	}
 
 	if !tree.skipFastStorageUpgrade {
 		// Attempt to upgrade
@@ -558,6 +893,10 @@ func (tree *MutableTree) IsUpgradeable() (bool, error) {
 // from latest tree.
 
 func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error) {
+	// the fast nodes on disk only match the latest version once the pending changes are written
+	if err := tree.ndb.flushPendingFastNodes(); err != nil {
+		return false, err
+	}
 	isUpgradeable, err := tree.IsUpgradeable()
 	if err != nil {
 		return false, err
@@ -588,6 +927,56 @@ func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error)
 	return true, nil
 }
 
+// ValidateFastCache cross-checks the fast nodes on disk with the leaves of the latest saved
+// version, which they must mirror, and returns ErrFastCacheMismatch describing the first key
+// which is missing on either side, or whose value differs, in ascending key order. Both are
+// streamed side by side, so the tree is never held in memory. The fast node changes pending a
+// background flush are written first.
+func (tree *MutableTree) ValidateFastCache() error {
+	if tree.skipFastStorageUpgrade {
+		return errors.New("fast storage is disabled")
+	}
+	if err := tree.ndb.flushPendingFastNodes(); err != nil {
+		return err
+	}
+	if !tree.ndb.hasUpgradedToFastStorage() {
+		return errors.New("fast storage is not enabled")
+	}
+
+	fastItr := NewFastIterator(nil, nil, true, tree.ndb)
+	defer fastItr.Close()
+	itr := NewIterator(nil, nil, true, tree.lastSaved)
+	defer itr.Close()
+
+	for fastItr.Valid() || itr.Valid() {
+		var cmp int
+		switch {
+		case !fastItr.Valid():
+			cmp = 1
+		case !itr.Valid():
+			cmp = -1
+		default:
+			cmp = bytes.Compare(fastItr.Key(), itr.Key())
+		}
+		switch {
+		case cmp < 0:
+			return fmt.Errorf("%w: key %X has a fast node but is not in version %d", ErrFastCacheMismatch, fastItr.Key(), tree.version)
+		case cmp > 0:
+			return fmt.Errorf("%w: key %X of version %d has no fast node", ErrFastCacheMismatch, itr.Key(), tree.version)
+		case !bytes.Equal(fastItr.Value(), itr.Value()):
+			return fmt.Errorf("%w: key %X has value %X in its fast node, but %X in version %d", ErrFastCacheMismatch, itr.Key(), fastItr.Value(), itr.Value(), tree.version)
+		case fastItr.nextFastNode.GetVersionLastUpdatedAt() > tree.version:
+			return fmt.Errorf("%w: key %X has a fast node updated at version %d, after version %d", ErrFastCacheMismatch, itr.Key(), fastItr.nextFastNode.GetVersionLastUpdatedAt(), tree.version)
+		}
+		fastItr.Next()
+		itr.Next()
+	}
+	if err := fastItr.Error(); err != nil {
+		return err
+	}
+	return itr.Error()
+}
+
 func (tree *MutableTree) enableFastStorageAndCommit() error {
 	var err error
 
@@ -619,7 +1008,14 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 
 // GetImmutable loads an ImmutableTree at a given version for querying. The returned tree is
 // safe for concurrent access, provided the version is not deleted, e.g. via `DeleteVersion()`.
+// Only the root is loaded: the other nodes are read when a query first visits them, so a Get
+// reads the nodes on the path to the key and no others.
 func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
+	if hidden, err := tree.ndb.isVersionHidden(version); err != nil {
+		return nil, err
+	} else if hidden {
+		return nil, ErrVersionPruned
+	}
 	rootNodeKey, err := tree.ndb.GetRoot(version)
 	if err != nil {
 		return nil, err
@@ -641,9 +1037,97 @@ func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 	}, nil
 }
 
+// GetImmutableOrEarlier returns the tree at the given version like GetImmutable, or, if that
+// version is not available, e.g. because it has not been saved yet or is missing from a legacy
+// db, the tree at the nearest earlier version still available. It also returns the version of the returned tree, which callers must
+// check to know if they fell back. It returns ErrVersionDoesNotExist if no version up to the
+// given one is available.
+func (tree *MutableTree) GetImmutableOrEarlier(version int64) (*ImmutableTree, int64, error) {
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, 0, err
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for version = min(version, latestVersion); version >= firstVersion && version > 0; version-- {
+		if tree.VersionExists(version) {
+			t, err := tree.GetImmutable(version)
+			if err != nil {
+				return nil, 0, err
+			}
+			return t, version, nil
+		}
+	}
+	return nil, 0, ErrVersionDoesNotExist
+}
+
+// GetImmutableRelative returns the tree at the given offset from the latest version, i.e. offset
+// 0 is the latest version and -10 the version 10 before it. It returns ErrVersionPruned if the
+// target version has been pruned or hidden, and ErrVersionDoesNotExist if it precedes the first
+// version ever saved, i.e. version 1 or Options.InitialVersion.
+func (tree *MutableTree) GetImmutableRelative(offset int64) (*ImmutableTree, error) {
+	if offset > 0 {
+		return nil, fmt.Errorf("offset %d is after the latest version", offset)
+	}
+	found, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrVersionDoesNotExist
+	}
+	version := latestVersion + offset
+	// the versions before Options.InitialVersion were never saved, rather than pruned
+	if version < max(1, int64(tree.ndb.opts.InitialVersion)) {
+		return nil, fmt.Errorf("%w: offset %d is before the first version from latest version %d", ErrVersionDoesNotExist, offset, latestVersion)
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version < firstVersion {
+		return nil, fmt.Errorf("%w: version %d at offset %d is before the first available version %d", ErrVersionPruned, version, offset, firstVersion)
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, fmt.Errorf("version %d at offset %d: %w", version, offset, err)
+	}
+	return t, nil
+}
+
+// WarmCache loads the nodes on the paths to the given keys into the node cache, and their fast
+// nodes into the fast node cache, so that the first reads of a hot key set after a restart do not
+// hit the disk. The paths are descended together, so the nodes they share are loaded once. Only
+// as many nodes as the caches hold are kept, so warming more keys than the cache size evicts the
+// nodes loaded first.
+func (tree *MutableTree) WarmCache(keys [][]byte) error {
+	if _, err := tree.ImmutableTree.HasBatch(keys); err != nil {
+		return err
+	}
+	if tree.skipFastStorageUpgrade || !tree.ndb.hasUpgradedToFastStorage() {
+		return nil
+	}
+	for _, key := range keys {
+		if _, err := tree.ndb.GetFastNode(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Rollback resets the working tree to the latest saved version, discarding
-// any unsaved modifications.
+// any unsaved modifications. The unsaved working nodes are detached from each
+// other, so their memory can be reclaimed promptly even if a stale reference to
+// the discarded working tree is still held somewhere. Like any other update, it
+// invalidates the iterators open on the working tree, while those on saved
+// versions are unaffected, since the saved nodes are left untouched.
 func (tree *MutableTree) Rollback() {
+	if tree.ImmutableTree != nil {
+		releaseUnsavedNodes(tree.root)
+	}
 	if tree.version > 0 {
 		tree.ImmutableTree = tree.lastSaved.clone()
 	} else {
@@ -657,11 +1141,29 @@ func (tree *MutableTree) Rollback() {
 		tree.unsavedFastNodeAdditions = &sync.Map{}
 		tree.unsavedFastNodeRemovals = &sync.Map{}
 	}
+	tree.unsavedExpiries = make(map[string]pendingExpiry)
+}
+
+// releaseUnsavedNodes drops the child references of all unsaved nodes in the subtree, along with
+// their child node keys, so a stale reader fails instead of reading the saved children.
+// Persisted nodes are left untouched since they may be shared with saved versions.
+func releaseUnsavedNodes(node *Node) {
+	if node == nil || node.nodeKey != nil {
+		return
+	}
+	leftNode, rightNode := node.leftNode, node.rightNode
+	node.leftNode, node.rightNode = nil, nil
+	node.leftNodeKey, node.rightNodeKey = nil, nil
+	releaseUnsavedNodes(leftNode)
+	releaseUnsavedNodes(rightNode)
 }
 
 // GetVersioned gets the value at the specified key and version. The returned value must not be
 // modified, since it may point to data stored within IAVL.
 func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
 	if tree.VersionExists(version) {
 		if !tree.skipFastStorageUpgrade {
 			isFastCacheEnabled, err := tree.IsFastCacheEnabled()
@@ -705,14 +1207,89 @@ func (tree *MutableTree) UnsetCommitting() {
 }
 
 // SaveVersion saves a new tree version to disk, based on the current state of
-// the tree. Returns the hash and new version number.
+// the tree. Returns the hash and new version number. The version is flushed with an fsync
+// if the Sync option is set.
+//
+// A version which is already saved is not overwritten: SaveVersion is a no-op if the root hash
+// matches, and fails with ErrVersionAlreadySaved otherwise. Only the versions known to the tree
+// are checked, without reading the db, so a version saved meanwhile by another tree over the same
+// db is not detected; a db must have a single writer.
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
+	return tree.saveVersion(tree.ndb.opts.Sync, nil, nil, nil)
+}
+
+// SaveVersionSync is SaveVersion, but always flushes the version with an fsync, regardless of
+// the Sync option, so the version survives a crash once it returns.
+func (tree *MutableTree) SaveVersionSync() ([]byte, int64, error) {
+	return tree.saveVersion(true, nil, nil, nil)
+}
+
+// SaveVersionNoSync is SaveVersion, but never flushes the version with an fsync, regardless of
+// the Sync option. The version may be lost on a crash, until a later synced write flushes it.
+func (tree *MutableTree) SaveVersionNoSync() ([]byte, int64, error) {
+	return tree.saveVersion(false, nil, nil, nil)
+}
+
+// SaveStats describes the writes of a saved version, see SaveVersionDetailed.
+type SaveStats struct {
+	Hash          []byte
+	Version       int64
+	NodesWritten  int   // the number of new nodes written
+	NodesOrphaned int   // the number of nodes of the previous version not part of the new one
+	BytesWritten  int64 // the total size of the keys and values written, including the fast nodes and metadata
+}
+
+// SaveVersionDetailed is SaveVersion, but also returns the statistics of the writes of the version,
+// e.g. to monitor the write amplification. The written nodes and bytes are counted as they are
+// added to the batch. With AsyncPruning, the deletions of a concurrent pruning may be counted too.
+// The orphaned nodes are counted from the sizes of the subtrees the new version keeps from the
+// previous one, without reading any node.
+func (tree *MutableTree) SaveVersionDetailed() (SaveStats, error) {
+	stats := SaveStats{}
+	hash, version, err := tree.saveVersion(tree.ndb.opts.Sync, &stats, nil, nil)
+	if err != nil {
+		return SaveStats{}, err
+	}
+	stats.Hash, stats.Version = hash, version
+	return stats, nil
+}
+
+// SaveVersionWithBatch is SaveVersion, but also commits the writes the callback adds to the batch
+// it is given, in the same batch as the version, e.g. to persist application state atomically
+// with the tree. The callback runs before anything is written, and may read the version being
+// saved with WorkingVersion; the batch it is given is written by SaveVersionWithBatch, so it must
+// not Write it. If the callback fails, nothing is written and the working tree is left unchanged.
+// If the version is not written, since it is already saved with the same hash or unchanged with
+// SkipUnchangedVersions, the writes are committed alone.
+//
+// The writes must not touch the keys of the tree. Like the nodes of the version, they may be
+// flushed before the version is complete if the batch exceeds the MaxBatchBytes, but they are
+// added to the batch before the nodes, so the root of the version never reaches the db without
+// them: once the version is loadable, the writes are persisted too.
+func (tree *MutableTree) SaveVersionWithBatch(extra func(batch corestore.Batch) error) ([]byte, int64, error) {
+	staged := &stagedBatch{}
+	if err := extra(staged); err != nil {
+		return nil, tree.WorkingVersion(), err
+	}
+	return tree.saveVersion(tree.ndb.opts.Sync, nil, staged, nil)
+}
+
+// saveVersion saves the working tree as a new version, filling the given stats unless nil, along
+// with the staged writes of SaveVersionWithBatch and the annotation of SaveVersionWithAnnotation
+// unless nil.
+func (tree *MutableTree) saveVersion(syncWrite bool, stats *SaveStats, staged *stagedBatch, annotation []byte) ([]byte, int64, error) {
+	defer tree.ndb.tracer().StartSpan("MutableTree.SaveVersion").End()
 	version := tree.WorkingVersion()
+	prevVersion := tree.version
+	bytesBefore := tree.ndb.batchBytesAdded()
 	tree.initialVersionSet = false
 
-	if tree.VersionExists(version) {
+	if tree.versionExists(version) {
 		// If the version already exists, return an error as we're attempting to overwrite.
-		// However, the same hash means idempotent (i.e. no-op).
+		// However, the same hash means idempotent (i.e. no-op), unless in strict mode.
+		if tree.ndb.opts.StrictSaveVersion {
+			return nil, version, fmt.Errorf("%w: version %d", ErrVersionAlreadySaved, version)
+		}
 		existingNodeKey, err := tree.ndb.GetRoot(version)
 		if err != nil {
 			return nil, version, err
@@ -732,21 +1309,61 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 			tree.root = existingRoot
 			tree.ImmutableTree = tree.clone()
 			tree.lastSaved = tree.clone()
+			tree.ndb.resetLatestSize(tree.Size())
+			// the replayed changes are those of the saved version, which must not be applied again
+			if !tree.skipFastStorageUpgrade {
+				tree.unsavedFastNodeAdditions = &sync.Map{}
+				tree.unsavedFastNodeRemovals = &sync.Map{}
+			}
+			tree.unsavedExpiries = make(map[string]pendingExpiry)
+			if err := tree.commitStaged(staged, syncWrite); err != nil {
+				return nil, version, err
+			}
 			return newHash, version, nil
 		}
 
-		return nil, version, fmt.Errorf("version %d was already saved to different hash from %X (existing nodeKey %d)", version, newHash, existingNodeKey)
+		return nil, version, fmt.Errorf("%w: version %d was saved to different hash from %X (existing nodeKey %d)", ErrVersionAlreadySaved, version, newHash, existingNodeKey)
+	}
+
+	if tree.ndb.opts.SkipUnchangedVersions {
+		unchanged, err := tree.unchangedSinceLastSaved(version)
+		if err != nil {
+			return nil, version, err
+		}
+		if unchanged {
+			if err := tree.commitStaged(staged, syncWrite); err != nil {
+				return nil, version, err
+			}
+			return tree.Hash(), tree.version, nil
+		}
 	}
 
 	tree.logger.Debug("SAVE TREE", "version", version)
 
-	// save new fast nodes
-	if !tree.skipFastStorageUpgrade {
+	// remove the expired keys before anything is persisted, so they are not part of the new version
+	if err := tree.applyExpiries(version); err != nil {
+		return nil, version, err
+	}
+
+	// the staged writes precede the nodes, so the root is written after them even if the batch is
+	// flushed before the commit
+	if staged != nil {
+		if err := tree.ndb.addStagedBatch(staged); err != nil {
+			return nil, version, err
+		}
+	}
+
+	// save new fast nodes, unless they are queued for the background flush once committed
+	asyncFastNodes := !tree.skipFastStorageUpgrade && tree.ndb.fastFlusher != nil
+	if !tree.skipFastStorageUpgrade && !asyncFastNodes {
 		if err := tree.saveFastNodeVersion(version); err != nil {
 			return nil, version, err
 		}
 	}
-	// save new nodes
+	// save new nodes, the nodes of the previous version not kept by the new one are orphaned
+	if stats != nil {
+		stats.NodesOrphaned = nodeCount(tree.lastSaved.Size())
+	}
 	if tree.root == nil {
 		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
 			return nil, 0, err
@@ -765,33 +1382,335 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 				if err := tree.ndb.SaveNode(tree.root); err != nil {
 					return nil, 0, fmt.Errorf("failed to save the reference legacy node: %w", err)
 				}
+				if stats != nil {
+					stats.NodesWritten++
+				}
+			}
+			if stats != nil {
+				stats.NodesOrphaned -= nodeCount(tree.root.size)
 			}
 		} else {
-			if err := tree.saveNewNodes(version); err != nil {
+			written, kept, err := tree.saveNewNodes(version)
+			if err != nil {
 				return nil, 0, err
 			}
+			if stats != nil {
+				stats.NodesWritten = written
+				stats.NodesOrphaned -= kept
+			}
 		}
 	}
 
-	if err := tree.ndb.Commit(); err != nil {
+	if err := tree.ndb.SaveVersionChecksum(version, tree.root); err != nil {
+		return nil, version, err
+	}
+	if len(annotation) > 0 {
+		if err := tree.ndb.saveAnnotation(version, annotation); err != nil {
+			return nil, version, err
+		}
+	}
+
+	if err := tree.ndb.commit(syncWrite); err != nil {
 		return nil, version, err
 	}
 
 	tree.ndb.resetLatestVersion(version)
 	tree.version = version
+	if asyncFastNodes {
+		tree.ndb.queueFastNodeChanges(tree.getUnsavedFastNodeAdditions(), tree.getUnsavedFastNodeRemovals(), version)
+	}
 
-	// set new working tree
+	// set new working tree, before the records below, so it matches the committed version even if
+	// writing them fails
+	prevTree := tree.lastSaved
 	tree.ImmutableTree = tree.clone()
 	tree.lastSaved = tree.clone()
+	tree.ndb.resetLatestSize(tree.Size())
 	if !tree.skipFastStorageUpgrade {
 		tree.unsavedFastNodeAdditions = &sync.Map{}
 		tree.unsavedFastNodeRemovals = &sync.Map{}
 	}
+	tree.unsavedExpiries = make(map[string]pendingExpiry)
+
+	indexOrphans := tree.ndb.opts.OrphanIndex && prevVersion > 0 && prevVersion == version-1
+	if indexOrphans {
+		legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+		if err != nil {
+			return nil, version, err
+		}
+		indexOrphans = prevVersion > legacyLatestVersion
+	}
+	if (tree.ndb.opts.UndoVersions > 0 && prevVersion > 0) || indexOrphans || tree.ndb.opts.EnableValueIndex {
+		// the orphans and changes are found from the committed version, so the records follow in
+		// a second write
+		if tree.ndb.opts.UndoVersions > 0 && prevVersion > 0 {
+			if err := tree.ndb.recordUndo(prevVersion, version); err != nil {
+				return nil, version, err
+			}
+		}
+		if indexOrphans {
+			if err := tree.ndb.indexOrphans(prevVersion); err != nil {
+				return nil, version, err
+			}
+		}
+		if tree.ndb.opts.EnableValueIndex {
+			if err := tree.updateValueIndex(prevTree, version); err != nil {
+				return nil, version, err
+			}
+		}
+		if err := tree.ndb.commit(syncWrite); err != nil {
+			return nil, version, err
+		}
+	}
+	var changes *ChangeSet
+	if len(tree.versionSavedCallbacks) > 0 {
+		var err error
+		if changes, err = tree.savedChanges(prevTree, version); err != nil {
+			return nil, version, err
+		}
+	}
+	if stats != nil {
+		stats.BytesWritten = tree.ndb.batchBytesAdded() - bytesBefore
+	}
+
+	tree.runCommitCallbacks(version, tree.Hash())
+	tree.runVersionSavedCallbacks(version, tree.Hash(), changes)
 
 	return tree.Hash(), version, nil
 }
 
+// commitStaged commits the staged writes of SaveVersionWithBatch when no version is written.
+func (tree *MutableTree) commitStaged(staged *stagedBatch, syncWrite bool) error {
+	if staged == nil || len(staged.ops) == 0 {
+		return nil
+	}
+	if err := tree.ndb.addStagedBatch(staged); err != nil {
+		return err
+	}
+	return tree.ndb.commit(syncWrite)
+}
+
+// unchangedSinceLastSaved returns whether saving the given version would only repeat the last saved
+// version, i.e. the working tree has no changes and no expiries are due or pending. Due expiry
+// hints are left alone, since they never change the tree.
+func (tree *MutableTree) unchangedSinceLastSaved(version int64) (bool, error) {
+	if tree.version == 0 || len(tree.unsavedExpiries) > 0 {
+		return false, nil
+	}
+	savedRoot := tree.lastSaved.root
+	if tree.root == nil || savedRoot == nil {
+		if tree.root != savedRoot {
+			return false, nil
+		}
+	} else if tree.root.nodeKey == nil || savedRoot.nodeKey == nil ||
+		*tree.root.nodeKey != *savedRoot.nodeKey || tree.root.isLegacy {
+		// the legacy root is rewritten by SaveVersion
+		return false, nil
+	}
+	entries, err := tree.ndb.getExpiriesTo(version, false)
+	if err != nil {
+		return false, err
+	}
+	return len(entries) == 0, nil
+}
+
+// OnCommit registers a callback invoked synchronously by SaveVersion once a new version has been
+// durably written, with the saved version and its root hash. The callbacks run in registration
+// order. A panic in a callback is recovered and logged, so it neither prevents the next callbacks
+// from running nor fails the commit.
+func (tree *MutableTree) OnCommit(fn func(version int64, rootHash []byte)) {
+	tree.commitCallbacks = append(tree.commitCallbacks, fn)
+}
+
+func (tree *MutableTree) runCommitCallbacks(version int64, rootHash []byte) {
+	for _, fn := range tree.commitCallbacks {
+		tree.runCallback("commit callback panicked", version, func() {
+			// pass a copy, so the callback cannot alter the root hash
+			fn(version, bytes.Clone(rootHash))
+		})
+	}
+}
+
+// OnVersionSaved registers a callback invoked by SaveVersion once a new version has been durably
+// written, with the saved version, its root hash and the changes from the previous version, in
+// ascending key order. It is meant for integrations mirroring the tree state to another system.
+// The changes are extracted from the saved version and the previous one, so a key written again
+// with the same value, or added and removed again before the save, is not reported. The
+// extraction only visits the subtrees changed by the version, and is skipped when no callback is
+// registered. If it fails, SaveVersion returns the error after the version is saved, and the
+// callbacks do not fire.
+//
+// The callback fires exactly once per saved version: it does not fire when SaveVersion fails,
+// nor when it is a no-op because the version is already saved with the same hash. It runs
+// synchronously, after the OnCommit callbacks, so the next version is not saved before the
+// callback returns. However, the version is already visible when the callback runs, so
+// concurrent readers may observe it, e.g. with GetImmutable, before the callback is invoked.
+//
+// A panic in a callback is recovered and logged like in OnCommit.
+func (tree *MutableTree) OnVersionSaved(fn func(version int64, rootHash []byte, changes *ChangeSet)) {
+	tree.versionSavedCallbacks = append(tree.versionSavedCallbacks, fn)
+}
+
+func (tree *MutableTree) runVersionSavedCallbacks(version int64, rootHash []byte, changes *ChangeSet) {
+	for _, fn := range tree.versionSavedCallbacks {
+		tree.runCallback("version saved callback panicked", version, func() {
+			fn(version, bytes.Clone(rootHash), changes)
+		})
+	}
+}
+
+// runCallback runs a callback of the given version, recovering and logging its panic with msg.
+func (tree *MutableTree) runCallback(msg string, version int64, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			tree.logger.Error(msg, "version", version, "panic", r)
+		}
+	}()
+	fn()
+}
+
+// savedChanges returns the changes of the saved version from the previous saved tree, in ascending
+// key order. They are extracted from the two saved versions, so the keys written again with the
+// same value are left out, as are the keys added and removed again before the save.
+func (tree *MutableTree) savedChanges(prevTree *ImmutableTree, version int64) (*ChangeSet, error) {
+	root, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	var prevRoot []byte
+	if prevTree.root != nil {
+		prevRoot = prevTree.root.GetKey()
+	}
+
+	changes := &ChangeSet{}
+	if err := tree.ndb.extractStateChanges(prevTree.version, prevRoot, root, func(pair *KVPair) error {
+		if !pair.Delete {
+			// the previous value is read from the tree, since the fast nodes may be updated already
+			_, prevValue, err := prevTree.GetWithIndex(pair.Key)
+			if err != nil {
+				return err
+			}
+			if prevValue != nil && bytes.Equal(prevValue, pair.Value) {
+				return nil
+			}
+		}
+		changes.Pairs = append(changes.Pairs, pair)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// applyExpiries removes the keys whose expiry version is less than or equal to the given version
+// from the working tree, and writes the pending expiries and expiry hints to the index.
+//
+// A saved expiry entry only applies if the leaf of its key was last written in the version the
+// expiry was saved with, otherwise the key has been rewritten or removed since and the entry is
+// stale. The expired keys are removed in ascending key order, which keeps the resulting root
+// independent of the iteration order of the pending expiries. The due expiry hints are kept until
+// their key is rewritten or removed, only the stale ones are deleted.
+func (tree *MutableTree) applyExpiries(version int64) error {
+	entries, expired, err := tree.dueExpiries(version, false)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tree.RemoveMany(expired); err != nil {
+		return err
+	}
+
+	hints, _, err := tree.dueExpiries(version, true)
+	if err != nil {
+		return err
+	}
+	for _, hint := range hints {
+		if !hint.live {
+			entries = append(entries, hint)
+		}
+	}
+
+	for _, entry := range entries {
+		if err := tree.ndb.DeleteExpiry(entry); err != nil {
+			return err
+		}
+	}
+	for key, expiry := range tree.unsavedExpiries {
+		if err := tree.ndb.SaveExpiry(expiry.version, []byte(key), version, expiry.hint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dueExpiries returns the saved expiry entries, or expiry hints, with an expiry version less than
+// or equal to the given version, along with the keys of the working tree which expire by then, in
+// ascending order. The entries whose key has not been rewritten or removed since are marked live.
+func (tree *MutableTree) dueExpiries(version int64, hint bool) ([]expiryEntry, [][]byte, error) {
+	entries, err := tree.ndb.getExpiriesTo(version, hint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expired := make([][]byte, 0, len(entries))
+	for i, entry := range entries {
+		if _, ok := tree.unsavedExpiries[string(entry.key)]; ok {
+			// the key has been set with a new expiry in the working tree
+			continue
+		}
+		leafVersion, err := tree.leafVersion(entry.key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if leafVersion == entry.setVersion {
+			entries[i].live = true
+			expired = append(expired, entry.key)
+		}
+	}
+	for key, expiry := range tree.unsavedExpiries {
+		if expiry.hint == hint && expiry.version <= version {
+			expired = append(expired, []byte(key))
+		}
+	}
+	slices.SortFunc(expired, bytes.Compare)
+	return entries, expired, nil
+}
+
+// ExpiredKeys returns the keys of the working tree set with SetWithExpiryHint whose expiry hint is
+// less than or equal to atVersion, in ascending order. The hints are metadata kept outside of the
+// tree, so they do not affect the hashes, and the keys stay in the tree until they are removed or
+// rewritten, which drops their hint.
+func (tree *MutableTree) ExpiredKeys(atVersion int64) ([][]byte, error) {
+	_, expired, err := tree.dueExpiries(atVersion, true)
+	return expired, err
+}
+
+// leafVersion returns the version at which the leaf of the given key was saved in the working
+// tree, or 0 if the key does not exist or its leaf has not been saved yet.
+func (tree *MutableTree) leafVersion(key []byte) (int64, error) {
+	node := tree.root
+	for node != nil && !node.isLeaf() {
+		var err error
+		if bytes.Compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(tree.ImmutableTree)
+		} else {
+			node, err = node.getRightNode(tree.ImmutableTree)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if node == nil || node.nodeKey == nil || !bytes.Equal(node.key, key) {
+		return 0, nil
+	}
+	return node.nodeKey.version, nil
+}
+
 func (tree *MutableTree) saveFastNodeVersion(latestVersion int64) error {
+	if err := tree.ndb.invalidateFastStorageVersion(); err != nil {
+		return err
+	}
 	if err := tree.saveFastNodeAdditions(); err != nil {
 		return err
 	}
@@ -878,11 +1797,145 @@ func (tree *MutableTree) SetInitialVersion(version uint64) {
 
 // DeleteVersionsTo removes versions upto the given version from the MutableTree.
 // It will not block the SaveVersion() call, instead it will be queued and executed deferred.
+// It returns ErrMinRetainVersions if fewer than Options.MinRetainVersions versions would be
+// retained, see ForceDeleteVersionsTo to override it.
 func (tree *MutableTree) DeleteVersionsTo(toVersion int64) error {
+	if minRetain := tree.ndb.opts.MinRetainVersions; minRetain > 0 {
+		_, latest, err := tree.ndb.getLatestVersion()
+		if err != nil {
+			return err
+		}
+		if latest-toVersion < minRetain {
+			return fmt.Errorf("%w: deleting versions to %d retains %d of the %d versions required", ErrMinRetainVersions, toVersion, max(latest-toVersion, 0), minRetain)
+		}
+	}
+	return tree.ForceDeleteVersionsTo(toVersion)
+}
+
+// ForceDeleteVersionsTo is DeleteVersionsTo, but ignores Options.MinRetainVersions.
+func (tree *MutableTree) ForceDeleteVersionsTo(toVersion int64) error {
 	if err := tree.ndb.DeleteVersionsTo(toVersion); err != nil {
 		return err
 	}
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+
+	return tree.ndb.compactIfDue()
+}
+
+// KeepLatestOnly deletes all the versions but the latest one, along with the history recorded
+// beside them, i.e. the changes recorded for Options.UndoVersions and the hidden versions, e.g.
+// to ship a minimal db. The orphan index entries of Options.OrphanIndex are deleted by the
+// pruning itself. It ignores Options.MinRetainVersions. With AsyncPruning, the versions are
+// deleted in the background, as with DeleteVersionsTo. The legacy versions are only deleted once
+// a newer version is saved in the current format, as with DeleteVersionsTo.
+func (tree *MutableTree) KeepLatestOnly() error {
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latestVersion == 0 {
+		return nil
+	}
+	if firstVersion < latestVersion {
+		if err := tree.ndb.DeleteVersionsTo(latestVersion - 1); err != nil {
+			return err
+		}
+	}
+	// the recorded changes of the latest version rebuild the previous one
+	if err := tree.ndb.traverseRange(undoKeyFormat.Key(int64(0)), undoKeyFormat.Key(latestVersion+1), func(k, _ []byte) error {
+		return tree.ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	// the deleted versions remain hidden until the pruning is done, which may be deferred
+	hidden, err := tree.ndb.getHiddenVersions()
+	if err != nil {
+		return err
+	}
+	if firstVersion, err = tree.ndb.getFirstVersion(); err != nil {
+		return err
+	}
+	if err := tree.ndb.setHiddenVersions(hidden.normalize(firstVersion)); err != nil {
+		return err
+	}
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+	return tree.ndb.compactIfDue()
+}
+
+// OrphansOfVersion streams the db keys which DeleteVersionsTo would delete when pruning the
+// given version, together with the size of their stored value, without deleting anything. Since
+// versions are pruned in ascending order, the result assumes all the lower versions have been
+// pruned already. The traversal stops when fn returns true.
+func (tree *MutableTree) OrphansOfVersion(version int64, fn func(dbKey []byte, size int) bool) error {
+	return tree.ndb.orphansOfVersion(version, fn)
+}
+
+// HideVersions makes the versions from fromVersion to toVersion, both included, unavailable
+// right away: GetImmutable returns ErrVersionPruned for them, and they are neither listed nor
+// loadable anymore. Their nodes are kept on disk until ReclaimHidden deletes them. The hidden
+// versions are recorded in the db, so they stay hidden when the tree is reopened. The latest
+// version cannot be hidden.
+func (tree *MutableTree) HideVersions(fromVersion, toVersion int64) error {
+	if fromVersion < 1 || fromVersion > toVersion {
+		return fmt.Errorf("invalid version range [%d, %d]", fromVersion, toVersion)
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if toVersion >= latestVersion {
+		return fmt.Errorf("latest version %d is less than or equal to toVersion %d", latestVersion, toVersion)
+	}
+	hidden, err := tree.ndb.getHiddenVersions()
+	if err != nil {
+		return err
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	hidden = append(slices.Clone(hidden), versionRange{fromVersion, toVersion}).normalize(firstVersion)
+	if err := tree.ndb.setHiddenVersions(hidden); err != nil {
+		return err
+	}
+	return tree.ndb.Commit()
+}
 
+// ReclaimHidden deletes the nodes of the hidden versions, like DeleteVersionsTo. Since versions
+// are pruned in ascending order, only the hidden versions following the first available version
+// are reclaimed, the others are reclaimed once the versions below them are hidden as well.
+func (tree *MutableTree) ReclaimHidden() error {
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	hidden, err := tree.ndb.getHiddenVersions()
+	if err != nil {
+		return err
+	}
+	hidden = hidden.normalize(firstVersion)
+	if len(hidden) == 0 || hidden[0].from > firstVersion {
+		return nil
+	}
+	if err := tree.ndb.DeleteVersionsTo(hidden[0].to); err != nil {
+		return err
+	}
+	// the deleted versions remain hidden until the pruning is done, which may be deferred
+	firstVersion, err = tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	if err := tree.ndb.setHiddenVersions(hidden.normalize(firstVersion)); err != nil {
+		return err
+	}
 	return tree.ndb.Commit()
 }
 
@@ -892,6 +1945,14 @@ func (tree *MutableTree) DeleteVersionsFrom(fromVersion int64) error {
 	if err := tree.ndb.DeleteVersionsFrom(fromVersion); err != nil {
 		return err
 	}
+	// the versions saved again later must not be hidden
+	hidden, err := tree.ndb.getHiddenVersions()
+	if err != nil {
+		return err
+	}
+	if err := tree.ndb.setHiddenVersions(hidden.truncate(fromVersion)); err != nil {
+		return err
+	}
 
 	return tree.ndb.Commit()
 }
@@ -1031,13 +2092,15 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, err error) {
 
 // saveNewNodes save new created nodes by the changes of the working tree.
 // NOTE: This function clears leftNode/rigthNode recursively and
-// calls _hash() on the given node.
-func (tree *MutableTree) saveNewNodes(version int64) error {
+// calls _hash() on the given node. It returns the number of nodes saved, and the number of
+// saved nodes kept in the subtrees the new nodes refer to.
+func (tree *MutableTree) saveNewNodes(version int64) (written, kept int, err error) {
 	nonce := uint32(0)
 	newNodes := make([]*Node, 0)
 	var recursiveAssignKey func(*Node) ([]byte, error)
 	recursiveAssignKey = func(node *Node) ([]byte, error) {
 		if node.nodeKey != nil {
+			kept += nodeCount(node.size)
 			return node.GetKey(), nil
 		}
 		nonce++
@@ -1066,17 +2129,25 @@ func (tree *MutableTree) saveNewNodes(version int64) error {
 	}
 
 	if _, err := recursiveAssignKey(tree.root); err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	for _, node := range newNodes {
 		if err := tree.ndb.SaveNode(node); err != nil {
-			return err
+			return 0, 0, err
 		}
 		node.leftNode, node.rightNode = nil, nil
 	}
 
-	return nil
+	return len(newNodes), kept, nil
+}
+
+// nodeCount returns the number of nodes of a tree with the given number of leaves.
+func nodeCount(size int64) int {
+	if size == 0 {
+		return 0
+	}
+	return int(2*size - 1)
 }
 
 // SaveChangeSet saves a ChangeSet to the tree.
@@ -1105,6 +2176,97 @@ func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
 	return version, err
 }
 
+// ReplaceAll replaces the whole content of the tree with the key/value pairs of the given iterator,
+// which must be in strictly ascending key order, and saves the result as the next version. Instead
+// of removing and setting the keys one by one, it builds a balanced tree from the pairs at once,
+// and the nodes of the previous version become orphans, pruned along with it. The iterator is
+// consumed but not closed, and the given key/value byte slices must not be modified afterwards.
+func (tree *MutableTree) ReplaceAll(pairs corestore.Iterator) (hash []byte, version int64, err error) {
+	// if the tree has uncommitted changes, return error
+	if tree.root != nil && tree.root.nodeKey == nil {
+		return nil, 0, errors.New("cannot replace the tree content with uncommitted changes")
+	}
+
+	var leaves []*Node
+	for ; pairs.Valid(); pairs.Next() {
+		key, value := pairs.Key(), pairs.Value()
+		if err := validateKey(key); err != nil {
+			return nil, 0, err
+		}
+		if value == nil {
+			return nil, 0, fmt.Errorf("attempt to store nil value at key '%s'", key)
+		}
+		if err := tree.checkSizeLimits(key, value); err != nil {
+			return nil, 0, err
+		}
+		if len(leaves) > 0 && bytes.Compare(leaves[len(leaves)-1].key, key) >= 0 {
+			return nil, 0, fmt.Errorf("keys are not in strictly ascending order at key '%s'", key)
+		}
+		leaves = append(leaves, NewNode(key, value))
+	}
+	if err := pairs.Error(); err != nil {
+		return nil, 0, err
+	}
+
+	if !tree.skipFastStorageUpgrade {
+		if err := tree.replaceFastNodes(leaves); err != nil {
+			return nil, 0, err
+		}
+	}
+	tree.unsavedExpiries = make(map[string]pendingExpiry)
+	tree.root = buildBalancedTree(leaves)
+
+	return tree.SaveVersion()
+}
+
+// replaceFastNodes records the fast node changes replacing the keys of the working tree with the
+// given leaves, which are in ascending key order.
+func (tree *MutableTree) replaceFastNodes(leaves []*Node) error {
+	itr, err := tree.ImmutableTree.Iterator(nil, nil, true)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	version := tree.WorkingVersion()
+	i := 0
+	for ; itr.Valid(); itr.Next() {
+		for i < len(leaves) && bytes.Compare(leaves[i].key, itr.Key()) < 0 {
+			i++
+		}
+		if i == len(leaves) || !bytes.Equal(leaves[i].key, itr.Key()) {
+			tree.addUnsavedRemoval(itr.Key())
+		}
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	for _, leaf := range leaves {
+		tree.addUnsavedAddition(leaf.key, fastnode.NewNode(leaf.key, leaf.value, version))
+	}
+	return nil
+}
+
+// buildBalancedTree builds a tree of new nodes over the given leaves, which are in ascending key
+// order, splitting them in halves so that the tree is balanced. It returns nil if there are none.
+func buildBalancedTree(leaves []*Node) *Node {
+	switch len(leaves) {
+	case 0:
+		return nil
+	case 1:
+		return leaves[0]
+	}
+	mid := (len(leaves) + 1) / 2
+	left, right := buildBalancedTree(leaves[:mid]), buildBalancedTree(leaves[mid:])
+	return &Node{
+		key:           leaves[mid].key,
+		subtreeHeight: max(left.subtreeHeight, right.subtreeHeight) + 1,
+		size:          int64(len(leaves)),
+		leftNode:      left,
+		rightNode:     right,
+	}
+}
+
 // Close closes the tree.
 func (tree *MutableTree) Close() error {
 	tree.mtx.Lock()
@@ -2,20 +2,27 @@ package iavl
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	mrand "math/rand"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 
+	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	gomock "go.uber.org/mock/gomock"
 
 	dbm "github.com/cosmos/iavl/db"
 	"github.com/cosmos/iavl/fastnode"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
 	"github.com/cosmos/iavl/internal/encoding"
 	iavlrand "github.com/cosmos/iavl/internal/rand"
 	"github.com/cosmos/iavl/mock"
@@ -1518,3 +1525,2220 @@ func TestMutableTree_InitialVersionZero(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int64(0), version)
 }
+
+func TestMutableTree_RemoveMany(t *testing.T) {
+	r := mrand.New(mrand.NewSource(2024))
+	for round := 0; round < 10; round++ {
+		// build two identical trees, one of them is saved beforehand to exercise persisted nodes
+		expected := setupMutableTree(false)
+		actual := setupMutableTree(false)
+		keys := make([][]byte, 0, 500)
+		for i := 0; i < 500; i++ {
+			key := []byte(fmt.Sprintf("k%05d", r.Intn(2000)))
+			value := []byte(fmt.Sprintf("v%d", i))
+			_, err := expected.Set(key, value)
+			require.NoError(t, err)
+			_, err = actual.Set(key, value)
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		if round%2 == 0 {
+			_, _, err := expected.SaveVersion()
+			require.NoError(t, err)
+			_, _, err = actual.SaveVersion()
+			require.NoError(t, err)
+		}
+
+		// remove a random subset along with absent keys and duplicates
+		toRemove := make([][]byte, 0)
+		for _, key := range keys {
+			if r.Intn(2) == 0 {
+				toRemove = append(toRemove, key)
+			}
+		}
+		toRemove = append(toRemove, toRemove[:10]...)
+		toRemove = append(toRemove, []byte("absent"), []byte("k99999"))
+
+		sorted := make([][]byte, len(toRemove))
+		copy(sorted, toRemove)
+		sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+		expectedRemoved := 0
+		for _, key := range sorted {
+			_, ok, err := expected.Remove(key)
+			require.NoError(t, err)
+			if ok {
+				expectedRemoved++
+			}
+		}
+
+		removed, err := actual.RemoveMany(toRemove)
+		require.NoError(t, err)
+		require.Equal(t, expectedRemoved, removed)
+		require.Equal(t, expected.WorkingHash(), actual.WorkingHash())
+		require.Equal(t, expected.Size(), actual.Size())
+
+		for _, key := range toRemove {
+			value, err := actual.Get(key)
+			require.NoError(t, err)
+			require.Nil(t, value)
+		}
+
+		expectedHash, _, err := expected.SaveVersion()
+		require.NoError(t, err)
+		actualHash, _, err := actual.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, actualHash)
+	}
+}
+
+func TestMutableTree_RemoveManyAll(t *testing.T) {
+	tree := setupMutableTree(false)
+	keys := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		_, err := tree.Set(key, []byte("v"))
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+
+	removed, err := tree.RemoveMany(keys)
+	require.NoError(t, err)
+	require.Equal(t, 100, removed)
+	require.True(t, tree.IsEmpty())
+
+	removed, err = tree.RemoveMany(keys)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+}
+
+func benchmarkRemove(b *testing.B, batch bool) {
+	const (
+		treeSize   = 100000
+		removeSize = 5000
+	)
+	keys := make([][]byte, treeSize)
+	for i := range keys {
+		keys[i] = iavlrand.RandBytes(10)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tree := NewMutableTree(dbm.NewMemDB(), 100000, true, NewNopLogger())
+		for _, key := range keys {
+			_, err := tree.Set(key, []byte{1})
+			require.NoError(b, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(b, err)
+		b.StartTimer()
+
+		if batch {
+			_, err = tree.RemoveMany(keys[:removeSize])
+			require.NoError(b, err)
+		} else {
+			for _, key := range keys[:removeSize] {
+				_, _, err = tree.Remove(key)
+				require.NoError(b, err)
+			}
+		}
+	}
+}
+
+func BenchmarkMutableTree_Remove(b *testing.B) {
+	benchmarkRemove(b, false)
+}
+
+func BenchmarkMutableTree_RemoveMany(b *testing.B) {
+	benchmarkRemove(b, true)
+}
+
+func TestMutableTree_SetWithExpiry(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, skip, NewNopLogger())
+		// ref applies the same changes with explicit removals
+		ref := setupMutableTree(skip)
+
+		_, err := tree.SetWithExpiry([]byte("a"), []byte{1}, 3)
+		require.NoError(t, err)
+		_, err = tree.SetWithExpiry([]byte("b"), []byte{2}, 2)
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("c"), []byte{3})
+		require.NoError(t, err)
+		for _, key := range []string{"a", "b", "c"} {
+			_, err = ref.Set([]byte(key), []byte{key[0] - 'a' + 1})
+			require.NoError(t, err)
+		}
+
+		_, err = tree.SetWithExpiry([]byte("d"), []byte{4}, 1)
+		require.Error(t, err)
+
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		refHash, _, err := ref.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, refHash, hash)
+
+		// b expires at version 2
+		hash, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = ref.Remove([]byte("b"))
+		require.NoError(t, err)
+		refHash, _, err = ref.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, refHash, hash)
+		has, err := tree.Has([]byte("b"))
+		require.NoError(t, err)
+		require.False(t, has)
+
+		// the expiry index is persisted, a reloaded tree expires a at version 3
+		tree = NewMutableTree(db, 0, skip, NewNopLogger())
+		_, err = tree.Load()
+		require.NoError(t, err)
+		hash, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = ref.Remove([]byte("a"))
+		require.NoError(t, err)
+		refHash, _, err = ref.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, refHash, hash)
+		require.EqualValues(t, 1, tree.Size())
+
+		entries, err := tree.ndb.getExpiriesTo(math.MaxInt64-1, false)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+}
+
+func TestMutableTree_SetWithExpiryOrder(t *testing.T) {
+	// keys are written in random order across versions with random expiries, the expired keys
+	// of a version must be removed as if by Remove calls in ascending key order
+	tree := setupMutableTree(false)
+	ref := setupMutableTree(false)
+	r := mrand.New(mrand.NewSource(0))
+
+	expiries := make(map[int64][]string)
+	for version := int64(1); version <= 10; version++ {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key%03d", r.Intn(200))
+			expiry := version + 1 + r.Int63n(4)
+			_, err := tree.SetWithExpiry([]byte(key), []byte(key), expiry)
+			require.NoError(t, err)
+			_, err = ref.Set([]byte(key), []byte(key))
+			require.NoError(t, err)
+			for v, keys := range expiries {
+				for j, k := range keys {
+					if k == key {
+						expiries[v] = append(keys[:j:j], keys[j+1:]...)
+						break
+					}
+				}
+			}
+			expiries[expiry] = append(expiries[expiry], key)
+		}
+
+		expired := expiries[version]
+		sort.Strings(expired)
+		for _, key := range expired {
+			_, _, err := ref.Remove([]byte(key))
+			require.NoError(t, err)
+		}
+
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		refHash, _, err := ref.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, refHash, hash, "version %d", version)
+	}
+}
+
+func TestMutableTree_SetWithExpiryCancel(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	_, err := tree.SetWithExpiry([]byte("a"), []byte{1}, 3)
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("b"), []byte{2}, 3)
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("c"), []byte{3}, 3)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// a is rewritten, b is removed and set again, c is set with a later expiry
+	_, err = tree.Set([]byte("a"), []byte{10})
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte{20})
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("c"), []byte{30}, 4)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "c"} {
+		has, err := tree.Has([]byte(key))
+		require.NoError(t, err)
+		require.True(t, has, key)
+	}
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	has, err := tree.Has([]byte("c"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// a pending expiry is discarded on rollback
+	_, err = tree.SetWithExpiry([]byte("d"), []byte{4}, 6)
+	require.NoError(t, err)
+	tree.Rollback()
+	_, err = tree.Set([]byte("d"), []byte{4})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 3, tree.Size())
+}
+
+func TestMutableTree_SetWithExpiryOverwriting(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	_, err := tree.Set([]byte("a"), []byte{1})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("a"), []byte{2}, 4)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the expiry saved by version 2 goes away with it
+	require.NoError(t, tree.LoadVersionForOverwriting(1))
+	_, err = tree.Set([]byte("a"), []byte{3})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	value, err := tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, value)
+}
+
+func TestMutableTree_ExpiredKeys(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	set := func(key, value string, expiry int64) {
+		_, err := tree.SetWithExpiryHint([]byte(key), []byte(value), expiry)
+		require.NoError(t, err)
+		_, err = plain.Set([]byte(key), []byte(value))
+		require.NoError(t, err)
+	}
+	// the hints are not part of the hash, and the keys are never removed by the tree
+	saveVersion := func() {
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		plainHash, _, err := plain.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, plainHash, hash)
+	}
+	expiredKeys := func(atVersion int64, expected ...string) {
+		keys, err := tree.ExpiredKeys(atVersion)
+		require.NoError(t, err)
+		require.Len(t, keys, len(expected))
+		for i, key := range expected {
+			require.Equal(t, []byte(key), keys[i])
+		}
+	}
+
+	set("k1", "v1", 3)
+	set("k2", "v2", 5)
+	_, err := tree.Set([]byte("k3"), []byte("v3"))
+	require.NoError(t, err)
+	_, err = plain.Set([]byte("k3"), []byte("v3"))
+	require.NoError(t, err)
+	saveVersion()
+
+	expiredKeys(2)
+	expiredKeys(3, "k1")
+	expiredKeys(5, "k1", "k2")
+
+	// the pending hints are listed, and rewriting a key cancels its hint
+	set("k4", "v4", 4)
+	_, err = tree.Set([]byte("k1"), []byte("v1"))
+	require.NoError(t, err)
+	_, err = plain.Set([]byte("k1"), []byte("v1"))
+	require.NoError(t, err)
+	expiredKeys(5, "k2", "k4")
+	saveVersion()
+	expiredKeys(4, "k4")
+
+	// the due keys stay in the tree until the janitor removes them
+	saveVersion()
+	saveVersion()
+	saveVersion()
+	require.EqualValues(t, 4, tree.Size())
+	expiredKeys(tree.Version(), "k2", "k4")
+	_, _, err = tree.Remove([]byte("k2"))
+	require.NoError(t, err)
+	_, _, err = plain.Remove([]byte("k2"))
+	require.NoError(t, err)
+	expiredKeys(tree.Version(), "k4")
+	saveVersion()
+	expiredKeys(tree.Version(), "k4")
+
+	// the stale hints are deleted once due, the live ones are kept
+	hints, err := tree.ndb.getExpiriesTo(math.MaxInt64-1, true)
+	require.NoError(t, err)
+	require.Len(t, hints, 1)
+	require.Equal(t, []byte("k4"), hints[0].key)
+	entries, err := tree.ndb.getExpiriesTo(math.MaxInt64-1, false)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// the due hints alone do not prevent skipping an unchanged version
+	skipping := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), SkipUnchangedVersionsOption(true))
+	_, err = skipping.SetWithExpiryHint([]byte("k"), []byte("v"), 2)
+	require.NoError(t, err)
+	_, _, err = skipping.SaveVersion()
+	require.NoError(t, err)
+	_, version, err := skipping.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+}
+
+func TestMutableTree_OrphansOfVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	r := mrand.New(mrand.NewSource(0))
+
+	const versions = 20
+	for v := 1; v <= versions; v++ {
+		// leave some versions unchanged, so they are saved as reference roots
+		if v%5 != 0 {
+			for i := 0; i < 20; i++ {
+				key := []byte(fmt.Sprintf("key%03d", r.Intn(100)))
+				if r.Intn(4) == 0 {
+					_, _, err := tree.Remove(key)
+					require.NoError(t, err)
+				} else {
+					_, err := tree.Set(key, []byte(fmt.Sprintf("value%d", r.Int())))
+					require.NoError(t, err)
+				}
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	dbKeys := func() map[string]int {
+		keys := make(map[string]int)
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			keys[string(itr.Key())] = len(itr.Value())
+		}
+		return keys
+	}
+
+	require.Error(t, tree.OrphansOfVersion(versions, func([]byte, int) bool { return false }))
+
+	// the traversal stops when the callback returns true
+	count := 0
+	err := tree.OrphansOfVersion(1, func([]byte, int) bool {
+		count++
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	for v := int64(1); v < versions; v++ {
+		orphans := make(map[string]int)
+		err = tree.OrphansOfVersion(v, func(dbKey []byte, size int) bool {
+			orphans[string(dbKey)] = size
+			return false
+		})
+		require.NoError(t, err)
+
+		before := dbKeys()
+		require.NoError(t, tree.DeleteVersionsTo(v))
+		after := dbKeys()
+
+		removed := make(map[string]int)
+		for key, size := range before {
+			if _, ok := after[key]; !ok {
+				removed[key] = size
+			}
+		}
+		require.Equal(t, removed, orphans, "version %d", v)
+	}
+
+	require.ErrorIs(t, tree.OrphansOfVersion(1, func([]byte, int) bool { return false }), ErrVersionDoesNotExist)
+}
+
+func TestMaxTreeHeight(t *testing.T) {
+	require.Equal(t, int8(0), MaxTreeHeight(1))
+	require.Equal(t, int8(1), MaxTreeHeight(2))
+	require.Equal(t, int8(2), MaxTreeHeight(3))
+	require.Equal(t, int8(28), MaxTreeHeight(1_000_000))
+
+	tree := setupMutableTree(false)
+	r := mrand.New(mrand.NewSource(0))
+	for i := 0; i < 2000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("%08d", i)), []byte{1})
+		require.NoError(t, err)
+		_, err = tree.Set([]byte(fmt.Sprintf("r%08d", r.Int())), []byte{1})
+		require.NoError(t, err)
+		require.LessOrEqual(t, tree.Height(), MaxTreeHeight(tree.Size()))
+	}
+}
+
+func TestMutableTree_MaxHeight(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skip, NewNopLogger(), MaxHeightOption(3))
+
+		// a tree of height 3 holds at most 8 keys
+		for i := 0; i < 8; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{1})
+			require.NoError(t, err)
+		}
+		require.Equal(t, int8(3), tree.Height())
+		hash := tree.WorkingHash()
+
+		_, err := tree.Set([]byte{8}, []byte{1})
+		require.ErrorIs(t, err, ErrMaxHeightExceeded)
+		require.Equal(t, hash, tree.WorkingHash())
+		require.EqualValues(t, 8, tree.Size())
+		value, err := tree.Get([]byte{8})
+		require.NoError(t, err)
+		require.Nil(t, value)
+
+		// updates don't grow the tree
+		updated, err := tree.Set([]byte{0}, []byte{2})
+		require.NoError(t, err)
+		require.True(t, updated)
+
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		value, err = tree.Get([]byte{0})
+		require.NoError(t, err)
+		require.Equal(t, []byte{2}, value)
+		has, err := tree.Has([]byte{8})
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+}
+
+func TestMutableTree_SizeLimits(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), MaxKeyBytesOption(4), MaxValueBytesOption(8))
+
+	// exactly at the limits
+	_, err := tree.Set([]byte("abcd"), []byte("12345678"))
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+
+	_, err = tree.Set([]byte("abcde"), []byte("1"))
+	require.ErrorIs(t, err, ErrKeyTooLarge)
+	_, err = tree.Set([]byte("abcd"), []byte("123456789"))
+	require.ErrorIs(t, err, ErrValueTooLarge)
+	_, err = tree.SetWithExpiry([]byte("abcde"), []byte("1"), 10)
+	require.ErrorIs(t, err, ErrKeyTooLarge)
+	_, err = tree.CompareAndSwap([]byte("abcd"), []byte("12345678"), []byte("123456789"))
+	require.ErrorIs(t, err, ErrValueTooLarge)
+	require.Equal(t, hash, tree.WorkingHash())
+	value, err := tree.Get([]byte("abcd"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("12345678"), value)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	pairs := dbm.NewMemDB()
+	require.NoError(t, pairs.Set([]byte("abcde"), []byte("1")))
+	itr, err := pairs.Iterator(nil, nil)
+	require.NoError(t, err)
+	_, _, err = tree.ReplaceAll(itr)
+	require.ErrorIs(t, err, ErrKeyTooLarge)
+	require.NoError(t, itr.Close())
+
+	// no limits by default
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err = tree.Set(make([]byte, 1<<16), make([]byte, 1<<20))
+	require.NoError(t, err)
+}
+
+func TestMutableTree_GetCommitted(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, skip, NewNopLogger())
+
+		// nothing is committed yet
+		_, err := tree.Set([]byte("a"), []byte{1})
+		require.NoError(t, err)
+		value, err := tree.GetCommitted([]byte("a"))
+		require.NoError(t, err)
+		require.Nil(t, value)
+		_, err = tree.GetCommitted(nil)
+		require.ErrorIs(t, err, ErrKeyEmpty)
+
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		// working changes are not visible
+		_, err = tree.Set([]byte("a"), []byte{2})
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("b"), []byte{3})
+		require.NoError(t, err)
+		value, err = tree.GetCommitted([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte{1}, value)
+		value, err = tree.GetCommitted([]byte("b"))
+		require.NoError(t, err)
+		require.Nil(t, value)
+		_, _, err = tree.Remove([]byte("a"))
+		require.NoError(t, err)
+		value, err = tree.GetCommitted([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte{1}, value)
+
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		value, err = tree.GetCommitted([]byte("a"))
+		require.NoError(t, err)
+		require.Nil(t, value)
+		value, err = tree.GetCommitted([]byte("b"))
+		require.NoError(t, err)
+		require.Equal(t, []byte{3}, value)
+
+		// the committed state follows the loaded version
+		tree = NewMutableTree(db, 0, skip, NewNopLogger())
+		_, err = tree.LoadVersion(1)
+		require.NoError(t, err)
+		value, err = tree.GetCommitted([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte{1}, value)
+	}
+}
+
+func TestMutableTree_NodeCodec(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), NodeCodecOption(testNodeCodec{}))
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+
+	r := mrand.New(mrand.NewSource(1))
+	for version := 1; version <= 10; version++ {
+		for i := 0; i < 50; i++ {
+			key := []byte{byte(r.Intn(100))}
+			if r.Intn(4) == 0 {
+				_, _, err := tree.Remove(key)
+				require.NoError(t, err)
+				_, _, err = reference.Remove(key)
+				require.NoError(t, err)
+				continue
+			}
+			value := iavlrand.RandBytes(8)
+			_, err := tree.Set(key, value)
+			require.NoError(t, err)
+			_, err = reference.Set(key, value)
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		referenceHash, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, referenceHash, hash)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(5))
+
+	// reload the tree from the db, with the node cache disabled
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), NodeCodecOption(testNodeCodec{}))
+	_, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, reference.Hash(), reloaded.Hash())
+	for version := int64(6); version <= 10; version++ {
+		want, err := reference.GetImmutable(version)
+		require.NoError(t, err)
+		got, err := reloaded.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, want.Hash(), got.Hash())
+		_, err = got.Iterate(func(key, value []byte) bool {
+			wantValue, err := want.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, wantValue, value)
+			proof, err := got.GetMembershipProof(key)
+			require.NoError(t, err)
+			ok, err := got.VerifyMembership(proof, key)
+			require.NoError(t, err)
+			require.True(t, ok)
+			return false
+		})
+		require.NoError(t, err)
+	}
+
+	// export into a fresh db with the custom codec
+	exported, err := reference.GetImmutable(10)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, exported.ExportCompressed(&buf, NoneCodec{}))
+	importDB := dbm.NewMemDB()
+	imported := NewMutableTree(importDB, 0, false, NewNopLogger(), NodeCodecOption(testNodeCodec{}))
+	require.NoError(t, imported.ImportCompressed(&buf))
+	imported = NewMutableTree(importDB, 0, false, NewNopLogger(), NodeCodecOption(testNodeCodec{}))
+	_, err = imported.Load()
+	require.NoError(t, err)
+	require.Equal(t, reference.Hash(), imported.Hash())
+
+	// the db refuses to open with another codec
+	_, err = NewMutableTree(db, 0, false, NewNopLogger()).Load()
+	require.ErrorIs(t, err, ErrNodeCodecMismatch)
+	_, err = NewMutableTree(importDB, 0, false, NewNopLogger()).Load()
+	require.ErrorIs(t, err, ErrNodeCodecMismatch)
+	_, err = NewMutableTree(reference.ndb.db, 0, false, NewNopLogger(), NodeCodecOption(testNodeCodec{})).Load()
+	require.ErrorIs(t, err, ErrNodeCodecMismatch)
+}
+
+func TestMutableTree_VerifyVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	r := mrand.New(mrand.NewSource(1))
+	for version := 1; version <= 5; version++ {
+		for i := 0; i < 200; i++ {
+			_, err := tree.Set([]byte(strconv.Itoa(r.Intn(500))), iavlrand.RandBytes(8))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	_, err := tree.Set([]byte("unsaved"), []byte("value"))
+	require.NoError(t, err)
+
+	for _, workers := range []int{1, 2, 8} {
+		for version := int64(1); version <= 5; version++ {
+			require.NoError(t, tree.VerifyVersionParallel(version, workers))
+		}
+	}
+	require.ErrorIs(t, tree.VerifyVersion(6), ErrVersionDoesNotExist)
+	require.Error(t, tree.VerifyVersionParallel(5, 0))
+
+	// corrupt a leaf value and, separately, an inner node size of the latest version
+	nodes, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	var leaf, inner *Node
+	for _, node := range nodes {
+		if node.nodeKey.version != 5 {
+			continue
+		}
+		if node.isLeaf() && leaf == nil {
+			leaf = node
+		}
+		if !node.isLeaf() && node.nodeKey.nonce != 1 && inner == nil {
+			inner = node
+		}
+	}
+	require.NotNil(t, leaf)
+	require.NotNil(t, inner)
+
+	corruptedLeaf, corruptedInner := *leaf, *inner
+	corruptedLeaf.value = []byte("corrupted")
+	corruptedInner.size++
+	for _, corrupted := range []*Node{&corruptedLeaf, &corruptedInner} {
+		original, err := db.Get(tree.ndb.nodeKey(corrupted.GetKey()))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, corrupted.writeBytes(&buf))
+		require.NoError(t, db.Set(tree.ndb.nodeKey(corrupted.GetKey()), buf.Bytes()))
+
+		// read the nodes from the db without the cache
+		reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+		_, err = reloaded.Load()
+		require.NoError(t, err)
+		require.ErrorIs(t, reloaded.VerifyVersion(5), ErrCorruptedVersion)
+		require.ErrorIs(t, reloaded.VerifyVersionParallel(5, 4), ErrCorruptedVersion)
+		require.NoError(t, reloaded.VerifyVersionParallel(1, 4))
+
+		require.NoError(t, db.Set(tree.ndb.nodeKey(corrupted.GetKey()), original))
+	}
+}
+
+func BenchmarkMutableTree_VerifyVersion(b *testing.B) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 100000; i++ {
+		_, err := tree.Set(iavlrand.RandBytes(10), iavlrand.RandBytes(32))
+		require.NoError(b, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(b, err)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, tree.VerifyVersionParallel(version, workers))
+			}
+		})
+	}
+}
+
+func TestMutableTree_OnCommit(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+
+	type commit struct {
+		version int64
+		hash    []byte
+	}
+	var commits []commit
+	var order []int
+	tree.OnCommit(func(version int64, rootHash []byte) {
+		order = append(order, 1)
+		commits = append(commits, commit{version, rootHash})
+	})
+	tree.OnCommit(func(int64, []byte) {
+		order = append(order, 2)
+		panic("callback failure")
+	})
+	tree.OnCommit(func(int64, []byte) {
+		order = append(order, 3)
+	})
+
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	hash1, version1, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	hash2, version2, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.Equal(t, []commit{{version1, hash1}, {version2, hash2}}, commits)
+	require.Equal(t, []int{1, 2, 3, 1, 2, 3}, order)
+
+	// the panic did not affect the tree
+	require.Equal(t, hash2, tree.Hash())
+	value, err := tree.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+
+	// the callbacks are not invoked when the commit fails
+	conflicting := NewMutableTree(db, 0, false, NewNopLogger())
+	conflicting.OnCommit(func(int64, []byte) {
+		t.Fatal("callback invoked on a failed commit")
+	})
+	_, err = conflicting.Set([]byte("c"), []byte("3"))
+	require.NoError(t, err)
+	_, _, err = conflicting.SaveVersion()
+	require.Error(t, err)
+}
+
+func TestMutableTree_OnVersionSaved(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+
+	type save struct {
+		version int64
+		hash    []byte
+		changes *ChangeSet
+	}
+	var saves []save
+	tree.OnVersionSaved(func(version int64, rootHash []byte, changes *ChangeSet) {
+		saves = append(saves, save{version, rootHash, changes})
+	})
+
+	_, err := tree.Set([]byte("b"), []byte("1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	hash1, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("2"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("c"), []byte("3"))
+	require.NoError(t, err)
+	hash2, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// a version without changes is saved too
+	hash3, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.Equal(t, []save{
+		{1, hash1, &ChangeSet{Pairs: []*KVPair{
+			{Key: []byte("a"), Value: []byte("1")},
+			{Key: []byte("b"), Value: []byte("1")},
+		}}},
+		{2, hash2, &ChangeSet{Pairs: []*KVPair{
+			{Key: []byte("a"), Value: []byte("2")},
+			{Key: []byte("b"), Delete: true},
+			{Key: []byte("c"), Value: []byte("3")},
+		}}},
+		{3, hash3, &ChangeSet{}},
+	}, saves)
+
+	// a key added and removed again, or written again with the same value, is not a change
+	_, err = tree.Set([]byte("x"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("x"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("2"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("c"), []byte("4"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Len(t, saves, 4)
+	require.Equal(t, &ChangeSet{Pairs: []*KVPair{
+		{Key: []byte("c"), Value: []byte("4")},
+	}}, saves[3].changes)
+
+	// the callback does not fire when the save fails or is a no-op
+	conflicting := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = conflicting.LoadVersion(1)
+	require.NoError(t, err)
+	conflicting.OnVersionSaved(func(int64, []byte, *ChangeSet) {
+		t.Fatal("callback invoked on a failed or no-op save")
+	})
+	_, err = conflicting.Set([]byte("d"), []byte("4"))
+	require.NoError(t, err)
+	_, _, err = conflicting.SaveVersion()
+	require.Error(t, err)
+
+	resaved := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = resaved.LoadVersion(1)
+	require.NoError(t, err)
+	resaved.OnVersionSaved(func(int64, []byte, *ChangeSet) {
+		t.Fatal("callback invoked on a failed or no-op save")
+	})
+	_, err = resaved.Set([]byte("a"), []byte("2"))
+	require.NoError(t, err)
+	_, _, err = resaved.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, err = resaved.Set([]byte("c"), []byte("3"))
+	require.NoError(t, err)
+	hash, _, err := resaved.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, hash2, hash)
+}
+
+func TestMutableTree_OnVersionSavedSkipFastStorage(t *testing.T) {
+	// the changes are reported without the fast storage too
+	tree := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	var changes []*ChangeSet
+	tree.OnVersionSaved(func(_ int64, _ []byte, c *ChangeSet) {
+		changes = append(changes, c)
+	})
+	for _, key := range []string{"c", "a", "b"} {
+		_, err := tree.Set([]byte(key), []byte("1"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	// discarded changes are not reported
+	_, err = tree.Set([]byte("d"), []byte("4"))
+	require.NoError(t, err)
+	tree.Rollback()
+	_, _, err = tree.Remove([]byte("c"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.Equal(t, []*ChangeSet{
+		{Pairs: []*KVPair{
+			{Key: []byte("a"), Value: []byte("1")},
+			{Key: []byte("b"), Value: []byte("1")},
+			{Key: []byte("c"), Value: []byte("1")},
+		}},
+		{Pairs: []*KVPair{
+			{Key: []byte("c"), Delete: true},
+		}},
+	}, changes)
+}
+
+func TestMutableTree_GetImmutableLazy(t *testing.T) {
+	db := &readCountingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for i := 0; i < 10000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	reopened := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = reopened.Load()
+	require.NoError(t, err)
+
+	// only the root entry and the root node are read
+	db.reads = 0
+	itree, err := reopened.GetImmutable(version)
+	require.NoError(t, err)
+	require.LessOrEqual(t, db.reads, 3)
+
+	// a Get reads the nodes on the path to the key below the root, and nothing else
+	for _, i := range []int{0, 4321, 9999} {
+		key := []byte(fmt.Sprintf("k%05d", i))
+		path, err := itree.PathTo(key)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(path)-1, int(itree.Height()))
+
+		db.reads = 0
+		value, err := itree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("v%d", i), string(value))
+		require.Equal(t, len(path)-1, db.reads, "key %s", key)
+	}
+}
+
+func TestMutableTree_GetImmutableOrEarlier(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, _, err := tree.GetImmutableOrEarlier(1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	hashes := map[int64][]byte{}
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	require.NoError(t, tree.DeleteVersionsTo(4))
+
+	// available versions are returned as is
+	for version := int64(5); version <= 10; version++ {
+		itree, got, err := tree.GetImmutableOrEarlier(version)
+		require.NoError(t, err)
+		require.Equal(t, version, got)
+		require.Equal(t, hashes[version], itree.Hash())
+	}
+
+	// later versions fall back to the latest one
+	itree, got, err := tree.GetImmutableOrEarlier(42)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), got)
+	require.Equal(t, hashes[10], itree.Hash())
+
+	// there is no version before the pruned ones
+	for _, version := range []int64{0, 1, 4} {
+		_, _, err = tree.GetImmutableOrEarlier(version)
+		require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	}
+}
+
+func TestMutableTree_HideVersions(t *testing.T) {
+	newTree := func(db *dbm.MemDB) *MutableTree {
+		tree := NewMutableTree(db, 0, false, NewNopLogger())
+		_, err := tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+	populate := func(tree *MutableTree) {
+		r := mrand.New(mrand.NewSource(7))
+		for i := 0; i < 10; i++ {
+			for j := 0; j < 20; j++ {
+				_, err := tree.Set([]byte{byte(r.Intn(50))}, []byte{byte(i), byte(j)})
+				require.NoError(t, err)
+			}
+			if i%3 == 0 {
+				_, _, err := tree.Remove([]byte{byte(r.Intn(50))})
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	dump := func(db *dbm.MemDB) map[string]string {
+		res := map[string]string{}
+		iter, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			if metadataKeyFormat.Prefix() == string(iter.Key()[:1]) {
+				continue
+			}
+			res[string(iter.Key())] = string(iter.Value())
+		}
+		return res
+	}
+
+	db := dbm.NewMemDB()
+	tree := newTree(db)
+	populate(tree)
+	before := dump(db)
+
+	require.Error(t, tree.HideVersions(5, 10))
+	require.Error(t, tree.HideVersions(3, 2))
+	require.NoError(t, tree.HideVersions(1, 3))
+	require.NoError(t, tree.HideVersions(6, 7))
+
+	// the hidden versions are unavailable right away, but their nodes are kept
+	for _, version := range []int64{1, 2, 3, 6, 7} {
+		_, err := tree.GetImmutable(version)
+		require.ErrorIs(t, err, ErrVersionPruned)
+		require.False(t, tree.VersionExists(version))
+	}
+	require.Equal(t, []int{4, 5, 8, 9, 10}, tree.AvailableVersions())
+	require.Equal(t, before, dump(db))
+
+	// and stay hidden when the tree is reopened
+	tree = newTree(db)
+	require.Equal(t, []int{4, 5, 8, 9, 10}, tree.AvailableVersions())
+	_, err := tree.LoadVersion(6)
+	require.ErrorIs(t, err, ErrVersionPruned)
+	tree = newTree(db)
+
+	// only the hidden versions following the first version are reclaimed
+	require.NoError(t, tree.ReclaimHidden())
+	firstVersion, err := tree.ndb.getFirstVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), firstVersion)
+	require.Equal(t, []int{4, 5, 8, 9, 10}, tree.AvailableVersions())
+
+	refDB := dbm.NewMemDB()
+	ref := newTree(refDB)
+	populate(ref)
+	require.NoError(t, ref.DeleteVersionsTo(3))
+	require.Equal(t, dump(refDB), dump(db))
+
+	require.NoError(t, tree.HideVersions(4, 5))
+	require.NoError(t, tree.ReclaimHidden())
+	firstVersion, err = tree.ndb.getFirstVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(8), firstVersion)
+	require.Equal(t, []int{8, 9, 10}, tree.AvailableVersions())
+	hidden, err := tree.ndb.getHiddenVersions()
+	require.NoError(t, err)
+	require.Empty(t, hidden)
+
+	require.NoError(t, ref.DeleteVersionsTo(7))
+	require.Equal(t, dump(refDB), dump(db))
+	for version := int64(8); version <= 10; version++ {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		refTree, err := ref.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, refTree.Hash(), itree.Hash())
+	}
+}
+
+func TestMutableTree_KeepLatestOnly(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), UndoVersionsOption(3), OrphanIndexOption(true), MinRetainVersionsOption(5))
+	require.NoError(t, tree.KeepLatestOnly())
+	for v := 0; v < 10; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%02d", (v*7+i)%50)), []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.HideVersions(2, 3))
+	hash := tree.Hash()
+	size := tree.Size()
+
+	require.NoError(t, tree.KeepLatestOnly())
+	require.Equal(t, []int{10}, tree.AvailableVersions())
+	_, err := tree.ReconstructVersion(9)
+	require.ErrorIs(t, err, ErrChangesNotRecorded)
+
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reopened.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), version)
+	require.Equal(t, hash, reopened.Hash())
+	require.NoError(t, reopened.VerifyVersion(10))
+	hidden, err := reopened.ndb.getHiddenVersions()
+	require.NoError(t, err)
+	require.Empty(t, hidden)
+
+	// only the nodes of the latest version and its checksum are left beside the metadata and the
+	// fast nodes
+	var manifest bytes.Buffer
+	require.NoError(t, reopened.WriteVersionManifest(10, &manifest))
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(manifest.String()), "\n") {
+		listed[strings.Fields(line)[1]] = true
+	}
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	var nodes int64
+	for ; itr.Valid(); itr.Next() {
+		switch itr.Key()[0] {
+		case 'm', 'f':
+		default:
+			require.True(t, listed[hex.EncodeToString(itr.Key())], "key %X", itr.Key())
+			if itr.Key()[0] == 's' {
+				nodes++
+			}
+		}
+	}
+	require.Equal(t, 2*size-1, nodes)
+
+	require.NoError(t, reopened.KeepLatestOnly())
+	require.Equal(t, []int{10}, reopened.AvailableVersions())
+}
+
+func TestMutableTree_SkipUnchangedVersions(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip=%v", skip), func(t *testing.T) {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), SkipUnchangedVersionsOption(skip))
+			var committed []int64
+			tree.OnCommit(func(version int64, _ []byte) {
+				committed = append(committed, version)
+			})
+
+			// the first version is always saved, even if empty
+			_, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, int64(1), version)
+
+			_, err = tree.Set([]byte("a"), []byte("1"))
+			require.NoError(t, err)
+			hash, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, int64(2), version)
+
+			// no mutations
+			unchangedHash, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, hash, unchangedHash)
+			if skip {
+				require.Equal(t, int64(2), version)
+				require.Equal(t, []int{1, 2}, tree.AvailableVersions())
+			} else {
+				require.Equal(t, int64(3), version)
+				require.Equal(t, []int{1, 2, 3}, tree.AvailableVersions())
+			}
+
+			// removing a missing key is no change either
+			_, removed, err := tree.Remove([]byte("b"))
+			require.NoError(t, err)
+			require.False(t, removed)
+			_, unchangedVersion, err := tree.SaveVersion()
+			require.NoError(t, err)
+			if skip {
+				require.Equal(t, version, unchangedVersion)
+			} else {
+				require.Equal(t, version+1, unchangedVersion)
+			}
+			version = unchangedVersion
+
+			// rewriting the same value creates new nodes, so it is a change
+			_, err = tree.Set([]byte("a"), []byte("1"))
+			require.NoError(t, err)
+			_, changedVersion, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, version+1, changedVersion)
+
+			_, err = tree.Set([]byte("b"), []byte("2"))
+			require.NoError(t, err)
+			changedHash, changedVersion, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, version+2, changedVersion)
+			require.NotEqual(t, hash, changedHash)
+
+			latest, err := tree.GetLatestVersion()
+			require.NoError(t, err)
+			require.Equal(t, changedVersion, latest)
+			require.Equal(t, latest, committed[len(committed)-1])
+			if skip {
+				require.Equal(t, []int64{1, 2, 3, 4}, committed)
+			} else {
+				require.Equal(t, []int64{1, 2, 3, 4, 5, 6}, committed)
+			}
+		})
+	}
+}
+
+// crashDB is a MemDB which only keeps the writes flushed with WriteSync across a simulated crash.
+type crashDB struct {
+	*dbm.MemDB
+	durable map[string][]byte
+}
+
+func newCrashDB() *crashDB {
+	return &crashDB{MemDB: dbm.NewMemDB(), durable: map[string][]byte{}}
+}
+
+func (db *crashDB) NewBatch() corestore.Batch {
+	return &crashBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+func (db *crashDB) NewBatchWithSize(size int) corestore.Batch {
+	return &crashBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+// crash returns the db as it is after a restart, with the writes which were not synced lost.
+func (db *crashDB) crash() *crashDB {
+	restarted := newCrashDB()
+	for key, value := range db.durable {
+		restarted.durable[key] = value
+		if err := restarted.MemDB.Set([]byte(key), value); err != nil {
+			panic(err)
+		}
+	}
+	return restarted
+}
+
+type crashBatch struct {
+	corestore.Batch
+	db *crashDB
+}
+
+func (b *crashBatch) WriteSync() error {
+	if err := b.Batch.Write(); err != nil {
+		return err
+	}
+	// an fsync flushes all the previous writes too
+	b.db.durable = map[string][]byte{}
+	itr, err := b.db.MemDB.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		b.db.durable[string(itr.Key())] = itr.Value()
+	}
+	return nil
+}
+
+func TestMutableTree_SaveVersionSync(t *testing.T) {
+	for _, syncOpt := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sync=%v", syncOpt), func(t *testing.T) {
+			db := newCrashDB()
+			tree := NewMutableTree(db, 0, false, NewNopLogger(), SyncOption(syncOpt))
+			_, err := tree.Set([]byte("a"), []byte("1"))
+			require.NoError(t, err)
+			syncedHash, _, err := tree.SaveVersionSync()
+			require.NoError(t, err)
+
+			_, err = tree.Set([]byte("b"), []byte("2"))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersionNoSync()
+			require.NoError(t, err)
+
+			_, err = tree.Set([]byte("c"), []byte("3"))
+			require.NoError(t, err)
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			// the default SaveVersion follows the Sync option, and flushes the unsynced
+			// version along with its own
+			restarted := NewMutableTree(db.crash(), 0, false, NewNopLogger())
+			version, err := restarted.Load()
+			require.NoError(t, err)
+			if syncOpt {
+				require.Equal(t, int64(3), version)
+				require.Equal(t, hash, restarted.Hash())
+			} else {
+				require.Equal(t, int64(1), version)
+				require.Equal(t, syncedHash, restarted.Hash())
+				value, err := restarted.Get([]byte("b"))
+				require.NoError(t, err)
+				require.Nil(t, value)
+			}
+		})
+	}
+}
+
+// gatedFlushDB is a MemDB holding the writes of the batches which record the storage version,
+// i.e. the background fast node flushes, while gate is locked.
+type gatedFlushDB struct {
+	*dbm.MemDB
+	gate sync.Mutex
+}
+
+func (db *gatedFlushDB) NewBatch() corestore.Batch {
+	return &gatedFlushBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+func (db *gatedFlushDB) NewBatchWithSize(size int) corestore.Batch {
+	return &gatedFlushBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type gatedFlushBatch struct {
+	corestore.Batch
+	db    *gatedFlushDB
+	gated bool
+}
+
+func (b *gatedFlushBatch) Set(key, value []byte) error {
+	if bytes.Equal(key, metadataKeyFormat.Key([]byte(storageVersionKey))) {
+		b.gated = true
+	}
+	return b.Batch.Set(key, value)
+}
+
+func (b *gatedFlushBatch) Write() error {
+	if b.gated {
+		b.db.gate.Lock()
+		defer b.db.gate.Unlock()
+	}
+	return b.Batch.Write()
+}
+
+func TestMutableTree_EnableAsyncFastNodeFlush(t *testing.T) {
+	db := &gatedFlushDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+	tree.EnableAsyncFastNodeFlush()
+
+	iterated := func() []string {
+		var keys []string
+		_, err := tree.Iterate(func(key, value []byte) bool {
+			keys = append(keys, string(key)+"="+string(value))
+			return false
+		})
+		require.NoError(t, err)
+		return keys
+	}
+	hasFastNode := func(key string) bool {
+		has, err := db.MemDB.Has(FastNodeDBKey([]byte(key)))
+		require.NoError(t, err)
+		return has
+	}
+
+	// hold the background flush
+	db.gate.Lock()
+	for _, key := range []string{"a", "b"} {
+		_, err := tree.Set([]byte(key), []byte("v"+key))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("c"), []byte("vc"))
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the pending changes are visible, but not written yet
+	require.False(t, hasFastNode("b"))
+	require.False(t, hasFastNode("c"))
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.False(t, enabled)
+	value, err := tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	value, err = tree.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("vc"), value)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	value, err = itree.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("vb"), value)
+	value, err = tree.GetVersioned([]byte("a"), version-1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("va"), value)
+	require.Equal(t, []string{"b=vb", "c=vc"}, iterated())
+
+	db.gate.Unlock()
+	require.NoError(t, tree.FlushFastNodes())
+	require.False(t, hasFastNode("a"))
+	require.True(t, hasFastNode("b"))
+	require.True(t, hasFastNode("c"))
+	enabled, err = tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	require.Equal(t, []string{"b=vb", "c=vc"}, iterated())
+
+	// a stop before the flush leaves a stale fast node index, which is rebuilt on load
+	db.gate.Lock()
+	_, err = tree.Set([]byte("d"), []byte("vd"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.False(t, hasFastNode("d"))
+
+	restarted := NewMutableTree(db.MemDB, 0, false, NewNopLogger())
+	_, err = restarted.Load()
+	require.NoError(t, err)
+	require.True(t, hasFastNode("d"))
+	enabled, err = restarted.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	value, err = restarted.Get([]byte("d"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("vd"), value)
+
+	db.gate.Unlock()
+	require.NoError(t, tree.Close())
+}
+
+func TestMutableTree_GetImmutableRelative(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.GetImmutableRelative(0)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	hashes := map[int64][]byte{}
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	require.NoError(t, tree.DeleteVersionsTo(4))
+
+	for offset := int64(0); offset >= -5; offset-- {
+		itree, err := tree.GetImmutableRelative(offset)
+		require.NoError(t, err)
+		require.Equal(t, 10+offset, itree.Version())
+		require.Equal(t, hashes[10+offset], itree.Hash())
+	}
+
+	// the pruned versions
+	for _, offset := range []int64{-6, -9} {
+		_, err = tree.GetImmutableRelative(offset)
+		require.ErrorIs(t, err, ErrVersionPruned)
+	}
+	// before the first version ever saved
+	_, err = tree.GetImmutableRelative(-10)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.GetImmutableRelative(1)
+	require.Error(t, err)
+
+	// the hidden versions
+	require.NoError(t, tree.HideVersions(6, 7))
+	_, err = tree.GetImmutableRelative(-3)
+	require.ErrorIs(t, err, ErrVersionPruned)
+	itree, err := tree.GetImmutableRelative(-2)
+	require.NoError(t, err)
+	require.Equal(t, int64(8), itree.Version())
+
+	// the versions before the initial version were never saved
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), InitialVersionOption(5))
+	for i := 0; i < 3; i++ {
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(5))
+	_, err = tree.GetImmutableRelative(-2)
+	require.ErrorIs(t, err, ErrVersionPruned)
+	_, err = tree.GetImmutableRelative(-3)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_WarmCache(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// a restarted tree has cold caches
+	stats := &Statistics{}
+	tree = NewMutableTree(db, 10000, false, NewNopLogger(), StatOption(stats))
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	hot := [][]byte{[]byte("key-0001"), []byte("key-0500"), []byte("key-0999"), []byte("missing")}
+	require.NoError(t, tree.WarmCache(hot))
+	require.NotZero(t, stats.GetCacheMissCnt())
+	require.NotZero(t, stats.GetFastCacheMissCnt())
+
+	stats.Reset()
+	for _, key := range hot {
+		_, _, err := tree.GetWithIndex(key)
+		require.NoError(t, err)
+		_, err = tree.Get(key)
+		require.NoError(t, err)
+	}
+	require.Zero(t, stats.GetCacheMissCnt())
+	require.NotZero(t, stats.GetCacheHitCnt())
+	require.Equal(t, uint64(3), stats.GetFastCacheHitCnt())
+	// the fast node of a missing key is not cached
+	require.Equal(t, uint64(1), stats.GetFastCacheMissCnt())
+
+	// cold keys still miss
+	_, _, err = tree.GetWithIndex([]byte("key-0250"))
+	require.NoError(t, err)
+	require.NotZero(t, stats.GetCacheMissCnt())
+
+	_, err = tree.Set([]byte("key-1000"), []byte("value"))
+	require.NoError(t, err)
+	require.NoError(t, tree.WarmCache(nil))
+	require.ErrorIs(t, tree.WarmCache([][]byte{nil}), ErrKeyEmpty)
+}
+
+func TestMutableTree_IsDirty(t *testing.T) {
+	tree := getTestTree(0)
+	require.False(t, tree.IsDirty())
+
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	require.True(t, tree.IsDirty())
+	hash := tree.WorkingHash()
+	require.False(t, tree.IsDirty())
+	// the memoized hash is returned without recomputing it
+	require.Same(t, &hash[0], &tree.WorkingHash()[0])
+
+	// an edit only invalidates the hashes on the path of the key
+	_, err := tree.Set([]byte("k042"), []byte("changed"))
+	require.NoError(t, err)
+	require.True(t, tree.IsDirty())
+	var unhashed func(node *Node) int
+	unhashed = func(node *Node) int {
+		if node == nil {
+			return 0
+		}
+		n := unhashed(node.leftNode) + unhashed(node.rightNode)
+		if node.hash == nil {
+			n++
+		}
+		return n
+	}
+	require.LessOrEqual(t, unhashed(tree.root), int(tree.root.subtreeHeight)+1)
+	require.NotEqual(t, hash, tree.WorkingHash())
+	require.False(t, tree.IsDirty())
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.False(t, tree.IsDirty())
+}
+
+func TestMutableTree_ReplaceAll(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("old"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the new content overlaps the old one on k025..k049
+	pairs := dbm.NewMemDB()
+	for i := 25; i < 125; i++ {
+		require.NoError(t, pairs.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("new%d", i))))
+	}
+	itr, err := pairs.Iterator(nil, nil)
+	require.NoError(t, err)
+	hash, version, err := tree.ReplaceAll(itr)
+	require.NoError(t, err)
+	require.NoError(t, itr.Close())
+	require.Equal(t, int64(2), version)
+	require.Equal(t, tree.Hash(), hash)
+	require.Equal(t, int64(100), tree.Size())
+	require.Equal(t, int8(7), tree.Height())
+
+	// the fast nodes are replaced along with the tree, as seen after reloading
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	isFastCacheEnabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, isFastCacheEnabled)
+	for i := 0; i < 125; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		value, err := tree.Get(key)
+		require.NoError(t, err)
+		if i < 25 {
+			require.Nil(t, value)
+		} else {
+			require.Equal(t, []byte(fmt.Sprintf("new%d", i)), value)
+		}
+	}
+	count := 0
+	_, err = tree.Iterate(func(_, _ []byte) bool {
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, 100, count)
+
+	// the previous version stays readable until pruned
+	value, err := tree.GetVersioned([]byte("k000"), 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), value)
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	value, err = tree.Get([]byte("k100"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new100"), value)
+
+	// unordered keys are rejected
+	require.NoError(t, pairs.Set([]byte("k200"), []byte("v")))
+	itr, err = pairs.ReverseIterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	_, _, err = tree.ReplaceAll(itr)
+	require.Error(t, err)
+}
+
+func TestMutableTree_SaveVersionDetailed(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	stats, err := tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Version)
+	require.Equal(t, tree.Hash(), stats.Hash)
+	require.Equal(t, 19, stats.NodesWritten)
+	require.Equal(t, 0, stats.NodesOrphaned)
+	require.Positive(t, stats.BytesWritten)
+
+	// updating a key replaces the nodes on its path
+	_, err = tree.Set([]byte("k3"), []byte("updated"))
+	require.NoError(t, err)
+	stats, err = tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats.Version)
+	require.Positive(t, stats.NodesWritten)
+	require.LessOrEqual(t, stats.NodesWritten, int(tree.Height())+1)
+	require.Equal(t, stats.NodesWritten, stats.NodesOrphaned)
+
+	// removing a key orphans its leaf and parent too
+	_, _, err = tree.Remove([]byte("k9"))
+	require.NoError(t, err)
+	stats, err = tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.Equal(t, stats.NodesWritten+2, stats.NodesOrphaned)
+
+	// a version without changes writes no nodes
+	stats, err = tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), stats.Version)
+	require.Equal(t, 0, stats.NodesWritten)
+	require.Equal(t, 0, stats.NodesOrphaned)
+
+	// the counts match the orphans found by comparing the versions, including when the new root
+	// is a saved node or the tree is emptied
+	r := mrand.New(mrand.NewSource(0))
+	for i := 0; i < 50; i++ {
+		for j := r.Intn(5); j >= 0; j-- {
+			key := []byte(fmt.Sprintf("k%d", r.Intn(12)))
+			if r.Intn(2) == 0 {
+				_, _, err = tree.Remove(key)
+			} else {
+				_, err = tree.Set(key, []byte(fmt.Sprintf("v%d", r.Int())))
+			}
+			require.NoError(t, err)
+		}
+		stats, err = tree.SaveVersionDetailed()
+		require.NoError(t, err)
+		orphaned := 0
+		require.NoError(t, tree.ndb.traverseOrphans(stats.Version-1, stats.Version, func(*Node) error {
+			orphaned++
+			return nil
+		}))
+		require.Equal(t, orphaned, stats.NodesOrphaned, "version %d", stats.Version)
+	}
+
+	// emptying the tree orphans all its nodes
+	size := tree.Size()
+	for i := 0; i < 12; i++ {
+		_, _, err = tree.Remove([]byte(fmt.Sprintf("k%d", i)))
+		require.NoError(t, err)
+	}
+	stats, err = tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.Equal(t, int(2*size-1), stats.NodesOrphaned)
+}
+
+func TestMutableTree_ValidateFastCache(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("k05"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.ValidateFastCache())
+
+	// unsaved changes are not part of the validated version
+	_, err = tree.Set([]byte("k99"), []byte{99})
+	require.NoError(t, err)
+	require.NoError(t, tree.ValidateFastCache())
+
+	save := func(node *fastnode.Node) {
+		require.NoError(t, tree.ndb.SaveFastNodeNoCache(node))
+		require.NoError(t, tree.ndb.Commit())
+	}
+	save(fastnode.NewNode([]byte("k03"), []byte{100}, 2))
+	err = tree.ValidateFastCache()
+	require.ErrorIs(t, err, ErrFastCacheMismatch)
+	require.Contains(t, err.Error(), "has value")
+
+	save(fastnode.NewNode([]byte("k03"), []byte{3}, 1))
+	save(fastnode.NewNode([]byte("k05"), []byte{5}, 1))
+	err = tree.ValidateFastCache()
+	require.ErrorIs(t, err, ErrFastCacheMismatch)
+	require.Contains(t, err.Error(), "is not in version")
+
+	require.NoError(t, tree.ndb.DeleteFastNode([]byte("k05")))
+	require.NoError(t, tree.ndb.DeleteFastNode([]byte("k19")))
+	require.NoError(t, tree.ndb.Commit())
+	err = tree.ValidateFastCache()
+	require.ErrorIs(t, err, ErrFastCacheMismatch)
+	require.Contains(t, err.Error(), "has no fast node")
+}
+
+func TestMutableTree_VersionChecksum(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// the root of version 2 refers to the one of version 1
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("k3"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for version := int64(1); version <= 3; version++ {
+		_, err = NewMutableTree(db, 0, false, NewNopLogger()).LoadVersion(version)
+		require.NoError(t, err, "version %d", version)
+	}
+
+	// flip the stored root hash of version 3
+	root, err := tree.ndb.GetNode(GetRootKey(3))
+	require.NoError(t, err)
+	root.hash[0] ^= 0xff
+	require.NoError(t, tree.ndb.SaveNode(root))
+	require.NoError(t, tree.ndb.Commit())
+
+	_, err = NewMutableTree(db, 0, false, NewNopLogger()).Load()
+	require.ErrorIs(t, err, ErrVersionMetadataCorrupt)
+	_, err = NewMutableTree(db, 0, false, NewNopLogger()).LoadVersion(2)
+	require.NoError(t, err)
+
+	// the checksums are deleted along with the versions
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	checksum, err := db.Get(checksumKeyFormat.Key(int64(1)))
+	require.NoError(t, err)
+	require.Nil(t, checksum)
+	require.NoError(t, tree.DeleteVersionsFrom(3))
+	checksum, err = db.Get(checksumKeyFormat.Key(int64(3)))
+	require.NoError(t, err)
+	require.Nil(t, checksum)
+}
+
+func TestMutableTree_VersionsIdentical(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// version 2 has no changes
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	identical, err := tree.VersionsIdentical(1, 2)
+	require.NoError(t, err)
+	require.True(t, identical)
+	identical, err = tree.VersionsIdentical(3, 3)
+	require.NoError(t, err)
+	require.True(t, identical)
+	identical, err = tree.VersionsIdentical(2, 3)
+	require.NoError(t, err)
+	require.False(t, identical)
+
+	_, err = tree.VersionsIdentical(3, 4)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_FastStore(t *testing.T) {
+	countPrefix := func(db corestore.KVStoreWithBatch, prefix []byte) int {
+		itr, err := db.Iterator(prefix, ibytes.CpIncr(prefix))
+		require.NoError(t, err)
+		defer itr.Close()
+		n := 0
+		for ; itr.Valid(); itr.Next() {
+			n++
+		}
+		return n
+	}
+
+	nodeDB, fastDB := dbm.NewMemDB(), dbm.NewMemDB()
+	tree := NewMutableTree(nodeDB, 0, false, NewNopLogger(), FastStoreOption(fastDB))
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("k00"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the fast nodes and the storage version are in the fast store only
+	storageVersion := metadataKeyFormat.Key([]byte(storageVersionKey))
+	require.Equal(t, 19, countPrefix(fastDB, fastKeyFormat.Key()))
+	require.Zero(t, countPrefix(nodeDB, fastKeyFormat.Key()))
+	has, err := nodeDB.Has(storageVersion)
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = fastDB.Has(storageVersion)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// reloaded, the fast nodes are used as they are
+	tree = NewMutableTree(nodeDB, 0, false, NewNopLogger(), FastStoreOption(fastDB))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	require.NoError(t, tree.ValidateFastCache())
+	value, err := tree.Get([]byte("k05"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v5"), value)
+
+	// with an empty fast store, the fast nodes are rebuilt into it
+	emptyDB := dbm.NewMemDB()
+	tree = NewMutableTree(nodeDB, 0, false, NewNopLogger(), FastStoreOption(emptyDB))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, 19, countPrefix(emptyDB, fastKeyFormat.Key()))
+	require.Zero(t, countPrefix(nodeDB, fastKeyFormat.Key()))
+	require.NoError(t, tree.ValidateFastCache())
+}
+
+func TestMutableTree_CompareAndSwap(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	// an absent key is only set with a nil expected value
+	swapped, err := tree.CompareAndSwap([]byte("a"), []byte{1}, []byte{2})
+	require.NoError(t, err)
+	require.False(t, swapped)
+	require.False(t, tree.IsDirty())
+	swapped, err = tree.CompareAndSwap([]byte("a"), nil, []byte{1})
+	require.NoError(t, err)
+	require.True(t, swapped)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+
+	// a mismatching value leaves the tree untouched
+	swapped, err = tree.CompareAndSwap([]byte("a"), nil, []byte{3})
+	require.NoError(t, err)
+	require.False(t, swapped)
+	swapped, err = tree.CompareAndSwap([]byte("a"), []byte{2}, []byte{3})
+	require.NoError(t, err)
+	require.False(t, swapped)
+	require.False(t, tree.IsDirty())
+	require.Equal(t, hash, tree.WorkingHash())
+	value, err := tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+
+	// a matching value is swapped
+	swapped, err = tree.CompareAndSwap([]byte("a"), []byte{1}, []byte{3})
+	require.NoError(t, err)
+	require.True(t, swapped)
+	value, err = tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, value)
+
+	// an empty value exists, so it does not match a nil expected value
+	_, err = tree.Set([]byte("b"), []byte{})
+	require.NoError(t, err)
+	swapped, err = tree.CompareAndSwap([]byte("b"), nil, []byte{1})
+	require.NoError(t, err)
+	require.False(t, swapped)
+	swapped, err = tree.CompareAndSwap([]byte("b"), []byte{}, []byte{1})
+	require.NoError(t, err)
+	require.True(t, swapped)
+}
+
+func TestMutableTree_GetHistory(t *testing.T) {
+	tree := setupMutableTree(false)
+	r := mrand.New(mrand.NewSource(7))
+
+	// the keys 10 to 29 are written, so 00 and 99 stay outside of the span of the keys
+	keys := []string{"00", "12", "15", "99"}
+	for version := 1; version <= 60; version++ {
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("%02d", 10+r.Intn(20))
+			if r.Intn(4) == 0 {
+				_, _, err := tree.Remove([]byte(key))
+				require.NoError(t, err)
+			} else {
+				_, err := tree.Set([]byte(key), []byte{byte(r.Intn(3))})
+				require.NoError(t, err)
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	for _, key := range keys {
+		for _, span := range [][2]int64{{1, 60}, {20, 40}, {35, 35}} {
+			history, err := tree.GetHistory([]byte(key), span[0], span[1])
+			require.NoError(t, err)
+
+			// the history must match the values read version by version
+			var expected []VersionedValue
+			var prev []byte
+			for version := int64(1); version <= span[1]; version++ {
+				value, err := tree.GetVersioned([]byte(key), version)
+				require.NoError(t, err)
+				switch {
+				case value != nil && (prev == nil || !bytes.Equal(value, prev)):
+					expected = append(expected, VersionedValue{Version: version, Value: value})
+				case value == nil && prev != nil:
+					expected = append(expected, VersionedValue{Version: version})
+				}
+				prev = value
+			}
+			// drop what precedes the value held at the start of the range
+			for len(expected) > 1 && expected[1].Version <= span[0] {
+				expected = expected[1:]
+			}
+			if len(expected) > 0 && expected[0].Value == nil && expected[0].Version <= span[0] {
+				expected = expected[1:]
+			}
+			if len(expected) == 0 {
+				expected = nil
+			}
+			require.Equal(t, expected, history, "key %s from %d to %d", key, span[0], span[1])
+		}
+	}
+
+	history, err := tree.GetHistory([]byte("00"), 1, 60)
+	require.NoError(t, err)
+	require.Empty(t, history)
+	_, err = tree.GetHistory([]byte("12"), 5, 4)
+	require.Error(t, err)
+}
+
+func TestMutableTree_GetKeyHistory(t *testing.T) {
+	tree := setupMutableTree(false)
+	r := mrand.New(mrand.NewSource(7))
+	for version := 1; version <= 60; version++ {
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("%02d", 10+r.Intn(20))
+			if r.Intn(4) == 0 {
+				_, _, err := tree.Remove([]byte(key))
+				require.NoError(t, err)
+			} else {
+				_, err := tree.Set([]byte(key), []byte{byte(r.Intn(3))})
+				require.NoError(t, err)
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	all := make([]int64, 0, 60)
+	for version := int64(1); version <= 60; version++ {
+		all = append(all, version)
+	}
+	for _, key := range []string{"00", "12", "15", "99"} {
+		for _, versions := range [][]int64{all, {60, 3, 17, 17, 42}, {1}, nil} {
+			values, err := tree.GetKeyHistory([]byte(key), versions)
+			require.NoError(t, err)
+
+			// the values must match the ones read version by version
+			expected := make(map[int64][]byte)
+			for _, version := range versions {
+				value, err := tree.GetVersioned([]byte(key), version)
+				require.NoError(t, err)
+				if value != nil {
+					expected[version] = value
+				}
+			}
+			require.Equal(t, expected, values, "key %s at versions %v", key, versions)
+		}
+	}
+
+	_, err := tree.GetKeyHistory([]byte("12"), []int64{5, 61})
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.NoError(t, tree.DeleteVersionsTo(10))
+	_, err = tree.GetKeyHistory([]byte("12"), []int64{5, 20})
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.GetKeyHistory(nil, []int64{20})
+	require.Error(t, err)
+}
+
+// setOrderDB records the keys set in its batches, in order.
+type setOrderDB struct {
+	*dbm.MemDB
+	keys []string
+}
+
+func (db *setOrderDB) NewBatch() corestore.Batch {
+	return &setOrderBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+func (db *setOrderDB) NewBatchWithSize(size int) corestore.Batch {
+	return &setOrderBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type setOrderBatch struct {
+	corestore.Batch
+	db *setOrderDB
+}
+
+func (b *setOrderBatch) Set(key, value []byte) error {
+	b.db.keys = append(b.db.keys, string(key))
+	return b.Batch.Set(key, value)
+}
+
+func TestMutableTree_SaveVersionWithBatchOrder(t *testing.T) {
+	// the staged writes precede the root, so a flush of the batch midway through the commit cannot
+	// persist the version without them
+	db := &setOrderDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), FlushThresholdOption(256))
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersionWithBatch(func(batch corestore.Batch) error {
+		return batch.Set([]byte("app/height"), []byte("1"))
+	})
+	require.NoError(t, err)
+	root := string(nodeKeyFormat.Key(GetRootKey(version)))
+	require.NotEqual(t, -1, slices.Index(db.keys, "app/height"))
+	require.Less(t, slices.Index(db.keys, "app/height"), slices.Index(db.keys, root))
+}
+
+func TestMutableTree_SaveVersionRecordsFailure(t *testing.T) {
+	db := &flushCountingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), UndoVersionsOption(2), EnableValueIndexOption(true))
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the version is committed, but writing its undo and value index records fails
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+	db.failAfter = db.flushes + 1
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+
+	// the tree still matches the committed version
+	require.Equal(t, int64(2), tree.Version())
+	require.Equal(t, hash, tree.Hash())
+	require.Equal(t, hash, tree.WorkingHash())
+	reopened := NewMutableTree(db.MemDB, 0, false, NewNopLogger())
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	require.Equal(t, hash, reopened.Hash())
+
+	// and the next version does not carry the changes of the previous one again
+	db.failAfter = 0
+	_, err = tree.Set([]byte("c"), []byte("3"))
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	itree, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	_, err = itree.Iterate(func(key, value []byte) bool {
+		require.Contains(t, []string{"a", "b", "c"}, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, itree.Size())
+}
+
+func TestMutableTree_SaveVersionWithBatch(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("k"), []byte("v1"))
+	require.NoError(t, err)
+
+	hash, version, err := tree.SaveVersionWithBatch(func(batch corestore.Batch) error {
+		key := []byte("app/height")
+		if err := batch.Set(key, []byte(strconv.FormatInt(tree.WorkingVersion(), 10))); err != nil {
+			return err
+		}
+		// the slices may be reused once added
+		key[0] = 'x'
+		require.Error(t, batch.Write())
+		return batch.Set([]byte("app/stale"), []byte("1"))
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, tree.Hash(), hash)
+	value, err := db.Get([]byte("app/height"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+
+	// a failing callback writes nothing and leaves the working tree as is
+	_, err = tree.Set([]byte("k"), []byte("v2"))
+	require.NoError(t, err)
+	workingHash := tree.WorkingHash()
+	errCallback := errors.New("callback failed")
+	_, _, err = tree.SaveVersionWithBatch(func(batch corestore.Batch) error {
+		require.NoError(t, batch.Set([]byte("app/height"), []byte("2")))
+		require.NoError(t, batch.Delete([]byte("app/stale")))
+		return errCallback
+	})
+	require.ErrorIs(t, err, errCallback)
+	require.Equal(t, int64(1), tree.Version())
+	require.False(t, tree.VersionExists(2))
+	require.Equal(t, workingHash, tree.WorkingHash())
+	value, err = db.Get([]byte("app/height"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	has, err := db.Has([]byte("app/stale"))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	_, version, err = tree.SaveVersionWithBatch(func(batch corestore.Batch) error {
+		require.NoError(t, batch.Set([]byte("app/height"), []byte("2")))
+		return batch.Delete([]byte("app/stale"))
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	value, err = tree.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+	value, err = db.Get([]byte("app/height"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	has, err = db.Has([]byte("app/stale"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// the writes are committed even if the version is unchanged and skipped
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), SkipUnchangedVersionsOption(true))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	_, version, err = tree.SaveVersionWithBatch(func(batch corestore.Batch) error {
+		return batch.Set([]byte("app/height"), []byte("3"))
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	value, err = db.Get([]byte("app/height"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 
 	"github.com/cosmos/iavl/cache"
 
@@ -72,6 +73,13 @@ type Node struct {
 	rightNode     *Node
 	subtreeHeight int8
 	isLegacy      bool
+	// pooled is set for the nodes taken from the node pool, see Options.UseNodePool. Such a node
+	// counts the references handed out by nodeDB.GetNode which are not released yet, and is put
+	// back into the pool once it is evicted from the node cache and no reference is left. The
+	// fields are guarded by the mutex of the nodeDB.
+	pooled  bool
+	refs    int32
+	evicted bool
 }
 
 var _ cache.Node = (*Node)(nil)
@@ -96,6 +104,26 @@ func (node *Node) GetKey() []byte {
 
 // MakeNode constructs an *Node from an encoded byte slice.
 func MakeNode(nk, buf []byte) (*Node, error) {
+	node, err := decodeNode(buf)
+	if err != nil {
+		return nil, err
+	}
+	node.nodeKey = GetNodeKey(nk)
+	if node.isLeaf() {
+		// ensure take the hash for the leaf node
+		node._hash(node.nodeKey.version)
+	}
+	return node, nil
+}
+
+// decodeNode decodes the node fields written by writeBytes, the caller is responsible for setting
+// the node key and the hash of leaf nodes.
+func decodeNode(buf []byte) (*Node, error) {
+	return decodeNodeInto(&Node{}, buf)
+}
+
+// decodeNodeInto is decodeNode, filling the given empty node.
+func decodeNodeInto(node *Node, buf []byte) (*Node, error) {
 	// Read node header (height, size, key).
 	height, n, err := encoding.DecodeVarint(buf)
 	if err != nil {
@@ -119,12 +147,9 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 	}
 	buf = buf[n:]
 
-	node := &Node{
-		subtreeHeight: height8,
-		size:          size,
-		nodeKey:       GetNodeKey(nk),
-		key:           key,
-	}
+	node.subtreeHeight = height8
+	node.size = size
+	node.key = key
 
 	// Read node body.
 	if node.isLeaf() {
@@ -133,8 +158,6 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 			return nil, fmt.Errorf("decoding node.value, %w", err)
 		}
 		node.value = val
-		// ensure take the hash for the leaf node
-		node._hash(node.nodeKey.version)
 	} else { // Read children.
 		node.hash, n, err = encoding.DecodeBytes(buf)
 		if err != nil {
@@ -345,6 +368,7 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 		if err != nil {
 			return false, err
 		}
+		defer node.releaseChild(t, leftNode)
 		return leftNode.has(t, key)
 	}
 
@@ -352,10 +376,46 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 	if err != nil {
 		return false, err
 	}
+	defer node.releaseChild(t, rightNode)
 
 	return rightNode.has(t, key)
 }
 
+// hasBatch sets found[i] for each index i of order whose key exists under the node. The indices
+// of order must be sorted by their keys, so each subtree is descended once for all its keys.
+func (node *Node) hasBatch(t *ImmutableTree, keys [][]byte, order []int, found []bool) error {
+	if node.isLeaf() {
+		for _, i := range order {
+			found[i] = bytes.Equal(keys[i], node.key)
+		}
+		return nil
+	}
+
+	// the keys lower than the node key are in the left subtree
+	split := sort.Search(len(order), func(j int) bool {
+		return bytes.Compare(keys[order[j]], node.key) >= 0
+	})
+	if split > 0 {
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		if err := leftNode.hasBatch(t, keys, order[:split], found); err != nil {
+			return err
+		}
+	}
+	if split < len(order) {
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		if err := rightNode.hasBatch(t, keys, order[split:], found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Get a key under the node.
 //
 // The index is the index in the list of leaf nodes sorted lexicographically by key. The leftmost leaf has index 0.
@@ -377,6 +437,7 @@ func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte,
 		if err != nil {
 			return 0, nil, err
 		}
+		defer node.releaseChild(t, leftNode)
 
 		return leftNode.get(t, key)
 	}
@@ -385,6 +446,7 @@ func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte,
 	if err != nil {
 		return 0, nil, err
 	}
+	defer node.releaseChild(t, rightNode)
 
 	index, value, err = rightNode.get(t, key)
 	if err != nil {
@@ -684,6 +746,14 @@ func (node *Node) getRightNode(t *ImmutableTree) (*Node, error) {
 	return rightNode, nil
 }
 
+// releaseChild releases the reference to a child node taken by getLeftNode or getRightNode, see
+// Options.UseNodePool, unless the child is held by the node itself.
+func (node *Node) releaseChild(t *ImmutableTree, child *Node) {
+	if child != node.leftNode && child != node.rightNode {
+		t.ndb.releaseNode(child)
+	}
+}
+
 // NOTE: mutates height and size
 func (node *Node) calcHeightAndSize(t *ImmutableTree) error {
 	leftNode, err := node.getLeftNode(t)
@@ -0,0 +1,214 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	corestore "cosmossdk.io/core/store"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// DefaultNodeCodecID is the format identifier of DefaultNodeCodec.
+const DefaultNodeCodecID = "iavl-v1"
+
+// ErrNodeCodecMismatch is returned when loading a tree whose nodes were written with a different
+// NodeCodec than the one configured.
+var ErrNodeCodecMismatch = errors.New("node codec does not match the one the db was written with")
+
+// NodeData holds the fields of a node which are persisted by a NodeCodec.
+type NodeData struct {
+	Height int8
+	Size   int64
+	Key    []byte
+	// Value is only set for leaf nodes.
+	Value []byte
+	// Hash, LeftNodeKey and RightNodeKey are only set for inner nodes, the hash of a leaf node is
+	// recomputed when it is loaded. A child node key is either a 12-byte node key, or the hash of
+	// the child if it is stored in the legacy format.
+	Hash         []byte
+	LeftNodeKey  []byte
+	RightNodeKey []byte
+}
+
+// NodeCodec serializes the nodes stored in the db. The codec of a db is recorded in its
+// metadata, and a tree refuses to load a db written with another codec. The node hashes do not
+// depend on the codec, so the same tree has the same root hash under any codec.
+//
+// Nodes in the legacy format are always decoded with the legacy encoding.
+type NodeCodec interface {
+	// ID returns the format identifier stored in the db metadata.
+	ID() string
+	// Encode writes the node to w. The encoded node must not start with the byte 's', which is
+	// reserved for the references of a root to the root of a previous version.
+	Encode(w io.Writer, node *NodeData) error
+	// Decode decodes a node written by Encode.
+	Decode(buf []byte) (*NodeData, error)
+}
+
+// DefaultNodeCodec is the encoding used by IAVL, made of varint and length-prefixed fields.
+type DefaultNodeCodec struct{}
+
+var _ NodeCodec = DefaultNodeCodec{}
+
+func (DefaultNodeCodec) ID() string { return DefaultNodeCodecID }
+
+func (DefaultNodeCodec) Encode(w io.Writer, node *NodeData) error {
+	return nodeFromData(node).writeBytes(w)
+}
+
+func (DefaultNodeCodec) Decode(buf []byte) (*NodeData, error) {
+	node, err := decodeNode(buf)
+	if err != nil {
+		return nil, err
+	}
+	return node.data(), nil
+}
+
+func (node *Node) data() *NodeData {
+	data := &NodeData{
+		Height: node.subtreeHeight,
+		Size:   node.size,
+		Key:    node.key,
+	}
+	if node.isLeaf() {
+		data.Value = node.value
+	} else {
+		data.Hash = node.hash
+		data.LeftNodeKey = node.leftNodeKey
+		data.RightNodeKey = node.rightNodeKey
+	}
+	return data
+}
+
+func nodeFromData(data *NodeData) *Node {
+	node := &Node{
+		subtreeHeight: data.Height,
+		size:          data.Size,
+		key:           data.Key,
+	}
+	if node.isLeaf() {
+		node.value = data.Value
+	} else {
+		node.hash = data.Hash
+		node.leftNodeKey = data.LeftNodeKey
+		node.rightNodeKey = data.RightNodeKey
+	}
+	return node
+}
+
+func (ndb *nodeDB) nodeCodec() NodeCodec {
+	if ndb.opts.NodeCodec == nil {
+		return DefaultNodeCodec{}
+	}
+	return ndb.opts.NodeCodec
+}
+
+// writeNodeBytes encodes the node with the codec of the db.
+func (ndb *nodeDB) writeNodeBytes(buf *bytes.Buffer, node *Node) error {
+	codec := ndb.nodeCodec()
+	if ndb.opts.DedupValues && node != nil && node.isLeaf() {
+		// the leaf refers to its value in the value store by its hash
+		data := node.data()
+		hash := sha256.Sum256(node.value)
+		data.Value = hash[:]
+		return codec.Encode(buf, data)
+	}
+	if _, ok := codec.(DefaultNodeCodec); ok {
+		buf.Grow(node.encodedSize())
+		return node.writeBytes(buf)
+	}
+	if node == nil {
+		return errors.New("cannot write nil node")
+	}
+	return codec.Encode(buf, node.data())
+}
+
+// makeNode decodes a node stored under the node key nk with the codec of the db.
+func (ndb *nodeDB) makeNode(nk, buf []byte) (*Node, error) {
+	codec := ndb.nodeCodec()
+	if _, ok := codec.(DefaultNodeCodec); ok && !ndb.opts.DedupValues {
+		if ndb.nodePool != nil {
+			return ndb.makePooledNode(nk, buf)
+		}
+		return MakeNode(nk, buf)
+	}
+	data, err := codec.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	if data.Height < 0 {
+		return nil, fmt.Errorf("invalid node height %d", data.Height)
+	}
+	node := nodeFromData(data)
+	node.nodeKey = GetNodeKey(nk)
+	if node.isLeaf() {
+		if ndb.opts.DedupValues {
+			if node.value, err = ndb.loadStoredValue(data.Value); err != nil {
+				return nil, err
+			}
+		}
+		node._hash(node.nodeKey.version)
+	} else if len(node.hash) != hashSize || !isChildNodeKey(node.leftNodeKey) || !isChildNodeKey(node.rightNodeKey) {
+		return nil, errors.New("invalid inner node, bad hash or child node keys")
+	}
+	return node, nil
+}
+
+// makePooledNode is MakeNode, decoding leaf nodes into a node taken from the node pool.
+func (ndb *nodeDB) makePooledNode(nk, buf []byte) (*Node, error) {
+	// inner nodes are held by traversals along their whole subtree, so they are not pooled
+	if height, _, err := encoding.DecodeVarint(buf); err != nil || height != 0 {
+		return MakeNode(nk, buf)
+	}
+	node, err := decodeNodeInto(ndb.nodePool.Get().(*Node), buf)
+	if err != nil {
+		return nil, err
+	}
+	*node.nodeKey = *GetNodeKey(nk)
+	// ensure take the hash for the leaf node
+	node._hash(node.nodeKey.version)
+	return node, nil
+}
+
+func isChildNodeKey(nk []byte) bool {
+	return len(nk) == int64Size+int32Size || len(nk) == hashSize
+}
+
+// checkNodeCodec returns ErrNodeCodecMismatch if the db was written with another codec. A db
+// without a recorded codec was written with DefaultNodeCodec, unless it is empty.
+func (ndb *nodeDB) checkNodeCodec(hasVersions bool) error {
+	stored, err := ndb.db.Get(metadataKeyFormat.Key([]byte(nodeCodecKey)))
+	if err != nil {
+		return err
+	}
+	id := ndb.nodeCodecID()
+	if stored == nil {
+		if hasVersions && id != DefaultNodeCodecID {
+			return fmt.Errorf("%w: db uses %s, configured %s", ErrNodeCodecMismatch, DefaultNodeCodecID, id)
+		}
+		return nil
+	}
+	if string(stored) != id {
+		return fmt.Errorf("%w: db uses %s, configured %s", ErrNodeCodecMismatch, stored, id)
+	}
+	ndb.nodeCodecStored = true
+	return nil
+}
+
+// writeNodeCodec records the codec in the db metadata, unless it is DefaultNodeCodec or it has
+// already been recorded.
+func (ndb *nodeDB) writeNodeCodec(batch corestore.Batch) error {
+	id := ndb.nodeCodecID()
+	if ndb.nodeCodecStored || id == DefaultNodeCodecID {
+		return nil
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(nodeCodecKey)), []byte(id)); err != nil {
+		return err
+	}
+	ndb.nodeCodecStored = true
+	return nil
+}
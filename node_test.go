@@ -3,13 +3,17 @@ package iavl
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
 	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	dbm "github.com/cosmos/iavl/db"
 	iavlrand "github.com/cosmos/iavl/internal/rand"
 )
 
@@ -113,6 +117,103 @@ func TestNode_encode_decode(t *testing.T) {
 	}
 }
 
+// testNodeCodec encodes the node fields with fixed-width integers and 4-byte length prefixes.
+type testNodeCodec struct{}
+
+func (testNodeCodec) ID() string { return "test-fixed" }
+
+func (testNodeCodec) Encode(w io.Writer, node *NodeData) error {
+	buf := []byte{'T', byte(node.Height)}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(node.Size))
+	for _, field := range [][]byte{node.Key, node.Value, node.Hash, node.LeftNodeKey, node.RightNodeKey} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func (testNodeCodec) Decode(buf []byte) (*NodeData, error) {
+	if len(buf) < 10 || buf[0] != 'T' {
+		return nil, errors.New("not a test node")
+	}
+	node := &NodeData{
+		Height: int8(buf[1]),
+		Size:   int64(binary.BigEndian.Uint64(buf[2:])),
+	}
+	buf = buf[10:]
+	for _, field := range []*[]byte{&node.Key, &node.Value, &node.Hash, &node.LeftNodeKey, &node.RightNodeKey} {
+		if len(buf) < 4 {
+			return nil, errors.New("truncated test node")
+		}
+		n := int(binary.BigEndian.Uint32(buf))
+		buf = buf[4:]
+		if len(buf) < n {
+			return nil, errors.New("truncated test node")
+		}
+		if n > 0 {
+			*field = buf[:n]
+		}
+		buf = buf[n:]
+	}
+	return node, nil
+}
+
+func TestNode_NodeCodec(t *testing.T) {
+	childNodeKey := &NodeKey{version: 1, nonce: 1}
+	hash := sha256.Sum256([]byte("hash"))
+	leaf := &Node{
+		key:     []byte("key"),
+		value:   []byte("value"),
+		size:    1,
+		nodeKey: &NodeKey{version: 3, nonce: 1},
+	}
+	leaf._hash(leaf.nodeKey.version)
+	nodes := map[string]*Node{
+		"leaf": leaf,
+		"inner": {
+			subtreeHeight: 3,
+			size:          7,
+			key:           []byte("key"),
+			nodeKey:       &NodeKey{version: 2, nonce: 1},
+			leftNodeKey:   childNodeKey.GetKey(),
+			rightNodeKey:  childNodeKey.GetKey(),
+			hash:          hash[:],
+		},
+		"inner hybrid": {
+			subtreeHeight: 3,
+			size:          7,
+			key:           []byte("key"),
+			nodeKey:       &NodeKey{version: 2, nonce: 1},
+			leftNodeKey:   childNodeKey.GetKey(),
+			rightNodeKey:  hash[:],
+			hash:          hash[:],
+		},
+	}
+
+	for _, codec := range []NodeCodec{DefaultNodeCodec{}, testNodeCodec{}} {
+		ndb := newNodeDB(dbm.NewMemDB(), 0, Options{NodeCodec: codec}, NewNopLogger())
+		for name, node := range nodes {
+			t.Run(codec.ID()+"/"+name, func(t *testing.T) {
+				var buf bytes.Buffer
+				require.NoError(t, ndb.writeNodeBytes(&buf, node))
+				decoded, err := ndb.makeNode(node.GetKey(), buf.Bytes())
+				require.NoError(t, err)
+				require.Equal(t, node, decoded)
+
+				// the codec does not affect the encoding by writeBytes
+				data, err := codec.Decode(buf.Bytes())
+				require.NoError(t, err)
+				var defaultBuf bytes.Buffer
+				require.NoError(t, node.writeBytes(&defaultBuf))
+				var dataBuf bytes.Buffer
+				require.NoError(t, DefaultNodeCodec{}.Encode(&dataBuf, data))
+				require.Equal(t, defaultBuf.Bytes(), dataBuf.Bytes())
+			})
+		}
+	}
+}
+
 func TestNode_validate(t *testing.T) {
 	k := []byte("key")
 	v := []byte("value")
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -27,6 +29,9 @@ const (
 	hashSize          = sha256.Size
 	genesisVersion    = 1
 	storageVersionKey = "storage_version"
+	nodeCodecKey      = "node_codec"
+	hiddenVersionsKey = "hidden_versions"
+	valueIndexKey     = "value_index_version"
 	// We store latest saved version together with storage version delimited by the constant below.
 	// This delimiter is valid only if fast storage is enabled (i.e. storageVersion >= fastStorageVersionValue).
 	// The latest saved version is needed for protection against downgrade and re-upgrade. In such a case, it would
@@ -59,6 +64,42 @@ var (
 	// decide how to parse.
 	metadataKeyFormat = keyformat.NewKeyFormat('m', 0) // m<keystring>
 
+	// Key Format for the expiry index of keys set with MutableTree.SetWithExpiry.
+	// The value at an entry is the version at which the expiry was saved.
+	expiryKeyFormat = keyformat.NewKeyFormat('e', int64Size, 0) // e<expiry-version><keystring>
+
+	// Key Format for the expiry hints of keys set with MutableTree.SetWithExpiryHint, which are
+	// only recorded and never applied. The value at an entry is as for expiryKeyFormat.
+	expiryHintKeyFormat = keyformat.NewKeyFormat('h', int64Size, 0) // h<expiry-version><keystring>
+
+	// Key Format for the value store of the leaves, see Options.DedupValues.
+	// The value at an entry is the number of leaves referring to it, followed by the value.
+	valueKeyFormat = keyformat.NewKeyFormat('v', hashSize) // v<value-hash>
+
+	// Key Format for the checksums of the versions, see versionChecksum.
+	checksumKeyFormat = keyformat.NewKeyFormat('c', int64Size) // c<version>
+
+	// Key Format for the recorded changes of the versions, see Options.UndoVersions.
+	// The entry with an empty node key holds the previous version and its root, the others hold
+	// the nodes of the previous version orphaned by the version.
+	undoKeyFormat = keyformat.NewKeyFormat('u', int64Size, 0) // u<version><node-key>
+
+	// Key Format for the orphan index, see Options.OrphanIndex.
+	// The value at an entry is the list of db keys of the nodes deleted when pruning the version.
+	orphanIndexKeyFormat = keyformat.NewKeyFormat('p', int64Size) // p<version>
+
+	// Key Format for the annotations of the versions, see MutableTree.SaveVersionWithAnnotation.
+	// The value at an entry is the annotation.
+	annotationKeyFormat = keyformat.NewKeyFormat('a', int64Size) // a<version>
+
+	// Key Format for the versions skipped by ImportDelta and ImportAllVersions, which are not
+	// stored. The value at an entry is the previous stored version, varint encoded.
+	skippedKeyFormat = keyformat.NewKeyFormat('g', int64Size) // g<version>
+
+	// Key Format for the value index, see Options.EnableValueIndex.
+	// The value at an entry is empty.
+	valueIndexKeyFormat = keyformat.NewKeyFormat('x', hashSize, 0) // x<value-hash><keystring>
+
 	// All legacy node keys are prefixed with the byte 'n'.
 	legacyNodeKeyFormat = keyformat.NewFastPrefixFormatter('n', hashSize) // n<hash>
 
@@ -80,21 +121,54 @@ type nodeDB struct {
 	done                chan struct{}              // Channel to signal that the pruning process is done.
 	db                  corestore.KVStoreWithBatch // Persistent node storage.
 	batch               corestore.Batch            // Batched writing buffer.
+	fastDB              corestore.KVStoreWithBatch // Storage of the fast nodes, db unless Options.FastStore is set.
+	fastBatch           corestore.Batch            // Batched writing buffer of the fast nodes, batch unless Options.FastStore is set.
 	opts                Options                    // Options to customize for pruning/writing
 	versionReaders      map[int64]uint32           // Number of active version readers
 	storageVersion      string                     // Storage version
 	firstVersion        int64                      // First version of nodeDB.
 	latestVersion       int64                      // Latest version of nodeDB.
+	latestSize          int64                      // Number of leaves of the latest version loaded or saved by the tree, see MutableTree.CollectMetrics.
 	pruneVersion        int64                      // Version to prune up to.
 	legacyLatestVersion int64                      // Latest version of nodeDB in legacy format.
 	nodeCache           cache.Cache                // Cache for nodes in the regular tree that consists of key-value pairs at any version.
+	valueCache          cache.Cache                // Cache for the values of the leaf nodes, if cached apart from the nodes, see Options.ValueCacheSize.
 	fastNodeCache       cache.Cache                // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
 	isCommitting        bool                       // Flag to indicate that the nodeDB is committing.
 	chCommitting        chan struct{}              // Channel to signal that the committing is done.
+	nodeCodecStored     bool                       // Flag to indicate that the node codec is recorded in the metadata.
+	hiddenVersions      versionRanges              // Versions hidden by MutableTree.HideVersions, loaded lazily.
+	hiddenLoaded        bool                       // Flag to indicate that hiddenVersions is loaded.
+	skippedVersions     versionRanges              // Versions skipped by ImportDelta and ImportAllVersions, loaded lazily.
+	skippedLoaded       bool                       // Flag to indicate that skippedVersions is loaded.
+	nodePool            *sync.Pool                 // Pool of the nodes read from the db, if Options.UseNodePool is set.
+	fastFlusher         *fastNodeFlusher           // Background writer of the fast nodes, if enabled with MutableTree.EnableAsyncFastNodeFlush.
+	storedValues        map[string]*storedValue    // Entries of the value store changed since the last commit, if Options.DedupValues is set.
+	compactor           dbCompactor                // Backend compaction, if supported by db, see Options.AutoCompactThreshold.
+	pruned              prunedRange                // Entries deleted by pruning since the last commit, if auto compacting.
+	prunedCommitted     prunedRange                // Entries deleted by pruning, committed since the last compaction, if auto compacting.
 }
 
 func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Logger) *nodeDB {
-	storeVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
+	fastDB := db
+	if opts.FastStore != nil {
+		fastDB = opts.FastStore
+	}
+	compactor, _ := db.(dbCompactor)
+	batchBytes := opts.FlushThreshold
+	if opts.MaxBatchBytes > 0 {
+		batchBytes = opts.MaxBatchBytes
+	}
+	if opts.RetryPolicy != nil {
+		db = newRetryDB(db, opts.RetryPolicy)
+		if opts.FastStore != nil {
+			fastDB = newRetryDB(fastDB, opts.RetryPolicy)
+		} else {
+			fastDB = db
+		}
+	}
+	// the storage version records the version the fast nodes match, so it is kept with them
+	storeVersion, err := fastDB.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
 
 	if err != nil || storeVersion == nil {
 		storeVersion = []byte(defaultStorageVersionValue)
@@ -106,7 +180,8 @@ func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Lo
 		cancel:              cancel,
 		logger:              lg,
 		db:                  db,
-		batch:               NewBatchWithFlusher(db, opts.FlushThreshold),
+		batch:               NewBatchWithFlusher(db, batchBytes),
+		fastDB:              fastDB,
 		opts:                opts,
 		firstVersion:        0,
 		latestVersion:       0, // initially invalid
@@ -117,6 +192,29 @@ func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Lo
 		versionReaders:      make(map[int64]uint32, 8),
 		storageVersion:      string(storeVersion),
 		chCommitting:        make(chan struct{}, 1),
+		storedValues:        make(map[string]*storedValue),
+		compactor:           compactor,
+	}
+
+	ndb.fastBatch = ndb.batch
+	if opts.FastStore != nil {
+		ndb.fastBatch = NewBatchWithFlusher(fastDB, batchBytes)
+	}
+
+	if opts.ValueCacheSize > 0 {
+		ndb.valueCache = cache.New(opts.ValueCacheSize)
+	}
+
+	if opts.WeakNodeCacheSize > 0 {
+		ndb.nodeCache = cache.NewWeak[Node](cacheSize, opts.WeakNodeCacheSize)
+	}
+
+	if opts.UseNodePool && opts.WeakNodeCacheSize == 0 {
+		ndb.nodePool = &sync.Pool{
+			New: func() any {
+				return &Node{nodeKey: &NodeKey{}, pooled: true}
+			},
+		}
 	}
 
 	if opts.AsyncPruning {
@@ -141,13 +239,136 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 
 	// Check the cache.
 	if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
-		ndb.opts.Stat.IncCacheHitCnt()
-		return cachedNode.(*Node), nil
+		node := cachedNode.(*Node)
+		if ndb.valueCache == nil || !node.isLeaf() {
+			ndb.opts.Stat.IncCacheHitCnt()
+			ndb.acquireNode(node)
+			return node, nil
+		}
+		if value := ndb.valueCache.Get(nk); value != nil {
+			ndb.opts.Stat.IncCacheHitCnt()
+			leaf := *node
+			leaf.value = value.(*cachedValue).value
+			return &leaf, nil
+		}
 	}
 
 	ndb.opts.Stat.IncCacheMissCnt()
 
 	// Doesn't exist, load.
+	node, err := ndb.readNode(nk)
+	if err != nil {
+		return nil, err
+	}
+
+	ndb.cacheNode(node)
+	ndb.acquireNode(node)
+
+	return node, nil
+}
+
+// cachedValue is the value of a leaf in the value cache, keyed by the key of the leaf node.
+type cachedValue struct {
+	key   []byte
+	value []byte
+}
+
+func (v *cachedValue) GetKey() []byte {
+	return v.key
+}
+
+// cacheNode adds the node to the node cache. If the values are cached apart, a leaf is cached
+// without its value, which goes to the value cache, so that the node given is left untouched.
+func (ndb *nodeDB) cacheNode(node *Node) {
+	if ndb.valueCache == nil || !node.isLeaf() {
+		evicted := ndb.nodeCache.Add(node)
+		ndb.reportEviction(node, evicted)
+		ndb.recycleNode(node, evicted)
+		return
+	}
+	leaf := *node
+	leaf.value, leaf.pooled = nil, false
+	evicted := ndb.nodeCache.Add(&leaf)
+	ndb.reportEviction(&leaf, evicted)
+	ndb.recycleNode(&leaf, evicted)
+	ndb.valueCache.Add(&cachedValue{key: node.GetKey(), value: node.value})
+}
+
+// reportEviction calls Options.OnEvict with the db key of the node evicted from the cache while
+// adding the given node, if any.
+func (ndb *nodeDB) reportEviction(added *Node, evicted cache.Node) {
+	if ndb.opts.OnEvict == nil || evicted == nil {
+		return
+	}
+	node := evicted.(*Node)
+	// a node replaced by another one with the same key is not evicted
+	if bytes.Equal(added.GetKey(), node.GetKey()) {
+		return
+	}
+	if node.isLegacy {
+		ndb.opts.OnEvict(ndb.legacyNodeKey(node.GetKey()))
+		return
+	}
+	ndb.opts.OnEvict(ndb.nodeKey(node.GetKey()))
+}
+
+// recycleNode marks the node evicted from the cache while adding the given node as evicted, if it
+// comes from the node pool, and puts it back into the pool if no reference to it is left.
+func (ndb *nodeDB) recycleNode(added *Node, evicted cache.Node) {
+	if ndb.nodePool == nil || evicted == nil {
+		return
+	}
+	node := evicted.(*Node)
+	if !node.pooled {
+		return
+	}
+	// a node replaced by another one with the same key is not evicted
+	if added.nodeKey != nil && *added.nodeKey == *node.nodeKey {
+		return
+	}
+	node.evicted = true
+	ndb.putPooledNode(node)
+}
+
+// acquireNode counts a reference to the node handed out by GetNode, if it comes from the node
+// pool. The references which are never released keep the node out of the pool for good, e.g. the
+// ones held by tree roots, working nodes and iterators.
+func (ndb *nodeDB) acquireNode(node *Node) {
+	if node.pooled {
+		node.refs++
+	}
+}
+
+// releaseNode releases a reference to the node acquired with GetNode, once the caller no longer
+// uses it.
+func (ndb *nodeDB) releaseNode(node *Node) {
+	if ndb == nil || ndb.nodePool == nil {
+		return
+	}
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if node.pooled {
+		node.refs--
+		ndb.putPooledNode(node)
+	}
+}
+
+// putPooledNode puts the node back into the node pool if it has been evicted from the cache and
+// no reference to it is left.
+func (ndb *nodeDB) putPooledNode(node *Node) {
+	if !node.evicted || node.refs > 0 {
+		return
+	}
+	nk := node.nodeKey
+	*node = Node{nodeKey: nk, pooled: true}
+	ndb.nodePool.Put(node)
+}
+
+// readNode reads a node from disk, bypassing the cache.
+func (ndb *nodeDB) readNode(nk []byte) (*Node, error) {
+	if !isChildNodeKey(nk) {
+		return nil, fmt.Errorf("invalid node key %X", nk)
+	}
 	isLegcyNode := len(nk) == hashSize
 	var nodeKey []byte
 	if isLegcyNode {
@@ -157,7 +378,7 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 	}
 	buf, err := ndb.db.Get(nodeKey)
 	if err != nil {
-		return nil, fmt.Errorf("can't get node %v: %v", nk, err)
+		return nil, fmt.Errorf("can't get node %v: %w", nk, err)
 	}
 	if buf == nil && !isLegcyNode {
 		// if the node is reformatted by pruning, check against (version, 0)
@@ -169,7 +390,7 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 			}).GetKey())
 			buf, err = ndb.db.Get(nodeKey)
 			if err != nil {
-				return nil, fmt.Errorf("can't get the reformatted node %v: %v", nk, err)
+				return nil, fmt.Errorf("can't get the reformatted node %v: %w", nk, err)
 			}
 		}
 	}
@@ -177,24 +398,47 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 		return nil, fmt.Errorf("Value missing for key %v corresponding to nodeKey %x", nk, nodeKey)
 	}
 
-	var node *Node
-	if isLegcyNode {
-		node, err = MakeLegacyNode(nk, buf)
-		if err != nil {
-			return nil, fmt.Errorf("error reading Legacy Node. bytes: %x, error: %v", buf, err)
+	node, err := ndb.decodeStoredNode(nk, buf)
+	if err != nil {
+		return nil, ndb.corruptNode(nodeKey, buf, err)
+	}
+	return node, nil
+}
+
+// decodeStoredNode decodes the bytes of the node with the given node key read from the db. It
+// returns an error instead of panicking on malformed bytes, e.g. a custom codec indexing past the
+// end of its input.
+func (ndb *nodeDB) decodeStoredNode(nk, buf []byte) (node *Node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			node, err = nil, fmt.Errorf("panic decoding the node: %v", r)
 		}
-	} else {
-		node, err = MakeNode(nk, buf)
-		if err != nil {
-			return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+	}()
+	if len(nk) == hashSize {
+		if node, err = MakeLegacyNode(nk, buf); err != nil {
+			return nil, fmt.Errorf("error reading Legacy Node. bytes: %x, error: %v", buf, err)
 		}
+	} else if node, err = ndb.makeNode(nk, buf); err != nil {
+		return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+	}
+	if !node.isLeaf() && (!isChildNodeKey(node.leftNodeKey) || !isChildNodeKey(node.rightNodeKey)) {
+		return nil, fmt.Errorf("invalid child node keys %X and %X", node.leftNodeKey, node.rightNodeKey)
 	}
-
-	ndb.nodeCache.Add(node)
-
 	return node, nil
 }
 
+// corruptNode returns the error reading the node stored at the given db key, whose bytes cannot
+// be decoded, calling Options.OnCorruptNode if set.
+func (ndb *nodeDB) corruptNode(dbKey, raw []byte, cause error) error {
+	err := fmt.Errorf("%w: db key %X: %w", ErrCorruptNode, dbKey, cause)
+	if ndb.opts.OnCorruptNode != nil {
+		if hookErr := ndb.opts.OnCorruptNode(dbKey, raw, err); hookErr != nil {
+			return hookErr
+		}
+	}
+	return err
+}
+
 func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	if !ndb.hasUpgradedToFastStorage() {
 		return nil, errors.New("storage version is not fast")
@@ -207,6 +451,13 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 		return nil, errors.New("nodeDB.GetFastNode() requires key, len(key) equals 0")
 	}
 
+	if ndb.fastFlusher != nil {
+		// the pending changes are newer than the db, a nil node being a removal
+		if node, ok := ndb.fastFlusher.pending[string(key)]; ok {
+			return node, nil
+		}
+	}
+
 	if cachedFastNode := ndb.fastNodeCache.Get(key); cachedFastNode != nil {
 		ndb.opts.Stat.IncFastCacheHitCnt()
 		return cachedFastNode.(*fastnode.Node), nil
@@ -215,7 +466,7 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	ndb.opts.Stat.IncFastCacheMissCnt()
 
 	// Doesn't exist, load.
-	buf, err := ndb.db.Get(ndb.fastNodeKey(key))
+	buf, err := ndb.fastDB.Get(ndb.fastNodeKey(key))
 	if err != nil {
 		return nil, fmt.Errorf("can't get FastNode %X: %w", key, err)
 	}
@@ -242,18 +493,21 @@ func (ndb *nodeDB) SaveNode(node *Node) error {
 
 	// Save node bytes to db.
 	var buf bytes.Buffer
-	buf.Grow(node.encodedSize())
-
-	if err := node.writeBytes(&buf); err != nil {
+	if err := ndb.writeNodeBytes(&buf, node); err != nil {
 		return err
 	}
+	if ndb.opts.DedupValues && node.isLeaf() {
+		if err := ndb.retainValueUnlocked(ndb.batch, node.value); err != nil {
+			return err
+		}
+	}
 
 	if err := ndb.batch.Set(ndb.nodeKey(node.GetKey()), buf.Bytes()); err != nil {
 		return err
 	}
 
 	ndb.logger.Debug("BATCH SAVE", "node", node)
-	ndb.nodeCache.Add(node)
+	ndb.cacheNode(node)
 	return nil
 }
 
@@ -305,13 +559,43 @@ func (ndb *nodeDB) SetFastStorageVersionToBatch(latestVersion int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
+	newVersion, err := ndb.fastStorageVersionAt(latestVersion)
+	if err != nil {
+		return err
+	}
+	if err := ndb.fastBatch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
+		return err
+	}
+	ndb.storageVersion = newVersion
+	return nil
+}
+
+// invalidateFastStorageVersion adds a storage version matching no version of the tree to the fast
+// batch, ahead of the fast nodes of a commit. The batch may be flushed before the commit completes
+// when it exceeds MaxBatchBytes, so if the commit is interrupted, the fast nodes flushed so far are
+// detected as stale on the next load and upgraded again. The storage version written last by
+// SetFastStorageVersionToBatch overrides it.
+func (ndb *nodeDB) invalidateFastStorageVersion() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	invalid, err := ndb.fastStorageVersionAt(math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	return ndb.fastBatch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(invalid))
+}
+
+// fastStorageVersionAt returns the storage version recording that the fast nodes match the given
+// latest version. The caller must hold ndb.mtx.
+func (ndb *nodeDB) fastStorageVersionAt(latestVersion int64) (string, error) {
 	var newVersion string
 	if ndb.storageVersion >= fastStorageVersionValue {
 		// Storage version should be at index 0 and latest fast cache version at index 1
 		versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
 
 		if len(versions) > 2 {
-			return errInvalidFastStorageVersion
+			return "", errInvalidFastStorageVersion
 		}
 
 		newVersion = versions[0]
@@ -319,13 +603,7 @@ func (ndb *nodeDB) SetFastStorageVersionToBatch(latestVersion int64) error {
 		newVersion = fastStorageVersionValue
 	}
 
-	newVersion += fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion))
-
-	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
-		return err
-	}
-	ndb.storageVersion = newVersion
-	return nil
+	return newVersion + fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion)), nil
 }
 
 func (ndb *nodeDB) getStorageVersion() string {
@@ -371,7 +649,7 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bo
 		return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
 	}
 
-	if err := ndb.batch.Set(ndb.fastNodeKey(node.GetKey()), buf.Bytes()); err != nil {
+	if err := ndb.fastBatch.Set(ndb.fastNodeKey(node.GetKey()), buf.Bytes()); err != nil {
 		return fmt.Errorf("error while writing key/val to nodedb batch. Err: %w", err)
 	}
 	if shouldAddToCache {
@@ -394,7 +672,23 @@ func (ndb *nodeDB) deleteFromPruning(key []byte) error {
 
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
-	return ndb.batch.Delete(key)
+	if ndb.autoCompacting() {
+		if err := ndb.recordPruned(key); err != nil {
+			return err
+		}
+	}
+	if !ndb.opts.DedupValues || key[0] != nodeKeyFormat.Prefix()[0] {
+		return ndb.batch.Delete(key)
+	}
+	// the value of a deleted leaf loses a reference
+	bz, err := ndb.db.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := ndb.batch.Delete(key); err != nil {
+		return err
+	}
+	return ndb.releaseStoredLeafUnlocked(ndb.batch, bz)
 }
 
 // saveNodeFromPruning saves the orphan nodes to the pruning process.
@@ -409,10 +703,14 @@ func (ndb *nodeDB) saveNodeFromPruning(node *Node) error {
 
 	// Save node bytes to db.
 	var buf bytes.Buffer
-	buf.Grow(node.encodedSize())
-	if err := node.writeBytes(&buf); err != nil {
+	if err := ndb.writeNodeBytes(&buf, node); err != nil {
 		return err
 	}
+	if ndb.opts.DedupValues && node.isLeaf() {
+		if err := ndb.retainValueUnlocked(ndb.batch, node.value); err != nil {
+			return err
+		}
+	}
 	return ndb.batch.Set(ndb.nodeKey(node.GetKey()), buf.Bytes())
 }
 
@@ -457,7 +755,80 @@ func newRootkeyCache() *rootkeyCache {
 
 // deleteVersion deletes a tree version from disk.
 // deletes orphans
-func (ndb *nodeDB) deleteVersion(version int64, cache *rootkeyCache) error {
+func (ndb *nodeDB) deleteVersion(version int64, cache *rootkeyCache, ops *pruneOps) error {
+	return ndb.traverseVersionDeletions(version, cache, false, ops.delete, ops.save)
+}
+
+// maxPendingPruneOps is the number of pending db operations above which deleteVersionsTo applies
+// them, once the version being pruned is done.
+var maxPendingPruneOps = 100000
+
+// pruneOps coalesces the db operations of pruning consecutive versions. Only the last operation
+// on a key is kept, so a key deleted by several versions is deleted once, and a root reformatted
+// by a version and then deleted by a later one is never written.
+type pruneOps struct {
+	deletes map[string]struct{}
+	saves   map[string]*Node
+}
+
+func newPruneOps() *pruneOps {
+	return &pruneOps{
+		deletes: make(map[string]struct{}),
+		saves:   make(map[string]*Node),
+	}
+}
+
+func (ops *pruneOps) delete(key []byte) error {
+	delete(ops.saves, string(key))
+	ops.deletes[string(key)] = struct{}{}
+	return nil
+}
+
+func (ops *pruneOps) save(node *Node) error {
+	key := string(nodeKeyFormat.Key(node.GetKey()))
+	delete(ops.deletes, key)
+	ops.saves[key] = node
+	return nil
+}
+
+func (ops *pruneOps) len() int {
+	return len(ops.deletes) + len(ops.saves)
+}
+
+// applyPruneOps writes the pending operations to the batch in key order, and resets them.
+func (ndb *nodeDB) applyPruneOps(ops *pruneOps) error {
+	keys := make([]string, 0, len(ops.deletes))
+	for key := range ops.deletes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := ndb.deleteFromPruning([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	keys = keys[:0]
+	for key := range ops.saves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := ndb.saveNodeFromPruning(ops.saves[key]); err != nil {
+			return err
+		}
+	}
+
+	clear(ops.deletes)
+	clear(ops.saves)
+	return nil
+}
+
+// traverseVersionDeletions calls del with every db key deleted when pruning the given version.
+// Unless dryRun is set, it also applies the accompanying changes, i.e. the reformatting of the
+// roots referred to by other versions, which are passed to save, so del is expected to delete
+// the keys.
+func (ndb *nodeDB) traverseVersionDeletions(version int64, cache *rootkeyCache, dryRun bool, del func(key []byte) error, save func(node *Node) error) error {
 	rootKey, err := cache.getRootKey(ndb, version)
 	if err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
 		return err
@@ -466,58 +837,71 @@ func (ndb *nodeDB) deleteVersion(version int64, cache *rootkeyCache) error {
 	if errors.Is(err, ErrVersionDoesNotExist) {
 		ndb.logger.Error("Error while pruning, moving on the the next version in the store", "version missing", version, "next version", version+1, "err", err)
 	}
+	next := version + 1
+	if err == nil {
+		if next, err = ndb.nextVersion(version); err != nil {
+			return err
+		}
+	}
+
+	if err := del(checksumKeyFormat.Key(version)); err != nil {
+		return err
+	}
+	if err := del(annotationKeyFormat.Key(version)); err != nil {
+		return err
+	}
+	if err := del(skippedKeyFormat.Key(version)); err != nil {
+		return err
+	}
 
 	if rootKey != nil {
-		if err := ndb.traverseOrphansWithRootkeyCache(cache, version, version+1, func(orphan *Node) error {
-			if orphan.nodeKey.nonce == 0 && !orphan.isLegacy {
-				// if the orphan is a reformatted root, it can be a legacy root
-				// so it should be removed from the pruning process.
-				if err := ndb.deleteFromPruning(ndb.legacyNodeKey(orphan.hash)); err != nil {
+		keys, err := ndb.getOrphanIndex(version)
+		if err != nil {
+			return err
+		}
+		if keys != nil {
+			for _, key := range keys {
+				if err := del(key); err != nil {
 					return err
 				}
 			}
-			if orphan.nodeKey.nonce == 1 && orphan.nodeKey.version < version {
-				// if the orphan is referred to the previous root, it should be reformatted
-				// to (version, 0), because the root (version, 1) should be removed but not
-				// applied now due to the batch writing.
-				orphan.nodeKey.nonce = 0
-			}
-			nk := orphan.GetKey()
-			if orphan.isLegacy {
-				return ndb.deleteFromPruning(ndb.legacyNodeKey(nk))
-			}
-			return ndb.deleteFromPruning(ndb.nodeKey(nk))
-		}); err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
+		} else if err := ndb.traverseOrphanKeys(cache, version, next, dryRun, del); err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
 			return err
 		}
 	}
+	if err := del(orphanIndexKeyFormat.Key(version)); err != nil {
+		return err
+	}
 
 	literalRootKey := GetRootKey(version)
 	if rootKey == nil || !bytes.Equal(rootKey, literalRootKey) {
 		// if the root key is not matched with the literal root key, it means the given root
 		// is a reference root to the previous version.
-		if err := ndb.deleteFromPruning(ndb.nodeKey(literalRootKey)); err != nil {
+		if err := del(ndb.nodeKey(literalRootKey)); err != nil {
 			return err
 		}
 	}
 
 	// check if the version is referred by the next version
-	nextRootKey, err := cache.getRootKey(ndb, version+1)
+	nextRootKey, err := cache.getRootKey(ndb, next)
 	if err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
 		return err
 	}
 	if bytes.Equal(literalRootKey, nextRootKey) {
-		root, err := ndb.GetNode(nextRootKey)
-		if err != nil {
+		// ensure that the given version is not included in the root search
+		if err := del(ndb.nodeKey(literalRootKey)); err != nil {
 			return err
 		}
-		// ensure that the given version is not included in the root search
-		if err := ndb.deleteFromPruning(ndb.nodeKey(literalRootKey)); err != nil {
+		if dryRun {
+			return nil
+		}
+		root, err := ndb.GetNode(nextRootKey)
+		if err != nil {
 			return err
 		}
 		// instead, the root should be reformatted to (version, 0)
 		root.nodeKey.nonce = 0
-		if err := ndb.saveNodeFromPruning(root); err != nil {
+		if err := save(root); err != nil {
 			return err
 		}
 	}
@@ -525,6 +909,85 @@ func (ndb *nodeDB) deleteVersion(version int64, cache *rootkeyCache) error {
 	return nil
 }
 
+// traverseOrphanKeys calls del with the db key of every node of the given version orphaned by the
+// next stored version, next, i.e. deleted when pruning the given version. Unless dryRun is set,
+// the node keys of the orphaned roots are reformatted in place.
+func (ndb *nodeDB) traverseOrphanKeys(cache *rootkeyCache, version, next int64, dryRun bool, del func(key []byte) error) error {
+	return ndb.traverseOrphansWithRootkeyCache(cache, version, next, func(orphan *Node) error {
+		if orphan.nodeKey.nonce == 0 && !orphan.isLegacy {
+			// if the orphan is a reformatted root, it can be a legacy root
+			// so it should be removed from the pruning process.
+			if err := del(ndb.legacyNodeKey(orphan.hash)); err != nil {
+				return err
+			}
+		}
+		if orphan.isLegacy {
+			return del(ndb.legacyNodeKey(orphan.GetKey()))
+		}
+		nk := orphan.nodeKey
+		if nk.nonce == 1 && nk.version < version {
+			// if the orphan is referred to the previous root, it should be reformatted
+			// to (version, 0), because the root (version, 1) should be removed but not
+			// applied now due to the batch writing.
+			if dryRun {
+				nk = &NodeKey{version: nk.version, nonce: 0}
+			} else {
+				nk.nonce = 0
+			}
+		}
+		return del(ndb.nodeKey(nk.GetKey()))
+	})
+}
+
+// errStopTraversal is used to stop a traversal early from within its callback.
+var errStopTraversal = errors.New("traversal stopped")
+
+// orphansOfVersion calls fn with every db key deleted when pruning the given version, and the
+// size of its stored value, without deleting anything.
+func (ndb *nodeDB) orphansOfVersion(version int64, fn func(dbKey []byte, size int) bool) error {
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	if version <= legacyLatestVersion {
+		return fmt.Errorf("version %d is a legacy version, legacy versions are pruned at once", version)
+	}
+
+	_, latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latest <= version {
+		return fmt.Errorf("latest version %d is less than or equal to version %d", latest, version)
+	}
+	ok, err := ndb.hasVersion(version)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrVersionDoesNotExist
+	}
+
+	err = ndb.traverseVersionDeletions(version, newRootkeyCache(), true, func(key []byte) error {
+		value, err := ndb.db.Get(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			// nothing to delete, i.e. there is no legacy copy of a reformatted root
+			return nil
+		}
+		if fn(key, len(value)) {
+			return errStopTraversal
+		}
+		return nil
+	}, nil)
+	if errors.Is(err, errStopTraversal) {
+		return nil
+	}
+	return err
+}
+
 // deleteLegacyNodes deletes all legacy nodes with the given version from disk.
 // NOTE: This is only used for DeleteVersionsFrom.
 func (ndb *nodeDB) deleteLegacyNodes(version int64, nk []byte) error {
@@ -627,7 +1090,61 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 	}
 
 	// Delete the nodes for new format
-	if err = ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(fromVersion), nodeKeyPrefixFormat.KeyInt64(latest+1), func(k, _ []byte) error {
+	if err = ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(fromVersion), nodeKeyPrefixFormat.KeyInt64(latest+1), func(k, v []byte) error {
+		if err := ndb.batch.Delete(k); err != nil {
+			return err
+		}
+		if !ndb.opts.DedupValues {
+			return nil
+		}
+		ndb.mtx.Lock()
+		defer ndb.mtx.Unlock()
+		return ndb.releaseStoredLeafUnlocked(ndb.batch, v)
+	}); err != nil {
+		return err
+	}
+
+	// Delete the expiries saved by the deleted versions
+	if err = ndb.deleteExpiriesFrom(dumpFromVersion); err != nil {
+		return err
+	}
+
+	// Delete the checksums of the deleted versions
+	if err = ndb.traverseRange(checksumKeyFormat.Key(dumpFromVersion), checksumKeyFormat.Key(latest+1), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+
+	// Delete the annotations of the deleted versions
+	if err = ndb.traverseRange(annotationKeyFormat.Key(dumpFromVersion), annotationKeyFormat.Key(latest+1), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+
+	// Delete the versions skipped before the deleted versions
+	if err = ndb.traverseRange(skippedKeyFormat.Key(dumpFromVersion), skippedKeyFormat.Key(latest+1), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	ndb.updateSkippedVersions(func(skipped versionRanges) versionRanges {
+		return slices.DeleteFunc(slices.Clone(skipped), func(r versionRange) bool {
+			return r.to+1 >= dumpFromVersion
+		})
+	})
+
+	// Delete the recorded changes of the deleted versions
+	if err = ndb.traverseRange(undoKeyFormat.Key(dumpFromVersion), undoKeyFormat.Key(latest+1), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+
+	// Delete the orphan index entries of the deleted versions, and of the version before them,
+	// which is derived from the first deleted version
+	if err = ndb.traverseRange(orphanIndexKeyFormat.Key(dumpFromVersion-1), orphanIndexKeyFormat.Key(latest+1), func(k, _ []byte) error {
 		return ndb.batch.Delete(k)
 	}); err != nil {
 		return err
@@ -653,6 +1170,9 @@ func (ndb *nodeDB) startPruning() {
 			ndb.mtx.Unlock()
 
 			if toVersion == 0 {
+				if err := ndb.compactIfDue(); err != nil {
+					ndb.logger.Error("Error while compacting after pruning", "err", err)
+				}
 				time.Sleep(100 * time.Millisecond)
 				continue
 			}
@@ -737,12 +1257,22 @@ func (ndb *nodeDB) deleteVersionsTo(toVersion int64) error {
 		ndb.resetLegacyLatestVersion(-1)
 	}
 
+	// the deletions of consecutive versions are coalesced, and applied in key order
 	rootkeyCache := newRootkeyCache()
+	ops := newPruneOps()
 	for version := first; version <= toVersion; version++ {
-		if err := ndb.deleteVersion(version, rootkeyCache); err != nil {
+		if err := ndb.deleteVersion(version, rootkeyCache, ops); err != nil {
 			return err
 		}
-		ndb.resetFirstVersion(version + 1)
+		if ops.len() >= maxPendingPruneOps || version == toVersion {
+			if err := ndb.applyPruneOps(ops); err != nil {
+				return err
+			}
+			ndb.resetFirstVersion(version + 1)
+			ndb.updateSkippedVersions(func(skipped versionRanges) versionRanges {
+				return skipped.normalize(version + 1)
+			})
+		}
 	}
 
 	return nil
@@ -751,7 +1281,7 @@ func (ndb *nodeDB) deleteVersionsTo(toVersion int64) error {
 func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
-	if err := ndb.batch.Delete(ndb.fastNodeKey(key)); err != nil {
+	if err := ndb.fastBatch.Delete(ndb.fastNodeKey(key)); err != nil {
 		return err
 	}
 	ndb.fastNodeCache.Remove(key)
@@ -759,21 +1289,55 @@ func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 }
 
 func (ndb *nodeDB) nodeKey(nk []byte) []byte {
-	return nodeKeyFormat.Key(nk)
+	return NodeDBKey(nk)
 }
 
 func (ndb *nodeDB) fastNodeKey(key []byte) []byte {
-	return fastKeyFormat.KeyBytes(key)
+	return FastNodeDBKey(key)
 }
 
 func (ndb *nodeDB) legacyNodeKey(nk []byte) []byte {
-	return legacyNodeKeyFormat.Key(nk)
+	return LegacyNodeDBKey(nk)
 }
 
 func (ndb *nodeDB) legacyRootKey(version int64) []byte {
+	return LegacyRootDBKey(version)
+}
+
+// NodeDBKey returns the db key of the node with the given node key, as returned by
+// NodeKey.GetKey(). Nodes are keyed by their version and nonce, not by their hash.
+func NodeDBKey(nk []byte) []byte {
+	return nodeKeyFormat.Key(nk)
+}
+
+// RootDBKey returns the db key of the root of the given version. The value is either the root
+// node itself, or the node key of the root of a previous version when it did not change.
+func RootDBKey(version int64) []byte {
+	return NodeDBKey(GetRootKey(version))
+}
+
+// FastNodeDBKey returns the db key of the fast node of the given tree key.
+func FastNodeDBKey(key []byte) []byte {
+	return fastKeyFormat.KeyBytes(key)
+}
+
+// LegacyNodeDBKey returns the db key of the node with the given hash in the legacy format, where
+// nodes are keyed by their hash.
+func LegacyNodeDBKey(hash []byte) []byte {
+	return legacyNodeKeyFormat.Key(hash)
+}
+
+// LegacyRootDBKey returns the db key of the root of the given version in the legacy format.
+func LegacyRootDBKey(version int64) []byte {
 	return legacyRootKeyFormat.Key(version)
 }
 
+// LegacyOrphanDBKey returns the db key of an orphan record in the legacy format, for the node
+// with the given hash which was orphaned from toVersion and created at fromVersion.
+func LegacyOrphanDBKey(toVersion, fromVersion int64, hash []byte) []byte {
+	return legacyOrphanKeyFormat.Key(toVersion, fromVersion, hash)
+}
+
 // getFirstNonLegacyVersion binary searches the store for the first non-legacy version
 func (ndb *nodeDB) getFirstNonLegacyVersion() (int64, error) {
 	ndb.mtx.Lock()
@@ -787,7 +1351,7 @@ func (ndb *nodeDB) getFirstNonLegacyVersion() (int64, error) {
 	}
 	for firstVersion < latestVersion {
 		version := (latestVersion + firstVersion) >> 1
-		has, err := ndb.hasVersion(version)
+		has, err := ndb.hasVersionOrSkipped(version)
 		if err != nil {
 			return 0, err
 		}
@@ -797,6 +1361,9 @@ func (ndb *nodeDB) getFirstNonLegacyVersion() (int64, error) {
 			firstVersion = version + 1
 		}
 	}
+	if latestVersion, err = ndb.storedVersionFrom(latestVersion); err != nil {
+		return 0, err
+	}
 
 	ndb.resetFirstVersion(latestVersion)
 
@@ -831,7 +1398,7 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 	}
 	for firstVersion < latestVersion {
 		version := (latestVersion + firstVersion) >> 1
-		has, err := ndb.hasVersion(version)
+		has, err := ndb.hasVersionOrSkipped(version)
 		if err != nil {
 			return 0, err
 		}
@@ -841,6 +1408,9 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 			firstVersion = version + 1
 		}
 	}
+	if latestVersion, err = ndb.storedVersionFrom(latestVersion); err != nil {
+		return 0, err
+	}
 
 	ndb.resetFirstVersion(latestVersion)
 
@@ -904,28 +1474,15 @@ func (ndb *nodeDB) getLatestVersion() (bool, int64, error) {
 		return true, latestVersion, nil
 	}
 
-	itr, err := ndb.db.ReverseIterator(
-		nodeKeyPrefixFormat.KeyInt64(int64(1)),
-		nodeKeyPrefixFormat.KeyInt64(int64(math.MaxInt64)),
-	)
+	latestVersion, err := ndb.findLatestRootVersion()
 	if err != nil {
 		return false, 0, err
 	}
-	defer itr.Close()
-
-	if itr.Valid() {
-		k := itr.Key()
-		var nk []byte
-		nodeKeyFormat.Scan(k, &nk)
-		latestVersion = GetNodeKey(nk).version
+	if latestVersion > 0 {
 		ndb.resetLatestVersion(latestVersion)
 		return true, latestVersion, nil
 	}
 
-	if err := itr.Error(); err != nil {
-		return false, 0, err
-	}
-
 	// If there are no versions, try to get the latest version from the legacy format.
 	latestVersion, err = ndb.getLegacyLatestVersion()
 	if err != nil {
@@ -940,17 +1497,101 @@ func (ndb *nodeDB) getLatestVersion() (bool, int64, error) {
 	// return -1, nil
 }
 
+// findLatestRootVersion returns the highest version whose root is stored, or 0 if there is none.
+// The nodes of a version can be flushed before its root when the batch exceeds MaxBatchBytes, and
+// the root is written last, so the versions whose commit was interrupted are skipped.
+func (ndb *nodeDB) findLatestRootVersion() (int64, error) {
+	end := int64(math.MaxInt64)
+	for {
+		nk, err := ndb.findLatestNodeKey(end)
+		if err != nil || nk == nil {
+			return 0, err
+		}
+		// the root has the lowest nonce of its version
+		if nk.nonce == 1 {
+			return nk.version, nil
+		}
+		has, err := ndb.hasVersion(nk.version)
+		if err != nil {
+			return 0, err
+		}
+		if has {
+			return nk.version, nil
+		}
+		end = nk.version
+	}
+}
+
+// findLatestNodeKey returns the highest key of the nodes stored below version end, or nil if
+// there is none.
+func (ndb *nodeDB) findLatestNodeKey(end int64) (*NodeKey, error) {
+	itr, err := ndb.db.ReverseIterator(
+		nodeKeyPrefixFormat.KeyInt64(int64(1)),
+		nodeKeyPrefixFormat.KeyInt64(end),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	if itr.Valid() {
+		var nk []byte
+		nodeKeyFormat.Scan(itr.Key(), &nk)
+		return GetNodeKey(nk), nil
+	}
+	return nil, itr.Error()
+}
+
 func (ndb *nodeDB) resetLatestVersion(version int64) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 	ndb.latestVersion = version
 }
 
+func (ndb *nodeDB) resetLatestSize(size int64) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.latestSize = size
+}
+
 // hasVersion checks if the given version exists.
 func (ndb *nodeDB) hasVersion(version int64) (bool, error) {
 	return ndb.db.Has(nodeKeyFormat.Key(GetRootKey(version)))
 }
 
+// hasVersionOrSkipped checks if the given version exists, or was skipped by an import. The
+// versions from the first one to the latest one all do, which the searches of the first version
+// rely on.
+func (ndb *nodeDB) hasVersionOrSkipped(version int64) (bool, error) {
+	has, err := ndb.hasVersion(version)
+	if err != nil || has {
+		return has, err
+	}
+	skipped, err := ndb.getSkippedVersions()
+	return skipped.contains(version), err
+}
+
+// storedVersionFrom returns the given version, or the next stored version if it was skipped by an
+// import.
+func (ndb *nodeDB) storedVersionFrom(version int64) (int64, error) {
+	skipped, err := ndb.getSkippedVersions()
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range skipped {
+		if r.from <= version && version <= r.to {
+			return r.to + 1, nil
+		}
+	}
+	return version, nil
+}
+
+// nextVersion returns the version stored after the given stored version, which is version+1
+// unless the versions in between were skipped by an import.
+func (ndb *nodeDB) nextVersion(version int64) (int64, error) {
+	return ndb.storedVersionFrom(version + 1)
+}
+
 // hasLegacyVersion checks if the given version exists in the legacy format.
 func (ndb *nodeDB) hasLegacyVersion(version int64) (bool, error) {
 	return ndb.db.Has(ndb.legacyRootKey(version))
@@ -1027,9 +1668,110 @@ func (ndb *nodeDB) SaveRoot(version int64, nk *NodeKey) error {
 	return ndb.batch.Set(nodeKeyFormat.Key(GetRootKey(version)), nodeKeyFormat.Key(nk.GetKey()))
 }
 
+// expiryEntry is an entry of the expiry index, or of the expiry hints if hint is set.
+type expiryEntry struct {
+	expiryVersion int64
+	key           []byte
+	setVersion    int64
+	hint          bool
+	// live is set by MutableTree.dueExpiries if the key has not been rewritten or removed since
+	// the entry was saved.
+	live bool
+}
+
+// expiryFormat returns the key format of the expiry index, or of the expiry hints.
+func expiryFormat(hint bool) *keyformat.KeyFormat {
+	if hint {
+		return expiryHintKeyFormat
+	}
+	return expiryKeyFormat
+}
+
+// SaveExpiry saves the expiry of a key set in the given version.
+func (ndb *nodeDB) SaveExpiry(expiryVersion int64, key []byte, setVersion int64, hint bool) error {
+	var value [int64Size]byte
+	binary.BigEndian.PutUint64(value[:], uint64(setVersion)) // nolint:gosec // versions are non-negative
+	return ndb.batch.Set(expiryFormat(hint).Key(expiryVersion, key), value[:])
+}
+
+// DeleteExpiry deletes an entry of the expiry index, or of the expiry hints.
+func (ndb *nodeDB) DeleteExpiry(entry expiryEntry) error {
+	return ndb.batch.Delete(expiryFormat(entry.hint).Key(entry.expiryVersion, entry.key))
+}
+
+// getExpiriesTo returns the expiry entries, or the expiry hints, with an expiry version less than
+// or equal to the given version, ordered by expiry version and key.
+func (ndb *nodeDB) getExpiriesTo(version int64, hint bool) ([]expiryEntry, error) {
+	kf := expiryFormat(hint)
+	var entries []expiryEntry
+	err := ndb.traverseRange(kf.Key(), kf.Key(version+1), func(k, v []byte) error {
+		entry, err := decodeExpiryEntry(k, v, hint)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// deleteExpiriesFrom deletes the expiry entries and hints saved in the given version or later.
+func (ndb *nodeDB) deleteExpiriesFrom(fromVersion int64) error {
+	var entries []expiryEntry
+	for _, hint := range []bool{false, true} {
+		if err := ndb.traversePrefix(expiryFormat(hint).Key(), func(k, v []byte) error {
+			entry, err := decodeExpiryEntry(k, v, hint)
+			if err != nil {
+				return err
+			}
+			if entry.setVersion >= fromVersion {
+				entries = append(entries, entry)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := ndb.DeleteExpiry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeExpiryEntry(k, v []byte, hint bool) (expiryEntry, error) {
+	if len(v) != int64Size {
+		return expiryEntry{}, fmt.Errorf("invalid expiry entry value %X", v)
+	}
+	entry := expiryEntry{
+		setVersion: int64(binary.BigEndian.Uint64(v)), // nolint:gosec // versions are non-negative
+		hint:       hint,
+	}
+	var key []byte
+	expiryFormat(hint).Scan(k, &entry.expiryVersion, &key)
+	// Scan returns a sub-slice of the iterator key, which is only valid during the iteration
+	entry.key = append([]byte{}, key...)
+	return entry, nil
+}
+
 // Traverse fast nodes and return error if any, nil otherwise
 func (ndb *nodeDB) traverseFastNodes(fn func(k, v []byte) error) error {
-	return ndb.traversePrefix(fastKeyFormat.Key(), fn)
+	prefix := fastKeyFormat.Key()
+	itr, err := ndb.fastDB.Iterator(prefix, ibytes.CpIncr(prefix))
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		if err := fn(itr.Key(), itr.Value()); err != nil {
+			return err
+		}
+	}
+
+	return itr.Error()
 }
 
 // Traverse all keys and return error if any, nil otherwise
@@ -1086,9 +1828,174 @@ func (ndb *nodeDB) getPrefixIterator(prefix []byte) (corestore.Iterator, error)
 	return ndb.db.Iterator(start, end)
 }
 
+// versionRange is a range of versions, both bounds included.
+type versionRange struct {
+	from, to int64
+}
+
+// versionRanges is a list of version ranges, in ascending order once normalized.
+type versionRanges []versionRange
+
+// normalize sorts and merges the ranges, and drops the versions lower than firstVersion.
+func (ranges versionRanges) normalize(firstVersion int64) versionRanges {
+	sorted := slices.Clone(ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].from < sorted[j].from })
+	res := versionRanges{}
+	for _, r := range sorted {
+		r.from = max(r.from, firstVersion)
+		if r.from > r.to {
+			continue
+		}
+		if n := len(res); n > 0 && r.from <= res[n-1].to+1 {
+			res[n-1].to = max(res[n-1].to, r.to)
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// truncate drops the versions greater than or equal to fromVersion.
+func (ranges versionRanges) truncate(fromVersion int64) versionRanges {
+	res := versionRanges{}
+	for _, r := range ranges {
+		r.to = min(r.to, fromVersion-1)
+		if r.from <= r.to {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func (ranges versionRanges) contains(version int64) bool {
+	for _, r := range ranges {
+		if r.from <= version && version <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// getHiddenVersions returns the versions hidden by MutableTree.HideVersions.
+func (ndb *nodeDB) getHiddenVersions() (versionRanges, error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if ndb.hiddenLoaded {
+		return ndb.hiddenVersions, nil
+	}
+
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(hiddenVersionsKey)))
+	if err != nil {
+		return nil, err
+	}
+	var ranges versionRanges
+	for len(bz) > 0 {
+		from, n := binary.Varint(bz)
+		if n <= 0 {
+			return nil, errors.New("invalid hidden versions")
+		}
+		to, m := binary.Varint(bz[n:])
+		if m <= 0 {
+			return nil, errors.New("invalid hidden versions")
+		}
+		ranges = append(ranges, versionRange{from, to})
+		bz = bz[n+m:]
+	}
+	ndb.hiddenVersions, ndb.hiddenLoaded = ranges, true
+	return ranges, nil
+}
+
+// getSkippedVersions returns the versions skipped by ImportDelta and ImportAllVersions, which are
+// not stored, see skippedKeyFormat.
+func (ndb *nodeDB) getSkippedVersions() (versionRanges, error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if ndb.skippedLoaded {
+		return ndb.skippedVersions, nil
+	}
+
+	var ranges versionRanges
+	if err := ndb.traversePrefix(skippedKeyFormat.Key(), func(k, v []byte) error {
+		var next int64
+		skippedKeyFormat.Scan(k, &next)
+		prev, n := binary.Varint(v)
+		if n <= 0 {
+			return errors.New("invalid skipped versions")
+		}
+		ranges = append(ranges, versionRange{prev + 1, next - 1})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	ndb.skippedVersions, ndb.skippedLoaded = ranges, true
+	return ranges, nil
+}
+
+// updateSkippedVersions updates the loaded skipped versions along with their entries in the db,
+// which are written by the importers and deleted with the version following them.
+func (ndb *nodeDB) updateSkippedVersions(update func(versionRanges) versionRanges) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if ndb.skippedLoaded {
+		ndb.skippedVersions = update(ndb.skippedVersions)
+	}
+}
+
+// setHiddenVersions records the hidden versions in the batch.
+func (ndb *nodeDB) setHiddenVersions(ranges versionRanges) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	key := metadataKeyFormat.Key([]byte(hiddenVersionsKey))
+	if len(ranges) == 0 {
+		if err := ndb.batch.Delete(key); err != nil {
+			return err
+		}
+	} else {
+		bz := make([]byte, 0, 2*binary.MaxVarintLen64*len(ranges))
+		for _, r := range ranges {
+			bz = binary.AppendVarint(bz, r.from)
+			bz = binary.AppendVarint(bz, r.to)
+		}
+		if err := ndb.batch.Set(key, bz); err != nil {
+			return err
+		}
+	}
+	ndb.hiddenVersions, ndb.hiddenLoaded = ranges, true
+	return nil
+}
+
+func (ndb *nodeDB) isVersionHidden(version int64) (bool, error) {
+	ranges, err := ndb.getHiddenVersions()
+	if err != nil {
+		return false, err
+	}
+	return ranges.contains(version), nil
+}
+
+// latestImmutableTree returns the tree of the latest saved version.
+func (ndb *nodeDB) latestImmutableTree() (*ImmutableTree, error) {
+	_, version, err := ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	tree := &ImmutableTree{
+		ndb:                    ndb,
+		version:                version,
+		skipFastStorageUpgrade: true,
+	}
+	rootKey, err := ndb.GetRoot(version)
+	if err != nil || rootKey == nil {
+		return tree, err
+	}
+	tree.root, err = ndb.GetNode(rootKey)
+	return tree, err
+}
+
 // Get iterator for fast prefix and error, if any
 func (ndb *nodeDB) getFastIterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
 	var startFormatted, endFormatted []byte
+	start, end = normalizeBound(start), normalizeBound(end)
 
 	if start != nil {
 		startFormatted = fastKeyFormat.KeyBytes(start)
@@ -1104,30 +2011,71 @@ func (ndb *nodeDB) getFastIterator(start, end []byte, ascending bool) (corestore
 	}
 
 	if ascending {
-		return ndb.db.Iterator(startFormatted, endFormatted)
+		return ndb.fastDB.Iterator(startFormatted, endFormatted)
 	}
 
-	return ndb.db.ReverseIterator(startFormatted, endFormatted)
+	return ndb.fastDB.ReverseIterator(startFormatted, endFormatted)
 }
 
 // Write to disk.
 func (ndb *nodeDB) Commit() error {
+	return ndb.commit(ndb.opts.Sync)
+}
+
+// commit writes to disk, with an fsync if sync is set.
+func (ndb *nodeDB) commit(sync bool) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
-	var err error
-	if ndb.opts.Sync {
-		err = ndb.batch.WriteSync()
-	} else {
-		err = ndb.batch.Write()
+	if err := ndb.writeNodeCodec(ndb.batch); err != nil {
+		return err
 	}
-	if err != nil {
-		return fmt.Errorf("failed to write batch, %w", err)
+
+	batches := []corestore.Batch{ndb.batch}
+	if ndb.fastBatch != ndb.batch {
+		// the fast nodes are written after the tree, if this fails they are detected as stale on
+		// the next load, since the storage version written along with them lags the tree
+		batches = append(batches, ndb.fastBatch)
 	}
+	for _, batch := range batches {
+		var err error
+		if sync {
+			err = batch.WriteSync()
+		} else {
+			err = batch.Write()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write batch, %w", err)
+		}
+	}
+	// the value store entries are now read from the db
+	clear(ndb.storedValues)
+	// the entries deleted by pruning are now gone from the db, and can be compacted
+	ndb.prunedCommitted.merge(ndb.pruned)
+	ndb.pruned = prunedRange{}
 
 	return nil
 }
 
+// addStagedBatch adds the writes staged by SaveVersionWithBatch to the batch.
+func (ndb *nodeDB) addStagedBatch(staged *stagedBatch) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return staged.replay(ndb.batch)
+}
+
+// batchBytesAdded returns the total size of the keys and values added to the batch of the nodeDB.
+func (ndb *nodeDB) batchBytesAdded() int64 {
+	var added int64
+	if batch, ok := ndb.batch.(*BatchWithFlusher); ok {
+		added += batch.bytesAdded()
+	}
+	if batch, ok := ndb.fastBatch.(*BatchWithFlusher); ok && ndb.fastBatch != ndb.batch {
+		added += batch.bytesAdded()
+	}
+	return added
+}
+
 func (ndb *nodeDB) incrVersionReaders(version int64) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -1214,10 +2162,22 @@ func (ndb *nodeDB) Close() error {
 	if ndb.opts.AsyncPruning {
 		<-ndb.done // wait for the pruning process to finish
 	}
+	if ndb.fastFlusher != nil {
+		<-ndb.fastFlusher.done // wait for the background flush to finish
+		if err := ndb.flushPendingFastNodes(); err != nil {
+			return err
+		}
+	}
 
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
+	if ndb.fastBatch != nil && ndb.fastBatch != ndb.batch {
+		if err := ndb.fastBatch.Close(); err != nil {
+			return err
+		}
+	}
+	ndb.fastBatch = nil
 	if ndb.batch != nil {
 		if err := ndb.batch.Close(); err != nil {
 			return err
@@ -1319,7 +2279,7 @@ func (ndb *nodeDB) traverseNodes(fn func(node *Node) error) error {
 		if isRef, _ := isReferenceRoot(value); isRef {
 			return nil
 		}
-		node, err := MakeNode(key[1:], value)
+		node, err := ndb.makeNode(key[1:], value)
 		if err != nil {
 			return err
 		}
@@ -1429,3 +2389,7 @@ func (ndb *nodeDB) String() (string, error) {
 }
 
 var ErrNodeMissingNodeKey = errors.New("node does not have a nodeKey")
+
+// ErrCorruptNode is returned when the bytes of a node stored in the db cannot be decoded, see
+// Options.OnCorruptNode.
+var ErrCorruptNode = errors.New("corrupt node")
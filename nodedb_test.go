@@ -1,16 +1,22 @@
 package iavl
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"math/rand"
+	"runtime"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/require"
 	gomock "go.uber.org/mock/gomock"
 
 	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/internal/encoding"
 	"github.com/cosmos/iavl/mock"
 )
 
@@ -486,3 +492,705 @@ func TestGetFirstNonLegacyVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int64(2), firstVersion) // Should still return the first non-legacy version
 }
+
+func TestPublicDBKeys(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// version 2 refers to the root of version 1
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// every node is stored under the key built from its node key
+	count := 0
+	tree.root.traverse(tree.ImmutableTree, true, func(node *Node) bool {
+		bz, err := db.Get(NodeDBKey(node.GetKey()))
+		require.NoError(t, err)
+		stored, err := MakeNode(node.GetKey(), bz)
+		require.NoError(t, err)
+		stored._hash(node.nodeKey.version)
+		require.Equal(t, node.hash, stored.hash)
+		count++
+		return false
+	})
+	require.Equal(t, 39, count)
+
+	bz, err := db.Get(RootDBKey(1))
+	require.NoError(t, err)
+	root, err := MakeNode(GetRootKey(1), bz)
+	require.NoError(t, err)
+	require.Equal(t, tree.root.key, root.key)
+	bz, err = db.Get(RootDBKey(2))
+	require.NoError(t, err)
+	require.Equal(t, RootDBKey(1), bz)
+
+	for i := 0; i < 20; i++ {
+		bz, err := db.Get(FastNodeDBKey([]byte{byte(i)}))
+		require.NoError(t, err)
+		require.NotNil(t, bz)
+	}
+
+	// the builders match the formats used by nodeDB
+	ndb := tree.ndb
+	nk := (&NodeKey{version: 3, nonce: 7}).GetKey()
+	require.Equal(t, ndb.nodeKey(nk), NodeDBKey(nk))
+	require.Equal(t, append([]byte{'s'}, nk...), NodeDBKey(nk))
+	require.Equal(t, ndb.fastNodeKey([]byte("key")), FastNodeDBKey([]byte("key")))
+	hash := tree.Hash()
+	require.Equal(t, ndb.legacyNodeKey(hash), LegacyNodeDBKey(hash))
+	require.Equal(t, append([]byte{'n'}, hash...), LegacyNodeDBKey(hash))
+	require.Equal(t, ndb.legacyRootKey(5), LegacyRootDBKey(5))
+	require.Equal(t, []byte{'r', 0, 0, 0, 0, 0, 0, 0, 5}, LegacyRootDBKey(5))
+
+	orphanKey := LegacyOrphanDBKey(9, 4, hash)
+	var toVersion, fromVersion int64
+	var orphanHash []byte
+	legacyOrphanKeyFormat.Scan(orphanKey, &toVersion, &fromVersion, &orphanHash)
+	require.Equal(t, int64(9), toVersion)
+	require.Equal(t, int64(4), fromVersion)
+	require.Equal(t, hash, orphanHash)
+}
+
+func TestNodeDB_NodePool(t *testing.T) {
+	// a tiny cache, so the leaves are constantly evicted and recycled
+	tree := NewMutableTree(dbm.NewMemDB(), 16, true, NewNopLogger(), UseNodePoolOption(true))
+	mirror := map[string]string{}
+	rnd := rand.New(rand.NewSource(42))
+	key := func() []byte {
+		return []byte(strconv.Itoa(rnd.Intn(1000)))
+	}
+
+	for version := int64(1); version <= 30; version++ {
+		for j := 0; j < 100; j++ {
+			k := key()
+			if rnd.Intn(4) == 0 {
+				_, _, err := tree.Remove(k)
+				require.NoError(t, err)
+				delete(mirror, string(k))
+				continue
+			}
+			v := fmt.Sprintf("%d-%d", version, j)
+			_, err := tree.Set(k, []byte(v))
+			require.NoError(t, err)
+			mirror[string(k)] = v
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		if version%10 == 0 {
+			require.NoError(t, tree.DeleteVersionsTo(version-5))
+		}
+
+		// point lookups interleaved with an iteration, which holds leaves in between
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		iter, err := itree.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		var prev []byte
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			require.Greater(t, string(iter.Key()), string(prev))
+			prev = iter.Key()
+			v, ok := mirror[string(iter.Key())]
+			require.True(t, ok)
+			require.Equal(t, v, string(iter.Value()))
+			k := key()
+			got, err := itree.Get(k)
+			require.NoError(t, err)
+			if v, ok := mirror[string(k)]; ok {
+				require.Equal(t, v, string(got))
+			} else {
+				require.Nil(t, got)
+			}
+			count++
+		}
+		require.NoError(t, iter.Close())
+		require.Equal(t, len(mirror), count)
+	}
+
+	// the nodes are also read from other goroutines, one at a time
+	require.NoError(t, tree.VerifyVersionParallel(30, 4))
+	itree, err := tree.GetImmutable(30)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	leaves := 0
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		if node.Height == 0 {
+			require.Equal(t, mirror[string(node.Key)], string(node.Value))
+			leaves++
+		}
+	}
+	require.Equal(t, len(mirror), leaves)
+}
+
+func TestNodeDB_NodePoolConcurrentReaders(t *testing.T) {
+	// a tiny cache, so the leaves read by one reader are evicted and recycled by the others
+	tree := NewMutableTree(dbm.NewMemDB(), 16, true, NewNopLogger(), UseNodePoolOption(true))
+	const versions = 8
+	mirrors := make([]map[string]string, versions+1)
+	rnd := rand.New(rand.NewSource(7))
+	mirror := map[string]string{}
+	for version := 1; version <= versions; version++ {
+		for j := 0; j < 200; j++ {
+			k := strconv.Itoa(rnd.Intn(500))
+			v := fmt.Sprintf("%d-%d", version, j)
+			_, err := tree.Set([]byte(k), []byte(v))
+			require.NoError(t, err)
+			mirror[k] = v
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		mirrors[version] = make(map[string]string, len(mirror))
+		for k, v := range mirror {
+			mirrors[version][k] = v
+		}
+	}
+
+	trees := make([]*ImmutableTree, versions+1)
+	for version := 1; version <= versions; version++ {
+		itree, err := tree.GetImmutable(int64(version))
+		require.NoError(t, err)
+		trees[version] = itree
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for reader := 0; reader < cap(errs); reader++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 2000; i++ {
+				version := 1 + rnd.Intn(versions)
+				k := strconv.Itoa(rnd.Intn(500))
+				got, err := trees[version].Get([]byte(k))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if want := mirrors[version][k]; string(got) != want {
+					errs <- fmt.Errorf("version %d key %s: got %q, want %q", version, k, got, want)
+					return
+				}
+				has, err := trees[version].Has([]byte(k))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, ok := mirrors[version][k]; has != ok {
+					errs <- fmt.Errorf("version %d key %s: has %t", version, k, has)
+					return
+				}
+			}
+		}(int64(reader))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func BenchmarkNodeDB_NodePool(b *testing.B) {
+	for _, usePool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%t", usePool), func(b *testing.B) {
+			tree := NewMutableTree(dbm.NewMemDB(), 1000, true, NewNopLogger(), UseNodePoolOption(usePool))
+			const numKeys = 100000
+			for i := 0; i < numKeys; i++ {
+				_, err := tree.Set([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+				require.NoError(b, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(b, err)
+			itree, err := tree.GetImmutable(1)
+			require.NoError(b, err)
+
+			rnd := rand.New(rand.NewSource(1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := itree.Get([]byte(strconv.Itoa(rnd.Intn(numKeys)))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeDB_ValueCache(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 100, true, NewNopLogger(), ValueCacheSizeOption(2))
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// reopen the tree, so that all the nodes are read from the db
+	tree = NewMutableTree(db, 100, true, NewNopLogger(), ValueCacheSizeOption(2))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 10; i++ {
+			value, err := itree.Get([]byte(fmt.Sprintf("k%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value%d", i)), value)
+		}
+	}
+
+	// the structure of all the nodes stays cached, while the values are evicted
+	ndb := tree.ndb
+	require.Equal(t, 19, ndb.nodeCache.Len())
+	require.Equal(t, 2, ndb.valueCache.Len())
+	leaves := 0
+	itree.root.traverse(itree, true, func(node *Node) bool {
+		cached := ndb.nodeCache.Get(node.GetKey())
+		require.NotNil(t, cached)
+		if node.isLeaf() {
+			leaves++
+			require.Nil(t, cached.(*Node).value)
+			require.Equal(t, node.hash, cached.(*Node).hash)
+		}
+		return false
+	})
+	require.Equal(t, 10, leaves)
+}
+
+func TestNodeDB_WeakNodeCache(t *testing.T) {
+	db := dbm.NewMemDB()
+	opts := []Option{WeakNodeCacheSizeOption(100), UseNodePoolOption(true)}
+	tree := NewMutableTree(db, 2, true, NewNopLogger(), opts...)
+	// the evicted nodes may still be reused, so they are not recycled
+	require.Nil(t, tree.ndb.nodePool)
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree = NewMutableTree(db, 2, true, NewNopLogger(), opts...)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.Hash())
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			value, err := itree.Get([]byte(fmt.Sprintf("k%02d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value%d", i)), value)
+		}
+		runtime.GC()
+	}
+	require.LessOrEqual(t, tree.ndb.nodeCache.Len(), 102)
+}
+
+// flakyDB fails the given number of the next reads and batch writes with the given error.
+type flakyDB struct {
+	*dbm.MemDB
+	failures int
+	err      error
+	calls    int
+}
+
+func (db *flakyDB) fail() error {
+	db.calls++
+	if db.failures > 0 {
+		db.failures--
+		return db.err
+	}
+	return nil
+}
+
+func (db *flakyDB) Get(key []byte) ([]byte, error) {
+	if err := db.fail(); err != nil {
+		return nil, err
+	}
+	return db.MemDB.Get(key)
+}
+
+func (db *flakyDB) NewBatch() corestore.Batch {
+	return &flakyBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+func (db *flakyDB) NewBatchWithSize(size int) corestore.Batch {
+	return &flakyBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type flakyBatch struct {
+	corestore.Batch
+	db *flakyDB
+}
+
+func (b *flakyBatch) Write() error {
+	if err := b.db.fail(); err != nil {
+		return err
+	}
+	return b.Batch.Write()
+}
+
+func TestNodeDB_RetryPolicy(t *testing.T) {
+	errTransient := errors.New("transient")
+	db := &flakyDB{MemDB: dbm.NewMemDB(), err: errTransient}
+	policy := &RetryPolicy{
+		MaxRetries: 3,
+		Backoff:    time.Microsecond,
+		Retryable: func(err error) bool {
+			return errors.Is(err, errTransient)
+		},
+	}
+	newTree := func() *MutableTree {
+		db.failures = 0
+		tree := NewMutableTree(db, 0, true, NewNopLogger(), RetryPolicyOption(policy))
+		_, err := tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+
+	tree := newTree()
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	db.failures = 3
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the reads of the nodes are retried within the budget
+	tree = newTree()
+	db.failures = 3
+	value, err := tree.Get([]byte("k5"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{5}, value)
+
+	// beyond the budget, the error is returned
+	tree = newTree()
+	db.failures = 4
+	_, err = tree.Get([]byte("k5"))
+	require.ErrorIs(t, err, errTransient)
+
+	// the errors which are not retryable fail at once
+	tree = newTree()
+	db.err = errors.New("corrupted")
+	db.failures, db.calls = 1, 0
+	_, err = tree.Get([]byte("k5"))
+	require.ErrorIs(t, err, db.err)
+	require.Equal(t, 1, db.calls)
+}
+
+func TestNodeDB_DedupValues(t *testing.T) {
+	// the refs of the values in the value store, by value
+	storedValues := func(db corestore.KVStoreWithBatch) map[string]uint64 {
+		itr, err := db.Iterator(valueKeyFormat.Key(), []byte{valueKeyFormat.Prefix()[0] + 1})
+		require.NoError(t, err)
+		defer itr.Close()
+		values := make(map[string]uint64)
+		for ; itr.Valid(); itr.Next() {
+			entry, err := decodeStoredValue(itr.Value())
+			require.NoError(t, err)
+			values[string(entry.value)] = entry.refs
+		}
+		return values
+	}
+
+	db, plainDB := dbm.NewMemDB(), dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger(), DedupValuesOption(true))
+	plain := NewMutableTree(plainDB, 0, true, NewNopLogger())
+	set := func(key, value string) {
+		for _, tree := range []*MutableTree{tree, plain} {
+			_, err := tree.Set([]byte(key), []byte(value))
+			require.NoError(t, err)
+		}
+	}
+	remove := func(key string) {
+		for _, tree := range []*MutableTree{tree, plain} {
+			_, _, err := tree.Remove([]byte(key))
+			require.NoError(t, err)
+		}
+	}
+	save := func() {
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		plainHash, _, err := plain.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, plainHash, hash)
+	}
+
+	// version 1: 10 keys share a value, 5 keys hold their own
+	for i := 0; i < 10; i++ {
+		set(fmt.Sprintf("shared%d", i), "shared")
+	}
+	for i := 0; i < 5; i++ {
+		set(fmt.Sprintf("own%d", i), fmt.Sprintf("own%d", i))
+	}
+	save()
+	values := storedValues(db)
+	require.Len(t, values, 6)
+	require.Equal(t, uint64(10), values["shared"])
+	require.Equal(t, uint64(1), values["own0"])
+
+	// version 2: half of the shared keys are removed, one is overwritten, the leaves of version 1
+	// are kept for it
+	for i := 0; i < 5; i++ {
+		remove(fmt.Sprintf("shared%d", i))
+	}
+	set("shared5", "other")
+	save()
+	values = storedValues(db)
+	require.Equal(t, uint64(10), values["shared"])
+	require.Equal(t, uint64(1), values["other"])
+
+	// pruning version 1 releases the values of its orphaned leaves
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	require.NoError(t, tree.ndb.Commit())
+	values = storedValues(db)
+	require.Equal(t, uint64(4), values["shared"])
+
+	// version 3 removes the last shared keys, whose value is deleted once version 2 is pruned
+	for i := 6; i < 10; i++ {
+		remove(fmt.Sprintf("shared%d", i))
+	}
+	save()
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	require.NoError(t, tree.ndb.Commit())
+	values = storedValues(db)
+	require.NotContains(t, values, "shared")
+	require.Len(t, values, 6)
+
+	// the values are read back from the value store
+	tree = NewMutableTree(db, 0, true, NewNopLogger(), DedupValuesOption(true))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	value, err := tree.Get([]byte("own3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("own3"), value)
+	value, err = tree.Get([]byte("shared5"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("other"), value)
+
+	// deleting the latest versions releases their values too
+	_, err = tree.Set([]byte("new"), []byte("new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), storedValues(db)["new"])
+	require.NoError(t, tree.LoadVersionForOverwriting(3))
+	require.NotContains(t, storedValues(db), "new")
+
+	// an imported tree stores its values once too
+	itree, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	importDB := dbm.NewMemDB()
+	imported := NewMutableTree(importDB, 0, true, NewNopLogger(), DedupValuesOption(true))
+	importer, err := imported.Import(3)
+	require.NoError(t, err)
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	exporter.Close()
+	require.NoError(t, importer.Commit())
+	require.Equal(t, itree.Hash(), imported.Hash())
+	require.Equal(t, storedValues(db), storedValues(importDB))
+
+	// the db is not loaded without the value store, nor a plain db with it
+	_, err = NewMutableTree(db, 0, true, NewNopLogger()).Load()
+	require.ErrorIs(t, err, ErrNodeCodecMismatch)
+	_, err = NewMutableTree(plainDB, 0, true, NewNopLogger(), DedupValuesOption(true)).Load()
+	require.ErrorIs(t, err, ErrNodeCodecMismatch)
+}
+
+func TestNodeDB_OnCorruptNode(t *testing.T) {
+	type report struct {
+		dbKey, raw []byte
+		err        error
+	}
+	errQuarantined := errors.New("quarantined")
+	for _, tc := range []struct {
+		name    string
+		hookErr error
+		noHook  bool
+	}{
+		{name: "no hook", noHook: true},
+		{name: "hook lets the caller decide"},
+		{name: "hook aborts", hookErr: errQuarantined},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := dbm.NewMemDB()
+			tree := NewMutableTree(db, 0, true, NewNopLogger())
+			for i := 0; i < 8; i++ {
+				_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+				require.NoError(t, err)
+			}
+			_, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			// overwrite the leftmost leaf with malformed bytes
+			nk := tree.root.GetKey()
+			for {
+				node, err := tree.ndb.GetNode(nk)
+				require.NoError(t, err)
+				if node.isLeaf() {
+					break
+				}
+				nk = node.leftNodeKey
+			}
+			dbKey := tree.ndb.nodeKey(nk)
+			raw := []byte{0x00, 0x02, 0xff}
+			require.NoError(t, db.Set(dbKey, raw))
+
+			var reports []report
+			options := []Option{}
+			if !tc.noHook {
+				options = append(options, OnCorruptNodeOption(func(dbKey, raw []byte, err error) error {
+					reports = append(reports, report{dbKey: dbKey, raw: raw, err: err})
+					return tc.hookErr
+				}))
+			}
+			reopened := NewMutableTree(db, 0, true, NewNopLogger(), options...)
+			_, err = reopened.Load()
+			require.NoError(t, err)
+			itree, err := reopened.GetImmutable(version)
+			require.NoError(t, err)
+
+			_, _, err = itree.GetWithIndex([]byte{0})
+			if tc.hookErr != nil {
+				require.ErrorIs(t, err, tc.hookErr)
+			} else {
+				require.ErrorIs(t, err, ErrCorruptNode)
+			}
+			if tc.noHook {
+				require.Empty(t, reports)
+				return
+			}
+			require.Len(t, reports, 1)
+			require.Equal(t, dbKey, reports[0].dbKey)
+			require.Equal(t, raw, reports[0].raw)
+			require.ErrorIs(t, reports[0].err, ErrCorruptNode)
+
+			// a proof through the corrupt node fails rather than panics
+			_, err = itree.GetMembershipProof([]byte{0})
+			require.Error(t, err)
+
+			// the other leaves are still readable
+			_, value, err := itree.GetWithIndex([]byte{7})
+			require.NoError(t, err)
+			require.Equal(t, []byte{7}, value)
+		})
+	}
+
+	// an inner node with a child node key of a bad length used to panic when the child was read
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err := tree.Set([]byte("a"), []byte("b"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("c"), []byte("d"))
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// height, size, key, hash, legacy left child mode, left and right child node keys
+	var buf bytes.Buffer
+	require.NoError(t, encoding.EncodeVarint(&buf, 1))
+	require.NoError(t, encoding.EncodeVarint(&buf, 2))
+	require.NoError(t, encoding.EncodeBytes(&buf, []byte("c")))
+	require.NoError(t, encoding.EncodeBytes(&buf, tree.root.hash))
+	require.NoError(t, encoding.EncodeVarint(&buf, ModeLegacyLeftNode))
+	require.NoError(t, encoding.EncodeBytes(&buf, []byte{1, 2, 3}))
+	require.NoError(t, encoding.EncodeVarint(&buf, version))
+	require.NoError(t, encoding.EncodeVarint(&buf, 3))
+	require.NoError(t, db.Set(tree.ndb.nodeKey(GetRootKey(version)), buf.Bytes()))
+
+	var hooked bool
+	reopened := NewMutableTree(db, 0, true, NewNopLogger(), OnCorruptNodeOption(func(_, _ []byte, err error) error {
+		hooked = true
+		return nil
+	}))
+	_, err = reopened.Load()
+	require.ErrorIs(t, err, ErrCorruptNode)
+	require.True(t, hooked)
+
+	// a corrupt inner node below the root fails the proofs of its leaves
+	db = dbm.NewMemDB()
+	tree = NewMutableTree(db, 0, true, NewNopLogger())
+	for i := 0; i < 8; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	left, err := tree.ndb.GetNode(tree.root.leftNodeKey)
+	require.NoError(t, err)
+	require.False(t, left.isLeaf())
+	require.NoError(t, db.Set(tree.ndb.nodeKey(tree.root.leftNodeKey), []byte{0x00, 0x02, 0xff}))
+	reopened = NewMutableTree(db, 0, true, NewNopLogger(), OnCorruptNodeOption(func(_, _ []byte, err error) error {
+		return nil
+	}))
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	itree, err := reopened.GetImmutable(version)
+	require.NoError(t, err)
+	_, err = itree.GetMembershipProof([]byte{0})
+	require.ErrorIs(t, err, ErrCorruptNode)
+}
+
+func TestNodeDB_OnEvict(t *testing.T) {
+	db := dbm.NewMemDB()
+	var evicted [][]byte
+	onEvict := OnEvictOption(func(dbKey []byte) {
+		evicted = append(evicted, dbKey)
+	})
+
+	// writing nodes within the capacity of the cache evicts nothing
+	tree := NewMutableTree(db, 100, false, NewNopLogger(), onEvict)
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Empty(t, evicted)
+
+	// reading nodes beyond the capacity evicts the least recently used ones
+	opts := DefaultOptions()
+	onEvict(&opts)
+	ndb := newNodeDB(db, 4, opts, NewNopLogger())
+	nodeKey := func(nonce uint32) []byte {
+		return (&NodeKey{version: version, nonce: nonce}).GetKey()
+	}
+	for nonce := uint32(1); nonce <= 6; nonce++ {
+		_, err := ndb.GetNode(nodeKey(nonce))
+		require.NoError(t, err)
+	}
+	require.Equal(t, [][]byte{ndb.nodeKey(nodeKey(1)), ndb.nodeKey(nodeKey(2))}, evicted)
+
+	// a cache hit evicts nothing, and the node read again evicts the oldest one
+	_, err = ndb.GetNode(nodeKey(3))
+	require.NoError(t, err)
+	require.Len(t, evicted, 2)
+	_, err = ndb.GetNode(nodeKey(1))
+	require.NoError(t, err)
+	require.Equal(t, ndb.nodeKey(nodeKey(4)), evicted[2])
+	require.Len(t, evicted, 3)
+}
@@ -1,6 +1,10 @@
 package iavl
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+
+	corestore "cosmossdk.io/core/store"
+)
 
 // Statisc about db runtime state
 type Statistics struct {
@@ -72,6 +76,10 @@ func (stat *Statistics) Reset() {
 type Options struct {
 	// Sync synchronously flushes all writes to storage, using e.g. the fsync syscall.
 	// Disabling this significantly improves performance, but can lose data on e.g. power loss.
+	// Without it, the most recently saved versions may be lost on a crash, but the tree stays
+	// consistent, since the backend still writes each batch atomically: after a restart, the
+	// tree loads at the latest version which reached the disk. SaveVersionSync and
+	// SaveVersionNoSync override it for a single version.
 	Sync bool
 
 	// InitialVersion specifies the initial version number. If any versions already exist below
@@ -85,9 +93,159 @@ type Options struct {
 	// Ethereum has found that commit of 100KB is optimal, ref ethereum/go-ethereum#15115
 	FlushThreshold int
 
+	// MaxBatchBytes caps the memory held by the batch of a commit, the FlushThreshold if 0: the
+	// batch is written to the backend whenever it grows beyond the cap, so arbitrarily large
+	// versions, e.g. a genesis state, can be saved. The root of a version is written last, and a
+	// version without its root is ignored when loading the tree, so a version flushed in parts
+	// only becomes visible once its commit completes.
+	MaxBatchBytes int
+
 	// AsyncPruning is a flag to enable async pruning
 	AsyncPruning bool
 
+	// PrehashValuesInProofs makes existence proofs carry the SHA256 hash of the value instead of
+	// the value itself, which keeps proofs small for large values. Such proofs commit to the same
+	// root, but must be verified against IavlPrehashedValueSpec with the hashed value.
+	PrehashValuesInProofs bool
+
+	// MaxHeight makes Set return ErrMaxHeightExceeded instead of growing the tree beyond the given
+	// height, 0 means no limit. Since an AVL tree of n keys is at most MaxTreeHeight(n) high, a
+	// taller tree implies corruption, so this acts as a tripwire.
+	MaxHeight int8
+
+	// MaxKeyBytes makes Set return ErrKeyTooLarge for a key longer than the given number of bytes,
+	// 0 means no limit. It guards against accidental huge writes bloating the tree.
+	MaxKeyBytes int
+
+	// MaxValueBytes makes Set return ErrValueTooLarge for a value longer than the given number of
+	// bytes, 0 means no limit.
+	MaxValueBytes int
+
+	// NodeCodec serializes the nodes stored in the db, nil means DefaultNodeCodec. A db must
+	// always be opened with the codec it was written with.
+	NodeCodec NodeCodec
+
+	// UseNodePool recycles the leaf nodes read from the db once they are evicted from the node
+	// cache, which saves allocations on read-heavy workloads. A leaf is only recycled once every
+	// reader which got it from the db has released it, which Get and Has do when they return;
+	// the leaves held by other readers, e.g. tree roots, working nodes, iterators and proofs, are
+	// never recycled, so the pool is safe for concurrent readers. It is ignored with
+	// WeakNodeCacheSize, which may hand out an evicted node again.
+	UseNodePool bool
+
+	// SkipUnchangedVersions makes a SaveVersion without any changes since the last saved version
+	// return the hash and number of that version instead of saving a new one, so nothing is
+	// written and no commit callbacks run. The version numbers then no longer advance by one per
+	// SaveVersion, so it must stay off when the caller, e.g. a consensus engine, expects the
+	// version to match its own height.
+	SkipUnchangedVersions bool
+
+	// StrictSaveVersion makes SaveVersion fail with ErrVersionAlreadySaved whenever the working
+	// version was already saved, e.g. after loading an earlier version. Otherwise, re-saving a
+	// version with the same root hash is a no-op which succeeds, so replaying the changes of a
+	// commit interrupted by a crash is safe, and only a different root hash fails.
+	StrictSaveVersion bool
+
+	// ValueCacheSize caches the values of the leaf nodes separately from the nodes, in an LRU cache
+	// of the given number of values, 0 means the values are cached along with their nodes. The
+	// node cache, whose size is given to the tree constructor, then only holds the structure of the
+	// leaves, so many nodes can be kept hot while the memory held by large values is bounded. A
+	// leaf whose value was evicted is read again from the db.
+	ValueCacheSize int
+
+	// RetryPolicy retries the reads and writes of the db failing with a transient error, nil
+	// means none are retried.
+	RetryPolicy *RetryPolicy
+
+	// MinRetainVersions makes DeleteVersionsTo fail with ErrMinRetainVersions instead of pruning
+	// the versions if fewer than the given number of versions up to the latest one would be
+	// retained, 0 means no minimum. It is a safety floor against mistaken prune calls, which
+	// ForceDeleteVersionsTo overrides.
+	MinRetainVersions int64
+
+	// WeakNodeCacheSize keeps tracking up to the given number of the nodes evicted from the node
+	// cache through weak references, 0 means none. The evicted nodes can then be reclaimed by the
+	// garbage collector, but are still reused while they are alive, e.g. held by a tree or an
+	// iterator, so a smaller node cache can be used to reduce the memory it retains and the GC
+	// pauses, without missing the nodes in use. It needs go1.24, and is ignored otherwise. The
+	// node pool, see UseNodePool, is disabled with it, since an evicted node may still be reused.
+	WeakNodeCacheSize int
+
+	// UnsafeIteratorValues makes the iterators over the fast nodes of a saved version return the
+	// values without copying them out of the db iterator, if the db supports it, see
+	// db.UnsafeValueIterator, which saves an allocation per value on large scans.
+	//
+	// WARNING: a value returned by Value then aliases a buffer of the db, and is only valid until
+	// the next call to Next or Close of the iterator. It must be consumed or copied before, and
+	// must never be modified. The iterators of a MutableTree, which merge the unsaved changes,
+	// always copy.
+	UnsafeIteratorValues bool
+
+	// FastStore stores the fast nodes in the given db instead of the node db, e.g. to keep the fast
+	// index on faster media than the tree nodes, nil means the node db. The storage version, which
+	// records the version the fast nodes match, is kept with them, so the fast index is rebuilt
+	// into the fast store when it is empty or lags the tree, e.g. if writing it failed after the
+	// tree was committed. The fast nodes left in the node db from before are not used.
+	FastStore corestore.KVStoreWithBatch
+
+	// DedupValues stores each distinct value of the leaves once, in a value store keyed by the
+	// hash of the value and counting the leaves referring to it, which saves space when many keys
+	// hold identical values. The leaves then store the hash instead of the value, and the value
+	// of a leaf loaded from the db is read from the value store, at the cost of an extra read.
+	// The root hashes are the same either way. Pruning releases the values of the deleted leaves,
+	// deleting those no leaf refers to anymore. It is recorded in the db along with the node
+	// codec, so a db must always be opened with the same setting, see ErrNodeCodecMismatch.
+	DedupValues bool
+
+	// Tracer records spans around the major operations of the tree, nil means none are recorded.
+	Tracer Tracer
+
+	// UndoVersions records the changes of the given number of latest versions, so a pruned version
+	// among them can be rebuilt with MutableTree.ReconstructVersion, 0 means none are recorded.
+	// The changes of a version are the root of the previous version and the nodes of the
+	// previous version it orphaned, which are kept when the previous version is pruned, so the
+	// space saved by pruning is only reclaimed once the versions fall out of the retention.
+	UndoVersions int64
+
+	// OrphanIndex records, when saving a version, the db keys of the nodes of the previous version
+	// it orphans in a single entry, so pruning the previous version reads that entry instead of
+	// comparing the nodes of both versions. The entry of a large version may be large, since it
+	// holds a key per orphaned node. The versions saved without it are pruned by comparing their
+	// nodes as usual, and MutableTree.IndexOrphans indexes the versions of an existing db.
+	OrphanIndex bool
+
+	// OnEvict is called with the db key of every node evicted from the node cache to make room
+	// for another one, e.g. to observe the cache churn or to keep the hot nodes in a secondary
+	// cache. Writing a node does not call it, unless caching the written node evicts another one.
+	// With WeakNodeCacheSize, it is called when a node leaves the strongly held nodes. It is
+	// called with the nodeDB lock held, so it must not call back into the tree.
+	OnEvict func(dbKey []byte)
+
+	// OnCorruptNode is called when the bytes of a node stored in the db cannot be decoded, with
+	// the db key and bytes of the node and an error wrapping ErrCorruptNode, e.g. to report and
+	// quarantine it. Returning an error makes the read of the node fail with it. Returning nil
+	// makes the read fail with the given error, so the caller decides what to do, e.g. a repair
+	// tool skips the node. A malformed node always fails the read instead of panicking, whether
+	// or not the hook is set.
+	OnCorruptNode func(dbKey, raw []byte, err error) error
+
+	// AutoCompactThreshold compacts the key range of the entries deleted by pruning once they
+	// exceed the threshold, nil means the backend is never compacted by the tree. The deletions
+	// are accumulated over the pruning calls until the threshold is exceeded. The compaction
+	// runs at the end of DeleteVersionsTo, once the deletions are committed, or with
+	// AsyncPruning, by the pruning goroutine after the next commit. It is skipped for the
+	// backends which cannot compact, i.e. which have no ForceCompact(start, limit []byte) error
+	// method like db.GoLevelDB.
+	AutoCompactThreshold *AutoCompactThreshold
+
+	// EnableValueIndex maintains an index from the hash of every value of the latest saved version
+	// to the keys holding it, so ImmutableTree.KeysByValue finds the keys with a given value
+	// without scanning the tree. The index is metadata kept outside of the tree, so it does not
+	// affect the hashes. It is updated after every saved version from the changes of the version,
+	// in a second write, and rebuilt from the whole tree when it does not match the loaded or
+	// saved version, e.g. when it is enabled on an existing db or after an import.
+	EnableValueIndex bool
+
 	initialVersionSet bool
 }
 
@@ -125,9 +283,170 @@ func FlushThresholdOption(ft int) Option {
 	}
 }
 
+// MaxBatchBytesOption sets the MaxBatchBytes for the tree.
+func MaxBatchBytesOption(maxBytes int) Option {
+	return func(opts *Options) {
+		opts.MaxBatchBytes = maxBytes
+	}
+}
+
 // AsyncPruningOption sets the AsyncPruning for the tree.
 func AsyncPruningOption(asyncPruning bool) Option {
 	return func(opts *Options) {
 		opts.AsyncPruning = asyncPruning
 	}
 }
+
+// PrehashValuesInProofsOption sets the PrehashValuesInProofs option.
+func PrehashValuesInProofsOption(prehash bool) Option {
+	return func(opts *Options) {
+		opts.PrehashValuesInProofs = prehash
+	}
+}
+
+// MaxHeightOption sets the MaxHeight option.
+func MaxHeightOption(maxHeight int8) Option {
+	return func(opts *Options) {
+		opts.MaxHeight = maxHeight
+	}
+}
+
+// MaxKeyBytesOption sets the MaxKeyBytes option.
+func MaxKeyBytesOption(maxBytes int) Option {
+	return func(opts *Options) {
+		opts.MaxKeyBytes = maxBytes
+	}
+}
+
+// MaxValueBytesOption sets the MaxValueBytes option.
+func MaxValueBytesOption(maxBytes int) Option {
+	return func(opts *Options) {
+		opts.MaxValueBytes = maxBytes
+	}
+}
+
+// NodeCodecOption sets the NodeCodec option.
+func NodeCodecOption(codec NodeCodec) Option {
+	return func(opts *Options) {
+		opts.NodeCodec = codec
+	}
+}
+
+// UseNodePoolOption sets the UseNodePool option.
+func UseNodePoolOption(useNodePool bool) Option {
+	return func(opts *Options) {
+		opts.UseNodePool = useNodePool
+	}
+}
+
+// SkipUnchangedVersionsOption sets the SkipUnchangedVersions option.
+func SkipUnchangedVersionsOption(skip bool) Option {
+	return func(opts *Options) {
+		opts.SkipUnchangedVersions = skip
+	}
+}
+
+// StrictSaveVersionOption sets the StrictSaveVersion option.
+func StrictSaveVersionOption(strict bool) Option {
+	return func(opts *Options) {
+		opts.StrictSaveVersion = strict
+	}
+}
+
+// ValueCacheSizeOption sets the ValueCacheSize option.
+func ValueCacheSizeOption(size int) Option {
+	return func(opts *Options) {
+		opts.ValueCacheSize = size
+	}
+}
+
+// WeakNodeCacheSizeOption sets the WeakNodeCacheSize option.
+func WeakNodeCacheSizeOption(size int) Option {
+	return func(opts *Options) {
+		opts.WeakNodeCacheSize = size
+	}
+}
+
+// UnsafeIteratorValuesOption sets the UnsafeIteratorValues option.
+func UnsafeIteratorValuesOption(unsafe bool) Option {
+	return func(opts *Options) {
+		opts.UnsafeIteratorValues = unsafe
+	}
+}
+
+// FastStoreOption sets the FastStore option.
+func FastStoreOption(db corestore.KVStoreWithBatch) Option {
+	return func(opts *Options) {
+		opts.FastStore = db
+	}
+}
+
+// DedupValuesOption sets the DedupValues option.
+func DedupValuesOption(dedup bool) Option {
+	return func(opts *Options) {
+		opts.DedupValues = dedup
+	}
+}
+
+// TracerOption sets the Tracer option.
+func TracerOption(tracer Tracer) Option {
+	return func(opts *Options) {
+		opts.Tracer = tracer
+	}
+}
+
+// RetryPolicyOption sets the RetryPolicy option.
+func RetryPolicyOption(policy *RetryPolicy) Option {
+	return func(opts *Options) {
+		opts.RetryPolicy = policy
+	}
+}
+
+// MinRetainVersionsOption sets the MinRetainVersions option.
+func MinRetainVersionsOption(minRetain int64) Option {
+	return func(opts *Options) {
+		opts.MinRetainVersions = minRetain
+	}
+}
+
+// UndoVersionsOption sets the UndoVersions option.
+func UndoVersionsOption(versions int64) Option {
+	return func(opts *Options) {
+		opts.UndoVersions = versions
+	}
+}
+
+// OrphanIndexOption sets the OrphanIndex option.
+func OrphanIndexOption(index bool) Option {
+	return func(opts *Options) {
+		opts.OrphanIndex = index
+	}
+}
+
+// OnEvictOption sets the OnEvict option.
+func OnEvictOption(onEvict func(dbKey []byte)) Option {
+	return func(opts *Options) {
+		opts.OnEvict = onEvict
+	}
+}
+
+// OnCorruptNodeOption sets the OnCorruptNode option.
+func OnCorruptNodeOption(hook func(dbKey, raw []byte, err error) error) Option {
+	return func(opts *Options) {
+		opts.OnCorruptNode = hook
+	}
+}
+
+// AutoCompactThresholdOption sets the AutoCompactThreshold option.
+func AutoCompactThresholdOption(threshold *AutoCompactThreshold) Option {
+	return func(opts *Options) {
+		opts.AutoCompactThreshold = threshold
+	}
+}
+
+// EnableValueIndexOption sets the EnableValueIndex option.
+func EnableValueIndexOption(enable bool) Option {
+	return func(opts *Options) {
+		opts.EnableValueIndex = enable
+	}
+}
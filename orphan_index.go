@@ -0,0 +1,92 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// indexOrphans writes the orphan index entry of the given version, which holds the db keys of the
+// nodes of the version orphaned by the next one, see Options.OrphanIndex. Both versions must be
+// committed. The entry starts with the number of keys, so that it is never empty.
+func (ndb *nodeDB) indexOrphans(version int64) error {
+	var (
+		buf   bytes.Buffer
+		count uint64
+	)
+	if err := ndb.traverseOrphanKeys(newRootkeyCache(), version, version+1, true, func(key []byte) error {
+		count++
+		return encoding.EncodeBytes(&buf, key)
+	}); err != nil {
+		return err
+	}
+	bz := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+buf.Len()), count)
+	return ndb.batch.Set(orphanIndexKeyFormat.Key(version), append(bz, buf.Bytes()...))
+}
+
+// getOrphanIndex returns the db keys held by the orphan index entry of the given version, or nil if
+// the version is not indexed.
+func (ndb *nodeDB) getOrphanIndex(version int64) ([][]byte, error) {
+	bz, err := ndb.db.Get(orphanIndexKeyFormat.Key(version))
+	if err != nil || bz == nil {
+		return nil, err
+	}
+	count, n := binary.Uvarint(bz)
+	if n <= 0 || count > uint64(len(bz)) {
+		return nil, errors.New("invalid orphan index entry")
+	}
+	bz = bz[n:]
+	keys := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, n, err := encoding.DecodeBytes(bz)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		bz = bz[n:]
+	}
+	return keys, nil
+}
+
+// IndexOrphans writes the orphan index entries of the stored versions which have none, see
+// Options.OrphanIndex, e.g. after enabling it on an existing db. A version is indexed if the next
+// version is stored too, and it is not a legacy version. The entries are committed version by
+// version, so an interrupted run can be resumed. It returns the number of indexed versions.
+func (tree *MutableTree) IndexOrphans() (int, error) {
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return 0, err
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	var indexed int
+	for version := max(firstVersion, legacyLatestVersion+1); version < latestVersion; version++ {
+		if !tree.versionExists(version) || !tree.versionExists(version+1) {
+			continue
+		}
+		bz, err := tree.ndb.db.Get(orphanIndexKeyFormat.Key(version))
+		if err != nil {
+			return indexed, err
+		}
+		if bz != nil {
+			continue
+		}
+		if err := tree.ndb.indexOrphans(version); err != nil {
+			return indexed, err
+		}
+		if err := tree.ndb.Commit(); err != nil {
+			return indexed, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
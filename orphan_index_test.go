@@ -0,0 +1,134 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// readCountingDB counts the reads of the db.
+type readCountingDB struct {
+	*dbm.MemDB
+	reads int
+}
+
+func (db *readCountingDB) Get(key []byte) ([]byte, error) {
+	db.reads++
+	return db.MemDB.Get(key)
+}
+
+// saveOrphanIndexWorkload saves the given number of versions of random updates and removals.
+func saveOrphanIndexWorkload(t *testing.T, tree *MutableTree, versions int) {
+	r := rand.New(rand.NewSource(1))
+	for v := 0; v < versions; v++ {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("k%05d", r.Intn(5000)))
+			if r.Intn(5) == 0 {
+				_, _, err := tree.Remove(key)
+				require.NoError(t, err)
+				continue
+			}
+			_, err := tree.Set(key, []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		if v%7 == 3 {
+			// an unchanged version is saved with a reference root
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+// dbEntries returns the entries of the db, but for the orphan index ones.
+func dbEntries(t *testing.T, db *dbm.MemDB) map[string]string {
+	entries := make(map[string]string)
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if itr.Key()[0] != orphanIndexKeyFormat.Prefix()[0] {
+			entries[string(itr.Key())] = string(itr.Value())
+		}
+	}
+	return entries
+}
+
+func TestOrphanIndex(t *testing.T) {
+	plainDB := &readCountingDB{MemDB: dbm.NewMemDB()}
+	plain := NewMutableTree(plainDB, 0, true, NewNopLogger())
+	saveOrphanIndexWorkload(t, plain, 30)
+
+	indexedDB := &readCountingDB{MemDB: dbm.NewMemDB()}
+	indexed := NewMutableTree(indexedDB, 0, true, NewNopLogger(), OrphanIndexOption(true))
+	saveOrphanIndexWorkload(t, indexed, 30)
+	latest := indexed.Version()
+	for version := int64(1); version < latest; version++ {
+		keys, err := indexed.ndb.getOrphanIndex(version)
+		require.NoError(t, err)
+		require.NotNil(t, keys, "version %d", version)
+	}
+	keys, err := indexed.ndb.getOrphanIndex(latest)
+	require.NoError(t, err)
+	require.Nil(t, keys)
+
+	// pruning deletes the same keys, reading the index instead of the nodes
+	plainDB.reads, indexedDB.reads = 0, 0
+	require.NoError(t, plain.DeleteVersionsTo(25))
+	require.NoError(t, indexed.DeleteVersionsTo(25))
+	t.Logf("pruning reads: %d without the orphan index, %d with it", plainDB.reads, indexedDB.reads)
+	require.Less(t, indexedDB.reads*10, plainDB.reads)
+	require.Equal(t, dbEntries(t, plainDB.MemDB), dbEntries(t, indexedDB.MemDB))
+	for version := int64(1); version <= 25; version++ {
+		bz, err := indexedDB.Get(orphanIndexKeyFormat.Key(version))
+		require.NoError(t, err)
+		require.Nil(t, bz)
+	}
+	for version := int64(26); version <= latest; version++ {
+		_, err := indexed.GetImmutable(version)
+		require.NoError(t, err)
+	}
+
+	// deleting versions deletes the entries derived from them
+	require.NoError(t, indexed.DeleteVersionsFrom(latest-1))
+	for _, version := range []int64{latest - 2, latest - 1} {
+		keys, err := indexed.ndb.getOrphanIndex(version)
+		require.NoError(t, err)
+		require.Nil(t, keys)
+	}
+	keys, err = indexed.ndb.getOrphanIndex(latest - 3)
+	require.NoError(t, err)
+	require.NotNil(t, keys)
+}
+
+func TestIndexOrphans(t *testing.T) {
+	expectedDB := dbm.NewMemDB()
+	expected := NewMutableTree(expectedDB, 0, true, NewNopLogger())
+	saveOrphanIndexWorkload(t, expected, 20)
+	require.NoError(t, expected.DeleteVersionsTo(15))
+
+	// an existing db is indexed
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	saveOrphanIndexWorkload(t, tree, 20)
+	latest := tree.Version()
+	require.NoError(t, tree.DeleteVersionsTo(3))
+
+	reopened := NewMutableTree(db, 0, true, NewNopLogger(), OrphanIndexOption(true))
+	_, err := reopened.Load()
+	require.NoError(t, err)
+	count, err := reopened.IndexOrphans()
+	require.NoError(t, err)
+	require.Equal(t, int(latest-4), count)
+	count, err = reopened.IndexOrphans()
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	require.NoError(t, reopened.DeleteVersionsTo(15))
+	require.Equal(t, dbEntries(t, expectedDB), dbEntries(t, db))
+}
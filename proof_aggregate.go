@@ -0,0 +1,304 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// AggregateProof proves the existence of a set of keys against a single root hash. It is the
+// part of the tree made of the paths from the root to the leaves of the keys: the ancestors the
+// keys share appear once, and only the hashes of the subtrees off the paths are included, while
+// the others are recomputed by the verifier. It is thus smaller than a proof per key, the more so
+// the more the keys share ancestors, e.g. for the neighboring keys of a range.
+type AggregateProof struct {
+	root *aggregateProofNode
+}
+
+// aggregateProofNode is a node of an AggregateProof: a leaf, an inner node on the path to a
+// proven leaf, or the hash of a subtree off the paths.
+type aggregateProofNode struct {
+	hash        []byte // set only for a subtree off the paths
+	height      int8
+	size        int64
+	version     int64
+	key, value  []byte // set only for a leaf
+	left, right *aggregateProofNode
+}
+
+// the tags of the nodes in the encoding of an AggregateProof
+const (
+	aggregateProofLeaf byte = iota
+	aggregateProofInner
+	aggregateProofHash
+)
+
+// GetAggregateProof returns the aggregate proof of the existence of the given keys in the tree.
+// It fails if any of the keys does not exist.
+func (t *ImmutableTree) GetAggregateProof(keys [][]byte) (*AggregateProof, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys given")
+	}
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if t.root == nil {
+		return nil, fmt.Errorf("key %X does not exist", keys[0])
+	}
+	keys = slices.Clone(keys)
+	slices.SortFunc(keys, bytes.Compare)
+	keys = slices.CompactFunc(keys, bytes.Equal)
+
+	// the proof needs the hashes of the unsaved nodes too
+	t.Hash()
+	root, err := t.aggregateProofNode(t.root, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &AggregateProof{root: root}, nil
+}
+
+// aggregateProofNode returns the proof node of the subtree of the given node for the given keys,
+// which are sorted and belong to the subtree.
+func (t *ImmutableTree) aggregateProofNode(node *Node, keys [][]byte) (*aggregateProofNode, error) {
+	if len(keys) == 0 {
+		return &aggregateProofNode{hash: node.hash}, nil
+	}
+	version := t.version + 1
+	if node.nodeKey != nil {
+		version = node.nodeKey.version
+	}
+	if node.isLeaf() {
+		if len(keys) > 1 || !bytes.Equal(keys[0], node.key) {
+			return nil, fmt.Errorf("key %X does not exist", keys[0])
+		}
+		return &aggregateProofNode{version: version, key: node.key, value: node.value}, nil
+	}
+
+	// the keys less than the key of an inner node are in its left subtree
+	split, _ := slices.BinarySearchFunc(keys, node.key, bytes.Compare)
+	leftNode, err := node.getLeftNode(t)
+	if err != nil {
+		return nil, err
+	}
+	rightNode, err := node.getRightNode(t)
+	if err != nil {
+		return nil, err
+	}
+	left, err := t.aggregateProofNode(leftNode, keys[:split])
+	if err != nil {
+		return nil, err
+	}
+	right, err := t.aggregateProofNode(rightNode, keys[split:])
+	if err != nil {
+		return nil, err
+	}
+	return &aggregateProofNode{
+		height:  node.subtreeHeight,
+		size:    node.size,
+		version: version,
+		left:    left,
+		right:   right,
+	}, nil
+}
+
+// Verify checks that the proof proves the given keys with the given values against the root
+// hash. It returns ErrInvalidProof if it does not.
+func (p *AggregateProof) Verify(root []byte, keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return fmt.Errorf("%d keys given with %d values", len(keys), len(values))
+	}
+	leaves := make(map[string][]byte)
+	hash, err := p.root.computeHash(leaves)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+	if !bytes.Equal(hash, root) {
+		return fmt.Errorf("%w: root hash %X does not match %X", ErrInvalidProof, hash, root)
+	}
+	for i, key := range keys {
+		value, ok := leaves[string(key)]
+		if !ok {
+			return fmt.Errorf("%w: key %X is not proven", ErrInvalidProof, key)
+		}
+		if !bytes.Equal(value, values[i]) {
+			return fmt.Errorf("%w: value of key %X does not match", ErrInvalidProof, key)
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys proven by the proof, in ascending order.
+func (p *AggregateProof) Keys() [][]byte {
+	var keys [][]byte
+	var collect func(n *aggregateProofNode)
+	collect = func(n *aggregateProofNode) {
+		switch {
+		case n.key != nil:
+			keys = append(keys, n.key)
+		case n.hash == nil:
+			collect(n.left)
+			collect(n.right)
+		}
+	}
+	collect(p.root)
+	return keys
+}
+
+// computeHash computes the hash of the proof node, collecting the proven leaves.
+func (n *aggregateProofNode) computeHash(leaves map[string][]byte) ([]byte, error) {
+	switch {
+	case n.hash != nil:
+		return n.hash, nil
+	case n.key != nil:
+		valueHash := sha256.Sum256(n.value)
+		leaves[string(n.key)] = n.value
+		return ProofLeafNode{Key: n.key, ValueHash: valueHash[:], Version: n.version}.Hash()
+	}
+	if n.height <= 0 {
+		return nil, fmt.Errorf("invalid inner node height %d", n.height)
+	}
+	leftHash, err := n.left.computeHash(leaves)
+	if err != nil {
+		return nil, err
+	}
+	rightHash, err := n.right.computeHash(leaves)
+	if err != nil {
+		return nil, err
+	}
+	return ProofInnerNode{
+		Height:  n.height,
+		Size:    n.size,
+		Version: n.version,
+		Left:    leftHash,
+	}.Hash(rightHash)
+}
+
+// Marshal encodes the proof.
+func (p *AggregateProof) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.root.writeBytes(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *aggregateProofNode) writeBytes(buf *bytes.Buffer) error {
+	switch {
+	case n.hash != nil:
+		buf.WriteByte(aggregateProofHash)
+		return encoding.EncodeBytes(buf, n.hash)
+	case n.key != nil:
+		buf.WriteByte(aggregateProofLeaf)
+		if err := encoding.EncodeVarint(buf, n.version); err != nil {
+			return err
+		}
+		if err := encoding.EncodeBytes(buf, n.key); err != nil {
+			return err
+		}
+		return encoding.EncodeBytes(buf, n.value)
+	}
+	buf.WriteByte(aggregateProofInner)
+	for _, v := range []int64{int64(n.height), n.size, n.version} {
+		if err := encoding.EncodeVarint(buf, v); err != nil {
+			return err
+		}
+	}
+	if err := n.left.writeBytes(buf); err != nil {
+		return err
+	}
+	return n.right.writeBytes(buf)
+}
+
+// UnmarshalAggregateProof decodes a proof encoded by AggregateProof.Marshal.
+func UnmarshalAggregateProof(bz []byte) (*AggregateProof, error) {
+	// the keys and values of the proof are sub-slices of the buffer
+	bz = bytes.Clone(bz)
+	root, n, err := readAggregateProofNode(bz, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decoding aggregate proof: %w", err)
+	}
+	if n != len(bz) {
+		return nil, fmt.Errorf("decoding aggregate proof: %d trailing bytes", len(bz)-n)
+	}
+	return &AggregateProof{root: root}, nil
+}
+
+// readAggregateProofNode decodes a proof node at the given depth, returning it along with the
+// number of bytes read.
+func readAggregateProofNode(bz []byte, depth int) (*aggregateProofNode, int, error) {
+	// the height of a tree fits in an int8
+	if depth > 127 {
+		return nil, 0, errors.New("proof is too deep")
+	}
+	if len(bz) == 0 {
+		return nil, 0, errors.New("buffer too small")
+	}
+	tag, n := bz[0], 1
+
+	switch tag {
+	case aggregateProofHash:
+		hash, m, err := encoding.DecodeBytes(bz[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(hash) != sha256.Size {
+			return nil, 0, fmt.Errorf("invalid hash length %d", len(hash))
+		}
+		return &aggregateProofNode{hash: hash}, n + m, nil
+
+	case aggregateProofLeaf:
+		node := &aggregateProofNode{}
+		version, m, err := encoding.DecodeVarint(bz[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		n += m
+		node.version = version
+		if node.key, m, err = encoding.DecodeBytes(bz[n:]); err != nil {
+			return nil, 0, err
+		}
+		n += m
+		if len(node.key) == 0 {
+			return nil, 0, errors.New("empty leaf key")
+		}
+		if node.value, m, err = encoding.DecodeBytes(bz[n:]); err != nil {
+			return nil, 0, err
+		}
+		return node, n + m, nil
+
+	case aggregateProofInner:
+		var fields [3]int64
+		for i := range fields {
+			v, m, err := encoding.DecodeVarint(bz[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			fields[i] = v
+			n += m
+		}
+		if fields[0] <= 0 || fields[0] > 127 {
+			return nil, 0, fmt.Errorf("invalid inner node height %d", fields[0])
+		}
+		node := &aggregateProofNode{height: int8(fields[0]), size: fields[1], version: fields[2]}
+		var m int
+		var err error
+		if node.left, m, err = readAggregateProofNode(bz[n:], depth+1); err != nil {
+			return nil, 0, err
+		}
+		n += m
+		if node.right, m, err = readAggregateProofNode(bz[n:], depth+1); err != nil {
+			return nil, 0, err
+		}
+		return node, n + m, nil
+
+	default:
+		return nil, 0, fmt.Errorf("invalid node tag %d", tag)
+	}
+}
@@ -0,0 +1,362 @@
+package iavl
+
+import (
+	"errors"
+	"math/bits"
+	"sync"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// ProofExporter exports the key/value pairs of an ImmutableTree in ascending key order, each with
+// its existence proof against the root hash of the tree, so that a consumer can verify every pair
+// without trusting the source of the export. It is created by ImmutableTree.ExportWithProofs().
+//
+// A proof holds an inner op of roughly 70 bytes per level of the tree on top of the leaf op, so
+// the export is about log2(n)·70 bytes per pair larger than a plain one, e.g. 1.5KB per pair for
+// a tree of a million keys. The proofs are generated along the traversal: the inner op of a node
+// is computed once per child it is descended to, and shared by the proofs of all the leaves below,
+// so the proofs must not be modified. The memory used is bounded by the tree height.
+//
+// With ProofExportWorkersOption, the proofs are generated by a pool of workers, each exporting a
+// subtree, and are still returned in ascending key order, identical to a sequential export.
+type ProofExporter struct {
+	tree    *ImmutableTree
+	path    []proofExportStep // the inner nodes from the root to the next leaf
+	base    int               // the leading steps of the path above the exported subtree
+	leaf    *Node             // the next leaf, nil when done
+	err     error
+	prehash bool
+
+	pool *proofExportPool // the workers generating the proofs, if any
+}
+
+// ProofExportOption configures ImmutableTree.ExportWithProofs.
+type ProofExportOption func(*proofExportOptions)
+
+type proofExportOptions struct {
+	workers int
+}
+
+// ProofExportWorkersOption generates the proofs of the export with the given number of workers,
+// each exporting a different subtree. The pairs and proofs are returned in the same order, and are
+// identical, whatever the number of workers. A number below 2 exports sequentially.
+func ProofExportWorkersOption(workers int) ProofExportOption {
+	return func(opts *proofExportOptions) {
+		opts.workers = workers
+	}
+}
+
+// proofExportStep is an inner node on the path to the next leaf, with its inner op for the child
+// descended to.
+type proofExportStep struct {
+	node  *Node
+	right bool
+	op    *ics23.InnerOp
+}
+
+// ExportWithProofs returns an exporter streaming the key/value pairs of the tree with their
+// existence proofs. Callers must call Close on the exporter when done.
+func (t *ImmutableTree) ExportWithProofs(options ...ProofExportOption) *ProofExporter {
+	opts := proofExportOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	e := &ProofExporter{
+		tree:    t,
+		prehash: t.prehashValuesInProofs(),
+	}
+	if t.ndb != nil {
+		t.ndb.incrVersionReaders(t.version)
+	}
+	if t.root != nil {
+		// the proofs need the hashes of the unsaved nodes too
+		t.Hash()
+		if opts.workers > 1 {
+			e.pool, e.err = e.startPool(opts.workers)
+		} else {
+			e.err = e.descend(t.root)
+		}
+	}
+	return e
+}
+
+// Next returns the next key/value pair with its existence proof, or ErrorExportDone when done.
+func (e *ProofExporter) Next() (key, value []byte, proof *ics23.CommitmentProof, err error) {
+	if e.pool != nil && e.err == nil {
+		key, value, proof, e.err = e.pool.next()
+		return key, value, proof, e.err
+	}
+	return e.next()
+}
+
+// next returns the next key/value pair of the traversal with its existence proof.
+func (e *ProofExporter) next() (key, value []byte, proof *ics23.CommitmentProof, err error) {
+	if e.err != nil {
+		return nil, nil, nil, e.err
+	}
+	if e.leaf == nil {
+		return nil, nil, nil, ErrorExportDone
+	}
+
+	leaf := e.leaf
+	leafVersion := e.tree.version + 1
+	if leaf.nodeKey != nil {
+		leafVersion = leaf.nodeKey.version
+	}
+	exist := &ics23.ExistenceProof{
+		Key:   leaf.key,
+		Value: leaf.value,
+		Leaf:  convertLeafOp(leafVersion),
+		Path:  make([]*ics23.InnerOp, len(e.path)),
+	}
+	for i, step := range e.path {
+		// the path of a proof goes up from the leaf to the root
+		exist.Path[len(e.path)-1-i] = step.op
+	}
+	if e.prehash {
+		exist.Value = PrehashValue(leaf.value)
+		exist.Leaf.PrehashValue = ics23.HashOp_NO_HASH
+	}
+
+	if e.err = e.advance(); e.err != nil {
+		return nil, nil, nil, e.err
+	}
+	return leaf.key, leaf.value, &ics23.CommitmentProof{
+		Proof: &ics23.CommitmentProof_Exist{Exist: exist},
+	}, nil
+}
+
+// advance moves to the leaf following the current one.
+func (e *ProofExporter) advance() error {
+	for len(e.path) > e.base && e.path[len(e.path)-1].right {
+		e.path = e.path[:len(e.path)-1]
+	}
+	if len(e.path) == e.base {
+		e.leaf = nil
+		return nil
+	}
+	step := &e.path[len(e.path)-1]
+	op, err := e.innerOp(step.node, true)
+	if err != nil {
+		return err
+	}
+	step.right, step.op = true, op
+	rightNode, err := step.node.getRightNode(e.tree)
+	if err != nil {
+		return err
+	}
+	return e.descend(rightNode)
+}
+
+// descend pushes the path from the given node to its leftmost leaf.
+func (e *ProofExporter) descend(node *Node) error {
+	for !node.isLeaf() {
+		op, err := e.innerOp(node, false)
+		if err != nil {
+			return err
+		}
+		e.path = append(e.path, proofExportStep{node: node, op: op})
+		if node, err = node.getLeftNode(e.tree); err != nil {
+			return err
+		}
+	}
+	e.leaf = node
+	return nil
+}
+
+// innerOp returns the inner op of the node for the proofs of the leaves below its right child if
+// right is set, or its left child otherwise.
+func (e *ProofExporter) innerOp(node *Node, right bool) (*ics23.InnerOp, error) {
+	version := e.tree.version + 1
+	if node.nodeKey != nil {
+		version = node.nodeKey.version
+	}
+	pin := ProofInnerNode{
+		Height:  node.subtreeHeight,
+		Size:    node.size,
+		Version: version,
+	}
+	if right {
+		leftNode, err := node.getLeftNode(e.tree)
+		if err != nil {
+			return nil, err
+		}
+		pin.Left = leftNode.hash
+	} else {
+		rightNode, err := node.getRightNode(e.tree)
+		if err != nil {
+			return nil, err
+		}
+		pin.Right = rightNode.hash
+	}
+	return convertInnerOps(PathToLeaf{pin})[0], nil
+}
+
+// Close closes the exporter. It is safe to call multiple times.
+func (e *ProofExporter) Close() {
+	if e.pool != nil {
+		// the workers read the nodes of the version, so they are stopped first
+		e.pool.stop()
+		e.pool = nil
+	}
+	if e.tree != nil && e.tree.ndb != nil {
+		e.tree.ndb.decrVersionReaders(e.tree.version)
+	}
+	e.tree = nil
+	e.path, e.leaf = nil, nil
+}
+
+// proofExportBatchSize is the number of proofs a worker hands over at once.
+const proofExportBatchSize = 64
+
+// proofExportPool is a pool of workers generating the proofs of an export, see
+// ProofExportWorkersOption. The tree is split into subtrees, which the workers take in key order,
+// each exporting its subtree into a channel of its own, and the channels are read in key order.
+// Since a subtree is only taken after all the previous ones, the one being read is always being
+// exported, and the workers blocked on a full channel only wait for it.
+type proofExportPool struct {
+	parts   []*ProofExporter
+	results []chan proofExportBatch
+	current int
+	batch   proofExportBatch
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// proofExportBatch is a batch of proofs of a subtree, along with the error ending its export.
+type proofExportBatch struct {
+	items []proofExportItem
+	err   error
+}
+
+type proofExportItem struct {
+	key, value []byte
+	proof      *ics23.CommitmentProof
+}
+
+// startPool splits the tree into about 4 subtrees per worker and starts the workers exporting
+// them. The subtrees are the nodes at a given depth, or the leaves above it.
+func (e *ProofExporter) startPool(workers int) (*proofExportPool, error) {
+	depth := bits.Len(uint(workers*4 - 1))
+	pool := &proofExportPool{done: make(chan struct{})}
+	var split func(node *Node, path []proofExportStep) error
+	split = func(node *Node, path []proofExportStep) error {
+		if len(path) == depth || node.isLeaf() {
+			part := &ProofExporter{
+				tree:    e.tree,
+				path:    path,
+				base:    len(path),
+				prehash: e.prehash,
+			}
+			part.err = part.descend(node)
+			pool.parts = append(pool.parts, part)
+			return nil
+		}
+		for _, right := range []bool{false, true} {
+			op, err := e.innerOp(node, right)
+			if err != nil {
+				return err
+			}
+			child, err := node.getLeftNode(e.tree)
+			if right {
+				child, err = node.getRightNode(e.tree)
+			}
+			if err != nil {
+				return err
+			}
+			// the path is copied, since the subtrees below both children share its prefix
+			childPath := append(append(make([]proofExportStep, 0, len(path)+1), path...), proofExportStep{node: node, right: right, op: op})
+			if err := split(child, childPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := split(e.tree.root, nil); err != nil {
+		return nil, err
+	}
+
+	pool.results = make([]chan proofExportBatch, len(pool.parts))
+	for i := range pool.results {
+		pool.results[i] = make(chan proofExportBatch, 1)
+	}
+	jobs := make(chan int, len(pool.parts))
+	for i := range pool.parts {
+		jobs <- i
+	}
+	close(jobs)
+	for i := 0; i < min(workers, len(pool.parts)); i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for i := range jobs {
+				select {
+				case <-pool.done:
+					return
+				default:
+				}
+				if !pool.export(pool.parts[i], pool.results[i]) {
+					return
+				}
+			}
+		}()
+	}
+	return pool, nil
+}
+
+// export exports a subtree into its channel in batches, and closes it. It returns false if the
+// pool is stopped.
+func (p *proofExportPool) export(part *ProofExporter, results chan<- proofExportBatch) bool {
+	defer close(results)
+	var batch proofExportBatch
+	for {
+		key, value, proof, err := part.next()
+		if err == nil {
+			batch.items = append(batch.items, proofExportItem{key: key, value: value, proof: proof})
+			if len(batch.items) < proofExportBatchSize {
+				continue
+			}
+		} else if !errors.Is(err, ErrorExportDone) {
+			batch.err = err
+		}
+		if len(batch.items) > 0 || batch.err != nil {
+			select {
+			case results <- batch:
+			case <-p.done:
+				return false
+			}
+		}
+		if err != nil {
+			return true
+		}
+		batch = proofExportBatch{}
+	}
+}
+
+// next returns the next key/value pair with its existence proof, in key order.
+func (p *proofExportPool) next() (key, value []byte, proof *ics23.CommitmentProof, err error) {
+	for len(p.batch.items) == 0 {
+		if p.batch.err != nil {
+			return nil, nil, nil, p.batch.err
+		}
+		if p.current == len(p.results) {
+			return nil, nil, nil, ErrorExportDone
+		}
+		batch, ok := <-p.results[p.current]
+		if !ok {
+			p.current++
+			continue
+		}
+		p.batch = batch
+	}
+	item := p.batch.items[0]
+	p.batch.items = p.batch.items[1:]
+	return item.key, item.value, item.proof, nil
+}
+
+// stop stops the workers and waits for them to return.
+func (p *proofExportPool) stop() {
+	close(p.done)
+	p.wg.Wait()
+}
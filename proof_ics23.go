@@ -1,17 +1,62 @@
 package iavl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 
 	ics23 "github.com/cosmos/ics23/go"
 )
 
+// IavlPrehashedValueSpec is the ProofSpec of the proofs generated with the PrehashValuesInProofs
+// option. It is ics23.IavlSpec, except that the value has already been hashed with SHA256 by the
+// verifier, so the leaf op does not hash it again. Proofs for this spec carry the value hash,
+// and must be verified with PrehashValue(value) as the value.
+var IavlPrehashedValueSpec = &ics23.ProofSpec{
+	LeafSpec: &ics23.LeafOp{
+		Prefix:       ics23.IavlSpec.LeafSpec.Prefix,
+		PrehashKey:   ics23.IavlSpec.LeafSpec.PrehashKey,
+		Hash:         ics23.IavlSpec.LeafSpec.Hash,
+		PrehashValue: ics23.HashOp_NO_HASH,
+		Length:       ics23.IavlSpec.LeafSpec.Length,
+	},
+	InnerSpec: ics23.IavlSpec.InnerSpec,
+}
+
+// PrehashValue returns the value hash embedded in the proofs for IavlPrehashedValueSpec.
+func PrehashValue(value []byte) []byte {
+	hash := sha256.Sum256(value)
+	return hash[:]
+}
+
+// ProofSpec returns the ProofSpec the proofs of the tree must be verified against.
+func (t *ImmutableTree) ProofSpec() *ics23.ProofSpec {
+	if t.prehashValuesInProofs() {
+		return IavlPrehashedValueSpec
+	}
+	return ics23.IavlSpec
+}
+
+func (t *ImmutableTree) prehashValuesInProofs() bool {
+	return t.ndb != nil && t.ndb.opts.PrehashValuesInProofs
+}
+
 /*
 GetMembershipProof will produce a CommitmentProof that the given key (and queries value) exists in the iavl tree.
 If the key doesn't exist in the tree, this will return an error.
+Note that ics23 verifiers reject empty values, so a proof for a key stored with an empty value
+cannot be verified against the IAVL spec.
+The proof is minimal for the IAVL spec: it holds one inner op per node on the path to the leaf,
+and every op only holds the bytes hashed with the child hash, i.e. the height, size and version
+of the node and the hash of the other child, so no op can be dropped or shortened.
 */
 func (t *ImmutableTree) GetMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	defer t.ndb.tracer().StartSpan("ImmutableTree.GetMembershipProof").End()
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
 	exist, err := t.createExistenceProof(key)
 	if err != nil {
 		return nil, err
@@ -30,9 +75,49 @@ func (t *ImmutableTree) VerifyMembership(proof *ics23.CommitmentProof, key []byt
 	if err != nil {
 		return false, err
 	}
+	if t.prehashValuesInProofs() && val != nil {
+		val = PrehashValue(val)
+	}
 	root := t.Hash()
 
-	return ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, val), nil
+	return ics23.VerifyMembership(t.ProofSpec(), root, proof, key, val), nil
+}
+
+// VerifyValuePredicate verifies that the membership proof proves the key under the given root
+// hash, then returns whether the proven value satisfies the predicate, e.g. a balance above a
+// threshold. It returns ErrInvalidProof without evaluating the predicate if the proof does not
+// verify. The proof is verified against ics23.IavlSpec, since the predicate needs the value
+// itself, so the proofs of trees with PrehashValuesInProofs are not supported.
+func VerifyValuePredicate(proof *ics23.CommitmentProof, root, key []byte, pred func(value []byte) bool) (bool, error) {
+	exist := proof.GetExist()
+	if exist == nil {
+		return false, fmt.Errorf("%w: not a membership proof", ErrInvalidProof)
+	}
+	if !ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, exist.Value) {
+		return false, fmt.Errorf("%w: membership of key %X", ErrInvalidProof, key)
+	}
+	return pred(exist.Value), nil
+}
+
+// MembershipProofItem is a key and value to verify the membership proof of, see
+// VerifyMembershipBatch.
+type MembershipProofItem struct {
+	Key   []byte
+	Value []byte
+	Proof *ics23.CommitmentProof
+}
+
+// VerifyMembershipBatch verifies the membership proofs of the items under the given root hash,
+// stopping at the first proof which does not verify. It returns the index of this item along with
+// an error wrapping ErrInvalidProof, or -1 if all the proofs verify. The proofs are verified
+// against ics23.IavlSpec, so the proofs of trees with PrehashValuesInProofs are not supported.
+func VerifyMembershipBatch(root []byte, items []MembershipProofItem) (firstFailedIndex int, err error) {
+	for i, item := range items {
+		if item.Proof == nil || !ics23.VerifyMembership(ics23.IavlSpec, root, item.Proof, item.Key, item.Value) {
+			return i, fmt.Errorf("%w: membership of key %X at index %d", ErrInvalidProof, item.Key, i)
+		}
+	}
+	return -1, nil
 }
 
 /*
@@ -40,6 +125,7 @@ GetNonMembershipProof will produce a CommitmentProof that the given key doesn't
 If the key exists in the tree, this will return an error.
 */
 func (t *ImmutableTree) GetNonMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	defer t.ndb.tracer().StartSpan("ImmutableTree.GetNonMembershipProof").End()
 	// idx is one node right of what we want....
 	var err error
 	idx, val, err := t.GetWithIndex(key)
@@ -88,28 +174,46 @@ func (t *ImmutableTree) GetNonMembershipProof(key []byte) (*ics23.CommitmentProo
 	return proof, nil
 }
 
-// VerifyNonMembership returns true iff proof is a NonExistenceProof for the given key.
+// VerifyNonMembership returns true iff proof is a NonExistenceProof for the given key. For an
+// empty tree, it is the empty-tree proof of GetNonMembershipProof, which has no neighbors, and
+// which the ics23 verifiers reject since it does not commit to the root hash.
 func (t *ImmutableTree) VerifyNonMembership(proof *ics23.CommitmentProof, key []byte) (bool, error) {
+	if t.root == nil {
+		nonexist := proof.GetNonexist()
+		return nonexist != nil && bytes.Equal(nonexist.Key, key) && nonexist.Left == nil && nonexist.Right == nil, nil
+	}
 	root := t.Hash()
 
-	return ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key), nil
+	return ics23.VerifyNonMembership(t.ProofSpec(), root, proof, key), nil
 }
 
 // createExistenceProof will get the proof from the tree and convert the proof into a valid
 // existence proof, if that's what it is.
 func (t *ImmutableTree) createExistenceProof(key []byte) (*ics23.ExistenceProof, error) {
+	if t.root == nil {
+		return nil, fmt.Errorf("%w: %X", ErrKeyDoesNotExist, key)
+	}
 	t.Hash()
 	path, node, err := t.root.PathToLeaf(t, key, t.version+1)
+	if err != nil {
+		return nil, err
+	}
 	nodeVersion := t.version + 1
 	if node.nodeKey != nil {
 		nodeVersion = node.nodeKey.version
 	}
-	return &ics23.ExistenceProof{
+	proof := &ics23.ExistenceProof{
 		Key:   node.key,
 		Value: node.value,
 		Leaf:  convertLeafOp(nodeVersion),
 		Path:  convertInnerOps(path),
-	}, err
+	}
+	if t.prehashValuesInProofs() {
+		// the leaf hash is computed over the value hash, so hashing it here yields the same leaf
+		proof.Value = PrehashValue(node.value)
+		proof.Leaf.PrehashValue = ics23.HashOp_NO_HASH
+	}
+	return proof, nil
 }
 
 func convertLeafOp(version int64) *ics23.LeafOp {
@@ -174,10 +278,11 @@ func convertVarIntToBytes(orig int64, buf [binary.MaxVarintLen64]byte) []byte {
 	return buf[:n]
 }
 
-// GetProof gets the proof for the given key.
+// GetProof gets the proof for the given key. The proof of an empty tree is the empty-tree proof,
+// a non-existence proof without neighbors, see VerifyNonMembership.
 func (t *ImmutableTree) GetProof(key []byte) (*ics23.CommitmentProof, error) {
-	if t.root == nil {
-		return nil, errors.New("cannot generate the proof with nil root")
+	if err := validateKey(key); err != nil {
+		return nil, err
 	}
 
 	exist, err := t.Has(key)
@@ -210,3 +315,58 @@ func (tree *MutableTree) GetVersionedProof(key []byte, version int64) (*ics23.Co
 	}
 	return nil, ErrVersionDoesNotExist
 }
+
+// GetChangedKeyProofs returns the proofs against the root of the given version of the watched
+// keys which the version set or deleted, keyed by the key as a string: a membership proof for a
+// key set, and a non-membership proof for a key deleted. The watched keys unchanged by the version
+// are omitted, so that the proofs can be pushed to the light clients watching the keys.
+func (tree *MutableTree) GetChangedKeyProofs(version int64, watched [][]byte) (map[string]*ics23.CommitmentProof, error) {
+	changed, err := tree.ChangedKeys(version)
+	if err != nil {
+		return nil, err
+	}
+	watchedSet := make(map[string]struct{}, len(watched))
+	for _, key := range watched {
+		watchedSet[string(key)] = struct{}{}
+	}
+
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	proofs := make(map[string]*ics23.CommitmentProof)
+	for _, key := range changed {
+		if _, ok := watchedSet[string(key)]; !ok {
+			continue
+		}
+		proof, err := t.GetProof(key)
+		if err != nil {
+			return nil, err
+		}
+		proofs[string(key)] = proof
+	}
+	return proofs, nil
+}
+
+// GetWorkingProof gets the proof for the given key in the working tree, i.e. including the
+// unsaved changes, along with the working root hash it verifies against. The working hash is the
+// hash the next SaveVersion returns, provided the working tree is not modified in between, so the
+// proof can be handed out before the version is saved.
+func (tree *MutableTree) GetWorkingProof(key []byte) (*ics23.CommitmentProof, []byte, error) {
+	// compute the working hashes first, since the unsaved nodes cache the hash computed with the
+	// version given to them
+	hash := tree.WorkingHash()
+	working := &ImmutableTree{
+		logger: tree.logger,
+		root:   tree.root,
+		ndb:    tree.ndb,
+		// the unsaved nodes are proven with the working version
+		version:                tree.WorkingVersion() - 1,
+		skipFastStorageUpgrade: true,
+	}
+	proof, err := working.GetProof(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proof, hash, nil
+}
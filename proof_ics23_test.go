@@ -3,7 +3,11 @@ package iavl
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	mrand "math/rand"
+	"slices"
 	"sort"
 	"testing"
 
@@ -200,6 +204,260 @@ func GetNonKey(allkeys [][]byte, loc Where) []byte {
 	return key
 }
 
+func TestRangeProofIterator(t *testing.T) {
+	tree, allkeys, err := BuildTree(1000, 0)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	// streamRange simulates a client which verifies the range entry by entry, tamper can alter
+	// the entries before they are verified.
+	streamRange := func(start, end []byte, tamper func(i int, entry *RangeProofEntry) *RangeProofEntry) (int, error) {
+		iter, err := tree.RangeProofIterator(start, end)
+		require.NoError(t, err)
+		defer iter.Close()
+
+		verifier, err := NewRangeProofVerifier(root, start, end, iter.LeftBoundary())
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for i := 0; iter.Valid(); iter.Next() {
+			entry := iter.Entry()
+			if tamper != nil {
+				entry = tamper(i, entry)
+			}
+			i++
+			if entry == nil {
+				continue
+			}
+			if err := verifier.Verify(entry); err != nil {
+				return count, err
+			}
+			count++
+		}
+		require.NoError(t, iter.Error())
+		return count, verifier.Finish(iter.RightBoundary())
+	}
+
+	ranges := []struct {
+		start, end []byte
+		count      int
+	}{
+		{nil, nil, 1000},
+		{allkeys[100], allkeys[300], 200},
+		{nil, allkeys[10], 10},
+		{allkeys[990], nil, 10},
+		{allkeys[500], allkeys[501], 1},
+		{allkeys[500], append(allkeys[500], 0), 1},
+		{append(allkeys[500], 0), allkeys[501], 0},
+	}
+	for _, r := range ranges {
+		count, err := streamRange(r.start, r.end, nil)
+		require.NoError(t, err)
+		require.Equal(t, r.count, count)
+	}
+
+	start, end := allkeys[100], allkeys[300]
+	// a tampered value is rejected
+	_, err = streamRange(start, end, func(i int, entry *RangeProofEntry) *RangeProofEntry {
+		if i == 50 {
+			return &RangeProofEntry{Key: entry.Key, Value: []byte("tampered"), Proof: entry.Proof}
+		}
+		return entry
+	})
+	require.ErrorIs(t, err, ErrInvalidRangeProof)
+	// so is a tampered proof carrying the tampered value
+	_, err = streamRange(start, end, func(i int, entry *RangeProofEntry) *RangeProofEntry {
+		if i == 50 {
+			proof := *entry.Proof
+			proof.Value = []byte("tampered")
+			return &RangeProofEntry{Key: entry.Key, Value: proof.Value, Proof: &proof}
+		}
+		return entry
+	})
+	require.ErrorIs(t, err, ErrInvalidRangeProof)
+	// a withheld entry is detected
+	count, err := streamRange(start, end, func(i int, entry *RangeProofEntry) *RangeProofEntry {
+		if i == 50 {
+			return nil
+		}
+		return entry
+	})
+	require.ErrorIs(t, err, ErrInvalidRangeProof)
+	require.Equal(t, 50, count)
+	// so is a truncated range
+	_, err = streamRange(start, end, func(i int, entry *RangeProofEntry) *RangeProofEntry {
+		if i == 199 {
+			return nil
+		}
+		return entry
+	})
+	require.ErrorIs(t, err, ErrInvalidRangeProof)
+
+	// so is the last key dropped from a range claimed to reach the end of the tree
+	_, err = streamRange(allkeys[990], nil, func(i int, entry *RangeProofEntry) *RangeProofEntry {
+		if i == 9 {
+			return nil
+		}
+		return entry
+	})
+	require.ErrorIs(t, err, ErrInvalidRangeProof)
+	require.ErrorContains(t, err, "received 9 entries out of 10")
+
+	// an empty tree proves empty ranges only
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	iter, err := empty.RangeProofIterator(nil, nil)
+	require.NoError(t, err)
+	require.False(t, iter.Valid())
+	require.NoError(t, iter.Close())
+	verifier, err := NewRangeProofVerifier(empty.Hash(), nil, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, verifier.Finish(nil))
+	verifier, err = NewRangeProofVerifier(root, nil, nil, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, verifier.Finish(nil), ErrInvalidRangeProof)
+}
+
+func TestMutableTree_GetWorkingProof(t *testing.T) {
+	for _, opts := range [][]Option{nil, {InitialVersionOption(10)}} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), opts...)
+		for _, key := range []string{"a", "c", "e", "g"} {
+			_, err := tree.Set([]byte(key), []byte("v1"))
+			require.NoError(t, err)
+		}
+		// the first version is proven before any version is saved
+		proof, hash, err := tree.GetWorkingProof([]byte("c"))
+		require.NoError(t, err)
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, hash, proof, []byte("c"), []byte("v1")))
+		savedHash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, savedHash, hash)
+
+		_, err = tree.Set([]byte("c"), []byte("v2"))
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("d"), []byte("v2"))
+		require.NoError(t, err)
+		_, _, err = tree.Remove([]byte("e"))
+		require.NoError(t, err)
+
+		members := map[string]string{"a": "v1", "c": "v2", "d": "v2", "g": "v1"}
+		var hash2 []byte
+		for key, value := range members {
+			proof, hash, err := tree.GetWorkingProof([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, tree.WorkingHash(), hash)
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, hash, proof, []byte(key), []byte(value)), key)
+			hash2 = hash
+		}
+		for _, key := range []string{"0", "e", "z"} {
+			proof, hash, err := tree.GetWorkingProof([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, hash, proof, []byte(key)), key)
+		}
+		// the proofs of the saved version are unaffected
+		proof, err = tree.GetVersionedProof([]byte("e"), tree.Version())
+		require.NoError(t, err)
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, savedHash, proof, []byte("e"), []byte("v1")))
+
+		savedHash, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, savedHash, hash2)
+	}
+}
+
+func TestExistenceProofIndex(t *testing.T) {
+	tree, allkeys, err := BuildTree(300, 0)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for i, key := range allkeys {
+		proof, err := tree.createExistenceProof(key)
+		require.NoError(t, err)
+		index, size, err := ExistenceProofIndex(proof)
+		require.NoError(t, err)
+		require.Equal(t, int64(i), index)
+		require.Equal(t, int64(300), size)
+	}
+
+	iter, err := tree.RangeProofIterator(allkeys[10], allkeys[20])
+	require.NoError(t, err)
+	defer iter.Close()
+	verifier, err := NewRangeProofVerifier(tree.Hash(), allkeys[10], allkeys[20], iter.LeftBoundary())
+	require.NoError(t, err)
+	require.Equal(t, int64(300), verifier.TreeSize())
+	for ; iter.Valid(); iter.Next() {
+		require.NoError(t, verifier.Verify(iter.Entry()))
+	}
+	require.NoError(t, verifier.Finish(iter.RightBoundary()))
+	require.Equal(t, int64(10), verifier.Count())
+
+	// a proof whose prefix is not an IAVL node is rejected
+	proof, err := tree.createExistenceProof(allkeys[0])
+	require.NoError(t, err)
+	proof.Path[0].Prefix = append(proof.Path[0].Prefix, 0)
+	_, _, err = ExistenceProofIndex(proof)
+	require.Error(t, err)
+}
+
+func TestPrehashValuesInProofs(t *testing.T) {
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	prehashed := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), PrehashValuesInProofsOption(true))
+	bigValue := bytes.Repeat([]byte{0xab}, 100000)
+	for _, tree := range []*MutableTree{plain, prehashed} {
+		for _, key := range []string{"a", "b", "d"} {
+			_, err := tree.Set([]byte(key), bigValue)
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	root := prehashed.Hash()
+	require.Equal(t, plain.Hash(), root)
+
+	require.Equal(t, ics23.IavlSpec, plain.ProofSpec())
+	spec := prehashed.ProofSpec()
+	require.Equal(t, IavlPrehashedValueSpec, spec)
+	require.False(t, spec.SpecEquals(ics23.IavlSpec))
+	require.Equal(t, ics23.HashOp_NO_HASH, spec.LeafSpec.PrehashValue)
+
+	plainProof, err := plain.GetMembershipProof([]byte("b"))
+	require.NoError(t, err)
+	proof, err := prehashed.GetMembershipProof([]byte("b"))
+	require.NoError(t, err)
+	require.Less(t, proof.Size()*100, plainProof.Size())
+
+	require.True(t, ics23.VerifyMembership(spec, root, proof, []byte("b"), PrehashValue(bigValue)))
+	require.False(t, ics23.VerifyMembership(spec, root, proof, []byte("b"), bigValue))
+	require.False(t, ics23.VerifyMembership(spec, root, proof, []byte("b"), PrehashValue([]byte("other"))))
+	require.False(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, []byte("b"), bigValue))
+	valid, err := prehashed.VerifyMembership(proof, []byte("b"))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	nonProof, err := prehashed.GetNonMembershipProof([]byte("c"))
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyNonMembership(spec, root, nonProof, []byte("c")))
+	valid, err = prehashed.VerifyNonMembership(nonProof, []byte("c"))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// range proofs carry the value hash too
+	iter, err := prehashed.RangeProofIterator([]byte("b"), []byte("c"))
+	require.NoError(t, err)
+	defer iter.Close()
+	verifier, err := NewRangeProofVerifier(root, []byte("b"), []byte("c"), iter.LeftBoundary())
+	require.NoError(t, err)
+	require.True(t, iter.Valid())
+	require.Equal(t, bigValue, iter.Entry().Value)
+	require.NoError(t, verifier.Verify(iter.Entry()))
+	iter.Next()
+	require.False(t, iter.Valid())
+	require.NoError(t, verifier.Finish(iter.RightBoundary()))
+}
+
 // BuildTree creates random key/values and stores in tree
 // returns a list of all keys in sorted order
 func BuildTree(size int, cacheSize int) (itree *MutableTree, keys [][]byte, err error) {
@@ -258,3 +516,448 @@ func BenchmarkConvertLeafOp(b *testing.B) {
 	}
 	sink = nil
 }
+
+func TestMutableTree_GetTransitionProof(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, values := range [][2]string{{"k1", "a"}, {"k2", "x"}, {"k1", "b"}} {
+		_, err := tree.Set([]byte(values[0]), []byte(values[1]))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// k1 changed from a to b
+	proof, err := tree.GetTransitionProof([]byte("k1"), 1, 3)
+	require.NoError(t, err)
+	v1, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, v1.Hash(), proof.FromRoot)
+	require.Equal(t, tree.Hash(), proof.ToRoot)
+	require.NoError(t, proof.Verify(ics23.IavlSpec, []byte("a"), []byte("b")))
+	require.ErrorIs(t, proof.Verify(ics23.IavlSpec, []byte("b"), []byte("b")), ErrInvalidTransitionProof)
+	require.ErrorIs(t, proof.Verify(ics23.IavlSpec, []byte("a"), []byte("a")), ErrInvalidTransitionProof)
+
+	// k2 did not change
+	proof, err = tree.GetTransitionProof([]byte("k2"), 2, 3)
+	require.NoError(t, err)
+	require.NotEqual(t, proof.FromRoot, proof.ToRoot)
+	require.NoError(t, proof.Verify(ics23.IavlSpec, []byte("x"), []byte("x")))
+
+	// tampered proofs are rejected
+	tampered := *proof
+	tampered.ToRoot = proof.FromRoot
+	require.ErrorIs(t, tampered.Verify(ics23.IavlSpec, []byte("x"), []byte("x")), ErrInvalidTransitionProof)
+	tampered = *proof
+	tampered.Key = []byte("k1")
+	require.ErrorIs(t, tampered.Verify(ics23.IavlSpec, []byte("x"), []byte("x")), ErrInvalidTransitionProof)
+	tampered = *proof
+	tampered.FromProof = nil
+	require.ErrorIs(t, tampered.Verify(ics23.IavlSpec, []byte("x"), []byte("x")), ErrInvalidTransitionProof)
+
+	_, err = tree.GetTransitionProof([]byte("k2"), 1, 3)
+	require.Error(t, err)
+	_, err = tree.GetTransitionProof([]byte("k1"), 1, 4)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.GetTransitionProof([]byte("k1"), 3, 1)
+	require.Error(t, err)
+}
+
+func TestBuildPartialTree(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i*2)), []byte(fmt.Sprintf("v%02d", i*2)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	leaf := func(tree *MutableTree, key string) LeafProof {
+		proof, err := tree.GetMembershipProof([]byte(key))
+		require.NoError(t, err)
+		value, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		return LeafProof{Key: []byte(key), Value: value, Proof: proof.GetExist()}
+	}
+	leaves := []LeafProof{leaf(tree, "k04"), leaf(tree, "k06"), leaf(tree, "k08"), leaf(tree, "k20"), leaf(tree, "k38")}
+
+	pt, err := BuildPartialTree(leaves)
+	require.NoError(t, err)
+	require.Equal(t, tree.Hash(), pt.Hash())
+	require.Equal(t, int64(20), pt.Size())
+
+	value, err := pt.Get([]byte("k06"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v06"), value)
+	has, err := pt.Has([]byte("k38"))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// absent between neighbors and after the rightmost key
+	for _, key := range []string{"k05", "k07", "k39", "z"} {
+		has, err := pt.Has([]byte(key))
+		require.NoError(t, err, key)
+		require.False(t, has, key)
+	}
+	// not covered, whether present or absent in the tree
+	for _, key := range []string{"k00", "k03", "k10", "k11", "k30", "k37", "a"} {
+		_, err := pt.Get([]byte(key))
+		require.ErrorIs(t, err, ErrKeyNotCovered, key)
+		_, err = pt.Has([]byte(key))
+		require.ErrorIs(t, err, ErrKeyNotCovered, key)
+	}
+
+	// the leftmost key covers the keys before it
+	pt, err = BuildPartialTree([]LeafProof{leaf(tree, "k00")})
+	require.NoError(t, err)
+	has, err = pt.Has([]byte("a"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// invalid leaves
+	_, err = BuildPartialTree(nil)
+	require.Error(t, err)
+	_, err = BuildPartialTree([]LeafProof{leaves[1], leaves[0]})
+	require.Error(t, err)
+	tampered := leaf(tree, "k04")
+	tampered.Value = []byte("other")
+	_, err = BuildPartialTree([]LeafProof{tampered, leaves[1]})
+	require.ErrorIs(t, err, ErrInvalidProof)
+
+	// all the leaves must be proven against the same root
+	_, err = tree.Set([]byte("k50"), []byte("v50"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = BuildPartialTree([]LeafProof{leaves[0], leaf(tree, "k06")})
+	require.ErrorIs(t, err, ErrInvalidProof)
+}
+
+func TestVerifyValuePredicate(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		balance := make([]byte, 8)
+		binary.BigEndian.PutUint64(balance, uint64(i*100))
+		_, err := tree.Set([]byte(fmt.Sprintf("account%02d", i)), balance)
+		require.NoError(t, err)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	key := []byte("account07")
+	proof, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	atLeast := func(x uint64) func([]byte) bool {
+		return func(value []byte) bool {
+			return binary.BigEndian.Uint64(value) >= x
+		}
+	}
+
+	ok, err := VerifyValuePredicate(proof, root, key, atLeast(500))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = VerifyValuePredicate(proof, root, key, atLeast(800))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// a tampered value, a wrong key or root fail the verification
+	tampered, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	tampered.GetExist().Value = binary.BigEndian.AppendUint64(nil, 10000)
+	_, err = VerifyValuePredicate(tampered, root, key, atLeast(500))
+	require.ErrorIs(t, err, ErrInvalidProof)
+	_, err = VerifyValuePredicate(proof, root, []byte("account08"), atLeast(500))
+	require.ErrorIs(t, err, ErrInvalidProof)
+	_, err = VerifyValuePredicate(proof, bytes.Repeat([]byte{1}, 32), key, atLeast(500))
+	require.ErrorIs(t, err, ErrInvalidProof)
+
+	nonMembership, err := tree.GetNonMembershipProof([]byte("account99"))
+	require.NoError(t, err)
+	_, err = VerifyValuePredicate(nonMembership, root, []byte("account99"), atLeast(0))
+	require.ErrorIs(t, err, ErrInvalidProof)
+}
+
+func TestExportWithProofs(t *testing.T) {
+	for _, prehash := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), PrehashValuesInProofsOption(prehash))
+		r := mrand.New(mrand.NewSource(0))
+		for i := 0; i < 300; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%05d", r.Intn(1000))), []byte(fmt.Sprintf("v%d", i)))
+			require.NoError(t, err)
+		}
+		root, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+
+		spec := ics23.IavlSpec
+		if prehash {
+			spec = IavlPrehashedValueSpec
+		}
+		exporter := itree.ExportWithProofs()
+		var count int64
+		var prev []byte
+		for {
+			key, value, proof, err := exporter.Next()
+			if errors.Is(err, ErrorExportDone) {
+				break
+			}
+			require.NoError(t, err)
+			require.True(t, prev == nil || bytes.Compare(prev, key) < 0)
+			if prehash {
+				value = PrehashValue(value)
+			}
+			require.True(t, ics23.VerifyMembership(spec, root, proof, key, value), "key %s", key)
+			prev = key
+			count++
+		}
+		exporter.Close()
+		exporter.Close()
+		require.Equal(t, itree.Size(), count)
+	}
+
+	exporter := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).ImmutableTree.ExportWithProofs()
+	defer exporter.Close()
+	_, _, _, err := exporter.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+}
+
+func TestExportWithProofsWorkers(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	r := mrand.New(mrand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%05d", r.Intn(5000))), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	root, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// a tree without a node cache reads the nodes from the db
+	reloaded := NewMutableTree(tree.ndb.db, 0, false, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	itree, err := reloaded.GetImmutable(version)
+	require.NoError(t, err)
+
+	export := func(options ...ProofExportOption) [][]byte {
+		exporter := itree.ExportWithProofs(options...)
+		defer exporter.Close()
+		var out [][]byte
+		for {
+			key, value, proof, err := exporter.Next()
+			if errors.Is(err, ErrorExportDone) {
+				break
+			}
+			require.NoError(t, err)
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value), "key %s", key)
+			bz, err := proof.Marshal()
+			require.NoError(t, err)
+			out = append(out, key, value, bz)
+		}
+		return out
+	}
+	expected := export()
+	require.Len(t, expected, 3*int(itree.Size()))
+	for _, workers := range []int{1, 2, 4, 8, 100} {
+		require.Equal(t, expected, export(ProofExportWorkersOption(workers)), "workers %d", workers)
+	}
+
+	// closing before the end stops the workers
+	exporter := itree.ExportWithProofs(ProofExportWorkersOption(4))
+	_, _, _, err = exporter.Next()
+	require.NoError(t, err)
+	exporter.Close()
+	exporter.Close()
+	_, _, _, err = exporter.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+
+	// a single leaf and an empty tree
+	single := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err = single.Set([]byte("a"), []byte("b"))
+	require.NoError(t, err)
+	exporter = single.ImmutableTree.ExportWithProofs(ProofExportWorkersOption(4))
+	key, _, _, err := exporter.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), key)
+	_, _, _, err = exporter.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+	exporter.Close()
+
+	exporter = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).ImmutableTree.ExportWithProofs(ProofExportWorkersOption(4))
+	defer exporter.Close()
+	_, _, _, err = exporter.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+}
+
+func TestGetChangedKeyProofs(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range []string{"a", "b", "c", "d"} {
+		_, err := tree.Set([]byte(key), []byte("v1"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("a"), []byte("v2"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("d"), []byte("v2"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("e"), []byte("v2"))
+	require.NoError(t, err)
+	root, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	watched := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("e"), []byte("z")}
+	proofs, err := tree.GetChangedKeyProofs(version, watched)
+	require.NoError(t, err)
+	require.Len(t, proofs, 3)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proofs["a"], []byte("a"), []byte("v2")))
+	require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proofs["b"], []byte("b")))
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proofs["e"], []byte("e"), []byte("v2")))
+
+	_, err = tree.GetChangedKeyProofs(version+1, watched)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestAggregateProof(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	root, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	r := mrand.New(mrand.NewSource(0))
+	sets := map[string][]int{
+		"scattered": r.Perm(1000)[:20],
+		"range":     {500, 501, 502, 503, 504, 505, 506, 507, 508, 509, 510, 511, 512, 513, 514, 515, 516, 517, 518, 519},
+	}
+	for name, indexes := range sets {
+		keys := make([][]byte, len(indexes))
+		values := make([][]byte, len(indexes))
+		separateSize := 0
+		for i, index := range indexes {
+			keys[i] = []byte(fmt.Sprintf("k%04d", index))
+			values[i] = []byte(fmt.Sprintf("v%d", index))
+			proof, err := itree.GetMembershipProof(keys[i])
+			require.NoError(t, err)
+			bz, err := proof.Marshal()
+			require.NoError(t, err)
+			separateSize += len(bz)
+		}
+
+		proof, err := itree.GetAggregateProof(keys)
+		require.NoError(t, err)
+		bz, err := proof.Marshal()
+		require.NoError(t, err)
+		t.Logf("%s: %d keys, aggregate proof %d bytes, separate proofs %d bytes", name, len(keys), len(bz), separateSize)
+		require.Less(t, len(bz), separateSize)
+
+		proof, err = UnmarshalAggregateProof(bz)
+		require.NoError(t, err)
+		require.Len(t, proof.Keys(), len(keys))
+		require.NoError(t, proof.Verify(root, keys, values))
+
+		// a tampered value, an unproven key or another root fail
+		values[0] = []byte("tampered")
+		require.ErrorIs(t, proof.Verify(root, keys, values), ErrInvalidProof)
+		values[0] = []byte(fmt.Sprintf("v%d", indexes[0]))
+		require.ErrorIs(t, proof.Verify(root, [][]byte{[]byte("k9999")}, [][]byte{[]byte("v")}), ErrInvalidProof)
+		require.ErrorIs(t, proof.Verify([]byte("another root"), keys, values), ErrInvalidProof)
+
+		bz[len(bz)-1] ^= 0xFF
+		proof, err = UnmarshalAggregateProof(bz)
+		if err == nil {
+			require.ErrorIs(t, proof.Verify(root, keys, values), ErrInvalidProof)
+		}
+	}
+
+	_, err = itree.GetAggregateProof([][]byte{[]byte("k0001"), []byte("missing")})
+	require.Error(t, err)
+	_, err = UnmarshalAggregateProof([]byte{aggregateProofInner, 2, 2})
+	require.Error(t, err)
+}
+
+func TestGetMembershipProofMinimal(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	r := mrand.New(mrand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%05d", r.Intn(100000))), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	varintLen := func(v int64) int {
+		return len(binary.AppendVarint(nil, v))
+	}
+	for i := int64(0); i < tree.Size(); i += 37 {
+		key, value, err := tree.GetByIndex(i)
+		require.NoError(t, err)
+		proof, err := tree.GetMembershipProof(key)
+		require.NoError(t, err)
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value))
+
+		// one op per inner node on the path, holding only the preimage of the node hash but the
+		// child hash
+		pathToLeaf, _, err := tree.root.PathToLeaf(tree.ImmutableTree, key, tree.version+1)
+		require.NoError(t, err)
+		exist := proof.GetExist()
+		require.Len(t, exist.Path, len(pathToLeaf))
+		for j, op := range exist.Path {
+			node := pathToLeaf[len(pathToLeaf)-1-j]
+			header := varintLen(int64(node.Height)) + varintLen(node.Size) + varintLen(node.Version)
+			// the length prefixed sibling hash and the length prefix of the child hash
+			require.Equal(t, header+1+hashSize+1, len(op.Prefix)+len(op.Suffix))
+
+			// dropping any op breaks the proof
+			dropped := *exist
+			dropped.Path = append(append([]*ics23.InnerOp(nil), exist.Path[:j]...), exist.Path[j+1:]...)
+			require.False(t, ics23.VerifyMembership(ics23.IavlSpec, root,
+				&ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Exist{Exist: &dropped}}, key, value))
+		}
+		require.Equal(t, varintLen(0)+varintLen(1)+varintLen(tree.version), len(exist.Leaf.Prefix))
+	}
+}
+
+func TestVerifyMembershipBatch(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%02d", i)))
+		require.NoError(t, err)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	items := make([]MembershipProofItem, 5)
+	for i := range items {
+		key := []byte(fmt.Sprintf("key%02d", i*3))
+		proof, err := tree.GetMembershipProof(key)
+		require.NoError(t, err)
+		items[i] = MembershipProofItem{Key: key, Value: []byte(fmt.Sprintf("value%02d", i*3)), Proof: proof}
+	}
+
+	idx, err := VerifyMembershipBatch(root, items)
+	require.NoError(t, err)
+	require.Equal(t, -1, idx)
+
+	// an empty batch is trivially valid
+	idx, err = VerifyMembershipBatch(root, nil)
+	require.NoError(t, err)
+	require.Equal(t, -1, idx)
+
+	// the first failure is reported, even if a later item fails too
+	invalid := slices.Clone(items)
+	invalid[2].Value = []byte("tampered")
+	invalid[4].Proof = nil
+	idx, err = VerifyMembershipBatch(root, invalid)
+	require.ErrorIs(t, err, ErrInvalidProof)
+	require.Equal(t, 2, idx)
+
+	idx, err = VerifyMembershipBatch([]byte("wrong root"), items)
+	require.ErrorIs(t, err, ErrInvalidProof)
+	require.Equal(t, 0, idx)
+}
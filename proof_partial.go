@@ -0,0 +1,128 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// ErrKeyNotCovered is returned by PartialTree when the presence of a key is not determined by the
+// leaves the partial tree was built from.
+var ErrKeyNotCovered = errors.New("key is not covered by the partial tree")
+
+// LeafProof is a key/value pair of a tree, together with its existence proof against the tree
+// root, as returned e.g. by RangeProofIterator.
+type LeafProof struct {
+	Key   []byte
+	Value []byte
+	Proof *ics23.ExistenceProof
+}
+
+// PartialTree is the part of a tree proven by a set of leaves, which can answer the queries for
+// the proven keys offline. Besides the proven keys, the keys between two proven keys which are
+// neighbors in the tree, or before the leftmost and after the rightmost key of the tree, are
+// known to be absent. The presence of any other key is unknown, and the queries for it fail with
+// ErrKeyNotCovered rather than reporting the key as absent.
+type PartialTree struct {
+	root    []byte
+	size    int64
+	leaves  []LeafProof
+	indexes []int64
+}
+
+// BuildPartialTree verifies the given leaves, which must be sorted by key, and returns the
+// partial tree they prove. All the proofs must commit to the same root hash, which the caller
+// must check against a trusted root hash with Hash.
+func BuildPartialTree(leaves []LeafProof) (*PartialTree, error) {
+	if len(leaves) == 0 {
+		return nil, errors.New("no leaves given")
+	}
+	if leaves[0].Proof == nil {
+		return nil, fmt.Errorf("%w: missing proof of key %X", ErrInvalidProof, leaves[0].Key)
+	}
+	root, err := leaves[0].Proof.Calculate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %X: %w", ErrInvalidProof, leaves[0].Key, err)
+	}
+
+	pt := &PartialTree{
+		root:    root,
+		size:    -1,
+		leaves:  make([]LeafProof, len(leaves)),
+		indexes: make([]int64, len(leaves)),
+	}
+	copy(pt.leaves, leaves)
+	for i, leaf := range pt.leaves {
+		if i > 0 && bytes.Compare(pt.leaves[i-1].Key, leaf.Key) >= 0 {
+			return nil, fmt.Errorf("leaves are not sorted by key at %X", leaf.Key)
+		}
+		if leaf.Proof == nil {
+			return nil, fmt.Errorf("%w: missing proof of key %X", ErrInvalidProof, leaf.Key)
+		}
+		spec, value := existenceProofSpec(leaf.Proof), leaf.Value
+		if spec == IavlPrehashedValueSpec {
+			value = PrehashValue(value)
+		}
+		if err := leaf.Proof.Verify(spec, root, leaf.Key, value); err != nil {
+			return nil, fmt.Errorf("%w: key %X: %w", ErrInvalidProof, leaf.Key, err)
+		}
+		index, size, err := ExistenceProofIndex(leaf.Proof)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %X: %w", ErrInvalidProof, leaf.Key, err)
+		}
+		if pt.size >= 0 && size != pt.size {
+			return nil, fmt.Errorf("%w: key %X is proven in a tree of %d keys instead of %d", ErrInvalidProof, leaf.Key, size, pt.size)
+		}
+		pt.size, pt.indexes[i] = size, index
+	}
+	return pt, nil
+}
+
+// Hash returns the root hash the leaves of the partial tree are proven against.
+func (pt *PartialTree) Hash() []byte {
+	return pt.root
+}
+
+// Size returns the number of keys of the whole tree.
+func (pt *PartialTree) Size() int64 {
+	return pt.size
+}
+
+// Get returns the value of the key, or nil if the key is known to be absent. It returns
+// ErrKeyNotCovered if the presence of the key is unknown.
+func (pt *PartialTree) Get(key []byte) ([]byte, error) {
+	i := sort.Search(len(pt.leaves), func(i int) bool {
+		return bytes.Compare(pt.leaves[i].Key, key) >= 0
+	})
+	if i < len(pt.leaves) && bytes.Equal(pt.leaves[i].Key, key) {
+		return pt.leaves[i].Value, nil
+	}
+
+	// the key would be right before the leaf i, so it is absent if the leaf i-1 is its left
+	// neighbor in the tree
+	prevIndex := int64(-1)
+	if i > 0 {
+		prevIndex = pt.indexes[i-1]
+	}
+	nextIndex := pt.size
+	if i < len(pt.leaves) {
+		nextIndex = pt.indexes[i]
+	}
+	if nextIndex == prevIndex+1 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w: %X", ErrKeyNotCovered, key)
+}
+
+// Has returns whether the key exists. It returns ErrKeyNotCovered if the presence of the key is
+// unknown.
+func (pt *PartialTree) Has(key []byte) (bool, error) {
+	value, err := pt.Get(key)
+	if err != nil {
+		return false, err
+	}
+	return value != nil, nil
+}
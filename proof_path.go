@@ -1,6 +1,7 @@
 package iavl
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 )
@@ -53,3 +54,67 @@ func (pl PathToLeaf) Index() (idx int64) {
 	}
 	return idx
 }
+
+// PathStep is a node on the path from the root to the leaf of a key, see ImmutableTree.ProofPath.
+type PathStep struct {
+	// Key, Hash, Height, Size and Version are those of the node.
+	Key     []byte
+	Hash    []byte
+	Height  int8
+	Size    int64
+	Version int64
+
+	// Right is whether the path goes down to the right child of the node, false for the leaf.
+	Right bool
+
+	// SiblingHash is the hash of the child of the node the path does not go down to, which is
+	// what the proof holds for the node, nil for the leaf.
+	SiblingHash []byte
+}
+
+func (ps PathStep) String() string {
+	if ps.Height == 0 {
+		return fmt.Sprintf("leaf %X (version %d) hash %X", ps.Key, ps.Version, ps.Hash)
+	}
+	direction := "left"
+	if ps.Right {
+		direction = "right"
+	}
+	return fmt.Sprintf("inner %X (height %d, size %d, version %d) hash %X: %s, sibling %X",
+		ps.Key, ps.Height, ps.Size, ps.Version, ps.Hash, direction, ps.SiblingHash)
+}
+
+// ProofPath returns the nodes on the path from the root to the leaf of the given key, or to the
+// leaf where it would be inserted if it does not exist, with the hashes a proof of the key is
+// built from, for debugging proofs. It returns an error if a node on the path is not saved yet,
+// and nil for an empty tree.
+func (t *ImmutableTree) ProofPath(key []byte) ([]PathStep, error) {
+	var path []PathStep
+	if err := t.walkPath(key, func(node *Node) error {
+		step := PathStep{
+			Key:     node.key,
+			Hash:    node.hash,
+			Height:  node.subtreeHeight,
+			Size:    node.size,
+			Version: node.nodeKey.version,
+		}
+		if !node.isLeaf() {
+			// the child on the path is loaded by the walk, only its sibling is loaded here
+			step.Right = bytes.Compare(key, node.key) >= 0
+			getSibling := node.getRightNode
+			if step.Right {
+				getSibling = node.getLeftNode
+			}
+			sibling, err := getSibling(t)
+			if err != nil {
+				return err
+			}
+			step.SiblingHash = sibling.hash
+		}
+		path = append(path, step)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
@@ -0,0 +1,379 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// ErrInvalidRangeProof is returned by RangeProofVerifier when a streamed entry does not prove
+// the range.
+var ErrInvalidRangeProof = errors.New("invalid range proof")
+
+// RangeProofEntry is a key/value pair yielded by RangeProofIterator, together with its existence
+// proof against the tree root.
+type RangeProofEntry struct {
+	Key   []byte
+	Value []byte
+	Proof *ics23.ExistenceProof
+}
+
+// RangeProofIterator iterates over the key/value pairs of the range [start, end) in ascending
+// order, and proves each entry on its own, so a client can verify a huge range one entry at a
+// time with RangeProofVerifier instead of holding a proof of the whole range. Besides the entry
+// proofs, it provides the proofs of the keys right outside of the range, which allow the client
+// to check that no key is left out at the edges of the range.
+//
+// The tree must not be modified while iterating. Callers must call Close() when done.
+type RangeProofIterator struct {
+	tree          *ImmutableTree
+	iter          corestore.Iterator
+	start, end    []byte
+	leftBoundary  *ics23.ExistenceProof
+	rightBoundary *ics23.ExistenceProof
+	entry         *RangeProofEntry
+	err           error
+}
+
+// RangeProofIterator returns an iterator over the proven entries of the range [start, end). If
+// either bound is nil, the range is open on that side.
+func (t *ImmutableTree) RangeProofIterator(start, end []byte) (*RangeProofIterator, error) {
+	start, end = normalizeBound(start), normalizeBound(end)
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, fmt.Errorf("invalid range [%X, %X)", start, end)
+	}
+
+	iter := &RangeProofIterator{
+		tree:  t,
+		start: start,
+		end:   end,
+	}
+	if t.root == nil {
+		return iter, nil
+	}
+
+	var err error
+	if start != nil {
+		if iter.leftBoundary, err = t.boundaryProof(start, -1); err != nil {
+			return nil, err
+		}
+	}
+	if end != nil {
+		if iter.rightBoundary, err = t.boundaryProof(end, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	iter.iter = NewIterator(start, end, true, t)
+	iter.next()
+	return iter, nil
+}
+
+// boundaryProof returns the existence proof of the key at the given offset from the index of
+// key, or nil if there is no such key.
+func (t *ImmutableTree) boundaryProof(key []byte, offset int64) (*ics23.ExistenceProof, error) {
+	idx, _, err := t.GetWithIndex(key)
+	if err != nil {
+		return nil, err
+	}
+	idx += offset
+	if idx < 0 || idx >= t.Size() {
+		return nil, nil
+	}
+	boundaryKey, _, err := t.GetByIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	return t.createExistenceProof(boundaryKey)
+}
+
+// Domain returns the bounds of the range, with empty bounds mapped to nil.
+func (iter *RangeProofIterator) Domain() ([]byte, []byte) {
+	return iter.start, iter.end
+}
+
+// LeftBoundary returns the existence proof of the greatest key lower than start, or nil if there
+// is none.
+func (iter *RangeProofIterator) LeftBoundary() *ics23.ExistenceProof {
+	return iter.leftBoundary
+}
+
+// RightBoundary returns the existence proof of the lowest key greater than or equal to end, or
+// nil if there is none.
+func (iter *RangeProofIterator) RightBoundary() *ics23.ExistenceProof {
+	return iter.rightBoundary
+}
+
+// Valid returns whether the iterator is positioned at an entry.
+func (iter *RangeProofIterator) Valid() bool {
+	return iter.entry != nil
+}
+
+// Entry returns the current entry.
+func (iter *RangeProofIterator) Entry() *RangeProofEntry {
+	return iter.entry
+}
+
+// Next moves the iterator to the next entry.
+func (iter *RangeProofIterator) Next() {
+	if iter.entry == nil {
+		return
+	}
+	iter.iter.Next()
+	iter.next()
+}
+
+func (iter *RangeProofIterator) next() {
+	iter.entry = nil
+	if !iter.iter.Valid() {
+		iter.err = iter.iter.Error()
+		return
+	}
+	proof, err := iter.tree.createExistenceProof(iter.iter.Key())
+	if err != nil {
+		iter.err = err
+		return
+	}
+	iter.entry = &RangeProofEntry{
+		Key:   iter.iter.Key(),
+		Value: iter.iter.Value(),
+		Proof: proof,
+	}
+}
+
+// Error returns the error encountered while iterating, if any.
+func (iter *RangeProofIterator) Error() error {
+	return iter.err
+}
+
+// Close releases the iterator.
+func (iter *RangeProofIterator) Close() error {
+	iter.entry = nil
+	if iter.iter == nil {
+		return nil
+	}
+	return iter.iter.Close()
+}
+
+// RangeProofVerifier verifies the entries of a RangeProofIterator one at a time against a root
+// hash. It only retains the proof of the last verified entry, so its memory does not grow with
+// the size of the range.
+//
+// Each entry is checked to exist under the root, to be within the range, and to be the right
+// neighbor of the previous entry in the tree, or of the left boundary for the first entry. Finish
+// then checks that the last entry is the left neighbor of the right boundary, which proves the
+// whole range has been received. The size of the tree and the index of every proven key are
+// committed to by the root hash, see ExistenceProofIndex, so Finish also checks that the number of
+// received entries is the number of keys between the boundaries.
+type RangeProofVerifier struct {
+	root       []byte
+	start, end []byte
+	prev       *ics23.ExistenceProof
+	empty      bool
+	// leftIndex is the index of the left boundary, or -1 if there is none.
+	leftIndex int64
+	treeSize  int64
+	count     int64
+}
+
+// NewRangeProofVerifier creates a verifier for the range [start, end) of the tree with the given
+// root hash. leftBoundary is RangeProofIterator.LeftBoundary() as received from the prover.
+func NewRangeProofVerifier(root, start, end []byte, leftBoundary *ics23.ExistenceProof) (*RangeProofVerifier, error) {
+	start, end = normalizeBound(start), normalizeBound(end)
+	v := &RangeProofVerifier{
+		root:      root,
+		start:     start,
+		end:       end,
+		empty:     bytes.Equal(root, sha256.New().Sum(nil)),
+		leftIndex: -1,
+		treeSize:  -1,
+	}
+	if leftBoundary != nil {
+		if start == nil || bytes.Compare(leftBoundary.Key, start) >= 0 {
+			return nil, fmt.Errorf("%w: left boundary %X is not lower than the range start", ErrInvalidRangeProof, leftBoundary.Key)
+		}
+		if err := leftBoundary.Verify(existenceProofSpec(leftBoundary), root, leftBoundary.Key, leftBoundary.Value); err != nil {
+			return nil, fmt.Errorf("%w: left boundary: %w", ErrInvalidRangeProof, err)
+		}
+		index, err := v.index(leftBoundary)
+		if err != nil {
+			return nil, err
+		}
+		v.prev, v.leftIndex = leftBoundary, index
+	}
+	return v, nil
+}
+
+// Verify verifies the next entry of the range.
+func (v *RangeProofVerifier) Verify(entry *RangeProofEntry) error {
+	if entry == nil || entry.Proof == nil {
+		return fmt.Errorf("%w: missing entry proof", ErrInvalidRangeProof)
+	}
+	if v.start != nil && bytes.Compare(entry.Key, v.start) < 0 {
+		return fmt.Errorf("%w: key %X is before the range start", ErrInvalidRangeProof, entry.Key)
+	}
+	if v.end != nil && bytes.Compare(entry.Key, v.end) >= 0 {
+		return fmt.Errorf("%w: key %X is after the range end", ErrInvalidRangeProof, entry.Key)
+	}
+	spec, value := existenceProofSpec(entry.Proof), entry.Value
+	if spec == IavlPrehashedValueSpec {
+		value = PrehashValue(value)
+	}
+	if !bytes.Equal(entry.Proof.Key, entry.Key) || !bytes.Equal(entry.Proof.Value, value) {
+		return fmt.Errorf("%w: proof does not match entry %X", ErrInvalidRangeProof, entry.Key)
+	}
+	if err := entry.Proof.Verify(spec, v.root, entry.Key, value); err != nil {
+		return fmt.Errorf("%w: entry %X: %w", ErrInvalidRangeProof, entry.Key, err)
+	}
+	if _, err := v.index(entry.Proof); err != nil {
+		return err
+	}
+	if err := v.checkNeighbor(entry.Proof); err != nil {
+		return err
+	}
+	v.prev = entry.Proof
+	v.count++
+	return nil
+}
+
+// TreeSize returns the number of keys of the tree, as proven by the proofs verified so far, or
+// -1 if no proof has been verified yet.
+func (v *RangeProofVerifier) TreeSize() int64 {
+	return v.treeSize
+}
+
+// Count returns the number of entries verified so far.
+func (v *RangeProofVerifier) Count() int64 {
+	return v.count
+}
+
+// Finish verifies that the range has been fully received. rightBoundary is
+// RangeProofIterator.RightBoundary() as received from the prover.
+func (v *RangeProofVerifier) Finish(rightBoundary *ics23.ExistenceProof) error {
+	if rightBoundary == nil {
+		if v.prev == nil {
+			if v.empty {
+				return nil
+			}
+			return fmt.Errorf("%w: no entry proven in a non-empty tree", ErrInvalidRangeProof)
+		}
+		if err := v.checkCount(v.treeSize); err != nil {
+			return err
+		}
+		if !ics23.IsRightMost(ics23.IavlSpec.InnerSpec, v.prev.Path) {
+			return fmt.Errorf("%w: last entry %X is not the rightmost key", ErrInvalidRangeProof, v.prev.Key)
+		}
+		return nil
+	}
+
+	if v.end == nil || bytes.Compare(rightBoundary.Key, v.end) < 0 {
+		return fmt.Errorf("%w: right boundary %X is not after the range end", ErrInvalidRangeProof, rightBoundary.Key)
+	}
+	if err := rightBoundary.Verify(existenceProofSpec(rightBoundary), v.root, rightBoundary.Key, rightBoundary.Value); err != nil {
+		return fmt.Errorf("%w: right boundary: %w", ErrInvalidRangeProof, err)
+	}
+	rightIndex, err := v.index(rightBoundary)
+	if err != nil {
+		return err
+	}
+	if err := v.checkCount(rightIndex); err != nil {
+		return err
+	}
+	return v.checkNeighbor(rightBoundary)
+}
+
+// index returns the index of the proven key, and checks that the proof agrees on the size of the
+// tree with the previous proofs.
+func (v *RangeProofVerifier) index(proof *ics23.ExistenceProof) (int64, error) {
+	index, size, err := ExistenceProofIndex(proof)
+	if err != nil {
+		return 0, fmt.Errorf("%w: key %X: %w", ErrInvalidRangeProof, proof.Key, err)
+	}
+	if v.treeSize >= 0 && size != v.treeSize {
+		return 0, fmt.Errorf("%w: key %X is proven in a tree of %d keys instead of %d", ErrInvalidRangeProof, proof.Key, size, v.treeSize)
+	}
+	v.treeSize = size
+	return index, nil
+}
+
+// checkCount checks that the entries received are all the keys between the left boundary and the
+// key at rightIndex.
+func (v *RangeProofVerifier) checkCount(rightIndex int64) error {
+	if expected := rightIndex - v.leftIndex - 1; v.count != expected {
+		return fmt.Errorf("%w: received %d entries out of %d", ErrInvalidRangeProof, v.count, expected)
+	}
+	return nil
+}
+
+// ExistenceProofIndex returns the index of the key proven by an IAVL existence proof among the
+// sorted keys of the tree, and the number of keys of the tree. Both are read from the heights and
+// sizes of the inner nodes on the path, which are hashed into the root, so they are authenticated
+// once the proof is verified against the root hash.
+func ExistenceProofIndex(proof *ics23.ExistenceProof) (index, size int64, err error) {
+	if proof == nil || proof.Leaf == nil {
+		return 0, 0, errors.New("missing leaf")
+	}
+	childHeight, childSize, _, rest, err := readNodePrefix(proof.Leaf.Prefix)
+	if err != nil || childHeight != 0 || childSize != 1 || len(rest) != 0 {
+		return 0, 0, errors.New("invalid leaf prefix")
+	}
+	for i, op := range proof.Path {
+		height, size, _, rest, err := readNodePrefix(op.Prefix)
+		if err != nil || height <= childHeight || size <= childSize {
+			return 0, 0, fmt.Errorf("invalid inner node %d", i)
+		}
+		switch {
+		case len(rest) == 1 && rest[0] == 0x20 && len(op.Suffix) == 1+hashSize && op.Suffix[0] == 0x20:
+			// the child is the left child, the keys of the right child follow the key
+		case len(rest) == 2+hashSize && rest[0] == 0x20 && rest[1+hashSize] == 0x20 && len(op.Suffix) == 0:
+			// the child is the right child, the keys of the left child precede the key
+			index += size - childSize
+		default:
+			return 0, 0, fmt.Errorf("invalid inner node %d", i)
+		}
+		childHeight, childSize = height, size
+	}
+	return index, childSize, nil
+}
+
+// readNodePrefix reads the height, size and version a node hash starts with.
+func readNodePrefix(prefix []byte) (height, size, version int64, rest []byte, err error) {
+	for _, field := range []*int64{&height, &size, &version} {
+		var n int
+		*field, n = binary.Varint(prefix)
+		if n <= 0 {
+			return 0, 0, 0, nil, errors.New("invalid varint")
+		}
+		prefix = prefix[n:]
+	}
+	return height, size, version, prefix, nil
+}
+
+// checkNeighbor checks that proof is the right neighbor of the previous proof, or the leftmost
+// key if there is none.
+func (v *RangeProofVerifier) checkNeighbor(proof *ics23.ExistenceProof) error {
+	if v.prev == nil {
+		if !ics23.IsLeftMost(ics23.IavlSpec.InnerSpec, proof.Path) {
+			return fmt.Errorf("%w: first key %X is not the leftmost key", ErrInvalidRangeProof, proof.Key)
+		}
+		return nil
+	}
+	if !ics23.IsLeftNeighbor(ics23.IavlSpec.InnerSpec, v.prev.Path, proof.Path) {
+		return fmt.Errorf("%w: key %X does not follow key %X", ErrInvalidRangeProof, proof.Key, v.prev.Key)
+	}
+	return nil
+}
+
+// existenceProofSpec returns the spec the proof was generated for, depending on whether the value
+// was prehashed. Both specs commit to the same root, so the prover is free to pick either.
+func existenceProofSpec(proof *ics23.ExistenceProof) *ics23.ProofSpec {
+	if proof.Leaf != nil && proof.Leaf.PrehashValue == ics23.HashOp_NO_HASH {
+		return IavlPrehashedValueSpec
+	}
+	return ics23.IavlSpec
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	dbm "github.com/cosmos/iavl/db"
 	iavlrand "github.com/cosmos/iavl/internal/rand"
 )
 
@@ -42,9 +43,12 @@ func TestTreeGetProof(t *testing.T) {
 func TestTreeKeyExistsProof(t *testing.T) {
 	tree := getTestTree(0)
 
-	// should get error
-	_, err := tree.GetProof([]byte("foo"))
-	assert.Error(t, err)
+	// an empty tree proves the absence of any key
+	proof, err := tree.GetProof([]byte("foo"))
+	require.NoError(t, err)
+	res, err := tree.VerifyProof(proof, []byte("foo"))
+	require.NoError(t, err)
+	assert.True(t, res)
 
 	// insert lots of info and store the bytes
 	allkeys := make([][]byte, 200)
@@ -126,3 +130,71 @@ func (bz byteslices) Less(i, j int) bool {
 func (bz byteslices) Swap(i, j int) {
 	bz[j], bz[i] = bz[i], bz[j]
 }
+
+func TestProofPath(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	path, err := tree.ImmutableTree.ProofPath([]byte("a"))
+	require.NoError(t, err)
+	require.Nil(t, path)
+
+	//        c
+	//      /   \
+	//     b     d
+	//    / \   / \
+	//   a   b c   d
+	for _, key := range []string{"a", "b", "c", "d"} {
+		_, err := tree.Set([]byte(key), []byte("value "+key))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	root := itree.root
+	left, err := root.getLeftNode(itree)
+	require.NoError(t, err)
+	right, err := root.getRightNode(itree)
+	require.NoError(t, err)
+	leaves := make(map[string]*Node)
+	for _, inner := range []*Node{left, right} {
+		for _, get := range []func(*ImmutableTree) (*Node, error){inner.getLeftNode, inner.getRightNode} {
+			leaf, err := get(itree)
+			require.NoError(t, err)
+			leaves[string(leaf.key)] = leaf
+		}
+	}
+
+	path, err = itree.ProofPath([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []PathStep{
+		{Key: []byte("c"), Hash: root.hash, Height: 2, Size: 4, Version: version, Right: false, SiblingHash: right.hash},
+		{Key: []byte("b"), Hash: left.hash, Height: 1, Size: 2, Version: version, Right: false, SiblingHash: leaves["b"].hash},
+		{Key: []byte("a"), Hash: leaves["a"].hash, Size: 1, Version: version},
+	}, path)
+
+	path, err = itree.ProofPath([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []PathStep{
+		{Key: []byte("c"), Hash: root.hash, Height: 2, Size: 4, Version: version, Right: true, SiblingHash: left.hash},
+		{Key: []byte("d"), Hash: right.hash, Height: 1, Size: 2, Version: version, Right: false, SiblingHash: leaves["d"].hash},
+		{Key: []byte("c"), Hash: leaves["c"].hash, Size: 1, Version: version},
+	}, path)
+
+	// an absent key leads to the leaf it would be inserted next to
+	path, err = itree.ProofPath([]byte("bb"))
+	require.NoError(t, err)
+	require.Len(t, path, 3)
+	require.Equal(t, []byte("b"), path[2].Key)
+
+	// the path holds the hashes of the proof, which goes from the leaf up, with the siblings on
+	// the right after the hash of the child
+	path, err = itree.ProofPath([]byte("a"))
+	require.NoError(t, err)
+	proof, err := itree.GetMembershipProof([]byte("a"))
+	require.NoError(t, err)
+	ops := proof.GetExist().Path
+	require.Len(t, ops, 2)
+	for i, op := range ops {
+		require.True(t, bytes.Contains(op.Suffix, path[1-i].SiblingHash))
+	}
+}
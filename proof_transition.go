@@ -0,0 +1,82 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// ErrInvalidTransitionProof is returned by TransitionProof.Verify when the proof does not prove
+// the transition.
+var ErrInvalidTransitionProof = errors.New("invalid transition proof")
+
+// TransitionProof proves the values a key held at two versions of the tree, by bundling the
+// membership proofs of the key at each version with the root hashes they verify against. The
+// root hashes are part of the proof, so the verifier must check them against the root hashes it
+// trusts for these versions.
+type TransitionProof struct {
+	Key         []byte
+	FromVersion int64
+	ToVersion   int64
+	FromRoot    []byte
+	ToRoot      []byte
+	FromProof   *ics23.CommitmentProof
+	ToProof     *ics23.CommitmentProof
+}
+
+// GetTransitionProof returns the proof that the key held its values at fromVersion and
+// toVersion. The key must exist at both versions.
+func (tree *MutableTree) GetTransitionProof(key []byte, fromVersion, toVersion int64) (*TransitionProof, error) {
+	if fromVersion > toVersion {
+		return nil, fmt.Errorf("from version %d is after to version %d", fromVersion, toVersion)
+	}
+	proof := &TransitionProof{
+		Key:         key,
+		FromVersion: fromVersion,
+		ToVersion:   toVersion,
+	}
+	var err error
+	if proof.FromRoot, proof.FromProof, err = tree.versionMembershipProof(key, fromVersion); err != nil {
+		return nil, err
+	}
+	if proof.ToRoot, proof.ToProof, err = tree.versionMembershipProof(key, toVersion); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+func (tree *MutableTree) versionMembershipProof(key []byte, version int64) ([]byte, *ics23.CommitmentProof, error) {
+	if !tree.VersionExists(version) {
+		return nil, nil, ErrVersionDoesNotExist
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := t.GetMembershipProof(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("version %d: %w", version, err)
+	}
+	return t.Hash(), proof, nil
+}
+
+// Verify verifies that the key held fromValue at the from version and toValue at the to version,
+// against the root hashes of the proof. The values are checked as the given spec expects them,
+// i.e. they must be prehashed with PrehashValue for IavlPrehashedValueSpec.
+func (p *TransitionProof) Verify(spec *ics23.ProofSpec, fromValue, toValue []byte) error {
+	if p.FromProof.GetExist() == nil || p.ToProof.GetExist() == nil {
+		return fmt.Errorf("%w: missing membership proof", ErrInvalidTransitionProof)
+	}
+	if !bytes.Equal(p.FromProof.GetExist().Key, p.Key) || !bytes.Equal(p.ToProof.GetExist().Key, p.Key) {
+		return fmt.Errorf("%w: proofs are not for key %X", ErrInvalidTransitionProof, p.Key)
+	}
+	if !ics23.VerifyMembership(spec, p.FromRoot, p.FromProof, p.Key, fromValue) {
+		return fmt.Errorf("%w: value at version %d", ErrInvalidTransitionProof, p.FromVersion)
+	}
+	if !ics23.VerifyMembership(spec, p.ToRoot, p.ToProof, p.Key, toValue) {
+		return fmt.Errorf("%w: value at version %d", ErrInvalidTransitionProof, p.ToVersion)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package iavl
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -66,3 +67,118 @@ func TestAsyncPruning(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestCoalescedPruning(t *testing.T) {
+	const versions, toVersion = 60, 40
+
+	// build the same history in several dbs, with versions without changes so that roots are
+	// referred to by later versions
+	newTree := func() (*MutableTree, *dbm.MemDB) {
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, false, NewNopLogger())
+		r := rand.New(rand.NewSource(1))
+		for v := 1; v <= versions; v++ {
+			if v%5 != 0 {
+				for i := 0; i < 20; i++ {
+					key := []byte(fmt.Sprintf("key-%d", r.Intn(100)))
+					if r.Intn(3) == 0 {
+						_, _, err := tree.Remove(key)
+						require.NoError(t, err)
+						continue
+					}
+					_, err := tree.Set(key, []byte(fmt.Sprintf("value-%d-%d", v, i)))
+					require.NoError(t, err)
+				}
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		return tree, db
+	}
+	dump := func(db *dbm.MemDB) map[string]string {
+		contents := map[string]string{}
+		iter, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			contents[string(iter.Key())] = string(iter.Value())
+		}
+		return contents
+	}
+
+	// prune version by version
+	sequential, sequentialDB := newTree()
+	for v := int64(1); v <= toVersion; v++ {
+		require.NoError(t, sequential.DeleteVersionsTo(v))
+	}
+	require.NoError(t, sequential.ndb.Commit())
+
+	// prune the whole range at once, and in small chunks
+	coalesced, coalescedDB := newTree()
+	require.NoError(t, coalesced.DeleteVersionsTo(toVersion))
+	require.NoError(t, coalesced.ndb.Commit())
+
+	defer func(max int) { maxPendingPruneOps = max }(maxPendingPruneOps)
+	maxPendingPruneOps = 10
+	chunked, chunkedDB := newTree()
+	require.NoError(t, chunked.DeleteVersionsTo(toVersion))
+	require.NoError(t, chunked.ndb.Commit())
+
+	require.Equal(t, dump(sequentialDB), dump(coalescedDB))
+	require.Equal(t, dump(sequentialDB), dump(chunkedDB))
+
+	// count the references to the stored nodes from the surviving versions: every node of a
+	// surviving version must exist, and every stored node must be referenced
+	tree := NewMutableTree(coalescedDB, 0, false, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, toVersion+1, tree.AvailableVersions()[0])
+	refs := map[string]int{}
+	for v := int64(toVersion + 1); v <= versions; v++ {
+		require.NoError(t, tree.VerifyVersion(v))
+		rootKey, err := tree.ndb.GetRoot(v)
+		require.NoError(t, err)
+		iter, err := NewNodeIterator(rootKey, tree.ndb)
+		require.NoError(t, err)
+		for ; iter.Valid(); iter.Next(false) {
+			key := tree.ndb.nodeKey(iter.GetNode().GetKey())
+			if has, err := coalescedDB.Has(key); err == nil && !has {
+				// a root reformatted by the pruning
+				key = tree.ndb.nodeKey((&NodeKey{version: iter.GetNode().nodeKey.version}).GetKey())
+			}
+			refs[string(key)]++
+		}
+		require.NoError(t, iter.Error())
+	}
+	err = tree.ndb.traversePrefix(nodeKeyFormat.Prefix(), func(key, value []byte) error {
+		if isRef, _ := isReferenceRoot(value); isRef {
+			return nil
+		}
+		require.Positive(t, refs[string(key)], "unreferenced node %X", key)
+		delete(refs, string(key))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, refs, "referenced nodes missing from the db")
+}
+
+func TestMinRetainVersions(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), MinRetainVersionsOption(3))
+	for v := 0; v < 10; v++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", v)), []byte("v"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// deleting to version 7 would only retain versions 8 to 10
+	require.NoError(t, tree.DeleteVersionsTo(7))
+	require.Equal(t, []int{8, 9, 10}, tree.AvailableVersions())
+
+	err := tree.DeleteVersionsTo(8)
+	require.ErrorIs(t, err, ErrMinRetainVersions)
+	require.Equal(t, []int{8, 9, 10}, tree.AvailableVersions())
+
+	require.NoError(t, tree.ForceDeleteVersionsTo(8))
+	require.Equal(t, []int{9, 10}, tree.AvailableVersions())
+}
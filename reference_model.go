@@ -0,0 +1,287 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// ErrModelMismatch is returned when a tree does not match its ReferenceModel.
+var ErrModelMismatch = errors.New("tree does not match the reference model")
+
+// ReferenceModel is a simple implementation of the key-value semantics of a tree, which property
+// tests compare the tree against across random operations, see RunModelOps. MapModel is the
+// built-in one.
+type ReferenceModel interface {
+	// Get returns the value of the key, or nil if it is absent.
+	Get(key []byte) []byte
+
+	// Set sets the value of the key, and returns whether the key existed.
+	Set(key, value []byte) (updated bool)
+
+	// Remove removes the key, and returns its value and whether it existed.
+	Remove(key []byte) (value []byte, removed bool)
+
+	// Iterate calls fn with the pairs in the domain [start, end), in ascending or descending key
+	// order, until fn returns true. A nil start or end is unbounded.
+	Iterate(start, end []byte, ascending bool, fn func(key, value []byte) bool)
+}
+
+// ModelTree is the read API of a tree compared with a ReferenceModel, implemented by both
+// MutableTree, including its unsaved changes, and ImmutableTree.
+type ModelTree interface {
+	Get(key []byte) ([]byte, error)
+	Iterator(start, end []byte, ascending bool) (corestore.Iterator, error)
+}
+
+var (
+	_ ModelTree      = (*MutableTree)(nil)
+	_ ModelTree      = (*ImmutableTree)(nil)
+	_ ReferenceModel = (*MapModel)(nil)
+)
+
+// MapModel is a ReferenceModel backed by a map, which sorts the keys on each iteration.
+type MapModel struct {
+	pairs map[string][]byte
+}
+
+// NewMapModel returns an empty MapModel.
+func NewMapModel() *MapModel {
+	return &MapModel{pairs: make(map[string][]byte)}
+}
+
+// Get implements ReferenceModel.
+func (m *MapModel) Get(key []byte) []byte {
+	return m.pairs[string(key)]
+}
+
+// Set implements ReferenceModel.
+func (m *MapModel) Set(key, value []byte) bool {
+	_, updated := m.pairs[string(key)]
+	m.pairs[string(key)] = bytes.Clone(value)
+	return updated
+}
+
+// Remove implements ReferenceModel.
+func (m *MapModel) Remove(key []byte) ([]byte, bool) {
+	value, removed := m.pairs[string(key)]
+	delete(m.pairs, string(key))
+	return value, removed
+}
+
+// Iterate implements ReferenceModel.
+func (m *MapModel) Iterate(start, end []byte, ascending bool, fn func(key, value []byte) bool) {
+	keys := make([]string, 0, len(m.pairs))
+	for key := range m.pairs {
+		if (start == nil || key >= string(start)) && (end == nil || key < string(end)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for i := range keys {
+		key := keys[i]
+		if !ascending {
+			key = keys[len(keys)-1-i]
+		}
+		if fn([]byte(key), m.pairs[key]) {
+			return
+		}
+	}
+}
+
+// ModelOp is a random operation applied to both a tree and a ReferenceModel: a removal of the key
+// if Value is nil, a set otherwise.
+type ModelOp struct {
+	Key, Value []byte
+}
+
+func (op ModelOp) String() string {
+	if op.Value == nil {
+		return fmt.Sprintf("REMOVE %X", op.Key)
+	}
+	return fmt.Sprintf("SET %X=%X", op.Key, op.Value)
+}
+
+// ModelOpGenerator draws random operations, with the keys and values of the given distributions,
+// so callers can fuzz their own key distributions.
+type ModelOpGenerator struct {
+	// Key draws the key of an operation, UniformKeys(256) if nil.
+	Key func(r *rand.Rand) []byte
+
+	// Value draws the value of a set, a random one if nil. It must not return nil.
+	Value func(r *rand.Rand) []byte
+
+	// RemoveRatio is the share of the removals among the operations.
+	RemoveRatio float64
+}
+
+// Ops draws n random operations.
+func (g ModelOpGenerator) Ops(r *rand.Rand, n int) []ModelOp {
+	key, value := g.Key, g.Value
+	if key == nil {
+		key = UniformKeys(256)
+	}
+	if value == nil {
+		value = func(r *rand.Rand) []byte {
+			return []byte(fmt.Sprintf("value%d", r.Int63()))
+		}
+	}
+	ops := make([]ModelOp, n)
+	for i := range ops {
+		ops[i].Key = key(r)
+		if r.Float64() >= g.RemoveRatio {
+			ops[i].Value = value(r)
+		}
+	}
+	return ops
+}
+
+// UniformKeys returns a key distribution drawing uniformly among count keys.
+func UniformKeys(count int) func(r *rand.Rand) []byte {
+	return func(r *rand.Rand) []byte {
+		return []byte(fmt.Sprintf("key%08d", r.Intn(count)))
+	}
+}
+
+// ApplyModelOp applies the operation to the tree and the model, and checks that they report the
+// same previous state of the key.
+func ApplyModelOp(tree *MutableTree, model ReferenceModel, op ModelOp) error {
+	if op.Value != nil {
+		updated, err := tree.Set(op.Key, op.Value)
+		if err != nil {
+			return err
+		}
+		if expected := model.Set(op.Key, op.Value); updated != expected {
+			return fmt.Errorf("%w: %s reports updated %t instead of %t", ErrModelMismatch, op, updated, expected)
+		}
+		return nil
+	}
+	value, removed, err := tree.Remove(op.Key)
+	if err != nil {
+		return err
+	}
+	expectedValue, expected := model.Remove(op.Key)
+	if removed != expected || !bytes.Equal(value, expectedValue) {
+		return fmt.Errorf("%w: %s reports removed %t with value %X instead of %t with %X",
+			ErrModelMismatch, op, removed, value, expected, expectedValue)
+	}
+	return nil
+}
+
+// modelRangeLimit is the number of pairs compared in the ranges starting or ending at a probed
+// key, which keeps CheckAgainstModel linear in the number of keys.
+const modelRangeLimit = 8
+
+// CheckAgainstModel checks that the tree matches the model: the values of the probed keys, the
+// full iteration in both orders, and the first pairs of the iterations starting or ending at each
+// probed key.
+func CheckAgainstModel(tree ModelTree, model ReferenceModel, probes [][]byte) error {
+	for _, key := range probes {
+		value, err := tree.Get(key)
+		if err != nil {
+			return err
+		}
+		if expected := model.Get(key); !bytes.Equal(value, expected) {
+			return fmt.Errorf("%w: Get(%X) returns %X instead of %X", ErrModelMismatch, key, value, expected)
+		}
+	}
+	for _, ascending := range []bool{true, false} {
+		if err := checkModelRange(tree, model, nil, nil, ascending, -1); err != nil {
+			return err
+		}
+	}
+	for _, key := range probes {
+		if err := checkModelRange(tree, model, key, nil, true, modelRangeLimit); err != nil {
+			return err
+		}
+		if err := checkModelRange(tree, model, nil, key, false, modelRangeLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkModelRange compares the first limit pairs of the iterations of the tree and the model, or
+// all of them if limit is negative.
+func checkModelRange(tree ModelTree, model ReferenceModel, start, end []byte, ascending bool, limit int) error {
+	var expected [][2][]byte
+	model.Iterate(start, end, ascending, func(key, value []byte) bool {
+		expected = append(expected, [2][]byte{key, value})
+		return len(expected) == limit
+	})
+
+	itr, err := tree.Iterator(start, end, ascending)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	i := 0
+	for ; itr.Valid() && i != limit; itr.Next() {
+		if i == len(expected) {
+			return fmt.Errorf("%w: Iterator(%X, %X, %t) returns extra key %X", ErrModelMismatch, start, end, ascending, itr.Key())
+		}
+		if !bytes.Equal(itr.Key(), expected[i][0]) || !bytes.Equal(itr.Value(), expected[i][1]) {
+			return fmt.Errorf("%w: Iterator(%X, %X, %t) returns %X=%X instead of %X=%X at position %d",
+				ErrModelMismatch, start, end, ascending, itr.Key(), itr.Value(), expected[i][0], expected[i][1], i)
+		}
+		i++
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	if i < len(expected) {
+		return fmt.Errorf("%w: Iterator(%X, %X, %t) misses key %X", ErrModelMismatch, start, end, ascending, expected[i][0])
+	}
+	return nil
+}
+
+// RunModelOps applies the operations to the tree and the model, and every saveEvery operations
+// and at the end, compares them with CheckAgainstModel, saves a version, and compares the saved
+// version too. The keys of the operations are the probed keys. A non-positive saveEvery only
+// saves at the end.
+func RunModelOps(tree *MutableTree, model ReferenceModel, ops []ModelOp, saveEvery int) error {
+	probes := make([][]byte, 0, len(ops))
+	seen := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		if !seen[string(op.Key)] {
+			seen[string(op.Key)] = true
+			probes = append(probes, op.Key)
+		}
+	}
+
+	check := func() error {
+		if err := CheckAgainstModel(tree, model, probes); err != nil {
+			return err
+		}
+		_, version, err := tree.SaveVersion()
+		if err != nil {
+			return err
+		}
+		saved, err := tree.GetImmutable(version)
+		if err != nil {
+			return err
+		}
+		if err := CheckAgainstModel(saved, model, probes); err != nil {
+			return fmt.Errorf("version %d: %w", version, err)
+		}
+		return nil
+	}
+	for i, op := range ops {
+		if err := ApplyModelOp(tree, model, op); err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+		if saveEvery > 0 && (i+1)%saveEvery == 0 {
+			if err := check(); err != nil {
+				return fmt.Errorf("after operation %d: %w", i, err)
+			}
+		}
+	}
+	if saveEvery > 0 && len(ops) > 0 && len(ops)%saveEvery == 0 {
+		return nil
+	}
+	return check()
+}
@@ -0,0 +1,64 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestRunModelOps(t *testing.T) {
+	generators := map[string]ModelOpGenerator{
+		"uniform": {RemoveRatio: 0.3},
+		"dense":   {Key: UniformKeys(8), RemoveRatio: 0.5},
+		"prefixed": {
+			Key: func(r *rand.Rand) []byte {
+				return []byte(fmt.Sprintf("%s/%d", []string{"a", "ab", "b"}[r.Intn(3)], r.Intn(50)))
+			},
+			Value:       func(r *rand.Rand) []byte { return []byte{} },
+			RemoveRatio: 0.2,
+		},
+	}
+	for name, generator := range generators {
+		t.Run(name, func(t *testing.T) {
+			for seed := int64(0); seed < 3; seed++ {
+				ops := generator.Ops(rand.New(rand.NewSource(seed)), 500)
+				tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+				require.NoError(t, RunModelOps(tree, NewMapModel(), ops, 50), "seed %d", seed)
+			}
+		})
+	}
+}
+
+// lossyModel is a MapModel forgetting a key.
+type lossyModel struct {
+	*MapModel
+	lost string
+}
+
+func (m lossyModel) Set(key, value []byte) bool {
+	if string(key) == m.lost {
+		return false
+	}
+	return m.MapModel.Set(key, value)
+}
+
+func TestRunModelOpsMismatch(t *testing.T) {
+	ops := []ModelOp{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("c"), Value: []byte("3")},
+	}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	err := RunModelOps(tree, lossyModel{MapModel: NewMapModel(), lost: "b"}, ops, 0)
+	require.ErrorIs(t, err, ErrModelMismatch)
+
+	// a set reporting a wrong previous state
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	model := NewMapModel()
+	model.Set([]byte("a"), []byte("0"))
+	require.ErrorIs(t, ApplyModelOp(tree, model, ops[0]), ErrModelMismatch)
+}
@@ -0,0 +1,203 @@
+package iavl
+
+import (
+	"fmt"
+	"slices"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// VersionIndexReport describes the versions whose root entries RebuildVersionIndex looked into.
+type VersionIndexReport struct {
+	// Recovered lists the versions whose missing root entry was rebuilt, in ascending order.
+	Recovered []int64
+
+	// Unrecoverable lists the versions whose root entry is missing and could not be rebuilt, in
+	// ascending order. Their trees stay unreadable.
+	Unrecoverable []int64
+}
+
+// RebuildVersionIndex rebuilds the root entries mapping the versions to their roots which are
+// missing from the db, from the nodes which survive, and reports the versions it recovered and
+// those it could not. It is a disaster recovery tool, which scans all the nodes of the db, and
+// holds the hashes of the legacy nodes in memory. The db must not be in use.
+//
+// A root is found as follows:
+//   - a legacy root is the legacy node no other legacy node refers to, and is recorded for the
+//     version the node was created in.
+//   - a version without any node of its own, between two versions whose roots are known, kept
+//     the tree of the preceding one if the tree of the following one still holds a node of the
+//     preceding one, since a node is part of every version from its creation to its orphaning.
+//     Its root entry then refers to the root of the preceding version, as SaveVersion records
+//     an unchanged version.
+//
+// The versions whose own nodes survive without their root, whose root node is then lost, and the
+// versions which emptied the tree are unrecoverable. The versions before the first known root are
+// taken as pruned. The orphans need no rebuilding, since they are found by comparing the trees of
+// consecutive versions when pruning.
+func RebuildVersionIndex(db corestore.KVStoreWithBatch, options ...Option) (*VersionIndexReport, error) {
+	opts := DefaultOptions()
+	for _, opt := range options {
+		opt(&opts)
+	}
+	ndb := newNodeDB(db, 0, opts, NewNopLogger())
+	report := &VersionIndexReport{}
+
+	legacyVersions, err := ndb.rebuildLegacyRoots(report)
+	if err != nil {
+		return nil, err
+	}
+	// the roots recovered so far are needed to rebuild the unchanged versions
+	if err := ndb.Commit(); err != nil {
+		return nil, err
+	}
+
+	// whether each version with nodes has a root entry
+	rooted := legacyVersions
+	if err := ndb.traversePrefix(nodeKeyFormat.Prefix(), func(key, _ []byte) error {
+		var nk []byte
+		nodeKeyFormat.Scan(key, &nk)
+		nodeKey := GetNodeKey(nk)
+		rooted[nodeKey.version] = rooted[nodeKey.version] || nodeKey.nonce == 1
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	versions := make([]int64, 0, len(rooted))
+	for version, hasRoot := range rooted {
+		if hasRoot {
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) == 0 {
+		return report, nil
+	}
+	slices.Sort(versions)
+
+	// prev is the last version whose root is known, 0 if its root entry is missing
+	prev := int64(0)
+	for version := versions[0]; version <= versions[len(versions)-1]; version++ {
+		hasRoot, hasNodes := rooted[version]
+		switch {
+		case hasRoot:
+			prev = version
+		case hasNodes:
+			report.Unrecoverable = append(report.Unrecoverable, version)
+			prev = 0
+		default:
+			// the versions up to the next one with nodes have none
+			next := version + 1
+			for {
+				if _, ok := rooted[next]; ok {
+					break
+				}
+				next++
+			}
+			kept := false
+			if prev > 0 && rooted[next] {
+				if kept, err = ndb.holdsNodeOf(next, prev); err != nil {
+					return nil, err
+				}
+			}
+			for ; version < next; version++ {
+				if !kept {
+					report.Unrecoverable = append(report.Unrecoverable, version)
+					continue
+				}
+				if err := ndb.saveReferenceRoot(version, prev); err != nil {
+					return nil, err
+				}
+				report.Recovered = append(report.Recovered, version)
+			}
+			version--
+		}
+	}
+
+	if err := ndb.Commit(); err != nil {
+		return nil, err
+	}
+	slices.Sort(report.Recovered)
+	return report, nil
+}
+
+// rebuildLegacyRoots records the missing legacy root entries, and returns the versions the legacy
+// nodes were created in, mapped to whether their root entry is stored.
+func (ndb *nodeDB) rebuildLegacyRoots(report *VersionIndexReport) (map[int64]bool, error) {
+	versions := make(map[string]int64) // the versions of the legacy nodes, by hash
+	children := make(map[string]bool)
+	if err := ndb.traversePrefix(legacyNodeKeyFormat.Prefix(), func(key, value []byte) error {
+		var hash []byte
+		legacyNodeKeyFormat.Scan(key, &hash)
+		node, err := MakeLegacyNode(hash, value)
+		if err != nil {
+			return fmt.Errorf("decoding the legacy node %X: %w", hash, err)
+		}
+		versions[string(hash)] = node.nodeKey.version
+		if !node.isLeaf() {
+			children[string(node.leftNodeKey)] = true
+			children[string(node.rightNodeKey)] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	rooted := make(map[int64]bool)
+	for hash, version := range versions {
+		if children[hash] {
+			if _, ok := rooted[version]; !ok {
+				rooted[version] = false
+			}
+			continue
+		}
+		has, err := ndb.hasLegacyVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			if err := ndb.batch.Set(ndb.legacyRootKey(version), []byte(hash)); err != nil {
+				return nil, err
+			}
+			report.Recovered = append(report.Recovered, version)
+		}
+		rooted[version] = true
+	}
+	return rooted, nil
+}
+
+// holdsNodeOf returns whether the tree of the given version holds a node created at or before
+// the version prev. Only the nodes created after prev are descended into.
+func (ndb *nodeDB) holdsNodeOf(version, prev int64) (bool, error) {
+	rootKey, err := ndb.GetRoot(version)
+	if err != nil || rootKey == nil {
+		return false, err
+	}
+	stack := [][]byte{rootKey}
+	for len(stack) > 0 {
+		node, err := ndb.GetNode(stack[len(stack)-1])
+		if err != nil {
+			return false, err
+		}
+		stack = stack[:len(stack)-1]
+		if node.nodeKey.version <= prev {
+			return true, nil
+		}
+		if !node.isLeaf() {
+			stack = append(stack, node.leftNodeKey, node.rightNodeKey)
+		}
+	}
+	return false, nil
+}
+
+// saveReferenceRoot records the root of the version prev as the root of the given version.
+func (ndb *nodeDB) saveReferenceRoot(version, prev int64) error {
+	rootKey, err := ndb.GetRoot(prev)
+	if err != nil {
+		return err
+	}
+	if len(rootKey) == hashSize {
+		return ndb.batch.Set(ndb.legacyRootKey(version), rootKey)
+	}
+	return ndb.SaveRoot(version, GetNodeKey(rootKey))
+}
@@ -0,0 +1,134 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+func TestRebuildVersionIndex(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	// the versions 3 and 4 keep the tree of 2, and 7 empties it
+	for version := int64(1); version <= 9; version++ {
+		switch version {
+		case 3, 4:
+		case 7:
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				_, _, err := tree.Remove([]byte(key))
+				require.NoError(t, err)
+			}
+		default:
+			_, err := tree.Set([]byte{byte('a' + version%5)}, []byte{byte(version)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	hashes := make(map[int64][]byte)
+	for version := int64(1); version <= 9; version++ {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		hashes[version] = itree.Hash()
+	}
+
+	// the unchanged versions and the emptied one lose their root entries, and 6 its root node
+	for _, version := range []int64{3, 4, 6, 7} {
+		require.NoError(t, db.Delete(RootDBKey(version)))
+	}
+	report, err := RebuildVersionIndex(db)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 4}, report.Recovered)
+	require.Equal(t, []int64{6, 7}, report.Unrecoverable)
+
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for _, version := range []int64{1, 2, 3, 4, 5, 8, 9} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, hashes[version], itree.Hash(), "version %d", version)
+	}
+
+	// a second run has nothing to do
+	report, err = RebuildVersionIndex(db)
+	require.NoError(t, err)
+	require.Empty(t, report.Recovered)
+	require.Equal(t, []int64{6, 7}, report.Unrecoverable)
+}
+
+func TestRebuildVersionIndexLegacy(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	// the version 3 keeps the tree of 2
+	for version := int64(1); version <= 4; version++ {
+		if version != 3 {
+			for i := 0; i < 4; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("k%d", int(version)*2+i)), []byte{byte(version)})
+				require.NoError(t, err)
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// write the versions in the legacy format
+	legacyDB := dbm.NewMemDB()
+	hashes := make(map[int64][]byte)
+	for version := int64(1); version <= 4; version++ {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		hashes[version] = itree.Hash()
+		require.NoError(t, legacyDB.Set(LegacyRootDBKey(version), itree.Hash()))
+		require.NoError(t, writeLegacyNodes(legacyDB, itree, itree.root))
+	}
+
+	require.NoError(t, legacyDB.Delete(LegacyRootDBKey(2)))
+	require.NoError(t, legacyDB.Delete(LegacyRootDBKey(3)))
+	report, err := RebuildVersionIndex(legacyDB)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 3}, report.Recovered)
+	require.Empty(t, report.Unrecoverable)
+
+	for version := int64(1); version <= 4; version++ {
+		hash, err := legacyDB.Get(LegacyRootDBKey(version))
+		require.NoError(t, err)
+		require.Equal(t, hashes[version], hash, "version %d", version)
+	}
+}
+
+// writeLegacyNodes writes the subtree of the node in the legacy node format.
+func writeLegacyNodes(db *dbm.MemDB, t *ImmutableTree, node *Node) error {
+	var buf bytes.Buffer
+	for _, v := range []int64{int64(node.subtreeHeight), node.size, node.nodeKey.version} {
+		if err := encoding.EncodeVarint(&buf, v); err != nil {
+			return err
+		}
+	}
+	if err := encoding.EncodeBytes(&buf, node.key); err != nil {
+		return err
+	}
+	if node.isLeaf() {
+		if err := encoding.EncodeBytes(&buf, node.value); err != nil {
+			return err
+		}
+		return db.Set(legacyNodeKeyFormat.Key(node.hash), buf.Bytes())
+	}
+	for _, get := range []func(*ImmutableTree) (*Node, error){node.getLeftNode, node.getRightNode} {
+		child, err := get(t)
+		if err != nil {
+			return err
+		}
+		if err := encoding.EncodeBytes(&buf, child.hash); err != nil {
+			return err
+		}
+		if err := writeLegacyNodes(db, t, child); err != nil {
+			return err
+		}
+	}
+	return db.Set(legacyNodeKeyFormat.Key(node.hash), buf.Bytes())
+}
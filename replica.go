@@ -0,0 +1,127 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+var (
+	// ErrVersionNotReplicated is returned when a version is newer than the latest version
+	// available in a read replica, which has not caught up with the primary yet.
+	ErrVersionNotReplicated = errors.New("version not yet replicated")
+
+	// ErrReadOnlyReplica is returned when a write is attempted against a read replica.
+	ErrReadOnlyReplica = errors.New("read replica is read-only")
+)
+
+// NewImmutableTreeFromReplica opens the tree at the given version from a read-only replica of the
+// node db, which may lag the primary. It returns ErrVersionNotReplicated if the version is newer
+// than the latest version of the replica, so that callers can retry once it caught up.
+//
+// The tree reads the tree nodes only and never writes to the replica: the fast node index of the
+// replica is not used, nor upgraded, since it may be stale or ahead of the requested version.
+func NewImmutableTreeFromReplica(replicaDB corestore.KVStoreWithBatch, version int64, lg Logger, options ...Option) (*ImmutableTree, error) {
+	return newReadOnlyImmutableTree(replicaDB, version, ErrVersionNotReplicated, lg, options...)
+}
+
+// NewImmutableTreeFromSnapshot opens the tree at the given version through a read-only
+// point-in-time snapshot of the node db, e.g. a goleveldb or pebble snapshot. All the reads go
+// through the snapshot, so the tree stays consistent while the live db is written to and pruned,
+// which suits long scans. The caller keeps ownership of the snapshot, and must release it once
+// the tree is no longer used.
+//
+// As for a replica, the fast node index is not used and nothing is written to the snapshot.
+func NewImmutableTreeFromSnapshot(snap corestore.KVStore, version int64, lg Logger, options ...Option) (*ImmutableTree, error) {
+	return newReadOnlyImmutableTree(snap, version, ErrVersionDoesNotExist, lg, options...)
+}
+
+// newReadOnlyImmutableTree opens the tree at the given version from a db it never writes to,
+// returning errNotAvailable if the version is newer than the latest version of the db.
+func newReadOnlyImmutableTree(db corestore.KVStore, version int64, errNotAvailable error, lg Logger, options ...Option) (*ImmutableTree, error) {
+	if version <= 0 {
+		return nil, ErrVersionDoesNotExist
+	}
+
+	opts := DefaultOptions()
+	for _, opt := range options {
+		opt(&opts)
+	}
+	// pruning in the background would write to the db
+	opts.AsyncPruning = false
+	ndb := newNodeDB(readOnlyDB{db}, 0, opts, lg)
+
+	_, latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > latestVersion {
+		return nil, fmt.Errorf("%w: version %d, latest version is %d", errNotAvailable, version, latestVersion)
+	}
+
+	rootNodeKey, err := ndb.GetRoot(version)
+	if err != nil {
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			firstVersion, ferr := ndb.getFirstVersion()
+			if ferr != nil {
+				return nil, ferr
+			}
+			if version < firstVersion {
+				return nil, ErrVersionPruned
+			}
+		}
+		return nil, err
+	}
+
+	var root *Node
+	if rootNodeKey != nil {
+		root, err = ndb.GetNode(rootNodeKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ImmutableTree{
+		logger:                 lg,
+		root:                   root,
+		ndb:                    ndb,
+		version:                version,
+		skipFastStorageUpgrade: true,
+	}, nil
+}
+
+// readOnlyDB guards a read replica or snapshot against writes, which fail with
+// ErrReadOnlyReplica. Closing it leaves the underlying db open, since the caller owns it.
+type readOnlyDB struct {
+	corestore.KVStore
+}
+
+func (readOnlyDB) Set(_, _ []byte) error {
+	return ErrReadOnlyReplica
+}
+
+func (readOnlyDB) Delete(_ []byte) error {
+	return ErrReadOnlyReplica
+}
+
+func (readOnlyDB) Close() error {
+	return nil
+}
+
+func (readOnlyDB) NewBatch() corestore.Batch {
+	return readOnlyBatch{}
+}
+
+func (readOnlyDB) NewBatchWithSize(_ int) corestore.Batch {
+	return readOnlyBatch{}
+}
+
+type readOnlyBatch struct{}
+
+func (readOnlyBatch) Set(_, _ []byte) error     { return ErrReadOnlyReplica }
+func (readOnlyBatch) Delete(_ []byte) error     { return ErrReadOnlyReplica }
+func (readOnlyBatch) Write() error              { return ErrReadOnlyReplica }
+func (readOnlyBatch) WriteSync() error          { return ErrReadOnlyReplica }
+func (readOnlyBatch) Close() error              { return nil }
+func (readOnlyBatch) GetByteSize() (int, error) { return 0, nil }
@@ -0,0 +1,172 @@
+package iavl
+
+import (
+	"time"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// RetryPolicy retries the reads and writes of the nodeDB which fail with a transient error, e.g.
+// a timeout of a network-backed store, instead of failing the whole operation.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of retries of a single read or write.
+	MaxRetries int
+
+	// Backoff is the delay before the first retry, doubled for each following one.
+	Backoff time.Duration
+
+	// Retryable classifies the errors, and only the errors it returns true for are retried. The
+	// errors which retrying cannot fix, e.g. corruption, must not be retryable. Nil retries none.
+	Retryable func(err error) bool
+}
+
+// retry runs op until it succeeds, fails with an error which is not retryable, or the retries are
+// exhausted, returning the last error.
+func (p *RetryPolicy) retry(op func() error) error {
+	err := op()
+	backoff := p.Backoff
+	for i := 0; i < p.MaxRetries && err != nil && p.Retryable != nil && p.Retryable(err); i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
+
+// retryDB retries the reads and writes of a db according to a RetryPolicy.
+type retryDB struct {
+	corestore.KVStoreWithBatch
+	policy *RetryPolicy
+}
+
+var _ corestore.KVStoreWithBatch = (*retryDB)(nil)
+
+func newRetryDB(db corestore.KVStoreWithBatch, policy *RetryPolicy) *retryDB {
+	return &retryDB{KVStoreWithBatch: db, policy: policy}
+}
+
+func (db *retryDB) Get(key []byte) (value []byte, err error) {
+	err = db.policy.retry(func() error {
+		value, err = db.KVStoreWithBatch.Get(key)
+		return err
+	})
+	return value, err
+}
+
+func (db *retryDB) Has(key []byte) (has bool, err error) {
+	err = db.policy.retry(func() error {
+		has, err = db.KVStoreWithBatch.Has(key)
+		return err
+	})
+	return has, err
+}
+
+func (db *retryDB) Set(key, value []byte) error {
+	return db.policy.retry(func() error {
+		return db.KVStoreWithBatch.Set(key, value)
+	})
+}
+
+func (db *retryDB) Delete(key []byte) error {
+	return db.policy.retry(func() error {
+		return db.KVStoreWithBatch.Delete(key)
+	})
+}
+
+func (db *retryDB) Iterator(start, end []byte) (itr corestore.Iterator, err error) {
+	err = db.policy.retry(func() error {
+		itr, err = db.KVStoreWithBatch.Iterator(start, end)
+		return err
+	})
+	return itr, err
+}
+
+func (db *retryDB) ReverseIterator(start, end []byte) (itr corestore.Iterator, err error) {
+	err = db.policy.retry(func() error {
+		itr, err = db.KVStoreWithBatch.ReverseIterator(start, end)
+		return err
+	})
+	return itr, err
+}
+
+func (db *retryDB) NewBatch() corestore.Batch {
+	return &retryBatch{Batch: db.KVStoreWithBatch.NewBatch(), db: db}
+}
+
+func (db *retryDB) NewBatchWithSize(size int) corestore.Batch {
+	return &retryBatch{Batch: db.KVStoreWithBatch.NewBatchWithSize(size), db: db, size: size}
+}
+
+// retryBatch records the operations of a batch, so that they can be replayed into a new batch
+// when writing the batch fails, since a batch cannot be used once written.
+type retryBatch struct {
+	corestore.Batch
+	db   *retryDB
+	size int
+	ops  []batchOp
+}
+
+type batchOp struct {
+	key, value []byte // value is nil for a deletion
+}
+
+func (b *retryBatch) Set(key, value []byte) error {
+	if err := b.Batch.Set(key, value); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+	return nil
+}
+
+func (b *retryBatch) Delete(key []byte) error {
+	if err := b.Batch.Delete(key); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, batchOp{key: key})
+	return nil
+}
+
+func (b *retryBatch) Write() error {
+	return b.write(func() error { return b.Batch.Write() })
+}
+
+func (b *retryBatch) WriteSync() error {
+	return b.write(func() error { return b.Batch.WriteSync() })
+}
+
+func (b *retryBatch) write(write func() error) error {
+	first := true
+	return b.db.policy.retry(func() error {
+		if !first {
+			if err := b.replay(); err != nil {
+				return err
+			}
+		}
+		first = false
+		return write()
+	})
+}
+
+// replay replaces the batch with a new one holding the recorded operations.
+func (b *retryBatch) replay() error {
+	if err := b.Batch.Close(); err != nil {
+		return err
+	}
+	if b.size > 0 {
+		b.Batch = b.db.KVStoreWithBatch.NewBatchWithSize(b.size)
+	} else {
+		b.Batch = b.db.KVStoreWithBatch.NewBatch()
+	}
+	for _, op := range b.ops {
+		var err error
+		if op.value == nil {
+			err = b.Batch.Delete(op.key)
+		} else {
+			err = b.Batch.Set(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package iavl
+
+// Tracer starts the spans the tree records around its major operations, SaveVersion, Get and the
+// proof generation, e.g. to export them to OpenTelemetry. The span names are the names of the
+// traced methods, qualified by their receiver type, e.g. "MutableTree.SaveVersion".
+type Tracer interface {
+	// StartSpan starts a span with the given name.
+	StartSpan(name string) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// End ends the span. It is called once per span, whether the operation failed or not.
+	End()
+}
+
+// NewNopTracer returns a new tracer that does nothing.
+func NewNopTracer() Tracer {
+	return noopTracer{}
+}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(string) Span { return noopSpan{} }
+
+type noopSpan struct{}
+
+func (noopSpan) End() {}
+
+// tracer returns the configured Tracer, or a no-op one, also for a tree without a nodeDB, e.g. one
+// built with NewImmutableTree(nil, ...).
+func (ndb *nodeDB) tracer() Tracer {
+	if ndb == nil || ndb.opts.Tracer == nil {
+		return noopTracer{}
+	}
+	return ndb.opts.Tracer
+}
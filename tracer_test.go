@@ -0,0 +1,87 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+type recordingTracer struct {
+	started []string
+	ended   []string
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	name   string
+}
+
+func (t *recordingTracer) StartSpan(name string) Span {
+	t.started = append(t.started, name)
+	return &recordingSpan{tracer: t, name: name}
+}
+
+func (s *recordingSpan) End() {
+	s.tracer.ended = append(s.tracer.ended, s.name)
+}
+
+func (t *recordingTracer) reset() {
+	t.started, t.ended = nil, nil
+}
+
+func TestTracer(t *testing.T) {
+	db := dbm.NewMemDB()
+	tracer := &recordingTracer{}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), TracerOption(tracer))
+
+	_, err := tree.Set([]byte("a"), []byte{1})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []string{"MutableTree.SaveVersion"}, tracer.started)
+	require.Equal(t, tracer.started, tracer.ended)
+
+	tracer.reset()
+	_, err = tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"MutableTree.Get", "ImmutableTree.Get"}, tracer.started)
+	require.ElementsMatch(t, tracer.started, tracer.ended)
+
+	tracer.reset()
+	_, err = tree.GetMembershipProof([]byte("a"))
+	require.NoError(t, err)
+	_, err = tree.GetNonMembershipProof([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"ImmutableTree.GetMembershipProof", "ImmutableTree.GetNonMembershipProof"}, tracer.started)
+	require.Equal(t, tracer.started, tracer.ended)
+
+	// the spans are ended on the error paths too
+	tracer.reset()
+	_, err = tree.GetMembershipProof([]byte("b"))
+	require.Error(t, err)
+	require.Equal(t, []string{"ImmutableTree.GetMembershipProof"}, tracer.started)
+	require.Equal(t, tracer.started, tracer.ended)
+
+	other := NewMutableTree(db, 0, false, NewNopLogger(), TracerOption(tracer))
+	_, err = other.Set([]byte("b"), []byte{2})
+	require.NoError(t, err)
+	tracer.reset()
+	_, _, err = other.SaveVersion()
+	require.Error(t, err)
+	require.Equal(t, []string{"MutableTree.SaveVersion"}, tracer.started)
+	require.Equal(t, tracer.started, tracer.ended)
+}
+
+func TestTracerInMemoryTree(t *testing.T) {
+	// a tree without a nodeDB traces nothing, rather than panicking
+	tree := NewImmutableTree(nil, 0, false, NewNopLogger())
+	value, err := tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	_, err = tree.GetMembershipProof([]byte("a"))
+	require.Error(t, err)
+	_, err = tree.GetNonMembershipProof([]byte("a"))
+	require.NoError(t, err)
+}
@@ -259,7 +259,7 @@ func testRandomOperations(t *testing.T, randSeed int64) {
 }
 
 // Checks that the database is empty, only containing a single root entry
-// at the given version.
+// and its checksum at the given version.
 func assertEmptyDatabase(t *testing.T, tree *MutableTree) {
 	version := tree.Version()
 	iter, err := tree.ndb.db.Iterator(nil, nil)
@@ -270,10 +270,11 @@ func assertEmptyDatabase(t *testing.T, tree *MutableTree) {
 		foundKeys = append(foundKeys, string(iter.Key()))
 	}
 	require.NoError(t, iter.Error())
-	require.EqualValues(t, 2, len(foundKeys), "Found %v database entries, expected 1", len(foundKeys)) // 1 for storage version and 1 for root
+	require.EqualValues(t, 3, len(foundKeys), "Found %v database entries, expected 3", len(foundKeys)) // 1 for the checksum, 1 for storage version and 1 for root
 
-	firstKey := foundKeys[0]
-	secondKey := foundKeys[1]
+	require.Equal(t, string(checksumKeyFormat.Key(version)), foundKeys[0], "Unexpected checksum key")
+	firstKey := foundKeys[1]
+	secondKey := foundKeys[2]
 	require.True(t, strings.HasPrefix(firstKey, metadataKeyFormat.Prefix()))
 
 	require.Equal(t, string(metadataKeyFormat.KeyBytes([]byte(storageVersionKey))), firstKey, "Unexpected storage version key")
@@ -9,8 +9,11 @@ import (
 	"math/rand"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/assert"
@@ -1262,6 +1265,93 @@ func TestRollback(t *testing.T) {
 	require.Equal([]byte("v"), val)
 }
 
+func TestRollbackReleasesWorkingNodes(t *testing.T) {
+	tree := getTestTree(0)
+	_, err := tree.Set([]byte("k"), []byte("v"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	const numKeys = 2000
+	for i := 0; i < numKeys; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%d", i)), make([]byte, 1024))
+		require.NoError(t, err)
+	}
+
+	var released atomic.Int64
+	unsavedLeaves := 0
+	tree.root.traverse(tree.ImmutableTree, true, func(node *Node) bool {
+		if node.nodeKey == nil && node.isLeaf() {
+			unsavedLeaves++
+			runtime.SetFinalizer(node, func(*Node) { released.Add(1) })
+		}
+		return false
+	})
+	require.Equal(t, numKeys, unsavedLeaves)
+
+	// keep a stale reference to the discarded working tree, which must not pin its nodes
+	stale := tree.ImmutableTree
+	tree.Rollback()
+	require.Equal(t, int64(1), tree.Size())
+
+	for i := 0; i < 50 && released.Load() < numKeys; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.EqualValues(t, numKeys, released.Load())
+	runtime.KeepAlive(stale)
+
+	val, err := tree.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), val)
+}
+
+func TestRollbackOpenIterator(t *testing.T) {
+	tree := getTestTree(0)
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%02d", i)), []byte("saved"))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	saved, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	for i := 0; i < 100; i += 2 {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%02d", i)), []byte("unsaved"))
+		require.NoError(t, err)
+	}
+
+	// iterators opened before the rollback, on the saved version and on the working tree
+	savedIter := NewIterator(nil, nil, true, saved)
+	workingIter := NewIterator(nil, nil, true, tree.ImmutableTree)
+	require.True(t, savedIter.Valid())
+	require.True(t, workingIter.Valid())
+	savedIter.Next()
+	workingIter.Next()
+	tree.Rollback()
+
+	// the saved nodes are untouched
+	for i := 1; i < 100; i++ {
+		require.True(t, savedIter.Valid())
+		require.Equal(t, []byte(fmt.Sprintf("key_%02d", i)), savedIter.Key())
+		require.Equal(t, []byte("saved"), savedIter.Value())
+		savedIter.Next()
+	}
+	require.False(t, savedIter.Valid())
+	require.NoError(t, savedIter.Close())
+
+	// the working tree iterator is invalidated, and fails rather than mixing in the saved values
+	for workingIter.Valid() {
+		require.True(t, bytes.HasPrefix(workingIter.Key(), []byte("key_")))
+		if i, _ := strconv.Atoi(string(workingIter.Key()[4:])); i%2 == 0 {
+			require.Equal(t, []byte("unsaved"), workingIter.Value())
+		}
+		workingIter.Next()
+	}
+	require.ErrorIs(t, workingIter.Error(), ErrNodeMissingNodeKey)
+	require.Error(t, workingIter.Close())
+}
+
 func TestLoadVersion(t *testing.T) {
 	tree := getTestTree(0)
 	maxVersions := 10
@@ -1333,6 +1423,52 @@ func TestOverwrite(t *testing.T) {
 	require.NoError(err, "SaveVersion should not fail, overwrite was idempotent")
 }
 
+func TestOverwriteStrict(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			mdb := dbm.NewMemDB()
+			tree := NewMutableTree(mdb, 0, false, NewNopLogger(), StrictSaveVersionOption(strict))
+			_, err := tree.Set([]byte("key1"), []byte("value1"))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("key2"), []byte("value2"))
+			require.NoError(t, err)
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			// a different hash always fails
+			tree = NewMutableTree(mdb, 0, false, NewNopLogger(), StrictSaveVersionOption(strict))
+			_, err = tree.LoadVersion(1)
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("key2"), []byte("different value 2"))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.ErrorIs(t, err, ErrVersionAlreadySaved)
+
+			// the same hash fails only in strict mode
+			_, err = tree.Set([]byte("key2"), []byte("value2"))
+			require.NoError(t, err)
+			resaved, version, err := tree.SaveVersion()
+			if strict {
+				require.ErrorIs(t, err, ErrVersionAlreadySaved)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, int64(2), version)
+			require.Equal(t, hash, resaved)
+
+			// the tree goes on from the re-saved version
+			_, err = tree.Set([]byte("key3"), []byte("value3"))
+			require.NoError(t, err)
+			_, version, err = tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, int64(3), version)
+			require.NoError(t, tree.ValidateFastCache())
+		})
+	}
+}
+
 func TestOverwriteEmpty(t *testing.T) {
 	require := require.New(t)
 
@@ -1665,6 +1801,145 @@ func TestGetWithIndex_ImmutableTree(t *testing.T) {
 	}
 }
 
+func TestPathTo(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	path, err := tree.ImmutableTree.PathTo([]byte("a"))
+	require.NoError(t, err)
+	require.Nil(t, path)
+
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", 2*i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("k00"), []byte("updated"))
+	require.NoError(t, err)
+	_, err = tree.ImmutableTree.PathTo([]byte("k00"))
+	require.Error(t, err)
+	_, version2, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	for _, v := range []int64{version, version2} {
+		itree, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("k%02d", i))
+			path, err := itree.PathTo(key)
+			require.NoError(t, err)
+			require.Equal(t, GetRootKey(v), path[0].GetKey())
+			// every node key on the path refers to the child of the previous node towards the key
+			for j, nk := range path {
+				node, err := tree.ndb.GetNode(nk.GetKey())
+				require.NoError(t, err)
+				if j == len(path)-1 {
+					require.True(t, node.isLeaf())
+					if i%2 == 0 {
+						require.Equal(t, key, node.key)
+					}
+					break
+				}
+				child := node.leftNodeKey
+				if bytes.Compare(key, node.key) >= 0 {
+					child = node.rightNodeKey
+				}
+				require.Equal(t, child, path[j+1].GetKey())
+			}
+		}
+	}
+
+	// the leaf updated by the second version was created by it
+	itree, err := tree.GetImmutable(version2)
+	require.NoError(t, err)
+	path, err = itree.PathTo([]byte("k00"))
+	require.NoError(t, err)
+	require.Equal(t, version2, path[len(path)-1].version)
+	path, err = itree.PathTo([]byte("k98"))
+	require.NoError(t, err)
+	require.Equal(t, version, path[len(path)-1].version)
+}
+
+func TestIterateLeavesNewerThan(t *testing.T) {
+	db := &readCountingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	setAt := make(map[string]int64)
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v1"))
+		require.NoError(t, err)
+		setAt[fmt.Sprintf("k%04d", i)] = 1
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for version := int64(2); version <= 4; version++ {
+		for _, i := range []int{int(version) * 7, 500 + int(version), 990} {
+			key := fmt.Sprintf("k%04d", i)
+			_, err := tree.Set([]byte(key), []byte(fmt.Sprintf("v%d", version)))
+			require.NoError(t, err)
+			setAt[key] = version
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	_, _, err = tree.Remove([]byte("k0990"))
+	require.NoError(t, err)
+	delete(setAt, "k0990")
+	_, err = tree.Set([]byte("k2000"), []byte("v5"))
+	require.NoError(t, err)
+	setAt["k2000"] = 5
+
+	collect := func(itree *ImmutableTree, since int64) []string {
+		var visited []string
+		require.NoError(t, itree.IterateLeavesNewerThan(since, func(key, value []byte, leafVersion int64) bool {
+			require.Equal(t, fmt.Sprintf("v%d", leafVersion), string(value))
+			visited = append(visited, string(key))
+			return false
+		}))
+		return visited
+	}
+	expected := func(since int64) []string {
+		var keys []string
+		for key, version := range setAt {
+			if version > since {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	// the working tree, with its unsaved changes
+	for since := int64(0); since <= 5; since++ {
+		require.Equal(t, expected(since), collect(tree.ImmutableTree, since), "since %d", since)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []string{"k0028", "k0504", "k2000"}, collect(tree.ImmutableTree, 3))
+
+	// the untouched subtrees are not read: only the nodes newer than the version are, and the
+	// root was loaded already
+	reopened := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	reads := db.reads
+	require.Equal(t, []string{"k0028", "k0504", "k2000"}, collect(reopened.ImmutableTree, 3))
+	reads = db.reads - reads
+	newer := 0
+	reopened.root.traverse(reopened.ImmutableTree, true, func(node *Node) bool {
+		if node.nodeKey.version > 3 {
+			newer++
+		}
+		return false
+	})
+	require.Equal(t, newer-1, reads)
+
+	// stopping early
+	var visited int
+	require.NoError(t, tree.IterateLeavesNewerThan(1, func(_, _ []byte, _ int64) bool {
+		visited++
+		return visited == 2
+	}))
+	require.Equal(t, 2, visited)
+}
+
 func Benchmark_GetWithIndex(b *testing.B) {
 	db := dbm.NewMemDB()
 
@@ -1947,3 +2222,388 @@ func TestWorkingHashWithInitialVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, commitHash1, commitHash)
 }
+
+func TestHasBatch(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	found, err := tree.HasBatch([][]byte{[]byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false}, found)
+
+	for i := 0; i < 100; i += 2 {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v"))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	found, err = itree.HasBatch(nil)
+	require.NoError(t, err)
+	require.Empty(t, found)
+
+	// all absent, including keys outside the range of the tree
+	found, err = itree.HasBatch([][]byte{[]byte("k001"), []byte("z"), []byte("a"), []byte("k099")})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, false, false, false}, found)
+
+	// unsorted keys with duplicates match the Has results in input order
+	keys := make([][]byte, 0, 120)
+	for i := 0; i < 120; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("k%03d", (i*37)%110)))
+	}
+	keys = append(keys, keys[3], keys[4])
+	found, err = itree.HasBatch(keys)
+	require.NoError(t, err)
+	require.Len(t, found, len(keys))
+	for i, key := range keys {
+		has, err := itree.Has(key)
+		require.NoError(t, err)
+		require.Equal(t, has, found[i], "key %s", key)
+	}
+
+	_, err = itree.HasBatch([][]byte{[]byte("a"), nil})
+	require.ErrorIs(t, err, ErrKeyEmpty)
+}
+
+func TestFindByValuePrefix(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	keys, err := tree.FindByValuePrefix([]byte("x"))
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	for i := 0; i < 30; i++ {
+		value := "odd"
+		if i%2 == 0 {
+			value = "even"
+		}
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("%s-%d", value, i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	keys, err = itree.FindByValuePrefix([]byte("odd-2"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("k21"), []byte("k23"), []byte("k25"), []byte("k27"), []byte("k29")}, keys)
+
+	keys, err = itree.FindByValuePrefix([]byte("none"))
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	// an empty prefix matches every key
+	keys, err = itree.FindByValuePrefix(nil)
+	require.NoError(t, err)
+	require.Len(t, keys, 30)
+
+	// the callback variant stops early
+	var visited []string
+	stopped, err := itree.IterateByValuePrefix([]byte("even"), func(key, value []byte) bool {
+		visited = append(visited, string(key))
+		require.True(t, bytes.HasPrefix(value, []byte("even")))
+		return len(visited) == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, []string{"k00", "k02", "k04"}, visited)
+}
+
+func TestNewImmutableTreeFromReplica(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for v := 1; v <= 2; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// the replica lags the primary by a version
+	replica := dbm.NewMemDB()
+	snapshot := func(db corestore.KVStoreWithBatch) map[string]string {
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		kvs := make(map[string]string)
+		for ; itr.Valid(); itr.Next() {
+			kvs[string(itr.Key())] = string(itr.Value())
+		}
+		return kvs
+	}
+	for k, v := range snapshot(db) {
+		require.NoError(t, replica.Set([]byte(k), []byte(v)))
+	}
+	_, err := tree.Set([]byte("k00"), []byte("v3"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	before := snapshot(replica)
+	for v := int64(1); v <= 2; v++ {
+		expected, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		itree, err := NewImmutableTreeFromReplica(replica, v, NewNopLogger())
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), itree.Hash())
+		value, err := itree.Get([]byte("k00"))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("v%d-0", v)), value)
+		_, err = itree.Iterate(func(_, _ []byte) bool { return false })
+		require.NoError(t, err)
+	}
+	require.Equal(t, before, snapshot(replica))
+
+	_, err = NewImmutableTreeFromReplica(replica, 3, NewNopLogger())
+	require.ErrorIs(t, err, ErrVersionNotReplicated)
+	_, err = NewImmutableTreeFromReplica(replica, 0, NewNopLogger())
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestKeyHistogram(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), bytes.Repeat([]byte{'v'}, i+1))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	stats, err := itree.KeyHistogram(4)
+	require.NoError(t, err)
+	require.Equal(t, []BucketStat{
+		{StartKey: []byte("k0"), EndKey: []byte("k1"), Keys: 2, EstKeyBytes: 4, EstValueBytes: 3},
+		{StartKey: []byte("k2"), EndKey: []byte("k4"), Keys: 3, EstKeyBytes: 6, EstValueBytes: 12},
+		{StartKey: []byte("k5"), EndKey: []byte("k6"), Keys: 2, EstKeyBytes: 4, EstValueBytes: 13},
+		{StartKey: []byte("k7"), EndKey: []byte("k9"), Keys: 3, EstKeyBytes: 6, EstValueBytes: 27},
+	}, stats)
+
+	stats, err = itree.KeyHistogram(20)
+	require.NoError(t, err)
+	require.Len(t, stats, 10)
+	for i, stat := range stats {
+		require.Equal(t, int64(1), stat.Keys)
+		require.Equal(t, int64(i+1), stat.EstValueBytes)
+	}
+
+	_, err = itree.KeyHistogram(0)
+	require.Error(t, err)
+	stats, err = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).ImmutableTree.KeyHistogram(4)
+	require.NoError(t, err)
+	require.Empty(t, stats)
+
+	// the buckets only load the paths to their first and last leaves, and the left siblings on them
+	db := &readCountingDB{MemDB: dbm.NewMemDB()}
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	itree, err = reloaded.GetImmutable(1)
+	require.NoError(t, err)
+	db.reads = 0
+	stats, err = itree.KeyHistogram(4)
+	require.NoError(t, err)
+	require.Len(t, stats, 4)
+	require.Equal(t, []byte("k0250"), stats[1].StartKey)
+	require.Equal(t, int64(250*5), stats[1].EstValueBytes)
+	require.LessOrEqual(t, db.reads, 2*8*int(itree.root.subtreeHeight))
+}
+
+func TestValueDuplicationStats(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	// 12 keys holding 4 distinct values of 1 to 4 bytes, and one empty value
+	for i := 0; i < 12; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), bytes.Repeat([]byte{'v'}, i%4+1))
+		require.NoError(t, err)
+	}
+	_, err := tree.Set([]byte("empty"), []byte{})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	distinct, total, deduped, err := itree.ValueDuplicationStats()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), distinct)
+	require.Equal(t, int64(13), total)
+	require.Equal(t, int64(1+2+3+4), deduped)
+
+	distinct, total, deduped, err = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).ImmutableTree.ValueDuplicationStats()
+	require.NoError(t, err)
+	require.Zero(t, distinct)
+	require.Zero(t, total)
+	require.Zero(t, deduped)
+}
+
+func TestNewImmutableTreeFromSnapshot(t *testing.T) {
+	db, err := dbm.NewGoLevelDB("snapshot", t.TempDir())
+	require.NoError(t, err)
+	defer db.Close()
+
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for v := 1; v <= 2; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	hash := tree.Hash()
+
+	snap, err := db.Snapshot()
+	require.NoError(t, err)
+	defer snap.Release()
+
+	// rewrite and remove keys on the live tree, and prune the version of the snapshot
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			_, _, err = tree.Remove([]byte(fmt.Sprintf("k%02d", i)))
+		} else {
+			_, err = tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v3"))
+		}
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	_, err = tree.GetImmutable(2)
+	require.Error(t, err)
+
+	itree, err := NewImmutableTreeFromSnapshot(snap, 2, NewNopLogger())
+	require.NoError(t, err)
+	require.Equal(t, hash, itree.Hash())
+	i := 0
+	_, err = itree.Iterate(func(key, value []byte) bool {
+		require.Equal(t, []byte(fmt.Sprintf("k%02d", i)), key)
+		require.Equal(t, []byte(fmt.Sprintf("v2-%d", i)), value)
+		i++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, 20, i)
+
+	_, err = NewImmutableTreeFromSnapshot(snap, 3, NewNopLogger())
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestSplitRange(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, size := range []int{0, 1, 5, 100, 1000} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		for tree.Size() < int64(size) {
+			key := make([]byte, 1+r.Intn(8))
+			r.Read(key)
+			_, err := tree.Set(key, []byte{1})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(1)
+		require.NoError(t, err)
+
+		for _, n := range []int{1, 2, 3, 7, 16} {
+			splits, err := itree.SplitRange(n)
+			require.NoError(t, err)
+			require.Len(t, splits, max(min(n, size)-1, 0))
+
+			bounds := append(append([][]byte{nil}, splits...), nil)
+			counts := make([]int, 0, len(bounds)-1)
+			for i := 0; i+1 < len(bounds); i++ {
+				itr, err := itree.Iterator(bounds[i], bounds[i+1], true)
+				require.NoError(t, err)
+				count := 0
+				for ; itr.Valid(); itr.Next() {
+					count++
+				}
+				require.NoError(t, itr.Close())
+				counts = append(counts, count)
+			}
+			total := 0
+			for _, count := range counts {
+				total += count
+				require.InDelta(t, float64(size)/float64(len(counts)), count, 1, "size %d, n %d", size, n)
+			}
+			require.Equal(t, size, total)
+		}
+	}
+
+	_, err := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).ImmutableTree.SplitRange(0)
+	require.Error(t, err)
+}
+
+func TestFindDivergence(t *testing.T) {
+	dbA, dbB := dbm.NewMemDB(), dbm.NewMemDB()
+	treeA := NewMutableTree(dbA, 0, false, NewNopLogger())
+	treeB := NewMutableTree(dbB, 0, false, NewNopLogger())
+	for v := 1; v <= 10; v++ {
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("k%d-%d", v, i))
+			_, err := treeA.Set(key, []byte{byte(v)})
+			require.NoError(t, err)
+			if v >= 7 && i == 0 {
+				// the trees fork at version 7
+				_, err = treeB.Set(key, []byte("fork"))
+			} else {
+				_, err = treeB.Set(key, []byte{byte(v)})
+			}
+			require.NoError(t, err)
+		}
+		_, _, err := treeA.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = treeB.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	version, err := FindDivergence(dbA, dbB)
+	require.NoError(t, err)
+	require.EqualValues(t, 7, version)
+
+	// only the common range is compared
+	require.NoError(t, treeB.DeleteVersionsTo(3))
+	version, err = FindDivergence(dbA, dbB)
+	require.NoError(t, err)
+	require.EqualValues(t, 7, version)
+
+	version, err = FindDivergence(dbA, dbA)
+	require.NoError(t, err)
+	require.EqualValues(t, -1, version)
+
+	_, err = FindDivergence(dbA, dbm.NewMemDB())
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// the roots converge again once the key written differently is overwritten
+	dbC, dbD := dbm.NewMemDB(), dbm.NewMemDB()
+	treeC := NewMutableTree(dbC, 0, false, NewNopLogger())
+	treeD := NewMutableTree(dbD, 0, false, NewNopLogger())
+	for v := 1; v <= 10; v++ {
+		valueC, valueD := []byte{byte(v)}, []byte{byte(v)}
+		if v == 3 {
+			valueD = []byte("fork")
+		}
+		_, err := treeC.Set([]byte(fmt.Sprintf("k%d", v%4)), valueC)
+		require.NoError(t, err)
+		_, err = treeD.Set([]byte(fmt.Sprintf("k%d", v%4)), valueD)
+		require.NoError(t, err)
+		hashC, _, err := treeC.SaveVersion()
+		require.NoError(t, err)
+		hashD, _, err := treeD.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, v >= 3 && v < 7, !bytes.Equal(hashC, hashD))
+	}
+	version, err = FindDivergence(dbC, dbD)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+}
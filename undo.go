@@ -0,0 +1,219 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// ErrChangesNotRecorded is returned by MutableTree.ReconstructVersion when the changes needed to
+// rebuild a version are not recorded, see Options.UndoVersions.
+var ErrChangesNotRecorded = errors.New("changes of the version are not recorded")
+
+// undoRecord is the header of the recorded changes of a version, see Options.UndoVersions.
+type undoRecord struct {
+	prevVersion int64
+	prevHash    []byte
+	prevRootKey []byte // nil if the previous tree is empty
+}
+
+func (r *undoRecord) encode() []byte {
+	bz := binary.AppendUvarint(nil, uint64(r.prevVersion)) // nolint:gosec // the integer version is always positive
+	bz = append(bz, r.prevHash...)
+	return append(bz, r.prevRootKey...)
+}
+
+func decodeUndoRecord(bz []byte) (*undoRecord, error) {
+	version, n := binary.Uvarint(bz)
+	if n <= 0 || len(bz) < n+hashSize {
+		return nil, errors.New("invalid undo record")
+	}
+	r := &undoRecord{
+		prevVersion: int64(version), // nolint:gosec // the integer version is always positive
+		prevHash:    bz[n : n+hashSize],
+	}
+	if rootKey := bz[n+hashSize:]; len(rootKey) > 0 {
+		r.prevRootKey = rootKey
+	}
+	return r, nil
+}
+
+// recordUndo records the changes of the given version from the version prev, which must both be
+// committed, and drops the recorded changes falling out of the retention of Options.UndoVersions.
+// The nodes are written with the default encoding along with their values, so they do not depend
+// on the codec or the value store. The legacy nodes are not recorded.
+func (ndb *nodeDB) recordUndo(prev, version int64) error {
+	prevRootKey, err := ndb.GetRoot(prev)
+	if err != nil {
+		return err
+	}
+	prevHash, err := ndb.rootHash(prev)
+	if err != nil {
+		return err
+	}
+	record := &undoRecord{prevVersion: prev, prevHash: prevHash, prevRootKey: prevRootKey}
+	if err := ndb.batch.Set(undoKeyFormat.Key(version), record.encode()); err != nil {
+		return err
+	}
+
+	if err := ndb.traverseOrphans(prev, version, func(orphan *Node) error {
+		if orphan.isLegacy {
+			return nil
+		}
+		var buf bytes.Buffer
+		buf.Grow(orphan.encodedSize())
+		if err := orphan.writeBytes(&buf); err != nil {
+			return err
+		}
+		return ndb.batch.Set(undoKeyFormat.Key(version, orphan.GetKey()), buf.Bytes())
+	}); err != nil {
+		return err
+	}
+
+	if version <= ndb.opts.UndoVersions {
+		return nil
+	}
+	return ndb.traverseRange(undoKeyFormat.Key(int64(0)), undoKeyFormat.Key(version-ndb.opts.UndoVersions+1), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	})
+}
+
+// ReconstructVersion rebuilds the tree of a pruned version from the first later version still
+// stored and the changes recorded for the versions in between, see Options.UndoVersions. The tree
+// is rebuilt in memory, and its root hash is recomputed from the nodes and verified against the
+// root hash recorded along with the changes. The returned tree is read-only, and independent of
+// the db of the tree. The tree of a version which is still stored is returned as is.
+//
+// It returns ErrChangesNotRecorded if the changes of a version in between are not recorded, e.g.
+// since it was saved without Options.UndoVersions, they fell out of the retention, or a crash
+// interrupted SaveVersion before it recorded them, and ErrVersionDoesNotExist if the version was
+// never saved. The legacy nodes are not
+// recorded, so the versions whose nodes were orphaned in the legacy format cannot be rebuilt.
+func (tree *MutableTree) ReconstructVersion(target int64) (*ImmutableTree, error) {
+	if tree.versionExists(target) {
+		return tree.GetImmutable(target)
+	}
+	_, latest, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if target <= 0 || target > latest {
+		return nil, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, target)
+	}
+	later := target + 1
+	for !tree.versionExists(later) {
+		if later++; later > latest {
+			return nil, fmt.Errorf("%w: no version later than %d is stored", ErrVersionDoesNotExist, target)
+		}
+	}
+
+	// un-apply the changes of the versions from the later one down to the target, collecting the
+	// nodes they orphaned
+	orphans := make(map[string][]byte)
+	var record *undoRecord
+	for version := later; ; version = record.prevVersion {
+		bz, err := tree.ndb.db.Get(undoKeyFormat.Key(version))
+		if err != nil {
+			return nil, err
+		}
+		if bz == nil {
+			return nil, fmt.Errorf("%w: version %d", ErrChangesNotRecorded, version)
+		}
+		if record, err = decodeUndoRecord(bz); err != nil {
+			return nil, err
+		}
+		if err := tree.ndb.traverseRange(undoKeyFormat.Key(version, []byte{0}), undoKeyFormat.Key(version+1), func(k, v []byte) error {
+			orphans[string(k[undoKeyFormat.Length():])] = v
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		if record.prevVersion == target {
+			break
+		}
+		if record.prevVersion < target {
+			return nil, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, target)
+		}
+	}
+
+	// copy the nodes of the target into an in-memory db, recomputing their hashes
+	memDB := dbm.NewMemDB()
+	ndb := newNodeDB(memDB, 0, DefaultOptions(), tree.logger)
+	var copyNode func(nk []byte) (*Node, error)
+	copyNode = func(nk []byte) (*Node, error) {
+		var node *Node
+		if bz, ok := orphans[string(nk)]; ok {
+			if node, err = MakeNode(nk, bz); err != nil {
+				return nil, err
+			}
+		} else {
+			stored, err := tree.ndb.GetNode(nk)
+			if err != nil {
+				return nil, err
+			}
+			copied := *stored
+			copied.pooled, copied.refs, copied.evicted = false, 0, false
+			node = &copied
+		}
+		if !node.isLeaf() {
+			left, err := copyNode(node.leftNodeKey)
+			if err != nil {
+				return nil, err
+			}
+			right, err := copyNode(node.rightNodeKey)
+			if err != nil {
+				return nil, err
+			}
+			node.leftNode, node.rightNode = left, right
+			node.hash = nil
+			node._hash(node.nodeKey.version)
+			node.leftNode, node.rightNode = nil, nil
+		}
+		if node.isLegacy {
+			bz, err := tree.ndb.db.Get(tree.ndb.legacyNodeKey(nk))
+			if err != nil {
+				return nil, err
+			}
+			return node, memDB.Set(ndb.legacyNodeKey(nk), bz)
+		}
+		var buf bytes.Buffer
+		if err := node.writeBytes(&buf); err != nil {
+			return nil, err
+		}
+		return node, memDB.Set(ndb.nodeKey(nk), buf.Bytes())
+	}
+
+	var root *Node
+	if record.prevRootKey != nil {
+		if root, err = copyNode(record.prevRootKey); err != nil {
+			return nil, err
+		}
+	}
+	if hash := root.hashWithCount(target + 1); !bytes.Equal(hash, record.prevHash) {
+		return nil, fmt.Errorf("%w: rebuilt version %d has root hash %X, but %X was recorded",
+			ErrVersionMetadataCorrupt, target, hash, record.prevHash)
+	}
+	switch {
+	case root == nil:
+		err = ndb.SaveEmptyRoot(target)
+	case len(record.prevRootKey) == hashSize:
+		err = ndb.batch.Set(ndb.legacyRootKey(target), record.prevRootKey)
+	case !bytes.Equal(record.prevRootKey, GetRootKey(target)):
+		err = ndb.SaveRoot(target, GetNodeKey(record.prevRootKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ndb.Commit(); err != nil {
+		return nil, err
+	}
+
+	rebuilt := NewMutableTree(memDB, 0, true, tree.logger)
+	if _, err := rebuilt.LoadVersion(target); err != nil {
+		return nil, err
+	}
+	return rebuilt.GetImmutable(target)
+}
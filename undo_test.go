@@ -0,0 +1,90 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestMutableTree_ReconstructVersion(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), UndoVersionsOption(10))
+	r := rand.New(rand.NewSource(7))
+	hashes := map[int64][]byte{}
+	states := map[int64]map[string]string{}
+	state := map[string]string{}
+	for version := int64(1); version <= 12; version++ {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key%03d", r.Intn(100))
+			if r.Intn(4) == 0 {
+				_, _, err := tree.Remove([]byte(key))
+				require.NoError(t, err)
+				delete(state, key)
+				continue
+			}
+			value := fmt.Sprintf("value%d-%d", version, i)
+			_, err := tree.Set([]byte(key), []byte(value))
+			require.NoError(t, err)
+			state[key] = value
+		}
+		if version == 6 {
+			// an unchanged version
+			tree.Rollback()
+			state = make(map[string]string, len(states[5]))
+			for k, v := range states[5] {
+				state[k] = v
+			}
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+		states[version] = make(map[string]string, len(state))
+		for k, v := range state {
+			states[version][k] = v
+		}
+	}
+
+	require.NoError(t, tree.DeleteVersionsTo(8))
+	require.False(t, tree.VersionExists(4))
+
+	for _, version := range []int64{3, 5, 6, 8} {
+		rebuilt, err := tree.ReconstructVersion(version)
+		require.NoError(t, err, "version %d", version)
+		require.Equal(t, hashes[version], rebuilt.Hash(), "version %d", version)
+		require.Equal(t, version, rebuilt.Version())
+		require.Equal(t, int64(len(states[version])), rebuilt.Size())
+		for key, value := range states[version] {
+			got, err := rebuilt.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, value, string(got))
+		}
+	}
+
+	// a stored version is returned as is
+	stored, err := tree.ReconstructVersion(10)
+	require.NoError(t, err)
+	require.Equal(t, hashes[10], stored.Hash())
+
+	// the changes of version 2 fell out of the retention
+	_, err = tree.ReconstructVersion(1)
+	require.ErrorIs(t, err, ErrChangesNotRecorded)
+	_, err = tree.ReconstructVersion(13)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_ReconstructVersionNotRecorded(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for version := 1; version <= 3; version++ {
+		_, err := tree.Set([]byte("key"), []byte(fmt.Sprintf("value%d", version)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(1))
+
+	_, err := tree.ReconstructVersion(1)
+	require.ErrorIs(t, err, ErrChangesNotRecorded)
+}
@@ -49,7 +49,7 @@ func NewUnsavedFastIterator(start, end []byte, ascending bool, ndb *nodeDB, unsa
 		nextKey:                  nil,
 		nextVal:                  nil,
 		nextUnsavedNodeIdx:       0,
-		fastIterator:             NewFastIterator(start, end, ascending, ndb),
+		fastIterator:             newFastIterator(start, end, ascending, ndb, false), // the values are held past its position, so never unsafe
 	}
 
 	if iter.ndb == nil {
@@ -72,6 +72,7 @@ func NewUnsavedFastIterator(start, end []byte, ascending bool, ndb *nodeDB, unsa
 	// We need to ensure that we iterate over saved and unsaved state in order.
 	// The strategy is to sort unsaved nodes, the fast node on disk are already sorted.
 	// Then, we keep a pointer to both the unsaved and saved nodes, and iterate over them in order efficiently.
+	start, end = normalizeBound(start), normalizeBound(end)
 	unsavedFastNodeAdditions.Range(func(k, v interface{}) bool {
 		fastNode := v.(*fastnode.Node)
 
@@ -103,14 +104,14 @@ func NewUnsavedFastIterator(start, end []byte, ascending bool, ndb *nodeDB, unsa
 }
 
 // Domain implements store.Iterator.
-// Maps the underlying nodedb iterator domain, to the 'logical' keys involved.
+// It returns the bounds the iterator was created with.
 func (iter *UnsavedFastIterator) Domain() ([]byte, []byte) {
 	return iter.start, iter.end
 }
 
 // Valid implements store.Iterator.
 func (iter *UnsavedFastIterator) Valid() bool {
-	if iter.start != nil && iter.end != nil {
+	if len(iter.start) > 0 && len(iter.end) > 0 {
 		if bytes.Compare(iter.end, iter.start) != 1 {
 			return false
 		}
@@ -216,6 +217,27 @@ func (iter *UnsavedFastIterator) Next() {
 	iter.nextVal = nil
 }
 
+// EstimateRemaining returns an estimate of the number of entries left to iterate, the current one
+// included. It adds the unsaved additions left to iterate to the remaining keys of the latest
+// saved version, so it is exact for a working set without changes in the range, but overcounts
+// updated and removed keys otherwise.
+func (iter *UnsavedFastIterator) EstimateRemaining() int64 {
+	if !iter.Valid() || iter.ndb == nil {
+		return 0
+	}
+	remaining := int64(len(iter.unsavedFastNodesToSort) - iter.nextUnsavedNodeIdx)
+	if !iter.fastIterator.Valid() {
+		// only the current entry and unsaved additions are left
+		return remaining + 1
+	}
+	tree, err := iter.ndb.latestImmutableTree()
+	if err != nil {
+		return remaining
+	}
+	// the fast iterator is positioned after the current entry
+	return remaining + 1 + tree.estimateRemaining(iter.fastIterator.Key(), iter.start, iter.end, iter.ascending)
+}
+
 // Close implements store.Iterator
 func (iter *UnsavedFastIterator) Close() error {
 	iter.valid = false
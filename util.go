@@ -55,9 +55,41 @@ func printNode(ndb *nodeDB, node *Node, indent int) error {
 	return nil
 }
 
+// validateKey returns ErrKeyEmpty if the key is nil or zero-length. Both forms are treated
+// identically across the public API, since an empty key can never be stored in the tree.
+func validateKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyEmpty
+	}
+	return nil
+}
+
+// normalizeBound maps an empty iteration bound to nil, so that []byte{} and nil both
+// denote an open end of the iteration domain.
+func normalizeBound(bound []byte) []byte {
+	if len(bound) == 0 {
+		return nil
+	}
+	return bound
+}
+
 func maxInt8(a, b int8) int8 {
 	if a > b {
 		return a
 	}
 	return b
 }
+
+// MaxTreeHeight returns the theoretical maximum height of an IAVL tree holding size keys. The
+// sparsest AVL tree of height h holds F(h+2) leaves, F being the Fibonacci sequence, so the height
+// is bounded by about 1.44*log2(size), e.g. 28 for a million keys and 42 for a billion keys.
+func MaxTreeHeight(size int64) int8 {
+	var height int8
+	// leaves(h) is the minimum number of leaves of a tree of height h
+	prev, leaves := int64(1), int64(2)
+	for leaves <= size {
+		prev, leaves = leaves, prev+leaves
+		height++
+	}
+	return height
+}
@@ -0,0 +1,142 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// ErrValueIndexDisabled is returned by KeysByValue when Options.EnableValueIndex is not set.
+var ErrValueIndexDisabled = errors.New("value index is disabled")
+
+// KeysByValue returns the keys holding the given value, in ascending order, using the value index
+// maintained with Options.EnableValueIndex. The index only covers the latest saved version, so it
+// returns an error for the other versions, and it does not reflect the unsaved changes of a
+// MutableTree. The index is read from the db as it is, so a version saved concurrently may be
+// partially reflected.
+func (t *ImmutableTree) KeysByValue(value []byte) ([][]byte, error) {
+	if !t.ndb.opts.EnableValueIndex {
+		return nil, ErrValueIndexDisabled
+	}
+	if value == nil {
+		return nil, errors.New("value cannot be nil")
+	}
+	indexVersion, err := t.ndb.getValueIndexVersion()
+	if err != nil {
+		return nil, err
+	}
+	if indexVersion != t.version {
+		return nil, fmt.Errorf("the value index is at version %d, not at version %d", indexVersion, t.version)
+	}
+
+	hash := sha256.Sum256(value)
+	prefix := valueIndexKeyFormat.Key(hash[:])
+	var keys [][]byte
+	if err := t.ndb.traversePrefix(prefix, func(k, _ []byte) error {
+		keys = append(keys, ibytes.Cp(k[len(prefix):]))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// getValueIndexVersion returns the version the value index reflects, or 0 if there is none.
+func (ndb *nodeDB) getValueIndexVersion() (int64, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(valueIndexKey)))
+	if err != nil || bz == nil {
+		return 0, err
+	}
+	version, n := binary.Varint(bz)
+	if n <= 0 {
+		return 0, errors.New("invalid value index version")
+	}
+	return version, nil
+}
+
+// setValueIndexEntry adds, or deletes if del is set, the value index entry of the given pair.
+func (ndb *nodeDB) setValueIndexEntry(key, value []byte, del bool) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	hash := sha256.Sum256(value)
+	if del {
+		return ndb.batch.Delete(valueIndexKeyFormat.Key(hash[:], key))
+	}
+	return ndb.batch.Set(valueIndexKeyFormat.Key(hash[:], key), []byte{})
+}
+
+// setValueIndexVersion records the version the value index reflects.
+func (ndb *nodeDB) setValueIndexVersion(version int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(valueIndexKey)), binary.AppendVarint(nil, version))
+}
+
+// updateValueIndex updates the value index from the previous saved tree to the given version,
+// which is the saved working tree, see Options.EnableValueIndex. The changes of the version are
+// applied if the index is at the previous version, otherwise the index is rebuilt. The writes
+// are left in the batch.
+func (tree *MutableTree) updateValueIndex(prevTree *ImmutableTree, version int64) error {
+	prevVersion := prevTree.version
+	indexVersion, err := tree.ndb.getValueIndexVersion()
+	if err != nil {
+		return err
+	}
+	if indexVersion == 0 || indexVersion != prevVersion {
+		return tree.rebuildValueIndex()
+	}
+
+	prevRoot, err := tree.ndb.GetRoot(prevVersion)
+	if err != nil {
+		return err
+	}
+	root, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return err
+	}
+	if err := tree.ndb.extractStateChanges(prevVersion, prevRoot, root, func(pair *KVPair) error {
+		// the previous value is read from the tree, since the fast nodes are already updated
+		_, prevValue, err := prevTree.GetWithIndex(pair.Key)
+		if err != nil {
+			return err
+		}
+		if prevValue != nil {
+			if err := tree.ndb.setValueIndexEntry(pair.Key, prevValue, true); err != nil {
+				return err
+			}
+		}
+		if pair.Delete {
+			return nil
+		}
+		return tree.ndb.setValueIndexEntry(pair.Key, pair.Value, false)
+	}); err != nil {
+		return err
+	}
+	return tree.ndb.setValueIndexVersion(version)
+}
+
+// rebuildValueIndex replaces the value index with the one of the saved working tree.
+func (tree *MutableTree) rebuildValueIndex() error {
+	if err := tree.ndb.traversePrefix(valueIndexKeyFormat.Key(), func(k, _ []byte) error {
+		tree.ndb.mtx.Lock()
+		defer tree.ndb.mtx.Unlock()
+		return tree.ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	// the leaves are read from the tree, since the fast nodes may be written asynchronously
+	var err error
+	if iterErr := tree.ImmutableTree.IterateLeavesNewerThan(0, func(key, value []byte, _ int64) bool {
+		err = tree.ndb.setValueIndexEntry(key, value, false)
+		return err != nil
+	}); iterErr != nil {
+		return iterErr
+	}
+	if err != nil {
+		return err
+	}
+	return tree.ndb.setValueIndexVersion(tree.version)
+}
@@ -0,0 +1,89 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// checkValueIndex checks that KeysByValue returns the keys of every value of the tree.
+func checkValueIndex(t *testing.T, tree *MutableTree, values []string) {
+	expected := make(map[string][]string)
+	_, err := tree.Iterate(func(key, value []byte) bool {
+		expected[string(value)] = append(expected[string(value)], string(key))
+		return false
+	})
+	require.NoError(t, err)
+	for _, value := range values {
+		keys, err := tree.KeysByValue([]byte(value))
+		require.NoError(t, err)
+		var actual []string
+		for _, key := range keys {
+			actual = append(actual, string(key))
+		}
+		sort.Strings(expected[value])
+		require.Equal(t, expected[value], actual, "value %s at version %d", value, tree.Version())
+	}
+}
+
+func TestValueIndex(t *testing.T) {
+	values := []string{"a", "b", "c", "d", "e"}
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), EnableValueIndexOption(true))
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+
+	r := rand.New(rand.NewSource(0))
+	for v := 0; v < 20; v++ {
+		for i := 0; i < 30; i++ {
+			key := []byte(fmt.Sprintf("k%02d", r.Intn(50)))
+			remove, value := r.Intn(4) == 0, []byte(values[r.Intn(len(values))])
+			for _, tr := range []*MutableTree{tree, plain} {
+				if remove {
+					_, _, err := tr.Remove(key)
+					require.NoError(t, err)
+				} else {
+					_, err := tr.Set(key, value)
+					require.NoError(t, err)
+				}
+			}
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		// the index is not part of the hashes
+		plainHash, _, err := plain.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, plainHash, hash)
+		checkValueIndex(t, tree, values)
+	}
+
+	// only the latest version is indexed
+	itree, err := tree.GetImmutable(tree.Version() - 1)
+	require.NoError(t, err)
+	_, err = itree.KeysByValue([]byte("a"))
+	require.Error(t, err)
+	_, err = plain.KeysByValue([]byte("a"))
+	require.ErrorIs(t, err, ErrValueIndexDisabled)
+
+	// the index is rebuilt after deleting the latest versions
+	require.NoError(t, tree.DeleteVersionsFrom(tree.Version()-2))
+	reopened := NewMutableTree(db, 0, false, NewNopLogger(), EnableValueIndexOption(true))
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	checkValueIndex(t, reopened, values)
+	_, err = reopened.Set([]byte("k00"), []byte("f"))
+	require.NoError(t, err)
+	_, _, err = reopened.SaveVersion()
+	require.NoError(t, err)
+	checkValueIndex(t, reopened, append(values, "f"))
+
+	// the index is built when enabling it on an existing db
+	reopened = NewMutableTree(plain.ndb.db, 0, false, NewNopLogger(), EnableValueIndexOption(true))
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	checkValueIndex(t, reopened, values)
+}
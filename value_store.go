@@ -0,0 +1,118 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// dedupCodecSuffix is appended to the ID of the node codec of a db whose leaves refer to the
+// value store, see Options.DedupValues, so the db is not loaded without it and vice versa.
+const dedupCodecSuffix = "+dedup"
+
+// storedValue is an entry of the value store, along with the number of leaves referring to it.
+type storedValue struct {
+	refs  uint64
+	value []byte
+}
+
+// nodeCodecID returns the ID recorded in the metadata for the codec of the db.
+func (ndb *nodeDB) nodeCodecID() string {
+	id := ndb.nodeCodec().ID()
+	if ndb.opts.DedupValues {
+		id += dedupCodecSuffix
+	}
+	return id
+}
+
+// storedValueUnlocked returns the entry of the value store with the given hash, or nil if there
+// is none. The entries changed since the last commit are read from memory, since the batch may
+// not be written yet.
+func (ndb *nodeDB) storedValueUnlocked(hash []byte) (*storedValue, error) {
+	if entry, ok := ndb.storedValues[string(hash)]; ok {
+		return entry, nil
+	}
+	bz, err := ndb.db.Get(valueKeyFormat.Key(hash))
+	if err != nil || bz == nil {
+		return nil, err
+	}
+	return decodeStoredValue(bz)
+}
+
+func decodeStoredValue(bz []byte) (*storedValue, error) {
+	refs, n := binary.Uvarint(bz)
+	if n <= 0 {
+		return nil, errors.New("invalid value store entry")
+	}
+	return &storedValue{refs: refs, value: bz[n:]}, nil
+}
+
+// writeStoredValueUnlocked records the entry of the value store with the given hash in the batch,
+// deleting it if no leaf refers to it anymore.
+func (ndb *nodeDB) writeStoredValueUnlocked(batch corestore.Batch, hash []byte, entry *storedValue) error {
+	ndb.storedValues[string(hash)] = entry
+	if entry.refs == 0 {
+		return batch.Delete(valueKeyFormat.Key(hash))
+	}
+	bz := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(entry.value)), entry.refs)
+	return batch.Set(valueKeyFormat.Key(hash), append(bz, entry.value...))
+}
+
+// retainValueUnlocked adds a reference to the value from a leaf written to the batch, storing
+// the value if it is not yet. It must precede the write of the leaf, so a leaf never refers to a
+// missing value, even if the batch is flushed in between.
+func (ndb *nodeDB) retainValueUnlocked(batch corestore.Batch, value []byte) error {
+	hash := sha256.Sum256(value)
+	entry, err := ndb.storedValueUnlocked(hash[:])
+	if err != nil {
+		return err
+	}
+	if entry == nil || entry.refs == 0 {
+		entry = &storedValue{value: value}
+	}
+	return ndb.writeStoredValueUnlocked(batch, hash[:], &storedValue{refs: entry.refs + 1, value: entry.value})
+}
+
+// releaseStoredLeafUnlocked removes the reference to its value of the leaf stored under the given
+// db key, which is deleted from the batch, and deletes the value once no leaf refers to it. It
+// must follow the deletion of the leaf, so a crash in between leaks the value at worst. The root
+// references and the inner nodes refer to no value.
+func (ndb *nodeDB) releaseStoredLeafUnlocked(batch corestore.Batch, bz []byte) error {
+	if len(bz) == 0 || bz[0] == nodeKeyFormat.Prefix()[0] {
+		return nil
+	}
+	data, err := ndb.nodeCodec().Decode(bz)
+	if err != nil {
+		return err
+	}
+	if data.Height != 0 {
+		return nil
+	}
+	entry, err := ndb.storedValueUnlocked(data.Value)
+	if err != nil {
+		return err
+	}
+	if entry == nil || entry.refs == 0 {
+		return fmt.Errorf("value %X of a deleted leaf is missing from the value store", data.Value)
+	}
+	return ndb.writeStoredValueUnlocked(batch, data.Value, &storedValue{refs: entry.refs - 1, value: entry.value})
+}
+
+// loadStoredValue returns the value with the given hash which a leaf refers to.
+func (ndb *nodeDB) loadStoredValue(hash []byte) ([]byte, error) {
+	bz, err := ndb.db.Get(valueKeyFormat.Key(hash))
+	if err != nil {
+		return nil, err
+	}
+	if bz == nil {
+		return nil, fmt.Errorf("value %X is missing from the value store", hash)
+	}
+	entry, err := decodeStoredValue(bz)
+	if err != nil {
+		return nil, err
+	}
+	return entry.value, nil
+}
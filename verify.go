@@ -0,0 +1,139 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrCorruptedVersion is returned by VerifyVersion when the nodes of a version are inconsistent.
+var ErrCorruptedVersion = errors.New("corrupted version")
+
+// VerifyVersion checks the integrity of the given saved version. It reads every node of the
+// version from the db, bypassing the node cache, recomputes the hashes bottom up and checks them against the stored inner
+// node hashes, along with the height, size and key ordering of every subtree.
+func (tree *MutableTree) VerifyVersion(version int64) error {
+	return tree.VerifyVersionParallel(version, 1)
+}
+
+// VerifyVersionParallel is VerifyVersion, verifying independent subtrees with up to the given
+// number of workers. The subtree hashes are still combined and checked up to the root.
+func (tree *MutableTree) VerifyVersionParallel(version int64, workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("invalid number of workers %d", workers)
+	}
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return err
+	}
+	if rootKey == nil {
+		return nil
+	}
+	v := &versionVerifier{
+		ndb: tree.ndb,
+		sem: make(chan struct{}, workers-1),
+	}
+	_, err = v.verify(rootKey)
+	return err
+}
+
+type versionVerifier struct {
+	ndb *nodeDB
+	// sem bounds the number of subtrees verified concurrently with the calling goroutine.
+	sem chan struct{}
+}
+
+// verifiedSubtree is the summary of a verified subtree which its parent is checked against.
+type verifiedSubtree struct {
+	hash           []byte
+	height         int8
+	size           int64
+	minKey, maxKey []byte
+}
+
+func (v *versionVerifier) verify(nk []byte) (*verifiedSubtree, error) {
+	// read from the db directly, so the workers do not contend on the node cache
+	node, err := v.ndb.readNode(nk)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.isLeaf() {
+		return v.verifyLeaf(nk, node)
+	}
+
+	var (
+		left, right *verifiedSubtree
+		leftErr     error
+		wg          sync.WaitGroup
+	)
+	select {
+	case v.sem <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-v.sem }()
+			left, leftErr = v.verify(node.leftNodeKey)
+		}()
+	default:
+		left, leftErr = v.verify(node.leftNodeKey)
+	}
+	right, err = v.verify(node.rightNodeKey)
+	wg.Wait()
+	if leftErr != nil {
+		return nil, leftErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func(format string, args ...interface{}) (*verifiedSubtree, error) {
+		return nil, fmt.Errorf("%w: node %v: %s", ErrCorruptedVersion, node.nodeKey, fmt.Sprintf(format, args...))
+	}
+	if node.subtreeHeight != max(left.height, right.height)+1 {
+		return fail("height %d does not match the children heights %d and %d", node.subtreeHeight, left.height, right.height)
+	}
+	if node.size != left.size+right.size {
+		return fail("size %d does not match the children sizes %d and %d", node.size, left.size, right.size)
+	}
+	if !bytes.Equal(node.key, right.minKey) || bytes.Compare(left.maxKey, right.minKey) >= 0 {
+		return fail("key %X does not split the children keys", node.key)
+	}
+
+	inner := &Node{
+		subtreeHeight: node.subtreeHeight,
+		size:          node.size,
+		leftNode:      &Node{hash: left.hash},
+		rightNode:     &Node{hash: right.hash},
+	}
+	hash := inner._hash(node.nodeKey.version)
+	if !bytes.Equal(hash, node.hash) {
+		return fail("hash %X does not match the recomputed hash %X", node.hash, hash)
+	}
+	return &verifiedSubtree{
+		hash:   hash,
+		height: node.subtreeHeight,
+		size:   node.size,
+		minKey: left.minKey,
+		maxKey: right.maxKey,
+	}, nil
+}
+
+func (v *versionVerifier) verifyLeaf(nk []byte, node *Node) (*verifiedSubtree, error) {
+	if node.size != 1 {
+		return nil, fmt.Errorf("%w: leaf %X has size %d", ErrCorruptedVersion, node.key, node.size)
+	}
+	// the hash of a leaf is not stored, except for legacy nodes which are keyed by their hash
+	leaf := &Node{key: node.key, value: node.value, size: 1}
+	hash := leaf._hash(node.nodeKey.version)
+	if node.isLegacy && !bytes.Equal(hash, nk) {
+		return nil, fmt.Errorf("%w: legacy leaf %X does not match its hash", ErrCorruptedVersion, node.key)
+	}
+	return &verifiedSubtree{
+		hash:   hash,
+		size:   1,
+		minKey: node.key,
+		maxKey: node.key,
+	}, nil
+}
@@ -0,0 +1,223 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// versionMetadataMagic prefixes the version metadata written by MutableTree.ExportVersionMetadata.
+var versionMetadataMagic = []byte("IAVLVERS")
+
+// versionMetadataFormat is the version of the format written after the magic.
+const versionMetadataFormat byte = 1
+
+// ErrInvalidVersionMetadata is returned by ImportVersionMetadata when the metadata is malformed,
+// or does not match the versions stored in the db.
+var ErrInvalidVersionMetadata = errors.New("invalid version metadata")
+
+// ErrVersionMetadataCorrupt is returned when loading a version whose root does not match the
+// checksum saved with the version.
+var ErrVersionMetadataCorrupt = errors.New("version metadata is corrupt")
+
+// checksumSize is the size of the checksum of a version.
+const checksumSize = 8
+
+// ExportVersionMetadata writes the list of the available versions and their root hashes to w.
+//
+// It is meant to bootstrap a replica by copying the db files: the metadata is exported before
+// the copy, and ImportVersionMetadata then makes the replica expose exactly the exported
+// versions, even if the source saved or pruned versions while the files were copied.
+func (tree *MutableTree) ExportVersionMetadata(w io.Writer) error {
+	versions := tree.AvailableVersions()
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(versionMetadataMagic)
+	buf.WriteByte(versionMetadataFormat)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(versions))))
+	prev := int64(0)
+	for _, v := range versions {
+		version := int64(v)
+		hash, err := tree.ndb.rootHash(version)
+		if err != nil {
+			return err
+		}
+		// the versions are ascending, so only the deltas are written
+		buf.Write(binary.AppendUvarint(nil, uint64(version-prev))) // nolint:gosec // the versions are ascending
+		buf.Write(hash)
+		prev = version
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ImportVersionMetadata makes the tree stored in db expose the versions written by
+// ExportVersionMetadata. It checks that every exported version is in the db with the exported
+// root hash, deletes the versions saved after the latest exported one, and hides the other
+// versions, see MutableTree.HideVersions, so they can be reclaimed later. The tree must not be
+// open while importing, and the options must be those it is opened with, in particular its
+// NodeCodec, since the roots are decoded to check their hashes.
+func ImportVersionMetadata(db corestore.KVStoreWithBatch, r io.Reader, options ...Option) error {
+	versions, hashes, err := readVersionMetadata(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("%w: no versions", ErrInvalidVersionMetadata)
+	}
+
+	opts := DefaultOptions()
+	for _, opt := range options {
+		opt(&opts)
+	}
+	// the versions are only deleted and hidden while importing, not pruned
+	opts.AsyncPruning = false
+	ndb := newNodeDB(db, 0, opts, NewNopLogger())
+	defer ndb.Close()
+	if err := ndb.checkNodeCodec(true); err != nil {
+		return err
+	}
+
+	for i, version := range versions {
+		hash, err := ndb.rootHash(version)
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			return fmt.Errorf("%w: version %d is missing from the db", ErrInvalidVersionMetadata, version)
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, hashes[i]) {
+			return fmt.Errorf("%w: version %d has root hash %X instead of %X", ErrInvalidVersionMetadata, version, hash, hashes[i])
+		}
+	}
+
+	latestVersion := versions[len(versions)-1]
+	if err := ndb.DeleteVersionsFrom(latestVersion + 1); err != nil {
+		return err
+	}
+
+	firstVersion, err := ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	hidden, err := ndb.getHiddenVersions()
+	if err != nil {
+		return err
+	}
+	hidden = hidden.truncate(latestVersion + 1)
+	next := firstVersion
+	for _, version := range versions {
+		if version > next {
+			hidden = append(hidden, versionRange{next, version - 1})
+		}
+		next = version + 1
+	}
+	if err := ndb.setHiddenVersions(hidden.normalize(firstVersion)); err != nil {
+		return err
+	}
+	return ndb.Commit()
+}
+
+func readVersionMetadata(r *bufio.Reader) ([]int64, [][]byte, error) {
+	header := make([]byte, len(versionMetadataMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: reading the header: %w", ErrInvalidVersionMetadata, err)
+	}
+	if !bytes.Equal(header[:len(versionMetadataMagic)], versionMetadataMagic) {
+		return nil, nil, fmt.Errorf("%w: bad magic", ErrInvalidVersionMetadata)
+	}
+	if format := header[len(versionMetadataMagic)]; format != versionMetadataFormat {
+		return nil, nil, fmt.Errorf("%w: unsupported format %d", ErrInvalidVersionMetadata, format)
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: reading the count: %w", ErrInvalidVersionMetadata, err)
+	}
+	var (
+		versions []int64
+		hashes   [][]byte
+		version  int64
+	)
+	for i := uint64(0); i < count; i++ {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: reading version %d: %w", ErrInvalidVersionMetadata, i, err)
+		}
+		if delta == 0 || delta > uint64(math.MaxInt64-version) {
+			return nil, nil, fmt.Errorf("%w: versions are not ascending", ErrInvalidVersionMetadata)
+		}
+		version += int64(delta) // nolint:gosec // we perform the check above
+		hash := make([]byte, hashSize)
+		if _, err := io.ReadFull(r, hash); err != nil {
+			return nil, nil, fmt.Errorf("%w: reading the hash of version %d: %w", ErrInvalidVersionMetadata, version, err)
+		}
+		versions = append(versions, version)
+		hashes = append(hashes, hash)
+	}
+	return versions, hashes, nil
+}
+
+// rootHash returns the root hash of the given version.
+func (ndb *nodeDB) rootHash(version int64) ([]byte, error) {
+	rootKey, err := ndb.GetRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	var root *Node
+	if rootKey != nil {
+		root, err = ndb.GetNode(rootKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return root.hashWithCount(version + 1), nil
+}
+
+// versionChecksum returns the checksum of a version over its root hash, size and height, which is
+// saved along with the version, so that a root mixed up with the one of another version, or
+// corrupted, is detected when loading it. It is truncated, since it guards against accidents,
+// not forgeries.
+func versionChecksum(version int64, root *Node) []byte {
+	var size int64
+	var height int8
+	if root != nil {
+		size, height = root.size, root.subtreeHeight
+	}
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(version))) // nolint:gosec // the integer version is always positive
+	h.Write(root.hashWithCount(version))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(size))) // nolint:gosec // sizes are non-negative
+	h.Write([]byte{byte(height)})
+	return h.Sum(nil)[:checksumSize]
+}
+
+// SaveVersionChecksum saves the checksum of the version with the given root, nil if empty.
+func (ndb *nodeDB) SaveVersionChecksum(version int64, root *Node) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Set(checksumKeyFormat.Key(version), versionChecksum(version, root))
+}
+
+// checkVersionChecksum returns ErrVersionMetadataCorrupt if the given root does not match the
+// checksum saved with the version. The versions saved without a checksum are not checked.
+func (ndb *nodeDB) checkVersionChecksum(version int64, root *Node) error {
+	checksum, err := ndb.db.Get(checksumKeyFormat.Key(version))
+	if err != nil {
+		return err
+	}
+	if checksum == nil {
+		return nil
+	}
+	if expected := versionChecksum(version, root); !bytes.Equal(checksum, expected) {
+		return fmt.Errorf("%w: version %d has checksum %X, but its root matches %X", ErrVersionMetadataCorrupt, version, checksum, expected)
+	}
+	return nil
+}